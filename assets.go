@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/ipfs/go-cid"
+)
+
+// assetEntry is an asset of the user as list prints it
+type assetEntry struct {
+	CID        string    `json:"cid"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	State      string    `json:"state"`
+	Created    time.Time `json:"created"`
+	Expiration time.Time `json:"expiration"`
+	// succeeded replicas
+	Replicas int `json:"replicas"`
+	// the scheduler api has no groups yet, it is always empty
+	Group string `json:"group"`
+	// Visibility is private, shared or forbidden, see visibilityOf
+	Visibility string `json:"visibility"`
+	// Local is from the history of this machine, not from the scheduler
+	Local *localInfo `json:"local,omitempty"`
+}
+
+// localInfo holds the history fields merged into an asset entry
+type localInfo struct {
+	Path        string    `json:"path,omitempty"`
+	Uploaded    time.Time `json:"uploaded"`
+	Description string    `json:"description,omitempty"`
+}
+
+func newAssetEntry(ov *types.AssetOverview) assetEntry {
+	var e assetEntry
+	if r := ov.AssetRecord; r != nil {
+		e.CID, e.Size, e.State, e.Created, e.Expiration = r.CID, r.TotalSize, r.State, r.CreatedTime, r.Expiration
+		e.Replicas = len(r.ReplicaInfos)
+	}
+
+	// the user detail has what the user gave on upload, prefer it
+	if d := ov.UserAssetDetail; d != nil {
+		e.Name, e.Type = d.AssetName, d.AssetType
+		e.Visibility = visibilityOf(d.ShareStatus)
+		if d.TotalSize > 0 {
+			e.Size = d.TotalSize
+		}
+		if !d.CreatedTime.IsZero() {
+			e.Created = d.CreatedTime
+		}
+		if !d.Expiration.IsZero() {
+			e.Expiration = d.Expiration
+		}
+	}
+	return e
+}
+
+// visibilityOf names the share status of an asset. Candidates serve an
+// asset only with a token, so no asset is public: shared means a tokened
+// link was made, forbidden that the visits of the links ran out
+func visibilityOf(shareStatus int64) string {
+	switch types.UserAssetShareStatus(shareStatus) {
+	case types.UserAssetShareStatusShared:
+		return "shared"
+	case types.UserAssetShareStatusForbid:
+		return "forbidden"
+	default:
+		return "private"
+	}
+}
+
+// addHistory merges the local history of the asset if there is one
+func (e *assetEntry) addHistory(history map[string]*historyEntry) {
+	if h, ok := history[historyKey(e.CID)]; ok {
+		e.Local = &localInfo{Path: h.Path, Uploaded: h.Uploaded, Description: h.Description}
+	}
+}
+
+// listUserAssets returns every asset of the user
+func listUserAssets(ctx context.Context, schedulerAPI api.Scheduler) ([]assetEntry, error) {
+	var entries []assetEntry
+	err := walkUserAssets(ctx, schedulerAPI, 0, 0, func(total int, page []assetEntry) error {
+		entries = append(entries, page...)
+		return nil
+	})
+	return entries, err
+}
+
+// walkUserAssets calls fn with the assets of the user page by page from
+// offset on, it stops after limit assets when limit is above 0.
+//
+// The scheduler orders by created time, newest first, and caps a page at
+// listPageSize. It skips assets whose record fails to load, so a page can
+// be short before the end and only the total tells when to stop. Assets
+// uploaded during the walk shift later pages, an asset can then show up twice.
+func walkUserAssets(ctx context.Context, schedulerAPI api.Scheduler, offset, limit int, fn func(total int, page []assetEntry) error) error {
+	for n := 0; limit <= 0 || n < limit; {
+		size := listPageSize
+		if limit > 0 && limit-n < size {
+			size = limit - n
+		}
+
+		rsp, err := listAssetPage(ctx, schedulerAPI, size, offset)
+		if err != nil {
+			return err
+		}
+
+		page := make([]assetEntry, 0, len(rsp.AssetOverviews))
+		for _, ov := range rsp.AssetOverviews {
+			page = append(page, newAssetEntry(ov))
+		}
+		// assets created at the same time have no order on the server
+		sort.SliceStable(page, func(i, j int) bool {
+			if page[i].Created.Equal(page[j].Created) {
+				return page[i].CID < page[j].CID
+			}
+			return page[i].Created.After(page[j].Created)
+		})
+
+		if err := fn(rsp.Total, page); err != nil {
+			return err
+		}
+
+		offset += size
+		n += size
+		if offset >= rsp.Total {
+			return nil
+		}
+	}
+	return nil
+}
+
+// the list is asked again this many times when the scheduler is busy
+const listAttempts = 5
+
+// listAssetPage gets a page of the asset list, backing off while the
+// scheduler reports it is busy
+func listAssetPage(ctx context.Context, schedulerAPI api.Scheduler, limit, offset int) (*types.ListAssetRecordRsp, error) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		rsp, err := schedulerAPI.ListUserAssets(ctx, limit, offset)
+		if err == nil {
+			return rsp, nil
+		}
+
+		if !schedulerBusy(err) || attempt == listAttempts {
+			return nil, fmt.Errorf("ListUserAssets %w", err)
+		}
+
+		logVerbose("ListUserAssets busy, retry in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// assetFilter selects assets on the client, the list api has no filters
+type assetFilter struct {
+	// substring of the name, or a glob when it has glob characters
+	name      string
+	assetType string
+	after     timeFlag
+	before    timeFlag
+}
+
+func (f *assetFilter) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.name, "filter-name", "", "only assets whose name contains the string or matches the glob")
+	fs.StringVar(&f.assetType, "filter-type", "", "only assets of the type, file or folder")
+	fs.Var(&f.after, "after", "only assets created after the date, like 2024-10-01 or an RFC 3339 time")
+	fs.Var(&f.before, "before", "only assets created before the date, like 2024-10-01 or an RFC 3339 time")
+}
+
+func (f *assetFilter) check() error {
+	if len(f.assetType) > 0 && f.assetType != "file" && f.assetType != "folder" {
+		return fmt.Errorf("filter-type must be file or folder")
+	}
+
+	if strings.ContainsAny(f.name, "*?[") {
+		if _, err := path.Match(f.name, ""); err != nil {
+			return fmt.Errorf("filter-name %w", err)
+		}
+	}
+	return nil
+}
+
+func (f *assetFilter) empty() bool {
+	return len(f.name) == 0 && len(f.assetType) == 0 && f.after.IsZero() && f.before.IsZero()
+}
+
+func (f *assetFilter) match(e assetEntry) bool {
+	if len(f.name) > 0 {
+		if strings.ContainsAny(f.name, "*?[") {
+			if ok, _ := path.Match(f.name, e.Name); !ok {
+				return false
+			}
+		} else if !strings.Contains(e.Name, f.name) {
+			return false
+		}
+	}
+
+	if len(f.assetType) > 0 && e.Type != f.assetType {
+		return false
+	}
+
+	if !f.after.IsZero() && !e.Created.After(f.after.Time) {
+		return false
+	}
+
+	if !f.before.IsZero() && !e.Created.Before(f.before.Time) {
+		return false
+	}
+	return true
+}
+
+func (f *assetFilter) apply(entries []assetEntry) []assetEntry {
+	matched := entries[:0]
+	for _, e := range entries {
+		if f.match(e) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+// timeFlag is a flag.Value for a date or an RFC 3339 time
+type timeFlag struct {
+	time.Time
+}
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(s string) error {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if v, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			t.Time = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q, want a date like 2024-10-01 or an RFC 3339 time", s)
+}
+
+func sortAssets(entries []assetEntry, by string, reverse bool) error {
+	var less func(a, b assetEntry) bool
+	switch by {
+	case "", "created":
+		less = func(a, b assetEntry) bool { return a.Created.Before(b.Created) }
+	case "name":
+		less = func(a, b assetEntry) bool { return a.Name < b.Name }
+	case "size":
+		less = func(a, b assetEntry) bool { return a.Size < b.Size }
+	default:
+		return fmt.Errorf("unknown sort %s, want name, size or created", by)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+	return nil
+}
+
+// connectError tells a scheduler that refused the api key from one that
+// could not be reached, the first needs another key and the second a retry
+func connectError(err error) error {
+	switch {
+	case errors.Is(err, errNoUsableKey), invalidKey(err):
+		return fmt.Errorf("authentication failed, the scheduler does not accept the api key, check --api-key or run auth login: %w", err)
+	case connectionError(err):
+		return &exitError{code: exitRetryable, err: fmt.Errorf("can not reach the scheduler, check the network and --locator-url: %w", err)}
+	}
+	return err
+}
+
+func runList(args []string) error {
+	opts := newOptions()
+	var (
+		filter        assetFilter
+		sortBy        string
+		reverse       bool
+		asJSON        bool
+		quiet         bool
+		output        string
+		out           string
+		all           bool
+		limit, offset int
+	)
+
+	fs := newFlagSet("list")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	opts.historyFlags(fs)
+	filter.register(fs)
+	fs.StringVar(&sortBy, "sort", "", "sort by name, size or created, default is the server order, newest first")
+	fs.BoolVar(&reverse, "reverse", false, "reverse the sort order")
+	fs.StringVar(&output, "output", "table", "output format, table, csv or json")
+	fs.BoolVar(&asJSON, "json", false, "same as --output json")
+	fs.BoolVar(&quiet, "quiet", false, "print only the cids, one per line, for piping into other commands")
+	fs.StringVar(&out, "out", "", "write the output to the file instead of stdout")
+	fs.IntVar(&limit, "limit", 0, "list at most this many assets from --offset, default is every asset")
+	fs.IntVar(&offset, "offset", 0, "skip this many assets in the server order")
+	fs.BoolVar(&all, "all", false, "stream every asset page by page instead of loading the whole list first")
+
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	if err := filter.check(); err != nil {
+		return err
+	}
+
+	if asJSON {
+		output = "json"
+	} else if quiet {
+		output = "cids"
+	}
+
+	if limit < 0 || offset < 0 {
+		return fmt.Errorf("limit and offset can not be negative")
+	} else if all && (limit > 0 || offset > 0) {
+		return fmt.Errorf("all can not be used with limit or offset")
+	} else if all && len(sortBy) > 0 {
+		return fmt.Errorf("sort needs the whole list, it can not be used with all")
+	}
+
+	// only the local history of this machine, the scheduler knows nothing of it
+	history, err := readHistory(opts.history)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if len(out) > 0 {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	aw, err := newAssetWriter(output, w, all, offset)
+	if err != nil {
+		return err
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return connectError(err)
+	}
+	defer conn.close()
+
+	var (
+		entries []assetEntry
+		shown   int
+		total   int
+	)
+	err = walkUserAssets(context.Background(), conn.api, offset, limit, func(t int, page []assetEntry) error {
+		total = t
+		page = filter.apply(page)
+		for i := range page {
+			page[i].addHistory(history)
+		}
+
+		if !all {
+			entries = append(entries, page...)
+			return nil
+		}
+
+		// stream the page so the whole list is never in memory
+		shown += len(page)
+		return aw.write(page)
+	})
+	if err != nil {
+		return connectError(err)
+	}
+
+	if !all {
+		if len(sortBy) > 0 {
+			if err := sortAssets(entries, sortBy, reverse); err != nil {
+				return err
+			}
+		} else if reverse {
+			for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+				entries[i], entries[j] = entries[j], entries[i]
+			}
+		}
+
+		shown = len(entries)
+		if err := aw.write(entries); err != nil {
+			return err
+		}
+	}
+	return aw.close(shown, total)
+}
+
+// exit codes of delete when every cid that failed failed the same way,
+// failures of different kinds exit with 1
+const (
+	deleteNotFound = 3
+	deleteDenied   = 4
+)
+
+// deleteFailure is the kind of a failed delete, for the message, the
+// summary and the exit code
+func deleteFailure(err error) (string, int) {
+	switch {
+	case errors.Is(err, errAssetNotFound):
+		return "not found", deleteNotFound
+	case invalidKey(err), unsupportedRPC(err):
+		return "permission denied", deleteDenied
+	case connectionError(err):
+		return "unreachable", exitRetryable
+	}
+	return "failed", 1
+}
+
+// confirm asks on stderr and is true for an answer of y or yes, without a
+// terminal on stdin nobody can answer and it is an error
+func confirm(prompt string) (bool, error) {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false, fmt.Errorf("stdin is not a terminal to confirm on, pass --yes")
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return false, err
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes", nil
+}
+
+func runDelete(args []string) error {
+	opts := newOptions()
+	var (
+		filter assetFilter
+		yes    bool
+	)
+
+	fs := newFlagSet("delete")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	filter.register(fs)
+	fs.BoolVar(&yes, "yes", false, "delete without asking, needed to delete the assets the filters select")
+
+	cids, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	if err := filter.check(); err != nil {
+		return err
+	}
+
+	if len(cids) > 0 && !filter.empty() {
+		return fmt.Errorf("give either cids or filters, not both")
+	} else if len(cids) == 0 && filter.empty() {
+		return fmt.Errorf("please input the cids to delete or filters selecting them")
+	} else if len(cids) == 0 && !yes {
+		return fmt.Errorf("deleting by filter needs --yes, run list with the same filters to see what would be deleted")
+	}
+
+	for _, c := range cids {
+		if _, err := cid.Decode(c); err != nil {
+			return fmt.Errorf("invalid cid %s %w", c, err)
+		}
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return connectError(err)
+	}
+	defer conn.close()
+
+	ctx := context.Background()
+	// the scheduler deletes nothing for a cid the user has no asset for
+	// without saying so, the list of the user tells
+	missing := make(map[string]bool)
+	if len(cids) == 0 {
+		entries, err := listUserAssets(ctx, conn.api)
+		if err != nil {
+			return connectError(err)
+		}
+
+		for _, e := range filter.apply(entries) {
+			cids = append(cids, e.CID)
+		}
+
+		if len(cids) == 0 {
+			fmt.Println("no asset matches the filters")
+			return nil
+		}
+	} else {
+		found, err := findUserAssets(ctx, conn.api, cids)
+		if err != nil {
+			return connectError(err)
+		}
+
+		var names []string
+		for _, c := range cids {
+			if ov, ok := found[c]; !ok || ov == nil {
+				missing[c] = true
+			} else {
+				names = append(names, fmt.Sprintf("  %s %s %s", c, newAssetEntry(ov).Name, formatSize(ov.AssetRecord.TotalSize)))
+			}
+		}
+
+		if len(names) > 0 && !yes {
+			fmt.Fprintf(os.Stderr, "delete %d assets:\n%s\n", len(names), strings.Join(names, "\n"))
+			ok, err := confirm("delete them?")
+			if err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("nothing deleted")
+			}
+		}
+	}
+
+	// every cid is tried, the summary at the end has the outcome of each
+	var (
+		results []string
+		failed  int
+		codes   = make(map[int]bool)
+	)
+	for _, c := range cids {
+		err := errAssetNotFound
+		if !missing[c] {
+			err = conn.api.DeleteUserAsset(ctx, c)
+		}
+
+		if err != nil {
+			kind, code := deleteFailure(err)
+			codes[code] = true
+			failed++
+			if code == deleteNotFound {
+				fmt.Printf("delete %s not found, the api key has no asset with the cid\n", c)
+			} else {
+				fmt.Printf("delete %s %s, %s\n", c, kind, describeError(err))
+			}
+			results = append(results, fmt.Sprintf("%s\t%s", c, kind))
+			continue
+		}
+		fmt.Printf("deleted %s\n", c)
+		results = append(results, fmt.Sprintf("%s\tdeleted", c))
+	}
+
+	if len(cids) > 1 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CID\tRESULT")
+		for _, r := range results {
+			fmt.Fprintln(tw, r)
+		}
+		tw.Flush()
+	}
+
+	if failed == 0 {
+		return nil
+	}
+	code := 1
+	if len(codes) == 1 {
+		for c := range codes {
+			code = c
+		}
+	}
+	return &exitError{code, fmt.Errorf("%d of %d assets not deleted", failed, len(cids))}
+}
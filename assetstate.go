@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/ipfs/go-cid"
+)
+
+// page size used when walking the asset list of the user
+const listPageSize = 100
+
+// errAssetNotFound is returned when the user has no asset with the cid
+var errAssetNotFound = fmt.Errorf("asset not found")
+
+// uploadPendingStates are the states of an asset whose upload the
+// scheduler still waits for, CreateUserAsset leaves the record in
+// UploadInit before a byte is sent
+var uploadPendingStates = map[string]bool{
+	"UploadInit":    true,
+	"SeedUploading": true,
+}
+
+// uploadFailedStates are the states of an asset whose upload the
+// scheduler gave up on
+var uploadFailedStates = map[string]bool{
+	"UploadFailed": true,
+	"SeedFailed":   true,
+}
+
+// assetStateError is an asset the scheduler has in a state the upload
+// did not get past, pending while it still waits for the data
+type assetStateError struct {
+	state   string
+	pending bool
+}
+
+func (e *assetStateError) Error() string {
+	if e.pending {
+		return fmt.Sprintf("asset is still in %s", e.state)
+	}
+	return fmt.Sprintf("asset is in %s", e.state)
+}
+
+// findUserAsset looks the asset up in the asset list of the user
+func findUserAsset(ctx context.Context, schedulerAPI api.Scheduler, assetCID string) (*types.AssetOverview, error) {
+	found, err := findUserAssets(ctx, schedulerAPI, []string{assetCID})
+	if err != nil {
+		return nil, err
+	}
+
+	asset, ok := found[assetCID]
+	if !ok {
+		return nil, errAssetNotFound
+	}
+	return asset, nil
+}
+
+// findUserAssets looks the assets up in one walk of the asset list of the
+// user, it stops once every cid is found. Cids the user has no asset for
+// are not in the map
+func findUserAssets(ctx context.Context, schedulerAPI api.Scheduler, assetCIDs []string) (map[string]*types.AssetOverview, error) {
+	wants := make(map[string]cid.Cid, len(assetCIDs))
+	for _, s := range assetCIDs {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		wants[s] = c
+	}
+
+	found := make(map[string]*types.AssetOverview, len(wants))
+	for offset := 0; len(found) < len(wants); offset += listPageSize {
+		rsp, err := schedulerAPI.ListUserAssets(ctx, listPageSize, offset)
+		if err != nil {
+			return nil, fmt.Errorf("ListUserAssets %w", err)
+		}
+
+		for _, asset := range rsp.AssetOverviews {
+			if asset.AssetRecord == nil {
+				continue
+			}
+			for s, want := range wants {
+				if sameCID(want, asset.AssetRecord.CID) {
+					found[s] = asset
+				}
+			}
+		}
+
+		// a page can be short before the end, see walkUserAssets
+		if offset+listPageSize >= rsp.Total {
+			break
+		}
+	}
+	return found, nil
+}
+
+// sameCID compares by multihash so v0/v1 and the base of s do not matter
+func sameCID(want cid.Cid, s string) bool {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return want.String() == s
+	}
+	return bytes.Equal(want.Hash(), c.Hash())
+}
+
+// uploadedState is nil when the scheduler got the data of the asset: its
+// state is past the upload or a node has a replica of it
+func uploadedState(asset *types.AssetOverview) error {
+	r := asset.AssetRecord
+	switch {
+	case uploadFailedStates[r.State]:
+		return &assetStateError{state: r.State}
+	case uploadPendingStates[r.State] && len(r.ReplicaInfos) == 0:
+		return &assetStateError{state: r.State, pending: true}
+	}
+	return nil
+}
+
+// waitForAsset polls the scheduler until the asset shows up under the user
+// past the upload, it tries attempts times with interval between them. A
+// failed upload state ends the wait at once
+func waitForAsset(ctx context.Context, schedulerAPI api.Scheduler, assetCID string, attempts int, interval time.Duration) (*types.AssetOverview, error) {
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		asset, err := findUserAsset(ctx, schedulerAPI, assetCID)
+		if err == nil {
+			err = uploadedState(asset)
+		}
+		var se *assetStateError
+		if err == nil || errors.As(err, &se) && !se.pending {
+			return asset, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Filecoin-Titan/titan/api/types"
+)
+
+const testRoot = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+
+func TestWaitForAsset(t *testing.T) {
+	tests := []struct {
+		name string
+		// state is the record of the scheduler, none when empty
+		state    string
+		replicas int
+		err      error
+		pending  bool
+		// lists is how often the scheduler is asked
+		lists int
+	}{
+		{"found", "Servicing", 0, nil, false, 1},
+		{"candidates pulling", "CandidatesPulling", 0, nil, false, 1},
+		{"uploading with a replica", "SeedUploading", 1, nil, false, 1},
+		{"not found", "", 0, errAssetNotFound, false, 3},
+		{"stuck in upload init", "UploadInit", 0, &assetStateError{}, true, 3},
+		{"stuck uploading", "SeedUploading", 0, &assetStateError{}, true, 3},
+		{"upload failed", "UploadFailed", 0, &assetStateError{}, false, 1},
+		{"seed failed", "SeedFailed", 0, &assetStateError{}, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeScheduler(t)
+			if len(tt.state) > 0 {
+				s.add(testRoot, tt.state)
+				for i := 0; i < tt.replicas; i++ {
+					s.records[testRoot].ReplicaInfos = append(s.records[testRoot].ReplicaInfos, &types.ReplicaInfo{NodeID: "c_1", IsCandidate: true})
+				}
+			}
+
+			asset, err := waitForAsset(context.Background(), s, testRoot, 3, time.Millisecond)
+			var se *assetStateError
+			switch {
+			case tt.err == nil && err != nil:
+				t.Fatalf("error %v", err)
+			case tt.err == nil && asset.AssetRecord.State != tt.state:
+				t.Errorf("state %s, want %s", asset.AssetRecord.State, tt.state)
+			case tt.err == errAssetNotFound && err != errAssetNotFound:
+				t.Errorf("error %v, want %v", err, errAssetNotFound)
+			case tt.err != nil && tt.err != errAssetNotFound && (!errors.As(err, &se) || se.state != tt.state || se.pending != tt.pending):
+				t.Errorf("error %#v, want state %s pending %t", err, tt.state, tt.pending)
+			}
+			if n := s.count("ListUserAssets"); n != tt.lists {
+				t.Errorf("%d ListUserAssets, want %d", n, tt.lists)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// inputResult is the outcome of one input of an upload with several inputs
+type inputResult struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	CID  string `json:"cid,omitempty"`
+	// Status is uploaded, failed or skipped after an earlier failure with --fail-fast
+	Status string `json:"status"`
+	// Class groups failures in the report, see failureClass
+	Class string `json:"class,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Retries of a failed input, those of an uploaded one are in its result
+	Retries []retryEvent `json:"retries,omitempty"`
+}
+
+// expandInputs expands glob patterns the shell left alone, as on windows.
+// An argument naming an existing path is taken as is even with glob
+// characters in it
+func expandInputs(args []string) ([]string, error) {
+	var inputs []string
+	for _, arg := range args {
+		if _, err := os.Lstat(arg); err == nil || isStreamInput(arg) || !strings.ContainsAny(arg, "*?[") {
+			inputs = append(inputs, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("input %s %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("input %s matches no path", arg)
+		}
+		inputs = append(inputs, matches...)
+	}
+	return inputs, nil
+}
+
+// checkBatch refuses the flags that only make sense for a single input
+func (opts *options) checkBatch() error {
+	switch {
+	case len(opts.name) > 0:
+		return fmt.Errorf("name can not be used with several inputs, each asset is named after its input")
+	case len(opts.incremental) > 0:
+		return fmt.Errorf("incremental keeps the car of one input, it can not be used with several inputs")
+	case opts.splitSize > 0:
+		return fmt.Errorf("split-size keeps the state of one input, it can not be used with several inputs")
+	case opts.offset != 0 || opts.length != 0:
+		return fmt.Errorf("offset and length are a window of one file, they can not be used with several inputs")
+	case len(opts.qrOut) > 0:
+		return fmt.Errorf("qr-out can not be used with several inputs, the png would be overwritten")
+	case opts.jsonResult:
+		return fmt.Errorf("json prints the result of one upload, use progress json for the results of several inputs")
+	case opts.pipelineDepth < 0:
+		return fmt.Errorf("pipeline-depth can not be negative")
+	case opts.concurrency < 1:
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	return nil
+}
+
+// packedInput is an input of a batch through the pack stage, index is its
+// place in the inputs
+type packedInput struct {
+	index int
+	input string
+	asset *packedAsset
+	err   error
+}
+
+// uploadedInput is an input of a batch through the upload stage
+type uploadedInput struct {
+	packedInput
+	start    time.Time
+	duration time.Duration
+	skipped  bool
+}
+
+// batchPipeline packs the next inputs of a batch while the cars before
+// them upload, workers cars upload at the same time and at most depth
+// cars wait for their upload
+type batchPipeline struct {
+	opts    *options
+	tempDir string
+	depth   int
+	workers int
+	packed  chan packedInput
+
+	// conn is the scheduler connection the uploads share
+	connOnce sync.Once
+	conn     *schedulerConn
+	connErr  error
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// cars on disk, being packed, waiting or uploading
+	cars   int
+	halted bool
+
+	// time spent in each stage, read once every upload is done
+	packTime, uploadTime time.Duration
+}
+
+// reserve waits until the car of input can be packed, it is false once
+// the batch is halted. Another car is only packed ahead when the temp
+// directory has room for it, alone a car is packed whatever the room
+func (p *batchPipeline) reserve(input string) bool {
+	need := estimateCarSize(input, p.opts.size)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for waited := false; !p.halted && p.cars > 0; waited = true {
+		if p.cars < p.depth+p.workers {
+			free, err := freeSpace(p.tempDir)
+			if err != nil {
+				logDebug("free space of %s %s", p.tempDir, err.Error())
+				break
+			} else if free >= need {
+				break
+			} else if !waited {
+				logVerbose("%s needs about %s, %s free in %s, wait for queued cars to upload", input, formatSize(need), formatSize(free), p.tempDir)
+			}
+		}
+		p.cond.Wait()
+	}
+
+	if p.halted {
+		return false
+	}
+	p.cars++
+	return true
+}
+
+// release is called when a car is gone from disk
+func (p *batchPipeline) release() {
+	p.mu.Lock()
+	p.cars--
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// halt stops packing inputs after a failure with --fail-fast
+func (p *batchPipeline) halt() {
+	p.mu.Lock()
+	p.halted = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *batchPipeline) isHalted() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.halted
+}
+
+// pack is the pack stage, it runs beside the upload stage
+func (p *batchPipeline) pack(inputs []string) {
+	defer close(p.packed)
+	for i, input := range inputs {
+		if !p.reserve(input) {
+			return
+		}
+
+		start := time.Now()
+		carPath := filepath.Join(p.tempDir, fmt.Sprintf("%d.car", i))
+		asset, err := packInput(p.opts, input, carPath)
+		p.packTime += time.Since(start)
+		if err != nil {
+			os.Remove(carPath)
+			p.release()
+			err = &stageError{"pack", err}
+		}
+		p.packed <- packedInput{index: i, input: input, asset: asset, err: err}
+	}
+}
+
+// connection is the connection the uploads of the batch share, made by the
+// first upload
+func (p *batchPipeline) connection() (*schedulerConn, error) {
+	p.connOnce.Do(func() {
+		p.conn, p.connErr = connectScheduler(p.opts, make(map[int]bool))
+	})
+	return p.conn, p.connErr
+}
+
+// upload is the upload stage for one packed input, the car is removed
+// whether the upload succeeds or not
+func (p *batchPipeline) upload(in packedInput) error {
+	defer p.release()
+	defer os.Remove(in.asset.carPath)
+
+	start := time.Now()
+	defer func() {
+		p.mu.Lock()
+		p.uploadTime += time.Since(start)
+		p.mu.Unlock()
+	}()
+
+	shared, err := p.connection()
+	if err != nil {
+		return &stageError{"connect", err}
+	}
+
+	// a key that runs out moves this upload to a connection of its own,
+	// the shared one stays with the others
+	conn := *shared
+	conn.close = func() {}
+	defer func() { conn.close() }()
+	tried := map[int]bool{conn.key: true}
+
+	opts := p.opts
+	if p.workers > 1 {
+		c := *p.opts
+		c.progress = labeledProgress{sink: p.opts.progress, label: in.asset.name}
+		opts = &c
+	}
+	return uploadPacked(opts, &conn, tried, in.input, in.asset)
+}
+
+// work is an upload worker, it uploads packed inputs until there are none
+func (p *batchPipeline) work(done chan<- uploadedInput) {
+	for in := range p.packed {
+		out := uploadedInput{packedInput: in, start: time.Now()}
+		if in.err == nil && p.isHalted() {
+			// packed ahead before an upload failed
+			os.Remove(in.asset.carPath)
+			p.release()
+			out.skipped = true
+		} else if in.err == nil {
+			fmt.Printf("upload %s\n", in.input)
+			out.err = p.upload(in)
+		}
+		out.duration = time.Since(out.start)
+		done <- out
+	}
+}
+
+// estimateCarSize is about the size of the car of input, the size of its
+// files with no room for the dag
+func estimateCarSize(input string, size int64) int64 {
+	info, err := os.Stat(input)
+	if err != nil {
+		return 0
+	} else if info.Mode().IsRegular() {
+		return info.Size()
+	} else if !info.IsDir() {
+		return size
+	}
+
+	var total int64
+	filepath.WalkDir(input, func(p string, d fs.DirEntry, err error) error { //nolint:errcheck
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				total += fi.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// uploadBatch uploads every input, a failed input is queued for retry and
+// the rest still run unless --fail-fast is given. The next inputs are
+// packed while the car before them uploads
+func uploadBatch(opts *options, inputs []string) error {
+	opts.batch = true
+
+	// the cars of a batch get names of their own, inputs with the same base
+	// name would overwrite each other's car while it waits for its upload
+	tempDir, err := os.MkdirTemp("", "storage-upload-sample-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	defer onInterrupt(func() { os.RemoveAll(tempDir) })()
+
+	p := &batchPipeline{opts: opts, tempDir: tempDir, depth: opts.pipelineDepth, workers: opts.concurrency, packed: make(chan packedInput, len(inputs))}
+	p.cond = sync.NewCond(&p.mu)
+	if p.workers > len(inputs) {
+		p.workers = len(inputs)
+	}
+
+	start := time.Now()
+	go p.pack(inputs)
+
+	// the workers upload side by side, their outcomes are handled here one
+	// at a time so reports and hooks do not run into each other
+	done := make(chan uploadedInput, len(inputs))
+	var wg sync.WaitGroup
+	for w := 0; w < p.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(done)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	results := make([]inputResult, len(inputs))
+	for i, input := range inputs {
+		// inputs never packed after a halt stay skipped
+		results[i] = inputResult{Path: input, Type: inputType(input), Status: "skipped"}
+	}
+	var (
+		failed, hookFailed int
+		uploadedSize       int64
+	)
+	for in := range done {
+		r := inputResult{Path: in.input, Type: inputType(in.input), Status: "uploaded"}
+		if in.asset != nil {
+			r.Type, r.CID = in.asset.assetType, in.asset.root.String()
+		}
+
+		if in.skipped {
+			r.Status, r.CID = "skipped", ""
+			results[in.index] = r
+			continue
+		}
+
+		if err := in.err; err != nil {
+			failed++
+			r.Status, r.Class, r.Error = "failed", failureClass(err), errText(err)
+			// uploads side by side share the retry log, it only tells the
+			// retries of one input when they run one at a time
+			if p.workers == 1 {
+				r.Retries = takeRetries()
+			}
+			fmt.Printf("upload %s error %s\n", in.input, describeError(err))
+			if isStreamInput(in.input) {
+				fmt.Printf("failed upload of %s not kept for retry, a stream is read once, upload it again\n", in.input)
+			} else if qerr := recordFailure(opts, in.input, err); qerr != nil {
+				fmt.Printf("record failed upload error %s\n", errText(qerr))
+			}
+
+			if opts.failFast || !opts.continueOnError {
+				p.halt()
+			}
+		}
+		results[in.index] = r
+
+		ev := hookEvent{cid: r.CID, name: filepath.Base(in.input), duration: in.duration, err: in.err}
+		if in.asset != nil {
+			ev.name = in.asset.name
+			if in.asset.result != nil {
+				ev.result, ev.size = in.asset.result, in.asset.result.Size
+			}
+		}
+		if ev.result == nil {
+			ev.result = r
+		}
+		uploadedSize += ev.size
+		if runHook(opts, ev) != nil {
+			hookFailed++
+		}
+	}
+
+	wall := time.Since(start)
+	saved := p.packTime + p.uploadTime - wall
+	if saved < 0 {
+		saved = 0
+	}
+	logVerbose("batch packed for %s and uploaded for %s in %s, overlapping saved %s", formatDuration(p.packTime), formatDuration(p.uploadTime), formatDuration(wall), formatDuration(saved))
+
+	printBatchResults(opts, results, failed)
+	logPhaseTimes()
+
+	// the hooks run once more for the whole batch
+	counts := &batchCounts{Failed: failed}
+	for _, r := range results {
+		if r.Status == "uploaded" {
+			counts.Uploaded++
+		} else if r.Status == "skipped" {
+			counts.Skipped++
+		}
+	}
+	var batchErr error
+	if failed > 0 {
+		batchErr = fmt.Errorf("%d of %d inputs failed", failed, len(inputs))
+	}
+	summary := struct {
+		Phase string `json:"phase"`
+		*batchCounts
+		Inputs []inputResult `json:"inputs"`
+	}{"batch", counts, results}
+	if runHook(opts, hookEvent{name: "batch", size: uploadedSize, duration: wall, err: batchErr, result: summary, batch: counts}) != nil {
+		hookFailed++
+	}
+
+	if p.conn != nil {
+		if failed < len(inputs) {
+			printQuota(opts, p.conn)
+		}
+		p.conn.close()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d inputs failed, kept in queue %s, run retry to upload them again", failed, len(inputs), opts.queue)
+	} else if hookFailed > 0 {
+		return fmt.Errorf("%d hooks failed", hookFailed)
+	}
+	return nil
+}
+
+// failureClass names what went wrong in words a report can group by,
+// falling back to the stage that failed
+func failureClass(err error) string {
+	var ne net.Error
+	if _, ok := keyExhausted(err); ok || errors.Is(err, errNoUsableKey) {
+		return "quota"
+	}
+
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not found"
+	case invalidKey(err):
+		return "api key"
+	case errors.As(err, &ne), errorClass(err) == "connect":
+		return "network"
+	}
+	return errorClass(err)
+}
+
+// inputType is file or folder like packInput decides, for inputs that
+// failed before they were packed
+func inputType(input string) string {
+	fi, err := os.Stat(input)
+	if err != nil {
+		return "-"
+	} else if fi.IsDir() {
+		return "folder"
+	}
+	return "file"
+}
+
+func printBatchResults(opts *options, results []inputResult, failed int) {
+	if opts.progressMode == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		var uploaded int
+		for _, r := range results {
+			if r.Status == "uploaded" {
+				uploaded++
+			}
+		}
+		enc.Encode(struct { //nolint:errcheck
+			Phase    string        `json:"phase"`
+			Uploaded int           `json:"uploaded"`
+			Failed   int           `json:"failed"`
+			Skipped  int           `json:"skipped"`
+			Inputs   []inputResult `json:"inputs"`
+		}{"summary", uploaded, failed, len(results) - uploaded - failed, results})
+		return
+	}
+
+	var skipped int
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tTYPE\tCID\tSTATUS")
+	for _, r := range results {
+		c := r.CID
+		if len(c) == 0 {
+			c = "-"
+		}
+		if r.Status == "skipped" {
+			skipped++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Path, r.Type, c, r.Status)
+	}
+	tw.Flush()
+
+	fmt.Printf("%d uploaded, %d failed, %d skipped\n", len(results)-failed-skipped, failed, skipped)
+	if failed == 0 {
+		return
+	}
+
+	// the report groups the failed paths by class in the order the
+	// classes first failed
+	var classes []string
+	paths := make(map[string][]inputResult)
+	for _, r := range results {
+		if r.Status != "failed" {
+			continue
+		}
+		if _, ok := paths[r.Class]; !ok {
+			classes = append(classes, r.Class)
+		}
+		paths[r.Class] = append(paths[r.Class], r)
+	}
+
+	fmt.Println("failures:")
+	for _, class := range classes {
+		fmt.Printf("  %s, %d inputs\n", class, len(paths[class]))
+		for _, r := range paths[class] {
+			fmt.Printf("    %s: %s\n", r.Path, r.Error)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// benchOptions are the flags of bench
+type benchOptions struct {
+	size   int64
+	files  int
+	seed   int64
+	upload bool
+}
+
+func runBench(args []string) error {
+	opts := newOptions()
+	bopts := benchOptions{size: 256 << 20}
+
+	fs := newFlagSet("bench")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	opts.uploadFlags(fs)
+	fs.Var((*byteSize)(&bopts.size), "size", "total size of the synthetic data, like 2GiB")
+	fs.IntVar(&bopts.files, "files", 100, "number of files the data is split into")
+	fs.Int64Var(&bopts.seed, "seed", 1, "seed of the data, the same seed makes the same data and cid on every machine")
+	fs.BoolVar(&bopts.upload, "upload", false, "upload to the scheduler of the api key and delete the asset after, default is a local endpoint that discards the data")
+	fs.IntVar(&opts.maxOpenFiles, "max-open-files", 0, "files and directories open at the same time while packing")
+	fs.Var(&opts.hashWorkerCount, "hash-workers", "files hashed at the same time while packing, default is the number of cpus up to 16")
+
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if bopts.size <= 0 {
+		return fmt.Errorf("size must be more than 0")
+	} else if bopts.files < 1 {
+		return fmt.Errorf("files must be at least 1")
+	}
+
+	if bopts.upload {
+		if err := opts.requireAPIKey(); err != nil {
+			return err
+		}
+	}
+
+	if err := opts.checkUploadFlags(); err != nil {
+		return err
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	tempDir, err := os.MkdirTemp("", "storage-upload-sample-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	onInterrupt(func() { os.RemoveAll(tempDir) })
+
+	dataDir := filepath.Join(tempDir, fmt.Sprintf("bench-%d", bopts.seed))
+	if err := writeBenchData(dataDir, bopts); err != nil {
+		return fmt.Errorf("write synthetic data %w", err)
+	}
+
+	carPath := filepath.Join(tempDir, "bench.car")
+	workers := opts.hashWorkers()
+	start := time.Now()
+	result, err := createCar(dataDir, carPath, packOptions{Workers: workers, MaxOpenFiles: opts.maxOpenFiles})
+	if err != nil {
+		return fmt.Errorf("pack %w", err)
+	}
+	packTime := time.Since(start)
+
+	// only the car is needed from here on
+	os.RemoveAll(dataDir)
+
+	stat, err := os.Stat(carPath)
+	if err != nil {
+		return err
+	}
+
+	var uploadTime time.Duration
+	if bopts.upload {
+		uploadTime, err = benchUpload(opts, carPath, result.Root.String(), filepath.Base(dataDir))
+	} else {
+		uploadTime, err = benchLocalUpload(opts, carPath)
+	}
+	if err != nil {
+		return fmt.Errorf("upload %w", err)
+	}
+
+	target := "local endpoint"
+	if bopts.upload {
+		target = "scheduler"
+	}
+
+	fmt.Printf("bench %s in %d files, seed %d, %d hash workers, cid %s\n", formatSize(bopts.size), bopts.files, bopts.seed, workers, result.Root.String())
+	fmt.Printf("pack: %s in %s, %s/s, %.0f blocks/s, car %s\n", formatSize(bopts.size), formatDuration(packTime), formatSize(rate(bopts.size, packTime)), float64(result.Stats.Blocks)/packTime.Seconds(), formatSize(stat.Size()))
+	fmt.Printf("upload to %s: %s in %s, %s/s\n", target, formatSize(stat.Size()), formatDuration(uploadTime), formatSize(rate(stat.Size(), uploadTime)))
+	if rss, ok := peakRSS(); ok {
+		fmt.Printf("peak rss: %s\n", formatSize(rss))
+	}
+	return nil
+}
+
+// rate is n bytes per second over d
+func rate(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
+
+// writeBenchData writes files that together have size bytes under dir,
+// in a few directories so folders are packed too. The content only
+// depends on the seed
+func writeBenchData(dir string, bopts benchOptions) error {
+	per := bopts.size / int64(bopts.files)
+	buf := make([]byte, 1<<20)
+	for i := 0; i < bopts.files; i++ {
+		// an interrupted run removes dir, nothing more is written to it
+		if err := interruptContext().Err(); err != nil {
+			return err
+		}
+
+		n := per
+		if i == bopts.files-1 {
+			n = bopts.size - per*int64(bopts.files-1)
+		}
+
+		sub := filepath.Join(dir, fmt.Sprintf("d%02d", i%16))
+		if err := os.MkdirAll(sub, 0700); err != nil {
+			return err
+		}
+
+		f, err := os.Create(filepath.Join(sub, fmt.Sprintf("f%06d", i)))
+		if err != nil {
+			return err
+		}
+
+		// every file has a source of its own so the order files are written
+		// in does not change their content
+		r := rand.New(rand.NewSource(bopts.seed*1000003 + int64(i)))
+		for n > 0 {
+			chunk := buf
+			if int64(len(chunk)) > n {
+				chunk = chunk[:n]
+			}
+			r.Read(chunk) //nolint:errcheck
+			if _, err := f.Write(chunk); err != nil {
+				f.Close()
+				return err
+			}
+			n -= int64(len(chunk))
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchLocalUpload uploads the car to an endpoint on this machine that
+// reads the body and answers like a candidate, it measures the client side
+func benchLocalUpload(opts *options, carPath string) (time.Duration, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) //nolint:errcheck
+
+		w.Write([]byte(`{"code":0,"err":0,"msg":"Upload succeeded"}`)) //nolint:errcheck
+	})}
+	go srv.Serve(l) //nolint:errcheck
+	defer srv.Close()
+
+	// the local endpoint has no tls
+	opts.allowInsecureUpload = true
+
+	start := time.Now()
+	if _, err := uploadFileWithForm(opts, newUploadProgress(opts.progress, 0), carPath, "http://"+l.Addr().String()+"/upload", "bench"); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// benchUpload uploads the car to the scheduler of the api key and deletes
+// the asset again, the time includes creating the asset and the postcheck
+func benchUpload(opts *options, carPath, root, name string) (time.Duration, error) {
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.close()
+
+	start := time.Now()
+	_, uploadErr := uploadFile(opts, conn.api, carPath, root, name, "folder")
+	d := time.Since(start)
+
+	// the asset can exist after a failed upload too
+	if err := conn.api.DeleteUserAsset(context.Background(), root); err != nil {
+		fmt.Printf("warning: delete bench asset %s error %s, delete it with delete %s\n", root, errText(err), root)
+	} else {
+		fmt.Printf("deleted bench asset %s\n", root)
+	}
+	return d, uploadErr
+}
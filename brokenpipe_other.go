@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isBrokenPipe reports whether a write failed because the reader went
+// away, for stdout the runtime ends the process with SIGPIPE before that
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// memoryBudget is the memory the process should try to stay under,
+// 0 means no budget. It is a target to adapt to, never a hard failure.
+type memoryBudget int64
+
+// apply makes the garbage collector work harder when close to the budget
+func (b memoryBudget) apply() {
+	if b > 0 {
+		debug.SetMemoryLimit(int64(b))
+	}
+}
+
+// a body larger than this is streamed from the car even without a budget,
+// holding a car of several GiB in memory gets the process killed
+const maxBufferedBody = 32 << 20
+
+// bufferBody reports whether an upload body of size bytes can be held in
+// memory, a quarter of the budget is left for it so the rest of the
+// process and the http transport have room
+func (b memoryBudget) bufferBody(size int64) bool {
+	return size <= maxBufferedBody && (b == 0 || size <= int64(b)/4)
+}
+
+// packWorkerMemory is the memory a pack worker holds at most with the
+// chunker, its blocks waiting for the writer plus the chunks being hashed,
+// each of them up to the largest chunk
+func packWorkerMemory(chunker chunkerFlag) int64 {
+	return 2 * segmentBlocks * chunker.maxSize()
+}
+
+// packWorkers limits the number of pack workers so their buffers fit in
+// a quarter of the budget, there is always at least one
+func (b memoryBudget) packWorkers(workers int, chunker chunkerFlag) int {
+	if b > 0 {
+		if limit := int(int64(b) / 4 / packWorkerMemory(chunker)); limit < workers {
+			workers = limit
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// maxDefaultHashWorkers caps the default of --hash-workers, more workers
+// than this wait on the disk rather than hash faster
+const maxDefaultHashWorkers = 16
+
+// workerCount is a flag.Value for a number of workers, 0 is the default
+// and a value given on the command line must be at least 1
+type workerCount int
+
+func (w *workerCount) String() string {
+	return strconv.Itoa(int(*w))
+}
+
+func (w *workerCount) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number of workers %q", s)
+	}
+	if n < 1 {
+		return fmt.Errorf("hash-workers must be at least 1")
+	}
+	*w = workerCount(n)
+	return nil
+}
+
+// hashWorkers is the number of pack workers, --hash-workers or the number
+// of cpus up to maxDefaultHashWorkers, limited by the memory budget
+func (opts *options) hashWorkers() int {
+	asked := int(opts.hashWorkerCount)
+	if asked == 0 {
+		asked = runtime.NumCPU()
+		if asked > maxDefaultHashWorkers {
+			asked = maxDefaultHashWorkers
+		}
+	}
+
+	workers := opts.maxMemory.packWorkers(asked, opts.chunker)
+	if workers < asked {
+		logVerbose("pack with %d hash workers, %d lowered to fit max-memory", workers, asked)
+	} else {
+		logVerbose("pack with %d hash workers", workers)
+	}
+	return workers
+}
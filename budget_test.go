@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestChunkerMaxSize(t *testing.T) {
+	tests := []struct {
+		chunker string
+		want    int64
+	}{
+		{"", 256 << 10},
+		{"size-16384", 16 << 10},
+		{"size-1048576", 1 << 20},
+		{"rabin", 384 << 10},
+		{"rabin-65536", 96 << 10},
+		{"rabin-16384-65536-131072", 128 << 10},
+		{"rabin-min:16384-avg:65536-max:524288", 512 << 10},
+		{"buzhash", 512 << 10},
+	}
+
+	for _, tt := range tests {
+		c := chunkerFlag(tt.chunker)
+		if got := c.maxSize(); got != tt.want {
+			t.Errorf("largest chunk of %q is %d, want %d", tt.chunker, got, tt.want)
+		}
+	}
+}
+
+func TestPackWorkers(t *testing.T) {
+	tests := []struct {
+		budget  memoryBudget
+		chunker string
+		workers int
+		want    int
+	}{
+		{0, "", 16, 16},
+		{0, "size-1048576", 16, 16},
+		// a worker holds 32 chunks, a quarter of the budget is for them
+		{256 << 20, "", 16, 8},
+		{256 << 20, "size-16384", 16, 16},
+		{256 << 20, "size-1048576", 16, 2},
+		{256 << 20, "rabin", 16, 5},
+		{256 << 20, "buzhash", 16, 4},
+		{64 << 20, "", 4, 2},
+		// there is always one worker, however small the budget
+		{16 << 20, "size-1048576", 4, 1},
+		{1, "", 4, 1},
+	}
+
+	for _, tt := range tests {
+		if got := tt.budget.packWorkers(tt.workers, chunkerFlag(tt.chunker)); got != tt.want {
+			t.Errorf("%d workers for a budget of %s with %q, want %d", got, formatSize(int64(tt.budget)), tt.chunker, tt.want)
+		}
+	}
+}
+
+func TestUploadMaxMemory(t *testing.T) {
+	tmp := testHome(t)
+	s := newFakeScheduler(t)
+	useScheduler(t, s)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "video.mp4")
+	if err := os.WriteFile(input, testData(12<<20+321), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root := packCID(t, input)
+
+	// the car is larger than a quarter of the budget, it is streamed and
+	// the budget leaves room for one worker
+	var out string
+	stderr, err := captureStderr(t, func() error {
+		var err error
+		out, err = captureStdout(t, func() error {
+			return runUpload(uploadArgs("-v", "--max-memory", "16MiB", "--hash-workers", "4", "--no-postcheck", input))
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("upload: %v\n%s\n%s", err, out, stderr)
+	}
+	if !strings.Contains(stderr, "pack with 1 hash workers, 4 lowered to fit max-memory") {
+		t.Errorf("the workers are not lowered:\n%s", stderr)
+	}
+	if s.uploads != 1 {
+		t.Fatalf("%d uploads", s.uploads)
+	}
+	if err := checkCarStream(bytes.NewReader(s.cars[root]), cid.MustParse(root)); err != nil {
+		t.Error(err)
+	}
+	if cars := tempCars(t, tmp); len(cars) > 0 {
+		t.Errorf("temp cars left: %v", cars)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+)
+
+// a bundle is a directory holding a packed car and the descriptor needed
+// to upload it later, so packing can run on a machine without network
+const (
+	bundleVersion    = 1
+	bundleCar        = "asset.car"
+	bundleDescriptor = "descriptor.json"
+)
+
+// bundleInfo is the descriptor of a bundle
+type bundleInfo struct {
+	Version int    `json:"version"`
+	Root    string `json:"root"`
+	Name    string `json:"name"`
+	// size of the car
+	Size    int64         `json:"size"`
+	Type    string        `json:"type"`
+	Car     string        `json:"car"`
+	Options bundleOptions `json:"options"`
+	// Metadata are the directories with a metadata file, kept for submit
+	Metadata map[string]manifestDir `json:"metadata,omitempty"`
+}
+
+// bundleOptions are the pack options the car was built with
+type bundleOptions struct {
+	// bytes read from a non regular input
+	InputSize int64 `json:"inputSize,omitempty"`
+	// Offset and Length are the window of the file that was packed
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+}
+
+func runPrepare(args []string) error {
+	opts := newOptions()
+	var dir string
+
+	fs := newFlagSet("prepare")
+	opts.commonFlags(fs)
+	opts.packFlags(fs)
+	fs.StringVar(&dir, "bundle", "", "directory to write the car and its descriptor to")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(dir) == 0 {
+		return fmt.Errorf("bundle can not empty")
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("please input file path")
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if err := prepareBundle(opts, args[0], dir); err != nil {
+		return fmt.Errorf("prepare bundle error %s", err.Error())
+	}
+	return nil
+}
+
+func runSubmit(args []string) error {
+	opts := newOptions()
+
+	fs := newFlagSet("submit")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	opts.uploadFlags(fs)
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	if err := opts.checkUploadFlags(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("please input bundle directory")
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if err := submitBundle(opts, args[0]); err != nil {
+		return fmt.Errorf("submit bundle error %s", err.Error())
+	}
+	return nil
+}
+
+func prepareBundle(opts *options, filePath string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	carPath := filepath.Join(dir, bundleCar)
+	asset, err := packInput(opts, filePath, carPath)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(carPath)
+	if err != nil {
+		return err
+	}
+
+	info := &bundleInfo{
+		Version:  bundleVersion,
+		Root:     asset.root.String(),
+		Name:     asset.name,
+		Size:     stat.Size(),
+		Type:     asset.assetType,
+		Car:      bundleCar,
+		Options:  bundleOptions{InputSize: asset.inputSize},
+		Metadata: asset.dirs(),
+	}
+	if asset.window != nil {
+		info.Options.Offset, info.Options.Length = asset.window.Offset, asset.window.Length
+	}
+	if err := info.write(filepath.Join(dir, bundleDescriptor)); err != nil {
+		return err
+	}
+	if err := writeChecksums(filepath.Join(dir, checksumsFile), asset.manifest); err != nil {
+		return err
+	}
+
+	fmt.Printf("bundle %s prepared, root %s, submit it with: submit %s\n", dir, info.Root, dir)
+	return nil
+}
+
+func submitBundle(opts *options, dir string) error {
+	info, err := readBundleInfo(filepath.Join(dir, bundleDescriptor))
+	if err != nil {
+		return err
+	}
+
+	carPath := filepath.Join(dir, info.Car)
+	if err := info.checkCar(carPath); err != nil {
+		return err
+	}
+
+	tried := make(map[int]bool)
+	conn, err := connectScheduler(opts, tried)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.close() }()
+
+	result, err := uploadWithKeys(opts, conn, tried, carPath, info.Root, info.Name, info.Type)
+	if opts.existsOK(err) {
+		fmt.Printf("asset %s already exists, nothing uploaded\n", info.Root)
+	} else if err != nil {
+		return err
+	} else {
+		recordUpload(opts, conn, info.Root, info.Name, info.Type, "")
+	}
+	// the bundle has only the metadata of the manifest, not its files
+	m := newManifest()
+	m.Root, m.Dirs = info.Root, info.Metadata
+	if err := storeManifest(info.Root, m); err != nil {
+		fmt.Printf("warning: manifest not kept, meta can not show the metadata of %s, %s\n", info.Root, err.Error())
+	}
+	printUploadResult(opts, conn, info.Root, info.Name, info.Type, result, m)
+
+	printQuota(opts, conn)
+	return nil
+}
+
+func (b *bundleInfo) write(p string) error {
+	buf, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so a failed prepare never leaves a half written descriptor
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func readBundleInfo(p string) (*bundleInfo, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bundleInfo{}
+	if err := json.Unmarshal(buf, b); err != nil {
+		return nil, fmt.Errorf("parse descriptor %s %w", p, err)
+	}
+
+	if b.Version != bundleVersion {
+		return nil, fmt.Errorf("descriptor %s has version %d, only %d is supported", p, b.Version, bundleVersion)
+	}
+
+	if _, err := cid.Decode(b.Root); err != nil {
+		return nil, fmt.Errorf("descriptor %s has invalid root %w", p, err)
+	}
+
+	if len(b.Name) == 0 {
+		return nil, fmt.Errorf("descriptor %s has no name", p)
+	}
+
+	if b.Type != "file" && b.Type != "folder" {
+		return nil, fmt.Errorf("descriptor %s has unknown type %q", p, b.Type)
+	}
+
+	// the car must stay inside the bundle
+	if len(b.Car) == 0 || filepath.Base(b.Car) != b.Car {
+		return nil, fmt.Errorf("descriptor %s has invalid car %q", p, b.Car)
+	}
+	return b, nil
+}
+
+// checkCar checks the car is the one the descriptor was written for
+func (b *bundleInfo) checkCar(carPath string) error {
+	stat, err := os.Stat(carPath)
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() != b.Size {
+		return fmt.Errorf("car %s has %d bytes, descriptor expects %d", carPath, stat.Size(), b.Size)
+	}
+
+	r, err := car.OpenReader(carPath)
+	if err != nil {
+		return fmt.Errorf("open car %s %w", carPath, err)
+	}
+	defer r.Close()
+
+	roots, err := r.Roots()
+	if err != nil {
+		return fmt.Errorf("read roots of car %s %w", carPath, err)
+	}
+
+	if len(roots) != 1 || roots[0].String() != b.Root {
+		return fmt.Errorf("car %s has roots %v, descriptor expects %s", carPath, roots, b.Root)
+	}
+	return nil
+}
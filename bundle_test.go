@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// prepareTestBundle prepares a bundle of a folder with two files, it
+// returns the bundle directory and the root the folder packs to
+func prepareTestBundle(t *testing.T) (string, string) {
+	site := filepath.Join(t.TempDir(), "site")
+	if err := os.Mkdir(site, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"index.html": "<h1>hello</h1>", "app.js": "console.log(1)"} {
+		if err := os.WriteFile(filepath.Join(site, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "bundle")
+	if _, err := captureStdout(t, func() error { return runPrepare([]string{"--bundle", dir, site}) }); err != nil {
+		t.Fatal(err)
+	}
+	return dir, packCID(t, site)
+}
+
+// editDescriptor changes the descriptor of the bundle at dir with fn
+func editDescriptor(t *testing.T, dir string, fn func(b *bundleInfo)) {
+	p := filepath.Join(dir, bundleDescriptor)
+	b, err := readBundleInfo(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(b)
+	buf, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepareBundle(t *testing.T) {
+	testHome(t)
+	dir, root := prepareTestBundle(t)
+
+	info, err := readBundleInfo(filepath.Join(dir, bundleDescriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carInfo, err := os.Stat(filepath.Join(dir, bundleCar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bundleInfo{Version: bundleVersion, Root: root, Name: "site", Size: carInfo.Size(), Type: "folder", Car: bundleCar}
+	if info.Version != want.Version || info.Root != want.Root || info.Name != want.Name || info.Size != want.Size || info.Type != want.Type || info.Car != want.Car {
+		t.Errorf("descriptor %+v, want %+v", info, want)
+	}
+
+	car, err := os.ReadFile(filepath.Join(dir, bundleCar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCarStream(bytes.NewReader(car), cid.MustParse(root)); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, checksumsFile)); err != nil {
+		t.Errorf("no checksums in the bundle: %v", err)
+	}
+}
+
+func TestSubmitBundle(t *testing.T) {
+	testHome(t)
+	s := newFakeScheduler(t)
+	useScheduler(t, s)
+	dir, root := prepareTestBundle(t)
+
+	out, err := captureStdout(t, func() error { return runSubmit(uploadArgs("--no-postcheck", dir)) })
+	if err != nil {
+		t.Fatalf("submit: %v\n%s", err, out)
+	}
+	if s.uploads != 1 || s.records[root] == nil || s.records[root].State != "Servicing" {
+		t.Fatalf("%d uploads, record %+v", s.uploads, s.records[root])
+	}
+	if err := checkCarStream(bytes.NewReader(s.cars[root]), cid.MustParse(root)); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(out, "url: https://candidate.example.com/ipfs/"+root) {
+		t.Errorf("no retrieval url in\n%s", out)
+	}
+
+	// the bundle can be submitted again, the asset is there already
+	out, err = captureStdout(t, func() error { return runSubmit(uploadArgs("--no-postcheck", dir)) })
+	if err != nil || !strings.Contains(out, "already exists, nothing uploaded") || s.uploads != 1 {
+		t.Errorf("second submit: %v after %d uploads\n%s", err, s.uploads, out)
+	}
+}
+
+func TestSubmitBundleInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(t *testing.T, dir string)
+		err  string
+	}{
+		{"version", func(t *testing.T, dir string) {
+			editDescriptor(t, dir, func(b *bundleInfo) { b.Version = bundleVersion + 1 })
+		}, "only 1 is supported"},
+		{"root", func(t *testing.T, dir string) {
+			editDescriptor(t, dir, func(b *bundleInfo) { b.Root = "not-a-cid" })
+		}, "has invalid root"},
+		{"name", func(t *testing.T, dir string) {
+			editDescriptor(t, dir, func(b *bundleInfo) { b.Name = "" })
+		}, "has no name"},
+		{"type", func(t *testing.T, dir string) {
+			editDescriptor(t, dir, func(b *bundleInfo) { b.Type = "blob" })
+		}, `has unknown type "blob"`},
+		{"car outside", func(t *testing.T, dir string) {
+			editDescriptor(t, dir, func(b *bundleInfo) { b.Car = "../asset.car" })
+		}, `has invalid car "../asset.car"`},
+		{"size", func(t *testing.T, dir string) {
+			editDescriptor(t, dir, func(b *bundleInfo) { b.Size++ })
+		}, "descriptor expects"},
+		{"other root", func(t *testing.T, dir string) {
+			editDescriptor(t, dir, func(b *bundleInfo) { b.Root = testRoot })
+		}, "descriptor expects " + testRoot},
+		{"no descriptor", func(t *testing.T, dir string) {
+			if err := os.Remove(filepath.Join(dir, bundleDescriptor)); err != nil {
+				t.Fatal(err)
+			}
+		}, bundleDescriptor},
+		{"broken descriptor", func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, bundleDescriptor), []byte("{"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, "parse descriptor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			dir, _ := prepareTestBundle(t)
+			tt.edit(t, dir)
+
+			_, err := captureStdout(t, func() error { return runSubmit(uploadArgs("--no-postcheck", dir)) })
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			// nothing is sent for a bundle that does not check out
+			if n := s.count("CreateUserAsset"); n > 0 || s.uploads > 0 {
+				t.Errorf("%d CreateUserAsset and %d uploads", n, s.uploads)
+			}
+		})
+	}
+}
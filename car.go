@@ -5,9 +5,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"path/filepath"
 
-	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-unixfsnode/data/builder"
 	"github.com/ipld/go-car/v2"
@@ -20,105 +21,117 @@ import (
 )
 
 // CreateCar creates a car
-func createCar(input string, output string) (string, error) {
+func createCar(input string, output string, opts packOptions) (*packResult, error) {
+	return writeCar(output, opts, true, input)
+}
+
+// createWrappedCar creates a car of a directory with the inputs in it
+func createWrappedCar(inputs []string, output string, opts packOptions) (*packResult, error) {
+	return writeCar(output, opts, false, inputs...)
+}
+
+func writeCar(output string, opts packOptions, noWrap bool, inputs ...string) (*packResult, error) {
+	if opts.Discard {
+		return writeFiles(interruptContext(), noWrap, discardBlocks{}, opts, inputs...)
+	}
+
 	// make a cid with the right length that we eventually will patch with the root.
-	hasher, err := multihash.GetHasher(multihash.SHA2_256)
+	hasher, err := multihash.GetHasher(opts.Hash.code())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	digest := hasher.Sum([]byte{})
-	hash, err := multihash.Encode(digest, multihash.SHA2_256)
+	hash, err := multihash.Encode(digest, opts.Hash.code())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	proxyRoot := cid.NewCidV1(uint64(multicodec.DagPb), hash)
 
 	cdest, err := blockstore.OpenReadWrite(output, []cid.Cid{proxyRoot})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Write the unixfs blocks into the store.
-	root, err := writeFiles(context.TODO(), true, cdest, input)
+	result, err := writeFiles(interruptContext(), noWrap, cdest, opts, inputs...)
 	if err != nil {
-		return "", err
+		// the car stops short of its root, nothing can read it
+		cdest.Discard()
+		os.Remove(output)
+		return nil, err
 	}
 
 	if err := cdest.Finalize(); err != nil {
-		return "", err
+		os.Remove(output)
+		return nil, err
 	}
 
 	// return nil
 	// re-open/finalize with the final root.
-	return root.String(), car.ReplaceRootsInFile(output, []cid.Cid{root})
+	return result, car.ReplaceRootsInFile(output, []cid.Cid{result.Root})
 }
 
-func writeFiles(ctx context.Context, noWrap bool, bs *blockstore.ReadWrite, paths ...string) (cid.Cid, error) {
-	ls := cidlink.DefaultLinkSystem()
-	ls.TrustedStorage = true
-	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
-		cl, ok := l.(cidlink.Link)
-		if !ok {
-			return nil, fmt.Errorf("not a cidlink")
-		}
-		blk, err := bs.Get(ctx, cl.Cid)
-		if err != nil {
-			return nil, err
-		}
-		return bytes.NewBuffer(blk.RawData()), nil
-	}
-	ls.StorageWriteOpener = func(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
-		buf := bytes.NewBuffer(nil)
-		return buf, func(l ipld.Link) error {
-			cl, ok := l.(cidlink.Link)
-			if !ok {
-				return fmt.Errorf("not a cidlink")
-			}
-			blk, err := blocks.NewBlockWithCid(buf.Bytes(), cl.Cid)
-			if err != nil {
-				return err
-			}
-			bs.Put(ctx, blk)
-			return nil
-		}, nil
+func writeFiles(ctx context.Context, noWrap bool, bs blockStore, opts packOptions, paths ...string) (*packResult, error) {
+	bp := newBlockPipeline(ctx, bs, opts.Workers, opts.dag())
+	pk := newPacker(bp, opts)
+
+	if noWrap {
+		paths = paths[:1]
 	}
 
-	topLevel := make([]dagpb.PBLink, 0, len(paths))
+	inputs := make([]*pendingNode, 0, len(paths))
 	for _, p := range paths {
-		l, size, err := builder.BuildUnixFSRecursive(p, &ls)
-		if err != nil {
-			return cid.Undef, err
-		}
-		if noWrap {
-			rcl, ok := l.(cidlink.Link)
-			if !ok {
-				return cid.Undef, fmt.Errorf("could not interpret %s", l)
-			}
-			return rcl.Cid, nil
+		pk.root = p
+		if !noWrap {
+			pk.root = filepath.Dir(p)
 		}
-		name := path.Base(p)
-		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), l)
-		if err != nil {
-			return cid.Undef, err
-		}
-		topLevel = append(topLevel, entry)
+		inputs = append(inputs, pk.buildInput(p))
 	}
 
-	// make a directory for the file(s).
+	root := inputs[0]
+	if !noWrap {
+		// make a directory for the file(s).
+		root = bp.spawn(func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+			topLevel := make([]dagpb.PBLink, 0, len(paths))
+			for i, p := range paths {
+				l, size, err := inputs[i].wait()
+				if err != nil {
+					return nil, 0, err
+				}
+				name := path.Base(p)
+				entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), l)
+				if err != nil {
+					return nil, 0, err
+				}
+				topLevel = append(topLevel, entry)
+			}
+			return builder.BuildUnixFSDirectory(topLevel, ls)
+		})
+	}
 
-	root, _, err := builder.BuildUnixFSDirectory(topLevel, &ls)
+	l, _, err := root.wait()
+	// the first failure is more useful than the cancellation it caused
+	if closeErr := bp.close(); closeErr != nil {
+		err = closeErr
+	}
 	if err != nil {
-		return cid.Undef, nil
+		return nil, err
 	}
-	rcl, ok := root.(cidlink.Link)
+
+	rcl, ok := l.(cidlink.Link)
 	if !ok {
-		return cid.Undef, fmt.Errorf("could not interpret %s", root)
+		return nil, fmt.Errorf("could not interpret %s", l)
 	}
 
-	return rcl.Cid, nil
+	pk.stats.Blocks = bp.blocks
+	if opts.Previous != nil {
+		pk.stats.ReusedBlocks = opts.Previous.reused
+	}
+	return &packResult{Root: rcl.Cid, Stats: pk.stats, Manifest: pk.manifest(rcl.Cid.String())}, nil
 }
 
-func calculateCid(r io.Reader) (cid.Cid, error) {
+// calculateCid is the cid of the file dag of r made in format f
+func calculateCid(r io.Reader, f dagFormat) (cid.Cid, error) {
 	ls := cidlink.DefaultLinkSystem()
 	ls.TrustedStorage = true
 
@@ -133,11 +146,13 @@ func calculateCid(r io.Reader) (cid.Cid, error) {
 		}, nil
 	}
 
-	link, _, err := builder.BuildUnixFSFile(r, "", &ls)
+	f.formatLinkSystem(&ls)
+
+	link, _, err := builder.BuildUnixFSFile(r, f.chunker, &ls)
 	if err != nil {
 		return cid.Cid{}, err
 	}
 
-	root := link.(cidlink.Link)
+	root := f.relabelLink(link).(cidlink.Link)
 	return root.Cid, nil
 }
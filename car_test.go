@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	chunk "github.com/ipfs/go-ipfs-chunker"
+	"github.com/multiformats/go-multihash"
+)
+
+// ipfsAdd is the dag ipfs add writes for a file: the balanced layout of
+// go-unixfs with at most 174 links a node. Leaves that are not raw blocks
+// are unixfs nodes, the first of type file and the others of type raw as
+// go-unixfs makes them. The blocks are encoded by hand so the cids of the
+// pack are checked against an implementation of the format of its own
+type ipfsAdd struct {
+	hash      uint64
+	rawLeaves bool
+	chunks    [][]byte
+}
+
+// ipfsAddNode is a block of the dag, fileSize is the file data below it
+// and tsize the size of the block and every block below it
+type ipfsAddNode struct {
+	c        cid.Cid
+	fileSize uint64
+	tsize    uint64
+}
+
+const (
+	unixfsRaw  = 0
+	unixfsFile = 2
+	// ipfsAddLinks is helpers.DefaultLinksPerBlock of go-unixfs
+	ipfsAddLinks = 174
+)
+
+// newIPFSAdd splits data with the chunker the way ipfs add --chunker does
+func newIPFSAdd(t *testing.T, data []byte, chunker string, hash uint64, rawLeaves bool) *ipfsAdd {
+	spl, err := chunk.FromString(bytes.NewReader(data), chunker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &ipfsAdd{hash: hash, rawLeaves: rawLeaves}
+	for {
+		b, err := spl.NextBytes()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		a.chunks = append(a.chunks, b)
+	}
+	return a
+}
+
+// root is the root cid of the dag, the loop of balanced.Layout
+func (a *ipfsAdd) root() cid.Cid {
+	if len(a.chunks) == 0 {
+		return a.leaf(nil, unixfsFile).c
+	}
+
+	root := a.nextLeaf(unixfsFile)
+	for depth := 1; len(a.chunks) > 0; depth++ {
+		root = a.fill([]ipfsAddNode{root}, depth)
+	}
+	return root.c
+}
+
+// fill adds children of depth below to the node with children, up to the
+// link limit or the end of the data
+func (a *ipfsAdd) fill(children []ipfsAddNode, depth int) ipfsAddNode {
+	for len(children) < ipfsAddLinks && len(a.chunks) > 0 {
+		if depth == 1 {
+			children = append(children, a.nextLeaf(unixfsRaw))
+		} else {
+			children = append(children, a.fill(nil, depth-1))
+		}
+	}
+
+	var fileSize uint64
+	sizes := make([]uint64, len(children))
+	for i, c := range children {
+		sizes[i] = c.fileSize
+		fileSize += c.fileSize
+	}
+	return a.block(cid.DagProtobuf, unixfsNode(unixfsFile, nil, fileSize, sizes, children), fileSize, children)
+}
+
+func (a *ipfsAdd) nextLeaf(typ uint64) ipfsAddNode {
+	b := a.chunks[0]
+	a.chunks = a.chunks[1:]
+	return a.leaf(b, typ)
+}
+
+func (a *ipfsAdd) leaf(b []byte, typ uint64) ipfsAddNode {
+	if a.rawLeaves {
+		return a.block(cid.Raw, b, uint64(len(b)), nil)
+	}
+	return a.block(cid.DagProtobuf, unixfsNode(typ, b, uint64(len(b)), nil, nil), uint64(len(b)), nil)
+}
+
+func (a *ipfsAdd) block(codec uint64, b []byte, fileSize uint64, children []ipfsAddNode) ipfsAddNode {
+	mh, err := multihash.Sum(b, a.hash, -1)
+	if err != nil {
+		panic(err)
+	}
+	n := ipfsAddNode{c: cid.NewCidV1(codec, mh), fileSize: fileSize, tsize: uint64(len(b))}
+	for _, c := range children {
+		n.tsize += c.tsize
+	}
+	return n
+}
+
+// unixfsNode is the dag-pb block of a unixfs node, the links first and
+// the unixfs data after them as dag-pb orders the fields
+func unixfsNode(typ uint64, data []byte, fileSize uint64, blockSizes []uint64, links []ipfsAddNode) []byte {
+	var u []byte
+	u = protoVarint(u, 1, typ)
+	if len(data) > 0 {
+		u = protoBytes(u, 2, data)
+	}
+	u = protoVarint(u, 3, fileSize)
+	for _, s := range blockSizes {
+		u = protoVarint(u, 4, s)
+	}
+
+	var n []byte
+	for _, l := range links {
+		var pl []byte
+		pl = protoBytes(pl, 1, l.c.Bytes())
+		// go-unixfs links have an empty name, which is still written
+		pl = protoBytes(pl, 2, nil)
+		pl = protoVarint(pl, 3, l.tsize)
+		n = protoBytes(n, 2, pl)
+	}
+	return protoBytes(n, 1, u)
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3))
+	return binary.AppendUvarint(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// testData is n bytes that are the same on every run
+func testData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b) //nolint:errcheck
+	return b
+}
+
+// packCID is the root cid cid prints for the input with the pack flags
+func packCID(t *testing.T, args ...string) string {
+	out, err := captureStdout(t, func() error { return runCid(args) })
+	if err != nil {
+		t.Fatalf("cid %v: %v", args, err)
+	}
+	return strings.TrimSpace(out)
+}
+
+// goldenInputs are the files of the golden cid tests: a single block, an
+// empty file and one of 13 chunks of the default chunker
+func goldenInputs(t *testing.T) (hello, empty, big string, bigData []byte) {
+	testHome(t)
+	dir := t.TempDir()
+	bigData = testData(3<<20 + 12345)
+	for name, b := range map[string][]byte{"hello.txt": []byte("hello world\n"), "empty": nil, "big.bin": bigData} {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "hello.txt"), filepath.Join(dir, "empty"), filepath.Join(dir, "big.bin"), bigData
+}
+
+// checkCID checks the cid of the input with the pack flags against the dag
+// of ipfs add and the golden cid of ipfs add with the same flags
+func checkCID(t *testing.T, a *ipfsAdd, golden string, args ...string) {
+	t.Helper()
+	want := a.root().String()
+	if want != golden {
+		t.Fatalf("the dag of ipfs add is %s, the golden cid %s", want, golden)
+	}
+	if got := packCID(t, args...); got != want {
+		t.Errorf("cid %v is %s, want %s", args, got, want)
+	}
+}
+
+func TestHashCIDs(t *testing.T) {
+	hello, _, big, bigData := goldenInputs(t)
+
+	tests := []struct {
+		hash string
+		code uint64
+		// the cids of ipfs add --cid-version 1 --hash <hash>
+		hello, big string
+	}{
+		{"sha2-256", multihash.SHA2_256, "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4", "bafybeie2eucoc5rwktxp243drkngonmbysjl2xgtvmegztqorqvysz5jri"},
+		{"blake2b-256", multihash.BLAKE2B_MIN + 31, "bafk2bzaceddrwbp5duohx57jfd7rrzmnwumt5eywifwme25jzsijjwua24ar4", "bafykbzacecvpfft4c2m7lnf2ytgrd746mdrsshxvo7775rvc47fqm3dcnemzw"},
+		{"blake3", multihash.BLAKE3, "bafkr4ig4ljhnxasawambeqcsymycobuw7ftxdjr3iusquxax2maa5artku", "bafyb4ig2pgy5e55rrrfnq3dwkeagxgptlujnklyrfb5pc7nskufdrfdwyi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			checkCID(t, newIPFSAdd(t, []byte("hello world\n"), defaultChunker, tt.code, true), tt.hello, "--hash", tt.hash, hello)
+			checkCID(t, newIPFSAdd(t, bigData, defaultChunker, tt.code, true), tt.big, "--hash", tt.hash, big)
+		})
+	}
+}
+
+func TestChunkerCIDs(t *testing.T) {
+	_, _, big, bigData := goldenInputs(t)
+
+	tests := []struct {
+		args    []string
+		chunker string
+		// the cid of ipfs add --cid-version 1 --chunker <chunker>
+		golden string
+	}{
+		{nil, defaultChunker, "bafybeie2eucoc5rwktxp243drkngonmbysjl2xgtvmegztqorqvysz5jri"},
+		{[]string{"--chunker", "size-16384"}, "size-16384", "bafybeihrzaqkjkd6hcnzuid7tubjip5ypqxt2ajq67bdahtaynadk5a3sq"},
+		{[]string{"--chunk-size", "1MiB"}, "size-1048576", "bafybeib2jtr5v7jjced64fncgcxbeo64sbkg4uzzfxieyemvsbd6ke5mga"},
+		{[]string{"--chunker", "rabin"}, "rabin", "bafybeiatf62rj5hkcmxy3yibsjdxtgi3byv2ztvtapxnwdngqiohkvkhum"},
+		{[]string{"--chunker", "rabin-16384-65536-131072"}, "rabin-16384-65536-131072", "bafybeifbk66abnfvfv4s2wizn5uwwcsyu2me26ahpqsjoagji4kp2l5524"},
+		{[]string{"--chunker", "buzhash"}, "buzhash", "bafybeifyub2aoq5cxciu6to46invvp5mwamjoicg6leaqycbw7wt6dxi4y"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.chunker, func(t *testing.T) {
+			checkCID(t, newIPFSAdd(t, bigData, tt.chunker, multihash.SHA2_256, true), tt.golden, append(tt.args, big)...)
+		})
+	}
+}
+
+func TestRawLeavesCIDs(t *testing.T) {
+	hello, empty, big, bigData := goldenInputs(t)
+
+	tests := []struct {
+		name    string
+		input   string
+		data    []byte
+		chunker string
+		// the cid of ipfs add --cid-version 1 --raw-leaves=false, and of
+		// ipfs add --cid-version 0 when the input is a single block
+		golden, v0 string
+	}{
+		{"hello", hello, []byte("hello world\n"), defaultChunker, "bafybeicg2rebjoofv4kbyovkw7af3rpiitvnl6i7ckcywaq6xjcxnc2mby", "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"},
+		{"empty", empty, nil, defaultChunker, "bafybeif7ztnhq65lumvvtr4ekcwd2ifwgm3awq4zfr3srh462rwyinlb4y", "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{"big", big, bigData, defaultChunker, "bafybeihdubuze3rbnp43vggkju2bijvufir6c43qwtcixlwdvpcb4jjk4m", ""},
+		{"big size-16384", big, bigData, "size-16384", "bafybeidmr5ustk3dblhf5xchdoo2nzk4yaw2h3vy5suiqdl6knhaaejdye", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.v0) > 0 {
+				c, err := cid.Decode(tt.golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v0 := cid.NewCidV0(c.Hash()).String(); v0 != tt.v0 {
+					t.Fatalf("the golden cid is %s in version 0, ipfs add gives %s", v0, tt.v0)
+				}
+			}
+			checkCID(t, newIPFSAdd(t, tt.data, tt.chunker, multihash.SHA2_256, false), tt.golden, "--raw-leaves=false", "--chunker", tt.chunker, tt.input)
+		})
+	}
+}
+
+func TestWriteCarFailed(t *testing.T) {
+	testHome(t)
+	// the link to nothing is walked after docs, the pack fails once the
+	// blocks of docs are in the car
+	site := symlinkFixture(t, map[string]string{"zz-gone": "missing"}, "docs")
+	if err := os.WriteFile(filepath.Join(site, "docs", "big.bin"), testData(4<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), "site.car")
+
+	if _, err := createCar(site, output, packOptions{Workers: 2, Symlinks: symlinkFollow}); err == nil {
+		t.Fatal("the pack did not fail")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("the car cut short is kept, %v", err)
+	}
+	// no file descriptor is left on the car
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return
+	}
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); strings.HasPrefix(target, output) {
+			t.Errorf("fd %s is still open on %s", fd.Name(), target)
+		}
+	}
+}
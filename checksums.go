@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// checksumsFile is the name of the sha256sum listing, next to the manifest
+// or in the root of the asset with --embed-checksums
+const checksumsFile = "SHA256SUMS"
+
+// formatChecksums is sums, sha256 by path, in the format of sha256sum so
+// sha256sum -c checks the files from the root of the input
+func formatChecksums(sums map[string]string) []byte {
+	paths := make([]string, 0, len(sums))
+	for p, sum := range sums {
+		if len(sum) > 0 {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var b bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%s  %s\n", sums[p], p)
+	}
+	return b.Bytes()
+}
+
+// checksums are the sha256 of the files of m by path, files of an
+// incremental pack whose previous manifest had none are missing
+func (m *manifest) checksums() (map[string]string, int) {
+	sums := make(map[string]string, len(m.Files))
+	var missing int
+	for p, f := range m.Files {
+		if len(f.SHA256) == 0 {
+			missing++
+			continue
+		}
+		sums[p] = f.SHA256
+	}
+	return sums, missing
+}
+
+// storeChecksums keeps the listing of the files of an upload next to the
+// manifests kept for meta, as <cid>.SHA256SUMS
+func storeChecksums(root string, m *manifest) error {
+	if m == nil || len(m.Files) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(manifestsDir(), 0700); err != nil {
+		return err
+	}
+	return writeChecksums(filepath.Join(manifestsDir(), root+"."+checksumsFile), m)
+}
+
+// writeChecksums writes the listing of the files of m to filePath, nothing
+// is written for a pack without checksums
+func writeChecksums(filePath string, m *manifest) error {
+	if m == nil {
+		return nil
+	}
+
+	sums, missing := m.checksums()
+	if len(sums) == 0 {
+		return nil
+	}
+	if missing > 0 {
+		fmt.Printf("warning: %d files have no checksum, they were reused from a pack without them\n", missing)
+	}
+
+	tmp := filePath + ".tmp"
+	if err := os.WriteFile(tmp, formatChecksums(sums), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filePath); err != nil {
+		return err
+	}
+	fmt.Printf("checksums of %d files written to %s\n", len(sums), filePath)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// checksumsFixture is a folder of files in directories, with a name that
+// has a space and an empty file
+func checksumsFixture(t *testing.T) string {
+	site := filepath.Join(t.TempDir(), "site")
+	files := map[string][]byte{
+		"index.html":         []byte("<h1>hello</h1>"),
+		"css/site style.css": []byte("body { color: red }"),
+		"img/logo.bin":       testData(1<<20 + 17),
+		"empty":              nil,
+	}
+	for name, b := range files {
+		p := filepath.Join(site, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return site
+}
+
+// sha256sumCheck runs sha256sum -c with the listing in dir
+func sha256sumCheck(t *testing.T, dir, listing string) {
+	t.Helper()
+	cmd := exec.Command("sha256sum", "--strict", "-c", listing)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("sha256sum -c %s: %v\n%s", listing, err, out)
+	}
+	// every file of the fixture is listed
+	if n := strings.Count(string(out), ": OK\n"); n != 4 {
+		t.Errorf("%d files checked, want 4:\n%s", n, out)
+	}
+}
+
+func TestChecksumsRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("no sha256sum")
+	}
+
+	t.Run("sidecar", func(t *testing.T) {
+		testHome(t)
+		site := checksumsFixture(t)
+		dir := filepath.Join(t.TempDir(), "bundle")
+		if _, err := captureStdout(t, func() error { return runPrepare([]string{"--bundle", dir, site}) }); err != nil {
+			t.Fatal(err)
+		}
+		info, err := readBundleInfo(filepath.Join(dir, bundleDescriptor))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := filepath.Join(t.TempDir(), "site")
+		if _, err := captureStdout(t, func() error {
+			return extractCar(testOptions(t), filepath.Join(dir, info.Car), cid.MustParse(info.Root), out)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sha256sumCheck(t, out, filepath.Join(dir, checksumsFile))
+	})
+
+	t.Run("embedded", func(t *testing.T) {
+		testHome(t)
+		site := checksumsFixture(t)
+		carPath := filepath.Join(t.TempDir(), "site.car")
+		result, err := createCar(site, carPath, packOptions{Workers: 2, EmbedChecksums: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := filepath.Join(t.TempDir(), "site")
+		if _, err := captureStdout(t, func() error { return extractCar(testOptions(t), carPath, result.Root, out) }); err != nil {
+			t.Fatal(err)
+		}
+		sha256sumCheck(t, out, checksumsFile)
+
+		// a changed file fails the check
+		if err := os.WriteFile(filepath.Join(out, "index.html"), []byte("<h1>changed</h1>"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("sha256sum", "-c", checksumsFile)
+		cmd.Dir = out
+		if b, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(b), "index.html: FAILED") {
+			t.Errorf("the changed file passed the check:\n%s", b)
+		}
+	})
+}
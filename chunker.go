@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	chunk "github.com/ipfs/go-ipfs-chunker"
+)
+
+// the bounds of a fixed chunk size, smaller chunks make a dag of mostly
+// links and candidates refuse blocks much over 1 MiB
+const (
+	minChunkSize = 16 << 10
+	maxChunkSize = 1 << 20
+)
+
+// defaultChunker is the chunker of the unixfs builder and of kubo
+const defaultChunker = "size-262144"
+
+// chunkerFlag is the chunker of --chunker, empty is defaultChunker
+type chunkerFlag string
+
+func (c *chunkerFlag) String() string {
+	if c == nil || len(*c) == 0 {
+		return defaultChunker
+	}
+	return string(*c)
+}
+
+func (c *chunkerFlag) Set(s string) error {
+	if strings.HasPrefix(s, "size-") {
+		n, err := strconv.ParseInt(strings.TrimPrefix(s, "size-"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("chunker %s has no chunk size", s)
+		}
+		return (*chunkSizeFlag)(c).set(n)
+	}
+
+	// the chunker parses rabin and buzhash itself
+	if _, err := chunk.FromString(strings.NewReader(""), s); err != nil || (s != "buzhash" && !strings.HasPrefix(s, "rabin")) {
+		return fmt.Errorf("unknown chunker %q, use size-<bytes>, rabin, rabin-<avg>, rabin-<min>-<avg>-<max> or buzhash", s)
+	}
+	*c = chunkerFlag(s)
+	return nil
+}
+
+// fixedSize is the chunk size of a size-N chunker, 0 for the others
+func (c *chunkerFlag) fixedSize() int64 {
+	n, err := strconv.ParseInt(strings.TrimPrefix(c.String(), "size-"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// buzhashMaxSize is the largest chunk of the buzhash chunker, go-ipfs-chunker
+// does not export it
+const buzhashMaxSize = 512 << 10
+
+// maxSize is the largest chunk the chunker makes, rabin without a max
+// makes chunks up to one and a half times the average
+func (c *chunkerFlag) maxSize() int64 {
+	s := c.String()
+	if s == "buzhash" {
+		return buzhashMaxSize
+	} else if !strings.HasPrefix(s, "rabin") {
+		return c.fixedSize()
+	}
+
+	// the sizes may be labeled, like rabin-min:16384-avg:65536-max:131072
+	parts := strings.Split(s, "-")
+	size := func(part string) int64 {
+		n, _ := strconv.ParseInt(part[strings.LastIndex(part, ":")+1:], 10, 64)
+		return n
+	}
+	switch len(parts) {
+	case 2:
+		return size(parts[1]) * 3 / 2
+	case 4:
+		return size(parts[3])
+	default:
+		return chunk.DefaultBlockSize * 3 / 2
+	}
+}
+
+// chunkSizeFlag is --chunk-size, the same as --chunker size-N
+type chunkSizeFlag chunkerFlag
+
+func (c *chunkSizeFlag) String() string {
+	return strconv.FormatInt((*chunkerFlag)(c).fixedSize(), 10)
+}
+
+func (c *chunkSizeFlag) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	return c.set(n)
+}
+
+func (c *chunkSizeFlag) set(n int64) error {
+	if n < minChunkSize || n > maxChunkSize {
+		return fmt.Errorf("chunk size %s is not between %s and %s", formatSize(n), formatSize(minChunkSize), formatSize(maxChunkSize))
+	}
+	*c = chunkSizeFlag(fmt.Sprintf("size-%d", n))
+	return nil
+}
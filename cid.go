@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// discardBlocks is the block store of a pack that only wants the root cid
+type discardBlocks struct{}
+
+func (discardBlocks) Put(context.Context, blocks.Block) error { return nil }
+
+func (discardBlocks) Get(_ context.Context, c cid.Cid) (blocks.Block, error) {
+	return nil, fmt.Errorf("block %s is not kept, cid packs into no car", c)
+}
+
+// runCid prints the root cid an upload of each input would get, with the
+// same pack flags. The dag is hashed without writing a car, no api key is
+// needed and nothing goes over the network
+func runCid(args []string) error {
+	opts := newOptions()
+	opts.cidOnly = true
+
+	fs := newFlagSet("cid")
+	opts.commonFlags(fs)
+	opts.packFlags(fs)
+	fs.BoolVar(&opts.wrap, "wrap", false, "print the cid of one folder with the inputs in it, as upload --wrap packs them")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("please input file path")
+	} else if len(opts.incremental) > 0 {
+		return fmt.Errorf("incremental writes the car it reuses, cid packs into no car")
+	}
+
+	inputs, err := expandInputs(args)
+	if err != nil {
+		return err
+	}
+	if err := opts.checkStreamInputs(inputs); err != nil {
+		return err
+	}
+	if opts.wrap {
+		if err := opts.checkWrap(inputs); err != nil {
+			return err
+		}
+	} else if len(inputs) > 1 && (opts.offset != 0 || opts.length != 0) {
+		return fmt.Errorf("offset and length are a window of one file, they can not be used with several inputs")
+	}
+
+	// the cids are the only thing on stdout, what the pack prints goes to
+	// stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = out }()
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if opts.wrap {
+		inputs = inputs[:1]
+	}
+	for _, input := range inputs {
+		asset, err := packInput(opts, input, "")
+		if err != nil {
+			return fmt.Errorf("cid of %s error %s", input, err.Error())
+		}
+
+		if len(inputs) == 1 {
+			fmt.Fprintln(out, asset.root)
+		} else {
+			fmt.Fprintf(out, "%s  %s\n", asset.root, input)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCidMatchesUpload(t *testing.T) {
+	inputs := map[string]func(t *testing.T) string{
+		"file":  func(t *testing.T) string { return writeFile(t, "hello.txt", "hello world\n") },
+		"empty": func(t *testing.T) string { return writeFile(t, "empty", "") },
+		"big": func(t *testing.T) string {
+			p := filepath.Join(t.TempDir(), "big.bin")
+			if err := os.WriteFile(p, testData(3<<20+12345), 0600); err != nil {
+				t.Fatal(err)
+			}
+			return p
+		},
+		"folder": func(t *testing.T) string { return writeTree(t, func(string) bool { return true }, "empty/dir") },
+	}
+	tests := []struct {
+		name  string
+		flags []string
+	}{
+		{"default", nil},
+		{"chunker", []string{"--chunker", "size-65536"}},
+		{"rabin", []string{"--chunker", "rabin"}},
+		{"no raw leaves", []string{"--raw-leaves=false"}},
+		{"hash", []string{"--hash", "blake3"}},
+		{"wrap", []string{"--wrap"}},
+		{"exclude", []string{"--exclude", "*.log"}},
+	}
+
+	for name, input := range inputs {
+		for _, tt := range tests {
+			t.Run(name+" "+tt.name, func(t *testing.T) {
+				tmp := testHome(t)
+				s := newFakeScheduler(t)
+				useScheduler(t, s)
+				p := input(t)
+
+				// cid needs no api key, asks no scheduler and writes no car
+				got := packCID(t, append(tt.flags, p)...)
+				if len(s.calls) > 0 || s.uploads > 0 {
+					t.Errorf("cid called the scheduler %v and uploaded %d cars", s.calls, s.uploads)
+				}
+				if files, _ := os.ReadDir(tmp); len(files) > 0 {
+					t.Errorf("cid left %d files in the temp directory", len(files))
+				}
+
+				out, err := captureStdout(t, func() error { return runUpload(uploadArgs(append(tt.flags, "--json", "--no-postcheck", p)...)) })
+				if err != nil {
+					t.Fatalf("upload: %v\n%s", err, out)
+				}
+				var result jsonResult
+				if err := json.Unmarshal([]byte(out), &result); err != nil {
+					t.Fatalf("%v in\n%s", err, out)
+				}
+				if got != result.RootCID {
+					t.Errorf("cid %s, the upload is %s", got, result.RootCID)
+				}
+				if _, ok := s.cars[got]; !ok {
+					t.Errorf("no car of %s was uploaded", got)
+				}
+			})
+		}
+	}
+}
+
+func TestCidMatchesCar(t *testing.T) {
+	testHome(t)
+	dir := writeTree(t, func(string) bool { return true })
+	file := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(file, testData(3<<20+12345), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cid is the root of the car the same pack writes
+	for _, p := range []string{dir, file} {
+		result, err := createCar(p, filepath.Join(t.TempDir(), "asset.car"), packOptions{Workers: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := packCID(t, p); got != result.Root.String() {
+			t.Errorf("cid of %s is %s, the car has %s", p, got, result.Root)
+		}
+	}
+}
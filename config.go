@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// the keys of the config file that are not flags
+const (
+	configAPIKey = "api_key"
+	configTmpDir = "tmp_dir"
+)
+
+// envFlags are the environment variables that stand in for a flag left off
+// the command line, they win over the config file. TITAN_API_KEY is taken by
+// resolveAPIKey
+var envFlags = map[string]string{"locator-url": "TITAN_LOCATOR_URL"}
+
+// tomlPrefix is the start of a toml error, the line is told in the words of
+// the config instead
+var tomlPrefix = regexp.MustCompile(`^toml: line \d+( \(last key "[^"]*"\))?: `)
+
+// configKey is a key of the config file, the name of a flag with _ for -
+var configKey = regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+
+// config is the config file, the defaults of the flags of every subcommand
+type config struct {
+	path   string
+	values map[string]interface{}
+	// raw is the file as it was read, for the line of a bad value
+	raw []byte
+}
+
+// loadedConfig is the config of this run, nil until a subcommand parsed
+// its flags or without a config file
+var loadedConfig *config
+
+// configPath is the config file read by default
+func configPath() string {
+	return filepath.Join(stateDir(), "config.toml")
+}
+
+// loadConfig reads the config file at p, a default path that does not exist
+// is an empty config
+func loadConfig(p string, explicit bool) (*config, error) {
+	c := &config{path: p, values: make(map[string]interface{})}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read config %w", err)
+	}
+	c.raw = b
+
+	if _, err := toml.Decode(string(b), &c.values); err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			return nil, c.parseError(pe)
+		}
+		return nil, fmt.Errorf("config %s %w", p, err)
+	}
+
+	for key, v := range c.values {
+		if _, ok := v.(map[string]interface{}); ok {
+			return nil, c.lineError(key, "tables are not supported, the keys go at the top of the file")
+		} else if !configKey.MatchString(key) {
+			return nil, c.lineError(key, fmt.Sprintf("%s is not a key, write the name of a flag with _ for -, like locator_url", key))
+		}
+	}
+
+	if _, ok := c.values[configAPIKey]; ok && runtime.GOOS != "windows" {
+		if info, err := os.Stat(p); err == nil && info.Mode().Perm()&0077 != 0 {
+			fmt.Fprintf(os.Stderr, "warning: config %s holds the api key and can be read by others, chmod 600 it\n", p)
+		}
+	}
+	return c, nil
+}
+
+// line is the line of the file the key is set at, or the table key starts
+// at, 0 when it is not found
+func (c *config) line(key string) int {
+	set := regexp.MustCompile(`^\s*("?` + regexp.QuoteMeta(key) + `"?\s*=|\[\s*` + regexp.QuoteMeta(key) + `\s*\])`)
+	for i, l := range bytes.Split(c.raw, []byte("\n")) {
+		if set.Match(l) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (c *config) lineError(key, msg string) error {
+	return c.errorAt(c.line(key), msg)
+}
+
+// parseError is the toml error pe at the line it was found in, a value
+// missing at the end of a line is told on that line and not the next
+func (c *config) parseError(pe toml.ParseError) error {
+	n := pe.Position.Line
+	if start := pe.Position.Start; start > 0 && start <= len(c.raw) {
+		n = bytes.Count(c.raw[:start], []byte("\n")) + 1
+	}
+	return c.errorAt(n, tomlPrefix.ReplaceAllString(pe.Error(), ""))
+}
+
+// errorAt is the error msg about line n of the file, with the line so it
+// can be found
+func (c *config) errorAt(n int, msg string) error {
+	lines := bytes.Split(c.raw, []byte("\n"))
+	if n < 1 || n > len(lines) {
+		return fmt.Errorf("config %s: %s", c.path, msg)
+	}
+	return fmt.Errorf("config %s line %d %q: %s", c.path, n, bytes.TrimSpace(lines[n-1]), msg)
+}
+
+// strings are the values of key as flags take them, an array sets a flag
+// that can be repeated once per element
+func (c *config) strings(key string) ([]string, error) {
+	var values []string
+	var add func(interface{}) error
+	add = func(v interface{}) error {
+		switch v := v.(type) {
+		case string:
+			values = append(values, v)
+		case bool:
+			values = append(values, strconv.FormatBool(v))
+		case int64, float64:
+			values = append(values, fmt.Sprint(v))
+		case []interface{}:
+			for _, e := range v {
+				if err := add(e); err != nil {
+					return err
+				}
+			}
+		default:
+			return c.lineError(key, fmt.Sprintf("%s can not be a %T, use a string, a number or a bool", key, v))
+		}
+		return nil
+	}
+	if v, ok := c.values[key]; ok {
+		if err := add(v); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// apiKeys are the api keys of the config, an array gives several like a
+// repeated --api-key
+func (c *config) apiKeys() []string {
+	if c == nil {
+		return nil
+	}
+	// the values were checked when the config was applied
+	values, _ := c.strings(configAPIKey)
+	return values
+}
+
+// applyConfig sets the flags of fs that the command line left alone to
+// their environment variable, or else to the values of the config of
+// --config. Keys that are not flags of the subcommand are left for the
+// others
+func applyConfig(fs *flag.FlagSet) error {
+	p, explicit := configPath(), false
+	if f := fs.Lookup("config"); f != nil && f.Value.String() != f.DefValue {
+		p, explicit = f.Value.String(), true
+	}
+
+	c, err := loadConfig(p, explicit)
+	if err != nil {
+		return err
+	}
+	loadedConfig = c
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for name, env := range envFlags {
+		if v := os.Getenv(env); len(v) > 0 && !set[name] && fs.Lookup(name) != nil {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for %s: %s", v, env, err.Error())
+			}
+			set[name] = true
+		}
+	}
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values, err := c.strings(key)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case configAPIKey:
+			// resolveAPIKey takes it after the flag
+			for _, v := range values {
+				addSecret(v)
+			}
+			continue
+		case configTmpDir:
+			// the temp cars go there unless the environment says otherwise
+			if len(values) > 0 && len(os.Getenv(tempDirEnv())) == 0 {
+				os.Setenv(tempDirEnv(), values[len(values)-1])
+			}
+			continue
+		}
+
+		name := strings.ReplaceAll(key, "_", "-")
+		f := fs.Lookup(name)
+		if f == nil {
+			logDebug("config %s is not a flag of %s", key, fs.Name())
+			continue
+		} else if set[name] {
+			continue
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return c.lineError(key, fmt.Sprintf("invalid value %q for %s: %s", v, key, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// tempDirEnv is the variable os.TempDir reads the temp directory from
+func tempDirEnv() string {
+	if runtime.GOOS == "windows" {
+		return "TMP"
+	}
+	return "TMPDIR"
+}
+
+func runConfig(args []string) error {
+	fs := newFlagSet("config")
+	path := fs.String("config", configPath(), "config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	args = fs.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("please input set, unset or show")
+	}
+
+	switch args[0] {
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("please input the key and the value, like config set locator_url https://locator.example.com/rpc/v0")
+		}
+		return setConfig(*path, args[1], &args[2])
+	case "unset":
+		if len(args) != 2 {
+			return fmt.Errorf("please input the key to remove")
+		}
+		return setConfig(*path, args[1], nil)
+	case "show":
+		return showConfig(*path)
+	default:
+		return fmt.Errorf("unknown config command %s", args[0])
+	}
+}
+
+// setConfig sets key to value in the config file at p, or removes it when
+// value is nil. The other lines are kept as they are
+func setConfig(p, key string, value *string) error {
+	if !configKey.MatchString(key) {
+		return fmt.Errorf("%s is not a key, write the name of a flag with _ for -, like locator_url", key)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read config %w", err)
+	}
+	// a broken file can still be fixed with set and unset, the result is
+	// checked before it is written
+	old := &config{path: p, raw: b}
+
+	var lines []string
+	if len(b) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	entry := ""
+	if value != nil {
+		entry = fmt.Sprintf("%s = %s", key, strconv.Quote(*value))
+	}
+	if n := old.line(key); n > 0 && value != nil {
+		lines[n-1] = entry
+	} else if n > 0 {
+		lines = append(lines[:n-1], lines[n:]...)
+	} else if value != nil {
+		lines = append(lines, entry)
+	} else {
+		return fmt.Errorf("config %s has no %s", p, key)
+	}
+
+	out := strings.Join(lines, "\n") + "\n"
+	if _, err := toml.Decode(out, new(map[string]interface{})); err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			fixed := &config{path: p, raw: []byte(out)}
+			return fmt.Errorf("%w, fix it before the change", fixed.parseError(pe))
+		}
+		return fmt.Errorf("config %s %w", p, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p, []byte(out), 0600); err != nil {
+		return err
+	}
+	// a file that was there keeps its mode with WriteFile
+	if err := os.Chmod(p, 0600); err != nil {
+		return err
+	}
+
+	if value == nil {
+		fmt.Printf("%s removed from %s\n", key, p)
+	} else if key == configAPIKey {
+		fmt.Printf("%s set to %s in %s\n", key, mask(*value), p)
+	} else {
+		fmt.Printf("%s set to %s in %s\n", key, *value, p)
+	}
+	return nil
+}
+
+// showConfig prints the config file at p with the api key masked
+func showConfig(p string) error {
+	c, err := loadConfig(p, false)
+	if err != nil {
+		return err
+	} else if len(c.raw) == 0 {
+		fmt.Printf("no config in %s, add keys with config set\n", p)
+		return nil
+	}
+
+	fmt.Printf("# %s\n", p)
+	lines := strings.Split(strings.TrimSuffix(string(c.raw), "\n"), "\n")
+	if n := c.line(configAPIKey); n > 0 {
+		masked := make([]string, 0, 1)
+		keys, err := c.strings(configAPIKey)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			masked = append(masked, strconv.Quote(mask(key)))
+		}
+		value := strings.Join(masked, ", ")
+		if _, ok := c.values[configAPIKey].([]interface{}); ok {
+			value = "[" + value + "]"
+		}
+		lines[n-1] = fmt.Sprintf("%s = %s", configAPIKey, value)
+	}
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeKeychain keeps the api keys of the profiles in memory
+type fakeKeychain map[string]string
+
+func (fakeKeychain) name() string { return "fake keychain" }
+
+func (k fakeKeychain) get(profile string) (string, error) {
+	key, ok := k[profile]
+	if !ok {
+		return "", errCredentialNotFound
+	}
+	return key, nil
+}
+
+func (k fakeKeychain) set(profile, apiKey string) error {
+	k[profile] = apiKey
+	return nil
+}
+
+func (k fakeKeychain) delete(profile string) error {
+	delete(k, profile)
+	return nil
+}
+
+// useKeychain makes k the keychain of the test
+func useKeychain(t *testing.T, k keychain) {
+	open := openKeychain
+	openKeychain = func() keychain { return k }
+	t.Cleanup(func() { openKeychain = open })
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	settings := []struct {
+		flag, env, key string
+		// keychain is true for the api key, the only setting it keeps
+		keychain bool
+		// def is the value when nothing sets it
+		def string
+		get func(opts *options) string
+	}{
+		{"locator-url", "TITAN_LOCATOR_URL", "locator_url", false, "https://localhost:5000/rpc/v0", func(opts *options) string { return opts.locatorURL }},
+		{"api-key", apiKeyEnv, configAPIKey, true, "", func(opts *options) string {
+			opts.resolveAPIKey()
+			if len(opts.apiKeys) == 0 {
+				return ""
+			}
+			return opts.apiKeys[0]
+		}},
+		{"concurrency", "", "concurrency", false, "3", func(opts *options) string { return strconv.Itoa(opts.concurrency) }},
+	}
+
+	// the layers that set the value, every combination of them, the value
+	// of the first one set wins
+	type layers struct {
+		flag, env, keychain, file bool
+		want                      string
+	}
+	var tests []layers
+	for i := 0; i < 16; i++ {
+		tt := layers{flag: i&8 != 0, env: i&4 != 0, keychain: i&2 != 0, file: i&1 != 0}
+		switch {
+		case tt.flag:
+			tt.want = "flag"
+		case tt.env:
+			tt.want = "env"
+		case tt.keychain:
+			tt.want = "keychain"
+		case tt.file:
+			tt.want = "file"
+		default:
+			tt.want = "default"
+		}
+		tests = append(tests, tt)
+	}
+
+	for _, s := range settings {
+		for _, tt := range tests {
+			if len(s.env) == 0 && tt.env || !s.keychain && tt.keychain {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s flag %t env %t keychain %t file %t", s.flag, tt.flag, tt.env, tt.keychain, tt.file), func(t *testing.T) {
+				testHome(t)
+				t.Setenv("TITAN_LOCATOR_URL", "")
+				values := map[string]string{"flag": "11", "env": "12", "keychain": "14", "file": "13", "default": s.def}
+				if s.flag == "locator-url" {
+					values = map[string]string{"flag": "https://flag.example.com/rpc/v0", "env": "https://env.example.com/rpc/v0", "file": "https://file.example.com/rpc/v0", "default": s.def}
+				}
+
+				var args []string
+				if tt.flag {
+					args = append(args, "--"+s.flag, values["flag"])
+				}
+				if tt.env {
+					t.Setenv(s.env, values["env"])
+				}
+				kc := fakeKeychain{}
+				if tt.keychain {
+					kc["default"] = values["keychain"]
+				}
+				useKeychain(t, kc)
+				if tt.file {
+					if err := os.MkdirAll(filepath.Dir(configPath()), 0700); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(configPath(), []byte(fmt.Sprintf("%s = %q\n", s.key, values["file"])), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				opts := newOptions()
+				fs := newFlagSet("upload")
+				opts.connectFlags(fs)
+				opts.batchFlags(fs)
+				if _, err := parseFlags(fs, append(args, "site")); err != nil {
+					t.Fatal(err)
+				}
+				if got := s.get(opts); got != values[tt.want] {
+					t.Errorf("%s is %q, want the %s value %q", s.flag, got, tt.want, values[tt.want])
+				}
+				if s.keychain && tt.want != "default" && opts.apiKeySource != strings.Replace(tt.want, "file", "config", 1) {
+					t.Errorf("api key source %q, want %s", opts.apiKeySource, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// packHashes are the multihash functions a car can be packed with, the
+// first is the default
+var packHashes = []string{"sha2-256", "blake2b-256", "blake3"}
+
+// hashFlag is the multihash code of --hash, 0 is sha2-256
+type hashFlag uint64
+
+func (h *hashFlag) String() string {
+	return multihash.Codes[h.code()]
+}
+
+func (h *hashFlag) Set(s string) error {
+	for _, name := range packHashes {
+		if name == s {
+			*h = hashFlag(multihash.Names[name])
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown hash %q, use one of %s", s, strings.Join(packHashes, ", "))
+}
+
+func (h *hashFlag) code() uint64 {
+	if h == nil || *h == 0 {
+		return multihash.SHA2_256
+	}
+	return uint64(*h)
+}
+
+// dagFormat is how the blocks of a file dag are made: the multihash
+// function, leaves of raw data or dag-pb leaves like older ipfs versions
+// make, and the chunker. The zero value is what the unixfs builder does
+type dagFormat struct {
+	hash     uint64
+	pbLeaves bool
+	chunker  string
+}
+
+func (o packOptions) dag() dagFormat {
+	return dagFormat{hash: o.Hash.code(), pbLeaves: o.NoRawLeaves, chunker: o.Chunker.String()}
+}
+
+func (f dagFormat) builderHash() bool {
+	return f.hash == 0 || f.hash == multihash.SHA2_256
+}
+
+// The unixfs builder always makes sha2-256 links and raw leaves. With
+// another hash the link system hashes with it and writes the leaves as
+// dag-pb, so the links of the builder hold a digest of that hash under the
+// sha2-256 code, and the raw codec for a dag-pb leaf; relabel gives them
+// the code and the codec of the block they point to
+
+// relabel is c with the codec and the hash code of the block its digest
+// was made of
+func (f dagFormat) relabel(c cid.Cid) cid.Cid {
+	if !c.Defined() {
+		return c
+	}
+
+	p := c.Prefix()
+	codec, mh := p.Codec, c.Hash()
+	if f.pbLeaves && codec == cid.Raw {
+		codec = cid.DagProtobuf
+	}
+	if !f.builderHash() && p.MhType == multihash.SHA2_256 {
+		dmh, err := multihash.Decode(mh)
+		if err != nil {
+			return c
+		}
+		if mh, err = multihash.Encode(dmh.Digest, f.hash); err != nil {
+			return c
+		}
+	}
+	if codec == p.Codec && mh.String() == c.Hash().String() {
+		return c
+	}
+	return cid.NewCidV1(codec, mh)
+}
+
+func (f dagFormat) relabelLink(l ipld.Link) ipld.Link {
+	if cl, ok := l.(cidlink.Link); ok {
+		return cidlink.Link{Cid: f.relabel(cl.Cid)}
+	}
+	return l
+}
+
+// relabelNode is n with its links relabeled, n itself when it is not a
+// dag-pb node
+func (f dagFormat) relabelNode(n datamodel.Node) (datamodel.Node, error) {
+	pb, ok := n.(dagpb.PBNode)
+	if !ok {
+		return n, nil
+	}
+
+	links := pb.FieldLinks()
+	return qp.BuildMap(dagpb.Type.PBNode, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "Links", qp.List(links.Length(), func(la datamodel.ListAssembler) {
+			it := links.Iterator()
+			for !it.Done() {
+				_, l := it.Next()
+				qp.ListEntry(la, qp.Map(3, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "Hash", qp.Link(f.relabelLink(l.FieldHash().Link())))
+					if l.FieldName().Exists() {
+						qp.MapEntry(ma, "Name", qp.String(l.FieldName().Must().String()))
+					}
+					if l.FieldTsize().Exists() {
+						qp.MapEntry(ma, "Tsize", qp.Int(l.FieldTsize().Must().Int()))
+					}
+				}))
+			}
+		}))
+		if pb.FieldData().Exists() {
+			qp.MapEntry(ma, "Data", qp.Bytes(pb.FieldData().Must().Bytes()))
+		}
+	})
+}
+
+// encodePBLeaf writes the chunk b as a dag-pb leaf the way kubo does
+// without raw leaves: the first leaf of a file is of type file, the
+// others of type raw
+func encodePBLeaf(b []byte, dataType int64, w io.Writer) error {
+	ufs, err := builder.BuildUnixFS(func(ub *builder.Builder) {
+		builder.DataType(ub, dataType)
+		// kubo leaves the data out of an empty file
+		if len(b) > 0 {
+			builder.Data(ub, b)
+		}
+		builder.FileSize(ub, uint64(len(b)))
+	})
+	if err != nil {
+		return err
+	}
+
+	pbn, err := qp.BuildMap(dagpb.Type.PBNode, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "Links", qp.List(0, func(datamodel.ListAssembler) {}))
+		qp.MapEntry(ma, "Data", qp.Bytes(data.EncodeUnixFSData(ufs)))
+	})
+	if err != nil {
+		return err
+	}
+	return dagpb.Encode(pbn, w)
+}
+
+// formatLinkSystem makes ls write the blocks of one file, or of nodes
+// without data, in format f. The links ls returns still need relabel
+func (f dagFormat) formatLinkSystem(ls *ipld.LinkSystem) {
+	if f.builderHash() && !f.pbLeaves {
+		return
+	}
+
+	leaves := 0
+	encoderChooser := ls.EncoderChooser
+	ls.EncoderChooser = func(lp datamodel.LinkPrototype) (codec.Encoder, error) {
+		if clp, ok := lp.(cidlink.LinkPrototype); ok && f.pbLeaves && clp.Codec == cid.Raw {
+			return func(n datamodel.Node, w io.Writer) error {
+				b, err := n.AsBytes()
+				if err != nil {
+					return err
+				}
+				dataType := data.Data_Raw
+				if leaves == 0 {
+					dataType = data.Data_File
+				}
+				leaves++
+				return encodePBLeaf(b, dataType, w)
+			}, nil
+		}
+
+		encode, err := encoderChooser(lp)
+		if err != nil {
+			return nil, err
+		}
+		return func(n datamodel.Node, w io.Writer) error {
+			n, err := f.relabelNode(n)
+			if err != nil {
+				return err
+			}
+			return encode(n, w)
+		}, nil
+	}
+	if !f.builderHash() {
+		ls.HasherChooser = func(datamodel.LinkPrototype) (hash.Hash, error) {
+			return multihash.GetHasher(f.hash)
+		}
+	}
+}
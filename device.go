@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// inputSize returns how many bytes to read from a non regular input,
+// override is used when it is greater than 0
+func inputSize(filePath string, override int64) (int64, error) {
+	if override > 0 {
+		return override, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	size, err := deviceSize(f)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("can not detect the size of %s, please set --size", filePath)
+	}
+	return size, nil
+}
+
+// seekSize returns the offset of the end of f and rewinds it
+func seekSize(f *os.File) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceSize returns the size of a block device, the ioctl is tried first
+// because some drivers do not support seeking to the end
+func deviceSize(f *os.File) (int64, error) {
+	var size uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if errno == 0 && size > 0 {
+		return int64(size), nil
+	}
+	return seekSize(f)
+}
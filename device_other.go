@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// deviceSize returns the size of a device by seeking to its end
+func deviceSize(f *os.File) (int64, error) {
+	return seekSize(f)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// metaFileName is the file a directory carries its metadata in
+const metaFileName = ".titan-meta.json"
+
+// dirMeta is the schema of a metadata file, fields it does not know fail
+// the pack so a typo is not silently dropped
+type dirMeta struct {
+	Owner string `json:"owner,omitempty"`
+	// Retention is the retention class, like short or archive
+	Retention     string            `json:"retention,omitempty"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// manifestDir is a directory of the manifest with its metadata
+type manifestDir struct {
+	CID  string  `json:"cid"`
+	Meta dirMeta `json:"meta"`
+}
+
+// parseDirMeta checks the content of a metadata file against dirMeta
+func parseDirMeta(b []byte) (*dirMeta, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	m := &dirMeta{}
+	if err := dec.Decode(m); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("more than one json value")
+	}
+
+	if m.SchemaVersion < 0 {
+		return nil, fmt.Errorf("schema_version can not be negative")
+	}
+	for k := range m.Labels {
+		if len(k) == 0 {
+			return nil, fmt.Errorf("labels can not have an empty key")
+		}
+	}
+	return m, nil
+}
+
+// readDirMeta reads the metadata file of dir with a slot of fds, it is nil
+// when the directory has none
+func readDirMeta(fds fdLimiter, dir string) (*dirMeta, error) {
+	fds.acquire()
+	b, err := os.ReadFile(filepath.Join(dir, metaFileName))
+	fds.release()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m, err := parseDirMeta(b)
+	if err != nil {
+		return nil, fmt.Errorf("metadata %s: %w", filepath.Join(dir, metaFileName), err)
+	}
+	return m, nil
+}
+
+// manifestsDir keeps the manifests of uploads that carry metadata
+func manifestsDir() string {
+	return filepath.Join(stateDir(), "manifests")
+}
+
+// storeManifest keeps the manifest of root for meta, only packs with
+// metadata are kept since a manifest lists every file
+func storeManifest(root string, m *manifest) error {
+	if m == nil || len(m.Dirs) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(manifestsDir(), 0700); err != nil {
+		return err
+	}
+	return m.write(filepath.Join(manifestsDir(), root+".json"))
+}
+
+func runMeta(args []string) error {
+	opts := newOptions()
+	var manifestPath string
+
+	fs := newFlagSet("meta")
+	opts.commonFlags(fs)
+	fs.StringVar(&manifestPath, "manifest", "", "manifest to read, like the manifest.json of an incremental directory, default is the one stored for the cid")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(manifestPath) == 0 {
+		if len(args) == 0 {
+			return fmt.Errorf("please input the cid, or pass --manifest")
+		}
+		manifestPath = filepath.Join(manifestsDir(), args[0]+".json")
+		args = args[1:]
+	}
+
+	m, err := readManifest(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no stored manifest %s, only uploads with %s files keep one", manifestPath, metaFileName)
+	} else if err != nil {
+		return err
+	}
+
+	// one directory, or all of them in the order of their paths
+	dirs := m.Dirs
+	if len(args) > 0 {
+		d, ok := m.Dirs[args[0]]
+		if !ok {
+			return fmt.Errorf("%s has no metadata in %s", args[0], manifestPath)
+		}
+		dirs = map[string]manifestDir{args[0]: d}
+	}
+
+	paths := make([]string, 0, len(dirs))
+	for p := range dirs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	for _, p := range paths {
+		enc.Encode(struct { //nolint:errcheck
+			Path string `json:"path"`
+			manifestDir
+		}{p, dirs[p]})
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// doctorCheck is the outcome of one check of doctor
+type doctorCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Critical checks make doctor exit non zero, the others only warn
+	Critical bool   `json:"critical"`
+	Detail   string `json:"detail"`
+	Hint     string `json:"hint,omitempty"`
+}
+
+const (
+	// clocks further apart than this make tokens look expired or not valid yet
+	maxClockSkew = time.Minute
+	// less free space than this in the temp directory is worth a warning
+	minTempSpace = 1 << 30
+	// open file limits below this are worth a warning
+	minOpenFiles = 1024
+)
+
+// doctor runs the checks one after the other, a later check that needs an
+// earlier one to pass is reported as not run
+type doctor struct {
+	opts   *options
+	checks []doctorCheck
+	// serverDate is the Date header of the locator and when it was received
+	serverDate, receivedAt time.Time
+	// locatorOK is false when the locator can not be reached, the checks
+	// that need it are not run then
+	locatorOK bool
+}
+
+func (d *doctor) pass(name string, critical bool, format string, args ...interface{}) {
+	d.checks = append(d.checks, doctorCheck{Name: name, OK: true, Critical: critical, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) fail(name string, critical bool, hint string, format string, args ...interface{}) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Critical: critical, Detail: redact(fmt.Sprintf(format, args...)), Hint: hint})
+}
+
+func runDoctor(args []string) error {
+	opts := newOptions()
+	var asJSON bool
+
+	fs := newFlagSet("doctor")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	fs.BoolVar(&asJSON, "json", false, "print the checks as one json object")
+
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	d := &doctor{opts: opts}
+	d.checkLocator()
+	if d.locatorOK {
+		d.checkTLS("locator tls", opts.locatorURL)
+		d.checkClock()
+		if schedulerURL, ok := d.checkAPIKey(); ok {
+			d.checkTLS("scheduler tls", schedulerURL)
+		}
+	} else {
+		for _, name := range []string{"locator tls", "clock", "api key"} {
+			d.fail(name, name == "api key", "", "not checked, the locator can not be reached")
+		}
+	}
+	d.checkTempDir()
+	d.checkOpenFiles()
+
+	var failed int
+	for _, c := range d.checks {
+		if !c.OK && c.Critical {
+			failed++
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.Encode(struct { //nolint:errcheck
+			OK     bool          `json:"ok"`
+			Checks []doctorCheck `json:"checks"`
+		}{failed == 0, d.checks})
+	} else {
+		for _, c := range d.checks {
+			status := "PASS"
+			if !c.OK && c.Critical {
+				status = "FAIL"
+			} else if !c.OK {
+				status = "WARN"
+			}
+			fmt.Printf("%s %s: %s\n", status, c.Name, c.Detail)
+			if len(c.Hint) > 0 {
+				fmt.Printf("     hint: %s\n", c.Hint)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d critical checks failed", failed)
+	}
+	return nil
+}
+
+// doctorRequest sends a GET over quic to rawURL, verify checks the
+// certificate chain of the server
+func doctorRequest(opts *options, rawURL string, verify bool) (*http.Response, time.Duration, error) {
+	pConn, err := net.ListenPacket(opts.net.network("udp"), ":0")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer pConn.Close()
+
+	nopts := opts.net
+	nopts.insecure = nopts.insecure || !verify
+	client := newHTTP3Client(pConn, nopts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	rsp.Body.Close()
+	return rsp, time.Since(start), nil
+}
+
+// checkLocator reaches the locator over udp and quic, any http answer
+// means the path is open
+func (d *doctor) checkLocator() {
+	const name = "locator udp/quic"
+	u, err := url.Parse(d.opts.locatorURL)
+	if err != nil || len(u.Host) == 0 {
+		d.fail(name, true, "pass the locator url like https://locator.example.com:5000/rpc/v0", "invalid locator url %q", d.opts.locatorURL)
+		return
+	}
+
+	rsp, rtt, err := doctorRequest(d.opts, d.opts.locatorURL, false)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			d.fail(name, true, "check the host of --locator-url and the dns of this machine", "%s can not be resolved, %s", u.Hostname(), err.Error())
+			return
+		}
+		d.fail(name, true, fmt.Sprintf("allow outgoing udp to %s, quic needs it and some networks block it", u.Host), "no quic answer from %s, %s", u.Host, err.Error())
+		return
+	}
+
+	if date, err := http.ParseTime(rsp.Header.Get("Date")); err == nil {
+		d.serverDate, d.receivedAt = date, time.Now().Add(-rtt/2)
+	}
+	d.locatorOK = true
+	d.pass(name, true, "%s answered %s in %s", u.Host, rsp.Status, formatDuration(rtt))
+}
+
+// checkTLS verifies the certificate chain of the server of rawURL, with
+// --cacert when it is given. A failure only warns with --insecure, the
+// other connections do not verify then either
+func (d *doctor) checkTLS(name, rawURL string) {
+	n := *d.opts
+	n.net.insecure = false
+	rsp, _, err := doctorRequest(&n, rawURL, true)
+	if err != nil {
+		d.fail(name, !d.opts.net.insecure, "a proxy or antivirus may intercept tls, or the server has a self-signed certificate, pass its ca with --cacert", "%s", err.Error())
+		return
+	}
+
+	if rsp.TLS == nil || len(rsp.TLS.PeerCertificates) == 0 {
+		d.pass(name, false, "no certificate to show")
+		return
+	}
+	leaf := rsp.TLS.PeerCertificates[0]
+	d.pass(name, false, "%s issued by %s, valid until %s, %d certificates in the chain", leaf.Subject.CommonName, leaf.Issuer.CommonName, leaf.NotAfter.Format(time.RFC3339), len(rsp.TLS.PeerCertificates))
+}
+
+// checkClock compares the clock with the Date of the locator
+func (d *doctor) checkClock() {
+	const name = "clock"
+	if d.serverDate.IsZero() {
+		d.fail(name, false, "", "not checked, the locator sent no Date")
+		return
+	}
+
+	// Date has whole seconds
+	skew := d.receivedAt.Sub(d.serverDate).Round(time.Second)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		d.fail(name, true, "sync the clock with ntp, tokens are checked against it", "local clock is %s off the locator", formatDuration(skew))
+		return
+	}
+	d.pass(name, true, "local clock is %s off the locator", formatDuration(skew))
+}
+
+// checkAPIKey asks the locator for the scheduler of the key and the
+// scheduler for the quota of it, a call that changes nothing
+func (d *doctor) checkAPIKey() (string, bool) {
+	const name = "api key"
+	if err := d.opts.requireAPIKey(); err != nil {
+		d.fail(name, true, "run auth login or pass --api-key", "%s", err.Error())
+		return "", false
+	}
+	_, key, _ := d.opts.keys.pick(make(map[int]bool))
+
+	locatorClose, locatorAPI, _, err := newLocatorAPI(d.opts)
+	if err != nil {
+		d.fail(name, true, "fix the locator check first", "%s", err.Error())
+		return "", false
+	}
+	defer locatorClose()
+
+	schedulerURL, err := locatorAPI.GetSchedulerWithAPIKey(context.Background(), key)
+	if err != nil {
+		d.fail(name, true, "fix the locator check first", "%s", err.Error())
+		return "", false
+	} else if len(schedulerURL) == 0 {
+		d.fail(name, true, "check the key with auth status, or log in again with auth login", "no scheduler knows the key %s", mask(key))
+		return "", false
+	}
+
+	close, schedulerAPI, _, err := dialScheduler(d.opts, key)
+	if err != nil {
+		d.fail(name, true, "check the key with auth status, or log in again with auth login", "%s", err.Error())
+		return schedulerURL, true
+	}
+	defer close()
+
+	// a rpc of the user permission, the one an api key has
+	rsp, err := schedulerAPI.ListUserAssets(context.Background(), 1, 0)
+	if err != nil {
+		d.fail(name, true, "check the key with auth status, or log in again with auth login", "%s", describeError(err))
+		return schedulerURL, true
+	}
+	d.pass(name, true, "key %s of %s is valid, %d assets", mask(key), schedulerURL, rsp.Total)
+	return schedulerURL, true
+}
+
+// checkTempDir writes a file to the temp directory, where cars are packed
+func (d *doctor) checkTempDir() {
+	const name = "temp dir"
+	dir := os.TempDir()
+
+	f, err := os.CreateTemp(dir, "storage-upload-sample-doctor-")
+	if err == nil {
+		_, err = f.Write([]byte("doctor"))
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if err != nil {
+		d.fail(name, true, "set TMPDIR (TMP on windows) to a writable directory", "%s is not writable, %s", dir, err.Error())
+		return
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		d.pass(name, true, "%s is writable, free space unknown", dir)
+		return
+	}
+	if free < minTempSpace {
+		d.fail(name, false, "free space or set TMPDIR to a bigger disk, the car of an input is about its size", "%s has only %s free", dir, formatSize(free))
+		return
+	}
+	d.pass(name, true, "%s is writable, %s free", dir, formatSize(free))
+}
+
+// checkOpenFiles warns about an open file limit packing large trees can
+// run into
+func (d *doctor) checkOpenFiles() {
+	const name = "open files"
+	n := openFileLimit()
+	if n < minOpenFiles {
+		d.fail(name, false, "raise it with ulimit -n 4096, packing waits for free files with a low limit", "limit is %d", n)
+		return
+	}
+	d.pass(name, false, "limit is %d", n)
+}
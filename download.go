@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+)
+
+const (
+	// size of the ranges a download is split into
+	downloadChunk = 8 << 20
+	// a source is dropped after this many failed ranges
+	sourceFailures = 2
+)
+
+// downloadSource is a candidate holding the asset
+type downloadSource struct {
+	nodeID  string
+	address string
+	// token is the gob encoded token the candidate wants as request body
+	token []byte
+	fails int
+}
+
+// byteRange is the half open range [start, end) of the content
+type byteRange struct {
+	start, end int64
+}
+
+// errNoCandidate is a cid the locator names no candidate for
+var errNoCandidate = errors.New("no candidate holds")
+
+// downloader fetches the content of a cid from several sources at once
+type downloader struct {
+	client *http.Client
+	cid    cid.Cid
+	// format is car for the car of the asset, empty for the file content
+	format string
+	// path selects a file below the root of a folder asset
+	path string
+	// dag is the chunker and the leaves the file was packed with, to check
+	// its content
+	dag   dagFormat
+	conns int
+	out   *os.File
+	part  *partFile
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	sources []*downloadSource
+	pending []byteRange
+	active  int
+	err     error
+
+	progress *transferProgress
+	sink     progressSink
+	// phase names the progress, download when it is empty
+	phase string
+}
+
+func newDownloadSources(infos []*types.CandidateDownloadInfo) ([]*downloadSource, error) {
+	sources := make([]*downloadSource, 0, len(infos))
+	for _, info := range infos {
+		if len(info.Address) == 0 || info.Tk == nil {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(info.Tk); err != nil {
+			return nil, err
+		}
+		sources = append(sources, &downloadSource{nodeID: info.NodeID, address: info.Address, token: buf.Bytes()})
+	}
+	return sources, nil
+}
+
+func (d *downloader) phaseName() string {
+	if len(d.phase) == 0 {
+		return "download"
+	}
+	return d.phase
+}
+
+func (d *downloader) request(ctx context.Context, src *downloadSource, r *byteRange) (*http.Response, error) {
+	return d.get(ctx, src, d.path, d.format, r)
+}
+
+// run downloads into the part file from its confirmed offset on, the first
+// request finds out whether the sources take ranges, when they do not the
+// whole content comes from one
+func (d *downloader) run(ctx context.Context) error {
+	d.preferSource(d.part.state.Source)
+
+	from := d.part.state.Confirmed
+	first := byteRange{from, from + downloadChunk}
+	for _, src := range d.sources {
+		rsp, err := d.request(ctx, src, &first)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			logVerbose("download from %s error %s", src.address, err.Error())
+			src.fails = sourceFailures
+			continue
+		}
+		defer rsp.Body.Close()
+
+		if rsp.StatusCode == http.StatusOK {
+			if from > 0 {
+				fmt.Printf("warning: %s ignores ranges, download %s again from the start\n", src.address, d.part.path)
+			}
+			logVerbose("%s does not take ranges, download everything from it", src.address)
+
+			// the sidecar stays at 0 bytes, without ranges there is nothing to resume
+			if err := d.part.reset(rsp.ContentLength, src.address); err != nil {
+				return err
+			}
+			d.progress = newTransferProgress(d.sink, d.phaseName(), rsp.ContentLength)
+			_, err := io.Copy(&offsetWriter{f: d.out}, &countingReader{r: rsp.Body, n: d.progress.add})
+			if err != nil {
+				return fmt.Errorf("download from %s %w", src.address, err)
+			}
+			return nil
+		}
+
+		total, err := contentRangeTotal(rsp.Header.Get("Content-Range"))
+		if err != nil {
+			return fmt.Errorf("download from %s %w", src.address, err)
+		}
+
+		if from > 0 && total != d.part.state.Size {
+			fmt.Printf("warning: %s has %s, %s was for %s, download again from the start\n", d.cid.String(), formatSize(total), d.part.path, formatSize(d.part.state.Size))
+			rsp.Body.Close()
+			if err := d.part.reset(0, ""); err != nil {
+				return err
+			}
+			return d.run(ctx)
+		}
+
+		if from == 0 {
+			if err := d.part.reset(total, src.address); err != nil {
+				return err
+			}
+		}
+
+		d.progress = newTransferProgress(d.sink, d.phaseName(), total)
+		d.progress.resume(from)
+		if err := d.out.Truncate(total); err != nil {
+			return err
+		}
+
+		if first.end > total {
+			first.end = total
+		}
+		for start := first.end; start < total; start += downloadChunk {
+			end := start + downloadChunk
+			if end > total {
+				end = total
+			}
+			d.pending = append(d.pending, byteRange{start, end})
+		}
+
+		// the rest of the body is the first range, fetch the others meanwhile,
+		// it counts as active so workers wait for it when nothing else is left
+		d.active = 1
+		var wg sync.WaitGroup
+		for i := 0; i < d.conns; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				d.worker(ctx, i)
+			}(i)
+		}
+
+		err = d.readRange(rsp.Body, first)
+		d.mu.Lock()
+		d.active--
+		d.mu.Unlock()
+		if err != nil {
+			d.failRange(src, first, err)
+		}
+		d.mu.Lock()
+		d.cond.Broadcast()
+		d.mu.Unlock()
+
+		wg.Wait()
+		return d.err
+	}
+	return fmt.Errorf("no source could serve %s", d.cid.String())
+}
+
+// preferSource moves the source at address to the front
+func (d *downloader) preferSource(address string) {
+	for i, src := range d.sources {
+		if src.address == address {
+			copy(d.sources[1:i+1], d.sources[:i])
+			d.sources[0] = src
+			return
+		}
+	}
+}
+
+// worker takes ranges until none are left, worker i starts on source i
+// and moves to another live source when its source drops out
+func (d *downloader) worker(ctx context.Context, i int) {
+	for {
+		d.mu.Lock()
+		for len(d.pending) == 0 && d.active > 0 && d.err == nil {
+			d.cond.Wait()
+		}
+		// an interrupt stops every worker, the confirmed ranges are kept
+		if d.err == nil && ctx.Err() != nil {
+			d.err = ctx.Err()
+		}
+		if len(d.pending) == 0 || d.err != nil {
+			d.cond.Broadcast()
+			d.mu.Unlock()
+			return
+		}
+
+		src := d.pickSource(i)
+		if src == nil {
+			d.err = fmt.Errorf("every source failed, %d ranges left", len(d.pending))
+			d.cond.Broadcast()
+			d.mu.Unlock()
+			return
+		}
+
+		r := d.pending[0]
+		d.pending = d.pending[1:]
+		d.active++
+		d.mu.Unlock()
+
+		err := d.fetchRange(ctx, src, r)
+
+		d.mu.Lock()
+		d.active--
+		d.mu.Unlock()
+		if err != nil {
+			d.failRange(src, r, err)
+		}
+
+		d.mu.Lock()
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}
+}
+
+// pickSource returns a live source, starting at source i, d.mu is held
+func (d *downloader) pickSource(i int) *downloadSource {
+	for n := 0; n < len(d.sources); n++ {
+		src := d.sources[(i+n)%len(d.sources)]
+		if src.fails < sourceFailures {
+			return src
+		}
+	}
+	return nil
+}
+
+func (d *downloader) fetchRange(ctx context.Context, src *downloadSource, r byteRange) error {
+	rsp, err := d.request(ctx, src, &r)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s ignored the range", src.address)
+	}
+	return d.readRange(rsp.Body, r)
+}
+
+func (d *downloader) readRange(body io.Reader, r byteRange) error {
+	var got int64
+	w := &offsetWriter{f: d.out, off: r.start}
+	n, err := io.Copy(w, io.LimitReader(&countingReader{r: body, n: func(n int64) {
+		got += n
+		d.progress.add(n)
+	}}, r.end-r.start))
+	if err == nil && n < r.end-r.start {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// the bytes of a failed range are fetched again
+		d.progress.add(-got)
+		return err
+	}
+	return d.part.confirm(r)
+}
+
+// failRange puts r back for the other workers, completed ranges stay done
+func (d *downloader) failRange(src *downloadSource, r byteRange, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	src.fails++
+	logVerbose("range %d-%d from %s error %s", r.start, r.end, src.address, err.Error())
+	if src.fails == sourceFailures {
+		fmt.Printf("source %s (%s) dropped after %d errors\n", src.nodeID, src.address, src.fails)
+	}
+	d.pending = append(d.pending, r)
+}
+
+// contentRangeTotal returns the complete length of a content range header
+func contentRangeTotal(s string) (int64, error) {
+	i := strings.LastIndexByte(s, '/')
+	if !strings.HasPrefix(s, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("invalid content range %q", s)
+	}
+
+	total, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("content range %q has no total", s)
+	}
+	return total, nil
+}
+
+// offsetWriter writes to f from off on
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// countingReader reports the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n func(int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	transfers.wait()
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.n(int64(n))
+	}
+	return n, err
+}
+
+// verifyDownload checks that the downloaded content hashes to want. A file
+// is plain bytes without its blocks, it is packed again in format dag once
+// it is complete and only the root is compared, a car has its blocks and
+// each of them is checked
+func verifyDownload(filePath string, format string, dag dagFormat, want cid.Cid) error {
+	if format == "car" {
+		return verifyCar(filePath, want)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the file is chunked again the way upload packs it
+	dag.hash = want.Prefix().MhType
+	got, err := calculateCid(f, dag)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(got.Hash(), want.Hash()) {
+		return fmt.Errorf("downloaded content has cid %s, want %s, it may be corrupt or packed with other options", got, want)
+	}
+	return nil
+}
+
+// verifyCar checks the root of the car and the hash of every block in it,
+// a corrupt block is reported with its offset in the car
+func verifyCar(carPath string, want cid.Cid) error {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br, err := car.NewBlockReader(f)
+	if err != nil {
+		return fmt.Errorf("read car %w", err)
+	}
+
+	if len(br.Roots) != 1 || !bytes.Equal(br.Roots[0].Hash(), want.Hash()) {
+		return fmt.Errorf("car has roots %v, want %s", br.Roots, want)
+	}
+
+	// blocks are skipped and read back by offset so a corrupt one can be located
+	var data []byte
+	for {
+		meta, err := br.SkipNext()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read car block %w", err)
+		}
+
+		// the block data ends where the reader stopped
+		end, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		if uint64(cap(data)) < meta.Size {
+			data = make([]byte, meta.Size)
+		}
+		data = data[:meta.Size]
+		if _, err := f.ReadAt(data, end-int64(meta.Size)); err != nil {
+			return fmt.Errorf("read block %s at byte offset %d %w", meta.Cid, meta.SourceOffset, err)
+		}
+
+		sum, err := meta.Cid.Prefix().Sum(data)
+		if err != nil {
+			return err
+		}
+
+		if !sum.Equals(meta.Cid) {
+			return fmt.Errorf("block %s at byte offset %d does not match its hash, got %s", meta.Cid, meta.SourceOffset, sum)
+		}
+	}
+}
+
+// stream writes the content to w in order, from one source at a time, when
+// a source fails the next one goes on from the offset already written
+func (d *downloader) stream(ctx context.Context, w io.Writer, want cid.Cid, noVerify bool) error {
+	out := &outputWriter{w: w}
+	var (
+		pw  *io.PipeWriter
+		sum chan error
+	)
+	if !noVerify {
+		// the cid is computed from a copy of the bytes going out
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		sum = make(chan error, 1)
+		go func() {
+			dag := d.dag
+			dag.hash = want.Prefix().MhType
+			got, err := calculateCid(pr, dag)
+			if err == nil && !bytes.Equal(got.Hash(), want.Hash()) {
+				err = fmt.Errorf("the content written has cid %s, want %s, do not use it", got, want)
+			}
+			pr.CloseWithError(err)
+			sum <- err
+		}()
+		out.tee = pw
+	}
+
+	var offset int64
+	for {
+		d.mu.Lock()
+		src := d.pickSource(0)
+		d.mu.Unlock()
+		if src == nil {
+			return fmt.Errorf("every source failed after %d bytes", offset)
+		}
+
+		rsp, err := d.request(ctx, src, &byteRange{start: offset})
+		if err != nil {
+			src.fails = sourceFailures
+			logVerbose("download from %s error %s", src.address, err.Error())
+			continue
+		}
+
+		if d.progress == nil {
+			d.progress = newTransferProgress(d.sink, d.phaseName(), rsp.ContentLength)
+		}
+
+		body := io.Reader(rsp.Body)
+		if offset > 0 && rsp.StatusCode == http.StatusOK {
+			// the source ignored the range, skip what was written already
+			if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+				rsp.Body.Close()
+				src.fails = sourceFailures
+				continue
+			}
+		}
+
+		n, err := io.Copy(out, &countingReader{r: body, n: d.progress.add})
+		rsp.Body.Close()
+		offset += n
+		if err == nil {
+			break
+		}
+
+		if out.err != nil && isBrokenPipe(out.err) {
+			// the reader has all it wants, that is not a failed download
+			logVerbose("output closed after %s, stop", formatSize(offset))
+			if pw != nil {
+				pw.CloseWithError(out.err)
+			}
+			return nil
+		} else if out.err != nil {
+			return out.err
+		}
+
+		src.fails++
+		fmt.Printf("download from %s failed after %s %s, go on with the next source\n", src.address, formatSize(offset), err.Error())
+	}
+	d.progress.done()
+
+	if noVerify {
+		return nil
+	}
+
+	pw.Close()
+	return <-sum
+}
+
+// outputWriter keeps the error of w apart from the errors of the source,
+// tee gets a copy of the bytes w took
+type outputWriter struct {
+	w   io.Writer
+	tee io.Writer
+	err error
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	if err != nil {
+		o.err = err
+		return n, err
+	}
+
+	if o.tee != nil {
+		if _, err := o.tee.Write(p[:n]); err != nil {
+			o.err = err
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func runDownload(args []string) error {
+	opts := newOptions()
+	var (
+		output  string
+		asCar   bool
+		extract string
+		subPath string
+		conns   int
+	)
+
+	fs := newFlagSet("download")
+	opts.commonFlags(fs)
+	opts.locatorFlags(fs)
+	opts.progressFlags(fs)
+	fs.StringVar(&output, "o", "", "output file, - for stdout, default is the cid")
+	fs.BoolVar(&asCar, "car", false, "download the car of the asset instead of the file content")
+	fs.StringVar(&extract, "extract", "", "download the car and unpack it to this path, a directory for a folder asset")
+	fs.StringVar(&subPath, "path", "", "file below the root of a folder asset to download")
+	fs.IntVar(&conns, "connections", 4, "ranges fetched at the same time, spread over the sources")
+	fs.BoolVar(&opts.noVerify, "no-verify", false, "do not check the downloaded content against the cid")
+	fs.Var(&opts.chunker, "chunker", "chunker the file was uploaded with, the content is chunked again with it to check the cid, default is "+defaultChunker)
+	fs.BoolVar(&opts.rawLeaves, "raw-leaves", true, "set --raw-leaves=false for a file uploaded with it, to check the cid")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("please input the cid to download")
+	}
+
+	want, err := cid.Decode(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid cid %s %w", args[0], err)
+	}
+
+	if conns < 1 {
+		return fmt.Errorf("connections must be at least 1")
+	}
+
+	format := ""
+	if asCar || len(extract) > 0 {
+		format = "car"
+	}
+
+	if len(format) > 0 && (len(subPath) > 0 || output == "-") {
+		return fmt.Errorf("--path and -o - are for file content, they can not be used with --car or --extract")
+	}
+
+	if len(output) == 0 {
+		output = want.String()
+		if len(subPath) > 0 {
+			output = path.Base(subPath)
+		} else if len(format) > 0 {
+			output += ".car"
+		}
+	}
+
+	var content io.Writer
+	if output == "-" {
+		// the content is the only thing on stdout, progress and messages go to stderr
+		content = os.Stdout
+		os.Stdout = os.Stderr
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	d := &downloader{cid: want, format: format, path: subPath, conns: conns, dag: dagFormat{chunker: opts.chunker.String(), pbLeaves: !opts.rawLeaves}}
+	if err := download(opts, d, output, content); err != nil {
+		return fmt.Errorf("download error %s", err.Error())
+	}
+
+	if len(extract) == 0 {
+		return nil
+	}
+
+	if err := extractCar(opts, output, want, extract); err != nil {
+		return fmt.Errorf("extract error %s, the car is kept in %s", err.Error(), output)
+	}
+	return os.Remove(output)
+}
+
+// locate asks the locator for the candidates that hold d.cid
+func (d *downloader) locate(opts *options) error {
+	close, locatorAPI, _, err := newLocatorAPI(opts)
+	if err != nil {
+		return err
+	}
+	defer close()
+
+	infos, err := locatorAPI.CandidateDownloadInfos(interruptContext(), d.cid.String())
+	if err != nil {
+		return fmt.Errorf("CandidateDownloadInfos %w", err)
+	}
+
+	sources, err := newDownloadSources(infos)
+	if err != nil {
+		return err
+	}
+
+	if len(sources) == 0 {
+		return fmt.Errorf("%w %s", errNoCandidate, d.cid.String())
+	}
+	logVerbose("%d sources for %s", len(sources), d.cid.String())
+
+	d.client = opts.uploadClient
+	d.sources = sources
+	d.sink = opts.progress
+	d.cond = sync.NewCond(&d.mu)
+	return nil
+}
+
+// download fetches what d names to output, or to content when it is not nil,
+// an interrupt stops it with the part kept to resume
+func download(opts *options, d *downloader, output string, content io.Writer) error {
+	if err := d.locate(opts); err != nil {
+		return err
+	}
+	ctx := interruptContext()
+
+	// the file content is checked against the cid of the file, the walk
+	// to it also tells folders apart, they have no file content
+	want := d.cid
+	if len(d.format) == 0 {
+		c, dir, err := d.resolve(ctx)
+		if err != nil {
+			return err
+		}
+
+		if dir {
+			return fmt.Errorf("%s is a folder, use --extract to unpack it or --path to select a single file", path.Join(d.cid.String(), d.path))
+		}
+		want = c
+
+		m, err := d.splitListing(ctx, want)
+		if err != nil {
+			return err
+		} else if m != nil {
+			return downloadSplit(opts, d, m, output, content)
+		}
+	}
+
+	if content != nil {
+		if err := d.stream(ctx, content, want, opts.noVerify); err != nil || !opts.noVerify {
+			return err
+		}
+		fmt.Println("warning: the content written is not verified")
+		return nil
+	}
+
+	part, err := openPart(output, want, d.format)
+	if err != nil {
+		return err
+	}
+
+	d.out = part.f
+	d.part = part
+	if err := d.run(ctx); err != nil {
+		part.close()
+		fmt.Printf("download kept in %s, run again to resume\n", part.path)
+		return err
+	}
+	d.progress.done()
+
+	if err := part.f.Sync(); err != nil {
+		part.close()
+		return err
+	}
+
+	if opts.noVerify {
+		fmt.Printf("warning: %s is not verified\n", output)
+	} else if err := verifyDownload(part.path, d.format, d.dag, want); err != nil {
+		incomplete, ierr := part.incomplete(output)
+		if ierr != nil {
+			return fmt.Errorf("%w, %s", err, ierr.Error())
+		}
+		return fmt.Errorf("%w, the download is kept in %s", err, incomplete)
+	}
+
+	stat, err := part.f.Stat()
+	if err != nil {
+		part.close()
+		return err
+	}
+
+	if err := part.finish(output); err != nil {
+		return err
+	}
+
+	fmt.Printf("downloaded %s to %s, %s\n", path.Join(d.cid.String(), d.path), output, formatSize(stat.Size()))
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// downloadFixture is a file of several blocks, its car and its root
+type downloadFixture struct {
+	data    []byte
+	file    string
+	carPath string
+	root    cid.Cid
+}
+
+func newDownloadFixture(t *testing.T) downloadFixture {
+	testHome(t)
+	dir := t.TempDir()
+	f := downloadFixture{data: testData(3<<20 + 12345), file: filepath.Join(dir, "video.mp4"), carPath: filepath.Join(dir, "video.car")}
+	if err := os.WriteFile(f.file, f.data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := createCar(f.file, f.carPath, packOptions{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.root = result.Root
+	return f
+}
+
+// corrupt flips a byte of the second chunk of the file in a copy of the car
+// or the file at p. It returns the copy, the cid of the chunk and where the
+// section of its block starts in a car
+func (f downloadFixture) corrupt(t *testing.T, p string) (string, cid.Cid, int) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int(new(chunkerFlag).fixedSize())
+	chunk := f.data[n : 2*n]
+	at := bytes.Index(b, chunk)
+	if at < 0 {
+		t.Fatalf("no second chunk in %s", p)
+	}
+	b[at+100] ^= 0xff
+
+	out := filepath.Join(t.TempDir(), filepath.Base(p))
+	if err := os.WriteFile(out, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mh, err := multihash.Sum(chunk, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cid.NewCidV1(cid.Raw, mh)
+	// a section is the varint of its length, the cid and the data
+	section := binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(len(c.Bytes())+len(chunk)))
+	return out, c, at - len(c.Bytes()) - section
+}
+
+func TestVerifyDownload(t *testing.T) {
+	f := newDownloadFixture(t)
+	badFile, _, _ := f.corrupt(t, f.file)
+	badCar, block, at := f.corrupt(t, f.carPath)
+	dag := dagFormat{chunker: defaultChunker}
+
+	tests := []struct {
+		name, path, format string
+		want               cid.Cid
+		// err is empty for content that checks out
+		err string
+	}{
+		{"file", f.file, "", f.root, ""},
+		{"corrupt file", badFile, "", f.root, "want " + f.root.String() + ", it may be corrupt"},
+		{"other file", f.file, "", cid.MustParse(testRoot), "want " + testRoot},
+		{"car", f.carPath, "car", f.root, ""},
+		// the block is found before anything is unpacked from the car
+		{"corrupt car", badCar, "car", f.root, fmt.Sprintf("block %s at byte offset %d does not match its hash", block, at)},
+		{"other car", f.carPath, "car", cid.MustParse(testRoot), "want " + testRoot},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyDownload(tt.path, tt.format, dag, tt.want)
+			if len(tt.err) == 0 && err != nil {
+				t.Fatal(err)
+			} else if len(tt.err) > 0 && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestExtractUnverified(t *testing.T) {
+	f := newDownloadFixture(t)
+	badCar, block, _ := f.corrupt(t, f.carPath)
+
+	// with --no-verify the blocks are checked as they are unpacked, what
+	// was written before is left in .incomplete
+	opts := testOptions(t)
+	opts.noVerify = true
+	out := filepath.Join(t.TempDir(), "video.mp4")
+	_, err := captureStdout(t, func() error { return extractCar(opts, badCar, f.root, out) })
+	if err == nil || !strings.Contains(err.Error(), block.String()) || !strings.Contains(err.Error(), "partial output is in "+out+".incomplete") {
+		t.Fatalf("error %v, want the block %s and the partial output", err, block)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("%s is there after a failed unpack: %v", out, err)
+	}
+	if _, err := os.Stat(out + ".incomplete"); err != nil {
+		t.Error(err)
+	}
+
+	// the good car unpacks to the file
+	out = filepath.Join(t.TempDir(), "video.mp4")
+	if _, err := captureStdout(t, func() error { return extractCar(opts, f.carPath, f.root, out) }); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(out); err != nil || !bytes.Equal(b, f.data) {
+		t.Errorf("the unpacked file is not the file, error %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+)
+
+// the layout of the unixfs builder, du projects the car from it without
+// reading the files
+const (
+	duChunkSize     = 256 << 10
+	duLinksPerBlock = 174
+	// a cid v1 with a sha256 multihash
+	duCIDSize = 36
+	// a link of a file node with the size of its block, and the framing
+	duLinkSize = 52
+	// a directory entry without its name
+	duEntrySize = 44
+	// the entry of a block in the index of the car, its digest and offset
+	duIndexSize = 40
+	// the car v2 pragma and header, the v1 header with the root and the
+	// header of the index
+	duHeaderSize = 140
+)
+
+// carSection is the size of a block of n bytes in the car, with its cid,
+// its length and its entry in the index
+func carSection(n int64) int64 {
+	return int64(binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(n+duCIDSize))) + duCIDSize + n + duIndexSize
+}
+
+// projectedFileSize is about the car size of the dag of a file of size
+// bytes: its chunks of chunk bytes as raw leaves and the balanced tree of
+// nodes above them
+func projectedFileSize(size, chunk int64) int64 {
+	n := (size + chunk - 1) / chunk
+	if n == 0 {
+		n = 1
+	}
+
+	total := size + (carSection(0) * n)
+	for n > 1 {
+		parents := (n + duLinksPerBlock - 1) / duLinksPerBlock
+		total += n*duLinkSize + carSection(16)*parents
+		n = parents
+	}
+	return total
+}
+
+// duEntry is the projected car size of a directory of the input, the link
+// to it from its parent counts towards it so the sizes of the entries of a
+// directory add up to it
+type duEntry struct {
+	Path    string  `json:"path"`
+	Size    int64   `json:"size"`
+	Files   int     `json:"files"`
+	Percent float64 `json:"percent"`
+}
+
+// duWalker walks the input the way the packer does, with the pack options
+// that decide what goes into the dag
+type duWalker struct {
+	opts     packOptions
+	maxDepth int
+	entries  []duEntry
+	dirs     map[string]string
+}
+
+// chunkSize is the chunk size of the chunker, the average one of the
+// chunkers that cut by content
+func (w *duWalker) chunkSize() int64 {
+	if n := w.opts.Chunker.fixedSize(); n > 0 {
+		return n
+	}
+	return duChunkSize
+}
+
+// walk is the projected size and file count of p, depth 0 is the input.
+// skipped is true below a directory the filter left out, a size of -1 is
+// an entry that is not packed
+func (w *duWalker) walk(p, rel string, depth int, skipped bool) (int64, int, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	info, skip, err := resolveSymlink(p, info, w.opts.Symlinks, depth == 0)
+	if err != nil {
+		return 0, 0, err
+	} else if skip {
+		return -1, 0, nil
+	}
+
+	m := info.Mode()
+	switch {
+	case m.IsRegular():
+		return projectedFileSize(info.Size(), w.chunkSize()), 1, nil
+	case m.Type() == fs.ModeSymlink:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		return carSection(int64(len(target)) + 8), 0, nil
+	case !m.IsDir():
+		return 0, 0, fmt.Errorf("cannot encode non regular file: %s", p)
+	}
+
+	if w.opts.Symlinks == symlinkFollow {
+		key := dirID(p, info)
+		if first, ok := w.dirs[key]; ok {
+			return 0, 0, symlinkCycle(p, first)
+		}
+		w.dirs[key] = p
+		defer delete(w.dirs, key)
+	}
+
+	children, err := os.ReadDir(p)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		links int64
+		size  int64
+		files int
+		kept  int
+	)
+	for _, e := range children {
+		if w.opts.ExcludeMetaFiles && e.Name() == metaFileName {
+			continue
+		}
+		skip, walk := w.opts.Filter.skip(path.Join(rel, e.Name()), e.IsDir(), skipped)
+		if skip && !walk {
+			continue
+		}
+		s, n, err := w.walk(path.Join(p, e.Name()), path.Join(rel, e.Name()), depth+1, skip)
+		if err != nil {
+			return 0, 0, err
+		} else if s < 0 {
+			continue
+		}
+		links += duEntrySize + int64(len(e.Name()))
+		size += s
+		files += n
+		kept++
+	}
+	if skipped && kept == 0 {
+		return -1, 0, nil
+	}
+	size += carSection(links + 4)
+
+	if depth > 0 && depth <= w.maxDepth {
+		// the entry of the directory in its parent goes with it
+		w.entries = append(w.entries, duEntry{Path: rel, Size: size + duEntrySize + int64(len(path.Base(rel))), Files: files})
+	}
+	return size, files, nil
+}
+
+func runDu(args []string) error {
+	opts := newOptions()
+	var (
+		depth  int
+		asJSON bool
+	)
+
+	fs := newFlagSet("du")
+	opts.commonFlags(fs)
+	opts.packFlags(fs)
+	fs.IntVar(&depth, "d", 1, "show the directories down to this depth below the input")
+	fs.BoolVar(&asJSON, "json", false, "print the directories as json")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("please input the directory")
+	} else if depth < 1 {
+		return fmt.Errorf("d must be at least 1")
+	} else if opts.offset != 0 || opts.length != 0 {
+		return fmt.Errorf("offset and length are a window of one file, du projects a folder")
+	}
+
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", args[0])
+	}
+
+	w := &duWalker{opts: packOptions{Symlinks: opts.symlinks, ExcludeMetaFiles: opts.excludeMetaFiles, Chunker: opts.chunker, Filter: opts.filter}, maxDepth: depth, dirs: make(map[string]string)}
+	total, files, err := w.walk(args[0], "", 0, false)
+	if err != nil {
+		return err
+	}
+	// the headers of the car and of its index
+	total += duHeaderSize
+
+	for i := range w.entries {
+		w.entries[i].Percent = float64(w.entries[i].Size) * 100 / float64(total)
+	}
+	sort.SliceStable(w.entries, func(i, j int) bool { return w.entries[i].Size > w.entries[j].Size })
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if w.entries == nil {
+			w.entries = []duEntry{}
+		}
+		return enc.Encode(struct {
+			Size    int64     `json:"size"`
+			Files   int       `json:"files"`
+			Entries []duEntry `json:"entries"`
+		}{total, files, w.entries})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tFILES\tPERCENT\tPATH")
+	for _, e := range w.entries {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%s\n", formatSize(e.Size), e.Files, e.Percent, e.Path)
+	}
+	fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%s\n", formatSize(total), files, 100.0, args[0])
+	tw.Flush()
+	return nil
+}
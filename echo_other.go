@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+func disableEcho(fd int) (func(), error) {
+	return nil, errors.New("not supported")
+}
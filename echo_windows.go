@@ -0,0 +1,18 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// disableEcho stops the console at fd from echoing input, it fails when
+// fd is not a console
+func disableEcho(fd int) (func(), error) {
+	h := windows.Handle(fd)
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return nil, err
+	}
+
+	if err := windows.SetConsoleMode(h, mode&^windows.ENABLE_ECHO_INPUT); err != nil {
+		return nil, err
+	}
+	return func() { windows.SetConsoleMode(h, mode) }, nil //nolint:errcheck
+}
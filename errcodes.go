@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/terrors"
+)
+
+// exitRetryable is the exit code of a run that failed for a reason that
+// can go away, like EX_TEMPFAIL of sysexits, other failures exit with 1
+const exitRetryable = 75
+
+// knownError is what a titan error means for the user
+type knownError struct {
+	message string
+	// action is what the user can do about it
+	action    string
+	retryable bool
+}
+
+// schedulerErrors maps the codes of api.ErrWeb, the errors of the
+// scheduler and the locator, to what they mean
+var schedulerErrors = map[int]knownError{
+	terrors.NotFound:                    {"the scheduler did not find it", "check the cid or the name", false},
+	terrors.DatabaseErr:                 {"the scheduler had a database error", "retry later", true},
+	terrors.ParametersAreWrong:          {"the scheduler refused the request", "check the name, size and cid of the asset", false},
+	terrors.CidToHashFiled:              {"the scheduler can not read the cid", "pack the input again", false},
+	terrors.UserStorageSizeNotEnough:    {"the storage of the account is full", "delete assets or raise the quota, then retry", false},
+	terrors.UserNotFound:                {"the api key is not known to the scheduler", "check the key with auth status or log in again", false},
+	terrors.NoDuplicateUploads:          {"the asset is already being uploaded", "wait for that upload, list shows it once it is done", false},
+	terrors.BusyServer:                  {"the scheduler is rate limiting requests", "wait a minute and retry", true},
+	terrors.NotFoundNode:                {"no candidate node can take the upload now", "retry later", true},
+	terrors.RequestNodeErr:              {"the scheduler could not reach a node", "retry later", true},
+	terrors.MarshalErr:                  {"the scheduler could not encode its answer", "retry later", true},
+	terrors.VisitShareLinkOutOfMaxCount: {"the share link was opened too many times", "share the asset again", false},
+	terrors.VerifyTokenError:            {"the scheduler refused the token", "log in again", false},
+}
+
+// candidateErrors map the messages candidates reject an upload with, they
+// all come with code -1 so the message is all there is
+var candidateErrors = []struct {
+	contains string
+	knownError
+}{
+	{"out of max size", knownError{"the asset is larger than the candidate takes", "split the input into smaller uploads", false}},
+	{"only allow post method", knownError{"the candidate only takes uploads posted in a form", "upload with --upload-style multipart", false}},
+	{"token is expire", knownError{"the upload token expired", "upload again for a new token", true}},
+	{"http status code 401", knownError{"the candidate refused the upload token", "upload again for a new token", true}},
+	{"verify car error", knownError{"the car does not hold the cid it was registered with", "pack the input again and upload it", false}},
+	{"not in update status", knownError{"the candidate was not told about the upload", "upload again", true}},
+}
+
+// statusErrors map the http status of an upload answered without the
+// envelope, by a proxy in front of the candidate or a stricter endpoint
+var statusErrors = map[int]knownError{
+	http.StatusUnauthorized:          {"the endpoint refused the upload token", "upload again for a new token", true},
+	http.StatusForbidden:             {"the endpoint refused the upload token", "upload again for a new token", true},
+	http.StatusRequestEntityTooLarge: {"the car is larger than the endpoint takes", "split the input into smaller uploads", false},
+	http.StatusInsufficientStorage:   {"the endpoint has no room for the car, or the quota is used up", "delete assets or raise the quota, then retry", false},
+	http.StatusConflict:              {"the car does not hold the cid it was registered with", "pack the input again and upload it", false},
+}
+
+// lookupError finds what err means, the code is the one of the scheduler
+// and 0 for the message of a candidate
+func lookupError(err error) (int, knownError, bool) {
+	var ew *api.ErrWeb
+	if errors.As(err, &ew) {
+		known, ok := schedulerErrors[ew.Code]
+		return ew.Code, known, ok
+	}
+
+	var se *uploadStatusError
+	if errors.As(err, &se) {
+		known, ok := statusErrors[se.code]
+		return se.code, known, ok
+	}
+
+	var re *uploadRejectedError
+	if errors.As(err, &re) {
+		for _, c := range candidateErrors {
+			if strings.Contains(re.msg, c.contains) {
+				return 0, c.knownError, true
+			}
+		}
+	}
+	return 0, knownError{}, false
+}
+
+// describeError is the message of err for the user, with what to do about
+// it when the error is known. An unknown scheduler code is kept with the
+// original message
+func describeError(err error) string {
+	code, known, ok := lookupError(err)
+	if !ok {
+		var ew *api.ErrWeb
+		if errors.As(err, &ew) {
+			return errText(fmt.Errorf("%w (code %d)", err, ew.Code))
+		}
+		return errText(err)
+	}
+
+	logVerbose("%s", err.Error())
+	if code != 0 {
+		return fmt.Sprintf("%s (code %d), %s", known.message, code, known.action)
+	}
+	return fmt.Sprintf("%s, %s", known.message, known.action)
+}
+
+// terminalError is true for errors retrying does not fix until the user
+// acts, unknown errors are not terminal
+func terminalError(err error) bool {
+	if invalidKey(err) {
+		return true
+	}
+	_, known, ok := lookupError(err)
+	return ok && !known.retryable
+}
+
+// exitError is an error of a command that decides its exit code itself,
+// without err the command already said all there is and main prints nothing
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCode is the code of an exitError, exitRetryable for a known error
+// that can go away and 1 for any other
+func exitCode(err error) int {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	if _, known, ok := lookupError(err); ok && known.retryable {
+		return exitRetryable
+	}
+	return 1
+}
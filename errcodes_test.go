@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/terrors"
+)
+
+func TestDescribeError(t *testing.T) {
+	const host = "candidate.example.com"
+	tests := []struct {
+		name string
+		err  error
+		// want is what describeError says, exit the exit code
+		want string
+		exit int
+	}{
+		{"larger than the candidate", &uploadRejectedError{host, -1, "file size out of max size 104857600"}, "the asset is larger than the candidate takes, split the input into smaller uploads", 1},
+		{"form only", &uploadRejectedError{host, -1, "only allow post method"}, "the candidate only takes uploads posted in a form, upload with --upload-style multipart", 1},
+		{"token expired", &uploadRejectedError{host, -1, "token is expire"}, "the upload token expired, upload again for a new token", exitRetryable},
+		{"token refused", &uploadRejectedError{host, -1, "verify token failed, http status code 401"}, "the candidate refused the upload token, upload again for a new token", exitRetryable},
+		{"wrong car", &uploadRejectedError{host, -1, "verify car error, root is not match"}, "the car does not hold the cid it was registered with, pack the input again and upload it", 1},
+		{"not told", &uploadRejectedError{host, -1, "asset bafy is not in update status"}, "the candidate was not told about the upload, upload again", exitRetryable},
+		{"unknown candidate message", &uploadRejectedError{host, -1, "disk on fire"}, host + " rejected the upload, code -1, disk on fire", 1},
+		{"401", &uploadStatusError{host, "401 Unauthorized", http.StatusUnauthorized, ""}, "the endpoint refused the upload token (code 401), upload again for a new token", exitRetryable},
+		{"403", &uploadStatusError{host, "403 Forbidden", http.StatusForbidden, ""}, "the endpoint refused the upload token (code 403), upload again for a new token", exitRetryable},
+		{"413", &uploadStatusError{host, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge, ""}, "the car is larger than the endpoint takes (code 413), split the input into smaller uploads", 1},
+		{"507", &uploadStatusError{host, "507 Insufficient Storage", http.StatusInsufficientStorage, ""}, "the endpoint has no room for the car, or the quota is used up (code 507), delete assets or raise the quota, then retry", 1},
+		{"409", &uploadStatusError{host, "409 Conflict", http.StatusConflict, ""}, "the car does not hold the cid it was registered with (code 409), pack the input again and upload it", 1},
+		{"unknown status", &uploadStatusError{host, "418 I'm a teapot", http.StatusTeapot, "short and stout"}, "upload to " + host + " answered 418 I'm a teapot, short and stout", 1},
+		{"storage full", &api.ErrWeb{Code: terrors.UserStorageSizeNotEnough, Message: "storage size not enough"}, fmt.Sprintf("the storage of the account is full (code %d), delete assets or raise the quota, then retry", terrors.UserStorageSizeNotEnough), 1},
+		{"rate limited", &api.ErrWeb{Code: terrors.BusyServer, Message: "busy"}, fmt.Sprintf("the scheduler is rate limiting requests (code %d), wait a minute and retry", terrors.BusyServer), exitRetryable},
+		{"unknown scheduler code", &api.ErrWeb{Code: 99999, Message: "new error"}, "new error (code 99999)", 1},
+		{"wrapped", fmt.Errorf("uploadFileWithForm error %w", &uploadRejectedError{host, -1, "token is expire"}), "the upload token expired, upload again for a new token", exitRetryable},
+		{"plain", errors.New("connection refused"), "connection refused", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeError(tt.err); got != tt.want {
+				t.Errorf("describeError is %q, want %q", got, tt.want)
+			}
+			if got := exitCode(tt.err); got != tt.exit {
+				t.Errorf("exit code %d, want %d", got, tt.exit)
+			}
+		})
+	}
+}
+
+// TestKnownErrors checks that every entry of the tables is found for the
+// error it describes and exits as retryable as it says
+func TestKnownErrors(t *testing.T) {
+	check := func(t *testing.T, err error, code int, want knownError) {
+		t.Helper()
+		gotCode, got, ok := lookupError(err)
+		if !ok || gotCode != code || got != want {
+			t.Errorf("lookupError(%v) is %d %+v %t, want %d %+v", err, gotCode, got, ok, code, want)
+		}
+		exit := 1
+		if want.retryable {
+			exit = exitRetryable
+		}
+		if got := exitCode(err); got != exit {
+			t.Errorf("exit code of %v is %d, want %d", err, got, exit)
+		}
+		if terminalError(err) == want.retryable {
+			t.Errorf("terminalError(%v) is %t for retryable %t", err, !want.retryable, want.retryable)
+		}
+		if msg := describeError(err); !strings.HasPrefix(msg, want.message) || !strings.HasSuffix(msg, want.action) {
+			t.Errorf("describeError(%v) is %q", err, msg)
+		}
+	}
+
+	for _, c := range candidateErrors {
+		check(t, &uploadRejectedError{"candidate.example.com", -1, "upload failed: " + c.contains}, 0, c.knownError)
+	}
+	for status, known := range statusErrors {
+		check(t, &uploadStatusError{"candidate.example.com", http.StatusText(status), status, ""}, status, known)
+	}
+	for code, known := range schedulerErrors {
+		check(t, &api.ErrWeb{Code: code, Message: "scheduler error"}, code, known)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// globList is the flag.Value of --exclude or --include, the patterns are
+// matched against the slash separated path of an entry below the input
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(s string) error {
+	pattern := strings.TrimSuffix(s, "/")
+	if len(strings.Trim(pattern, "/")) == 0 {
+		return fmt.Errorf("empty pattern %q", s)
+	}
+	for _, seg := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if _, err := path.Match(seg, ""); err != nil || len(seg) == 0 {
+			return fmt.Errorf("invalid pattern %q, want a glob like *.log, node_modules/** or /build", s)
+		}
+	}
+	*g = append(*g, pattern)
+	return nil
+}
+
+// match is true when a pattern matches rel. A pattern starting with / is
+// matched from the input, the others at every depth. ** matches any number
+// of directories, so dir/** is dir and all below it
+func (g globList) match(rel string) bool {
+	name := strings.Split(rel, "/")
+	for _, pattern := range g {
+		segs := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+		if strings.HasPrefix(pattern, "/") {
+			if matchSegments(segs, name) {
+				return true
+			}
+			continue
+		}
+		for i := range name {
+			if matchSegments(segs, name[i:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// below is true when a pattern may match an entry inside the directory
+// rel, a pattern of every depth always may
+func (g globList) below(rel string) bool {
+	dir := strings.Split(rel, "/")
+	for _, pattern := range g {
+		if !strings.HasPrefix(pattern, "/") || prefixSegments(strings.Split(pattern[1:], "/"), dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchSegments(pattern[1:], name[1:])
+}
+
+// prefixSegments is true when pattern may match a path that starts with
+// the directories of dir
+func prefixSegments(pattern, dir []string) bool {
+	if len(dir) == 0 {
+		return len(pattern) > 0
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return true
+	}
+	ok, _ := path.Match(pattern[0], dir[0])
+	return ok && prefixSegments(pattern[1:], dir[1:])
+}
+
+// pathFilter is what --exclude leaves out of a folder and --include keeps
+// in it anyway
+type pathFilter struct {
+	Exclude globList
+	Include globList
+}
+
+// skip is true when the entry rel is left out, inSkipped is true for the
+// entries of a directory that was left out. A directory left out is still
+// walked when walk is true, for the entries an include keeps
+func (f pathFilter) skip(rel string, isDir, inSkipped bool) (skip, walk bool) {
+	if len(f.Exclude) == 0 && !inSkipped {
+		return false, false
+	}
+	if f.Include.match(rel) {
+		return false, false
+	}
+	if !inSkipped && !f.Exclude.match(rel) {
+		return false, false
+	}
+	return true, isDir && f.Include.below(rel)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"*.log", "app.log", true},
+		{"*.log", "src/deep/app.log", true},
+		{"*.log", "app.log.gz", false},
+		{"node_modules", "node_modules", true},
+		{"node_modules", "web/node_modules", true},
+		{"node_modules/**", "node_modules", true},
+		{"node_modules/**", "node_modules/a/index.js", true},
+		{"node_modules/**", "web/node_modules/a", true},
+		{"/build", "build", true},
+		{"/build", "docs/build", false},
+		{"/build/**", "build/out/a.bin", true},
+		{"src/*.log", "src/debug.log", true},
+		{"src/*.log", "src/deep/debug.log", false},
+		{"src/**/*.log", "src/deep/debug.log", true},
+		{"src/**/*.log", "src/debug.log", true},
+		{".*.swp", "src/.main.go.swp", true},
+		{"?.txt", "ab.txt", false},
+	}
+	for _, tt := range tests {
+		var g globList
+		if err := g.Set(tt.pattern); err != nil {
+			t.Fatal(err)
+		}
+		if got := g.match(tt.rel); got != tt.want {
+			t.Errorf("%s matches %s: %t, want %t", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestGlobSet(t *testing.T) {
+	for _, pattern := range []string{"", "/", "//", "[a", "a//b"} {
+		var g globList
+		if err := g.Set(pattern); err == nil {
+			t.Errorf("pattern %q is taken", pattern)
+		}
+	}
+	// a trailing slash is the directory
+	var g globList
+	if err := g.Set("build/"); err != nil || !g.match("docs/build") {
+		t.Errorf("build/ is %v, %v", g, err)
+	}
+}
+
+// excludeFixture are the files of a project folder, by slash separated
+// path below it
+var excludeFixture = map[string]string{
+	"index.html":                  "<h1>hello</h1>",
+	"app.log":                     "started",
+	"main.swp":                    "swap",
+	"src/main.go":                 "package main",
+	"src/debug.log":               "debug",
+	"src/keep.log":                "keep",
+	"node_modules/a/index.js":     "module.exports = 1",
+	"node_modules/b/package.json": "{}",
+	".git/HEAD":                   "ref: refs/heads/main",
+	".git/objects/ab/cdef":        "object",
+	"build/out.bin":               "binary",
+	"docs/build/page.html":        "<p>docs</p>",
+}
+
+// writeTree writes the files of the fixture that keep says to keep into a
+// new folder site, with the empty directories dirs
+func writeTree(t *testing.T, keep func(string) bool, dirs ...string) string {
+	site := filepath.Join(t.TempDir(), "site")
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(site, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range excludeFixture {
+		if !keep(name) {
+			continue
+		}
+		p := filepath.Join(site, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return site
+}
+
+func TestPackExclude(t *testing.T) {
+	tests := []struct {
+		name             string
+		exclude, include []string
+		// left are the files left out; excluded the entries counted, a
+		// directory counts once for all below it
+		left     []string
+		excluded int
+		// empty are the directories left empty without the files
+		empty []string
+	}{
+		{"every depth", []string{"*.log"}, nil, []string{"app.log", "src/debug.log", "src/keep.log"}, 3, nil},
+		{"subtree", []string{"node_modules/**"}, nil, []string{"node_modules/a/index.js", "node_modules/b/package.json"}, 1, nil},
+		{"dot directory", []string{".git", "*.swp"}, nil, []string{".git/HEAD", ".git/objects/ab/cdef", "main.swp"}, 2, nil},
+		{"from the root", []string{"/build"}, nil, []string{"build/out.bin"}, 1, nil},
+		{"any build", []string{"build"}, nil, []string{"build/out.bin", "docs/build/page.html"}, 2, []string{"docs"}},
+		{"in a directory", []string{"src/*.log"}, nil, []string{"src/debug.log", "src/keep.log"}, 2, nil},
+		{"include a file", []string{"*.log"}, []string{"keep.log"}, []string{"app.log", "src/debug.log"}, 2, nil},
+		// the directory left out is walked for the include, what is not
+		// included in it counts one by one
+		{"include in a subtree", []string{"node_modules"}, []string{"node_modules/b/**"}, []string{"node_modules/a/index.js"}, 1, nil},
+		{"include nothing there", []string{"/build"}, []string{"docs/**"}, []string{"build/out.bin"}, 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			left := make(map[string]bool)
+			for _, name := range tt.left {
+				left[name] = true
+			}
+			site := writeTree(t, func(string) bool { return true })
+
+			var filter pathFilter
+			var args []string
+			for _, p := range tt.exclude {
+				filter.Exclude = append(filter.Exclude, p)
+				args = append(args, "--exclude", p)
+			}
+			for _, p := range tt.include {
+				filter.Include = append(filter.Include, p)
+				args = append(args, "--include", p)
+			}
+			result, err := createCar(site, filepath.Join(t.TempDir(), "site.car"), packOptions{Workers: 2, Filter: filter})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want, got []string
+			for name := range excludeFixture {
+				if !left[name] {
+					want = append(want, name)
+				}
+			}
+			for name := range result.Manifest.Files {
+				got = append(got, name)
+			}
+			sort.Strings(want)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("packed %s, want %s", strings.Join(got, " "), strings.Join(want, " "))
+			}
+			if result.Stats.Excluded != tt.excluded {
+				t.Errorf("%d entries excluded, want %d", result.Stats.Excluded, tt.excluded)
+			}
+
+			// the asset is the one of a folder without the files left out,
+			// the flags give the same
+			kept := writeTree(t, func(name string) bool { return !left[name] }, tt.empty...)
+			if cid := packCID(t, kept); result.Root.String() != cid {
+				t.Errorf("cid %s, the folder of the kept files is %s", result.Root, cid)
+			}
+			if cid := packCID(t, append(args, site)...); result.Root.String() != cid {
+				t.Errorf("cid %s, the flags give %s", result.Root, cid)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// exit codes of exists, a failed lookup is told apart from an asset that
+// is not there
+const (
+	existsMissing = 1
+	existsInvalid = 2
+)
+
+func runExists(args []string) error {
+	opts := newOptions()
+	var quiet bool
+
+	fs := newFlagSet("exists")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	fs.BoolVar(&quiet, "quiet", false, "print only the cids that are found, one per line")
+
+	cids, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(cids) == 0 {
+		return &exitError{existsInvalid, fmt.Errorf("please input the cids to look up")}
+	}
+
+	for _, c := range cids {
+		if _, err := cid.Decode(c); err != nil {
+			return &exitError{existsInvalid, fmt.Errorf("invalid cid %s %w", c, err)}
+		}
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return &exitError{existsInvalid, err}
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	// a lookup that did not get an answer is worth retrying, unlike an
+	// asset that is not there
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return &exitError{exitRetryable, err}
+	}
+	defer conn.close()
+
+	found, err := findUserAssets(context.Background(), conn.api, cids)
+	if err != nil {
+		return &exitError{exitRetryable, err}
+	}
+
+	var missing int
+	for _, c := range cids {
+		ov, ok := found[c]
+		if !ok {
+			missing++
+			if !quiet {
+				fmt.Printf("%s not found\n", c)
+			}
+			continue
+		}
+
+		if quiet {
+			fmt.Println(c)
+			continue
+		}
+		e := newAssetEntry(ov)
+		fmt.Printf("%s found, name %s, size %s, state %s\n", c, e.Name, formatSize(e.Size), e.State)
+	}
+
+	if missing > 0 && quiet {
+		return &exitError{code: existsMissing}
+	} else if missing > 0 {
+		return &exitError{existsMissing, fmt.Errorf("%d of %d assets not found", missing, len(cids))}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// assetWriter writes the assets list prints, write is called for every
+// page when the list is streamed
+type assetWriter interface {
+	write(entries []assetEntry) error
+	// close is called once after the last write
+	close(shown, total int) error
+}
+
+// newAssetWriter returns the writer of format, a streamed json list is
+// written one asset per line since the total is only known at the end
+func newAssetWriter(format string, w io.Writer, stream bool, offset int) (assetWriter, error) {
+	switch format {
+	case "table":
+		return &tableWriter{w: w}, nil
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case "cids":
+		return &cidWriter{w: w}, nil
+	case "json":
+		if stream {
+			return &jsonLinesWriter{enc: json.NewEncoder(w)}, nil
+		}
+		return &jsonWriter{w: w, offset: offset}, nil
+	default:
+		return nil, fmt.Errorf("unknown output %s, want table, csv or json", format)
+	}
+}
+
+type tableWriter struct {
+	w      io.Writer
+	header bool
+}
+
+// write aligns the columns within the rows of one call
+func (t *tableWriter) write(entries []assetEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(t.w, 0, 4, 2, ' ', 0)
+	if !t.header {
+		fmt.Fprintln(tw, "CID\tTYPE\tSIZE\tCREATED\tSTATE\tVISIBILITY\tNAME\tLOCAL DESCRIPTION")
+		t.header = true
+	}
+
+	for _, e := range entries {
+		var description string
+		if e.Local != nil {
+			description = truncate(e.Local.Description, tableDescriptionWidth)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.CID, e.Type, formatSize(e.Size), e.Created.Format(time.RFC3339), e.State, e.Visibility, e.Name, description)
+	}
+	return tw.Flush()
+}
+
+// descriptions are cut to this many characters in the table
+const tableDescriptionWidth = 40
+
+// truncate cuts s to n characters, marking the cut with ...
+func truncate(s string, n int) string {
+	r := []rune(strings.Join(strings.Fields(s), " "))
+	if len(r) <= n {
+		return string(r)
+	}
+	return string(r[:n-3]) + "..."
+}
+
+func (t *tableWriter) close(shown, total int) error {
+	// an empty account is not an error, it has nothing to show
+	if total == 0 {
+		_, err := fmt.Fprintln(t.w, "no assets")
+		return err
+	}
+	_, err := fmt.Fprintf(t.w, "%d shown, %d assets in total\n", shown, total)
+	return err
+}
+
+// cidWriter writes a cid per line and nothing else
+type cidWriter struct {
+	w io.Writer
+}
+
+func (c *cidWriter) write(entries []assetEntry) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(c.w, e.CID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cidWriter) close(shown, total int) error {
+	return nil
+}
+
+// local_ columns come from the history of this machine
+var csvHeader = []string{"cid", "name", "type", "size", "created", "expiration", "replicas", "group", "local_path", "local_uploaded", "visibility", "local_description"}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvWriter) write(entries []assetEntry) error {
+	if !c.header {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.header = true
+	}
+
+	for _, e := range entries {
+		var localPath, localUploaded, localDescription string
+		if e.Local != nil {
+			localPath, localUploaded, localDescription = e.Local.Path, e.Local.Uploaded.Format(time.RFC3339), e.Local.Description
+		}
+
+		record := []string{
+			e.CID, e.Name, e.Type, strconv.FormatInt(e.Size, 10),
+			e.Created.Format(time.RFC3339), e.Expiration.Format(time.RFC3339),
+			strconv.Itoa(e.Replicas), e.Group, localPath, localUploaded, e.Visibility, localDescription,
+		}
+		if err := c.w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) close(shown, total int) error {
+	// an empty list still gets its header
+	return c.write(nil)
+}
+
+type jsonLinesWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonLinesWriter) write(entries []assetEntry) error {
+	for _, e := range entries {
+		if err := j.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonLinesWriter) close(shown, total int) error {
+	return nil
+}
+
+type jsonWriter struct {
+	w       io.Writer
+	offset  int
+	entries []assetEntry
+}
+
+func (j *jsonWriter) write(entries []assetEntry) error {
+	j.entries = append(j.entries, entries...)
+	return nil
+}
+
+func (j *jsonWriter) close(shown, total int) error {
+	if j.entries == nil {
+		j.entries = []assetEntry{}
+	}
+
+	enc := json.NewEncoder(j.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Total  int          `json:"total"`
+		Offset int          `json:"offset"`
+		Assets []assetEntry `json:"assets"`
+	}{total, j.offset, j.entries})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipld/go-car/v2/blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// extractor writes the unixfs dag of a car to files
+type extractor struct {
+	lsys     ipld.LinkSystem
+	progress *transferProgress
+}
+
+// extractCar unpacks root from the car at carPath to out, a file asset
+// becomes the file out and a folder asset the directory out. It is written
+// to <out>.incomplete first, which is left behind when unpacking fails
+func extractCar(opts *options, carPath string, root cid.Cid, out string) error {
+	incomplete := out + ".incomplete"
+	for _, p := range []string{out, incomplete} {
+		if _, err := os.Lstat(p); err == nil {
+			return fmt.Errorf("%s already exists", p)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	bs, err := blockstore.OpenReadOnly(carPath)
+	if err != nil {
+		return fmt.Errorf("open car %w", err)
+	}
+	defer bs.Close()
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		blk, err := bs.Get(lctx.Ctx, l.(cidlink.Link).Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	// the download checked every block against its hash, with --no-verify
+	// the blocks are checked here as they are loaded
+	lsys.TrustedStorage = !opts.noVerify
+
+	// the size of the files is only known once they are reached
+	e := &extractor{lsys: lsys, progress: newTransferProgress(opts.progress, "extract", 0)}
+	if err := e.extract(context.Background(), root, incomplete); err != nil {
+		return fmt.Errorf("%w, partial output is in %s", err, incomplete)
+	}
+	e.progress.done()
+
+	if err := os.Rename(incomplete, out); err != nil {
+		return err
+	}
+
+	ev := e.progress.snapshot()
+	fmt.Printf("extracted %d files, %s to %s\n", ev.Files, formatSize(ev.Confirmed), out)
+	return nil
+}
+
+func (e *extractor) extract(ctx context.Context, c cid.Cid, p string) error {
+	var proto ipld.NodePrototype = basicnode.Prototype.Any
+	if c.Prefix().Codec == cid.DagProtobuf {
+		proto = dagpb.Type.PBNode
+	}
+
+	lctx := ipld.LinkContext{Ctx: ctx}
+	nd, err := e.lsys.Load(lctx, cidlink.Link{Cid: c}, proto)
+	if err != nil {
+		return fmt.Errorf("load %s %w", c, err)
+	}
+
+	// the reifier takes a symlink for an empty directory, so it is read
+	// from the node before
+	if target, ok := symlinkTarget(nd); ok {
+		return os.Symlink(target, p)
+	}
+	if nd, err = unixfsnode.Reify(lctx, nd, &e.lsys); err != nil {
+		return fmt.Errorf("read %s %w", c, err)
+	}
+
+	switch nd.Kind() {
+	case ipld.Kind_Map:
+		return e.extractDir(ctx, c, nd, p)
+	case ipld.Kind_Bytes:
+		return e.extractFile(nd, p)
+	default:
+		return fmt.Errorf("%s is neither a file nor a directory", c)
+	}
+}
+
+// symlinkTarget is the target of nd when it is a unixfs symlink
+func symlinkTarget(nd ipld.Node) (string, bool) {
+	pb, ok := nd.(dagpb.PBNode)
+	if !ok || !pb.FieldData().Exists() {
+		return "", false
+	}
+	ufs, err := data.DecodeUnixFSData(pb.FieldData().Must().Bytes())
+	if err != nil || ufs.FieldDataType().Int() != data.Data_Symlink || !ufs.FieldData().Exists() {
+		return "", false
+	}
+	return string(ufs.FieldData().Must().Bytes()), true
+}
+
+func (e *extractor) extractDir(ctx context.Context, c cid.Cid, nd ipld.Node, p string) error {
+	if err := os.Mkdir(p, 0755); err != nil {
+		return err
+	}
+
+	it := nd.MapIterator()
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return fmt.Errorf("read directory %s %w", c, err)
+		}
+
+		name, err := k.AsString()
+		if err != nil {
+			return err
+		}
+
+		// names come from the car, they must not leave the directory
+		if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("directory %s has invalid entry %q", c, name)
+		}
+
+		lnk, err := v.AsLink()
+		if err != nil {
+			return err
+		}
+
+		if err := e.extract(ctx, lnk.(cidlink.Link).Cid, filepath.Join(p, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extractFile(nd ipld.Node, p string) error {
+	var r io.Reader
+	if lb, ok := nd.(interface{ AsLargeBytes() (io.ReadSeeker, error) }); ok {
+		rs, err := lb.AsLargeBytes()
+		if err != nil {
+			return err
+		}
+		r = rs
+	} else {
+		b, err := nd.AsBytes()
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, &countingReader{r: r, n: e.progress.add}); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s %w", p, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	e.progress.file()
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+
+	"github.com/Filecoin-Titan/titan/api"
+)
+
+// the locator is asked this many times for another scheduler when the
+// assigned one is down, it may hand out a different one every time
+const schedulerFailoverAttempts = 3
+
+// schedulerURLs caches the scheduler the locator assigned to an api key for
+// the run, an upload of several inputs connects once per input
+var schedulerURLs = struct {
+	sync.Mutex
+	byKey map[string]string
+}{byKey: make(map[string]string)}
+
+// lookupScheduler is the scheduler of apiKey, from the cache or the locator
+func lookupScheduler(locatorAPI api.Locator, apiKey string) (string, error) {
+	schedulerURLs.Lock()
+	u, ok := schedulerURLs.byKey[apiKey]
+	schedulerURLs.Unlock()
+	if ok {
+		logDebug("scheduler %s of api key %s from cache", u, mask(apiKey))
+		return u, nil
+	}
+
+	u, err := locatorAPI.GetSchedulerWithAPIKey(context.Background(), apiKey)
+	if err != nil {
+		return "", fmt.Errorf("GetSchedulerWithAPIKey %w", err)
+	}
+
+	// the locator answers without error when no scheduler knows the key
+	if len(u) == 0 {
+		return "", errInvalidAPIKey
+	}
+
+	schedulerURLs.Lock()
+	schedulerURLs.byKey[apiKey] = u
+	schedulerURLs.Unlock()
+	return u, nil
+}
+
+// forgetScheduler drops the cached scheduler of apiKey when it is still u
+func forgetScheduler(apiKey, u string) {
+	schedulerURLs.Lock()
+	defer schedulerURLs.Unlock()
+	if schedulerURLs.byKey[apiKey] == u {
+		delete(schedulerURLs.byKey, apiKey)
+	}
+}
+
+// connectionError is true for an rpc that never got an answer from the
+// scheduler: refused, reset, unreachable or timed out. An answer, even an
+// auth error, would be the same from any scheduler of the key
+func connectionError(err error) bool {
+	var ne net.Error
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return true
+	}
+	return errors.As(err, &ne)
+}
+
+// schedulerRoute is the scheduler the rpcs of an api key go to, it moves
+// to another scheduler of the locator when the current one is down
+type schedulerRoute struct {
+	locator api.Locator
+	apiKey  string
+
+	mu       sync.Mutex
+	current  string
+	assigned string
+	down     map[string]bool
+}
+
+func newSchedulerRoute(locatorAPI api.Locator, apiKey, schedulerURL string) *schedulerRoute {
+	return &schedulerRoute{locator: locatorAPI, apiKey: apiKey, current: schedulerURL, assigned: schedulerURL, down: make(map[string]bool)}
+}
+
+// url is the scheduler that serves the rpcs now
+func (r *schedulerRoute) url() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// failedOver is true when the rpcs no longer go to the assigned scheduler
+func (r *schedulerRoute) failedOver() bool {
+	return r.url() != r.assigned
+}
+
+// next marks failed down and asks the locator for a scheduler that is not,
+// failed is the scheduler the rpc went to, another rpc may have moved on
+func (r *schedulerRoute) next(failed string, cause error) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != failed {
+		return r.current, nil
+	}
+
+	r.down[failed] = true
+	forgetScheduler(r.apiKey, failed)
+	fmt.Printf("scheduler %s is down, %s, ask the locator for another one\n", failed, errText(cause))
+
+	for attempt := 1; attempt <= schedulerFailoverAttempts; attempt++ {
+		u, err := lookupScheduler(r.locator, r.apiKey)
+		if err != nil {
+			return "", err
+		} else if !r.down[u] {
+			recordRetry("scheduler", len(r.down), endpointHost(failed), failureClass(cause), 0, false)
+			fmt.Printf("fail over to scheduler %s\n", u)
+			r.current = u
+			return u, nil
+		}
+		forgetScheduler(r.apiKey, u)
+		logVerbose("locator assigned scheduler %s again, it is down", u)
+	}
+	return "", fmt.Errorf("the locator knows no other scheduler for api key %s", mask(r.apiKey))
+}
+
+// failoverTransport sends the rpcs of a scheduler client to the current
+// scheduler of its route, and to the next one when it can not be reached
+type failoverTransport struct {
+	base  http.RoundTripper
+	route *schedulerRoute
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := t.route.url()
+	for {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+
+		r := req.Clone(req.Context())
+		r.URL, r.Host = u, ""
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if err == nil || !connectionError(err) || req.GetBody == nil {
+			return resp, err
+		}
+
+		next, nerr := t.route.next(target, err)
+		if nerr != nil {
+			return nil, fmt.Errorf("%w, %s", err, nerr.Error())
+		}
+		target = next
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+)
+
+// fdHeadroom is kept free of the open file limit for the car, sockets and
+// the files the runtime opens
+const fdHeadroom = 64
+
+// fdLimiter bounds the files and directories the packer has open at the
+// same time, an open waits for a free slot instead of failing with too
+// many open files
+type fdLimiter chan struct{}
+
+func newFDLimiter(n int) fdLimiter {
+	if n < 1 {
+		n = 1
+	}
+	return make(fdLimiter, n)
+}
+
+func (l fdLimiter) acquire() { l <- struct{}{} }
+
+func (l fdLimiter) release() { <-l }
+
+// open opens name once a slot is free, the slot is given back on Close
+func (l fdLimiter) open(name string) (*limitedFile, error) {
+	l.acquire()
+	f, err := os.Open(name)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &limitedFile{File: f, l: l}, nil
+}
+
+// readDir reads the directory name with a slot for its handle
+func (l fdLimiter) readDir(name string) ([]os.DirEntry, error) {
+	l.acquire()
+	defer l.release()
+	return os.ReadDir(name)
+}
+
+// limitedFile is a file opened through an fdLimiter
+type limitedFile struct {
+	*os.File
+	l      fdLimiter
+	closed bool
+}
+
+func (f *limitedFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	err := f.File.Close()
+	f.l.release()
+	return err
+}
+
+// defaultMaxOpenFiles is the open file limit of the process less the
+// headroom, at least a few files are always allowed
+func defaultMaxOpenFiles() int {
+	n := openFileLimit() - fdHeadroom
+	if n < 8 {
+		n = 8
+	}
+	return n
+}
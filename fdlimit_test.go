@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackMaxOpenFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("packs a folder of 20000 files")
+	}
+	testHome(t)
+
+	// most files are a block, the big ones have more blocks than a segment
+	// holds so their workers wait for the writer while they hold a file
+	dir := filepath.Join(t.TempDir(), "tree")
+	big := testData((segmentBlocks + 4) * minChunkSize)
+	for i := 0; i < 20000; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%03d", i/100))
+		if i%100 == 0 {
+			if err := os.MkdirAll(sub, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := []byte(fmt.Sprintf("file %d\n", i))
+		if i%250 < 4 {
+			data = append(data, big...)
+		}
+		if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("f%05d", i)), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := packCID(t, "--chunk-size", "16KiB", dir)
+	for _, limit := range []string{"1", "2", "4"} {
+		t.Run(limit, func(t *testing.T) {
+			// a pack that waits on itself never ends, go test times it out
+			if got := packCID(t, "--chunk-size", "16KiB", "--hash-workers", "16", "--max-open-files", limit, dir); got != want {
+				t.Errorf("cid %s with %s open files, want %s", got, limit, want)
+			}
+		})
+	}
+}
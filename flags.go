@@ -0,0 +1,389 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// options holds the settings from the command line
+type options struct {
+	locatorURL string
+	apiKeys    keyList
+	keys       *keyPool
+	// where apiKeys came from, flag or keychain
+	apiKeySource string
+	// keychain entry the api key is stored under
+	credProfile string
+	// asset name, the base name of the input by default
+	name string
+	// length of a non regular input such as a block device
+	size int64
+	// window of a file to pack, a length of 0 is to its end
+	offset int64
+	length int64
+	// files larger than this are uploaded in parts, 0 never splits
+	splitSize int64
+	// what packing does with symlinks, strict is only kept for older
+	// scripts, a cycle of followed links always fails
+	symlinks symlinkMode
+	strict   bool
+	// files open at the same time while packing, 0 is from the rlimit
+	maxOpenFiles int
+	// files hashed at the same time, 0 is from the number of cpus
+	hashWorkerCount workerCount
+	// leave the .titan-meta.json files out of the dag
+	excludeMetaFiles bool
+	// skip the sha256 of the files, or add their listing to the asset
+	noChecksums    bool
+	embedChecksums bool
+	// multihash function, chunker and leaf codec of the blocks of the car
+	hash      hashFlag
+	chunker   chunkerFlag
+	rawLeaves bool
+	// entries of folders left out of the car
+	filter pathFilter
+	// cidOnly packs into no car, for the cid subcommand
+	cidOnly bool
+	// headers are sent with the request of a url input
+	headers headerList
+	// memory the upload should stay under, 0 is no limit
+	maxMemory memoryBudget
+	profile   profileOptions
+	// directory keeping the car and manifest of an incremental pack
+	incremental  string
+	progressMode string
+	progress     progressSink
+	// skip asking the scheduler whether the upload was registered
+	noPostcheck bool
+	// fetch the asset back after the upload and check its cid
+	verify bool
+	// print the outcome of the upload as one json object, everything else
+	// goes to stderr
+	jsonResult bool
+	// take upload endpoints in the order the scheduler returned them
+	noProbe bool
+	// skip the cheap request to the upload endpoint before the upload
+	noPreflight bool
+	// keep the asset record of an upload that failed after it was created
+	noRollback bool
+	// failIfExists fails an upload of an asset the scheduler already has,
+	// force deletes the asset and uploads it again
+	failIfExists bool
+	force        bool
+	// keep the car, record and token of a failed upload for the next run,
+	// pendingState is the upload they are kept for
+	resume       bool
+	pendingState *uploadState
+	// attempts of an upload to an endpoint after the first, see transientUpload
+	retries      int
+	retryMaxWait time.Duration
+	// notify on the desktop when an upload longer than notifyAfter ends
+	notify      bool
+	notifyAfter time.Duration
+	// wrap packs the inputs into one folder, wrapped are their absolute paths
+	wrap    bool
+	wrapped []string
+	// commands run after an upload, see hookFlags
+	onSuccess   string
+	onFailure   string
+	hookTimeout time.Duration
+	hookStrict  bool
+	// hosts upload urls may point to, any host when empty
+	allowedUploadHosts hostPatterns
+	// take http upload urls
+	allowInsecureUpload bool
+	// print the upload url and token unmasked
+	printUploadInfo bool
+	// skip checking downloaded content against its cid
+	noVerify bool
+	// base of the retrieval url instead of the node the scheduler names
+	gatewayBase string
+	// render the retrieval url as a qr code in the terminal or to a png
+	qr    bool
+	qrOut string
+	// private only, the scheduler has no public assets
+	visibility string
+	// kept in the local history, the scheduler has no field for it
+	description string
+	// area the upload must stay in, refused since it can not be chosen
+	area       string
+	ipv4, ipv6 bool
+	net        netOptions
+	// client for the upload endpoints
+	uploadClient *http.Client
+	// file keeping failed uploads for retry
+	queue string
+	// file keeping a line for every finished upload, empty to keep none
+	history string
+	// several uploads run in one command, the quota is printed once at the end
+	batch bool
+	// keep uploading the other inputs of a batch after one failed, failFast
+	// is the same as continueOnError false
+	continueOnError bool
+	failFast        bool
+	// cars of a batch packed ahead while an upload runs
+	pipelineDepth int
+	// inputs of a batch uploaded at the same time
+	concurrency int
+	// an upload attempt that sends nothing for this long is aborted
+	stallTimeout time.Duration
+	// answerTimeout bounds the wait for the answer once the car is sent
+	answerTimeout time.Duration
+	// multipart posts the car in a form, put sends it as the body
+	uploadStyle string
+}
+
+func newOptions() *options {
+	return &options{progressMode: "auto", rawLeaves: true, net: netOptions{resolve: resolveOverrides{}}}
+}
+
+// commonFlags are the flags of every subcommand
+func (opts *options) commonFlags(fs *flag.FlagSet) {
+	fs.Var((*verbosity)(&logLevel), "v", "verbose output, give it twice for debug output")
+	fs.Var((*debugVerbosity)(&logLevel), "vv", "debug output, same as -v -v")
+	fs.BoolVar(&logRelativeTime, "log-relative-time", false, "prefix log lines with the time since the start instead of the time of day")
+	fs.BoolVar(&siUnits, "si", false, "show sizes in decimal units like MB and GB, default is binary units like MiB and GiB")
+	fs.Var((*byteSize)(&opts.maxMemory), "max-memory", "memory budget like 256MiB, buffering adapts to stay under it, default is no limit")
+	fs.StringVar(&opts.profile.cpuProfile, "cpuprofile", "", "write a cpu profile to the file")
+	fs.StringVar(&opts.profile.memProfile, "memprofile", "", "write a memory profile to the file on exit")
+	fs.StringVar(&opts.profile.trace, "trace", "", "write an execution trace to the file")
+	fs.StringVar(&opts.profile.pprofListen, "pprof-listen", "", "serve net/http/pprof on the address while running, like localhost:6060")
+	fs.String("config", configPath(), "config file with the defaults of the flags, like locator_url = \"https://...\"")
+}
+
+// connectFlags are the flags of subcommands that talk to the scheduler
+func (opts *options) connectFlags(fs *flag.FlagSet) {
+	opts.locatorFlags(fs)
+	fs.Var(&opts.apiKeys, "api-key", "api key, can be repeated to upload with the next key when one runs out of quota, default is the one stored by auth login")
+	opts.credentialFlags(fs)
+}
+
+// locatorFlags are the flags of subcommands that only need the locator
+func (opts *options) locatorFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.locatorURL, "locator-url", "https://localhost:5000/rpc/v0", "locator url")
+	fs.BoolVar(&opts.ipv4, "ipv4", false, "connect over IPv4 only")
+	fs.BoolVar(&opts.ipv6, "ipv6", false, "connect over IPv6 only")
+	fs.Var(opts.net.resolve, "resolve", "dial addr for host:port given as host:port:addr, can be repeated")
+	fs.StringVar(&opts.net.serverName, "tls-server-name", "", "name tls verifies and sends as sni instead of the host of the url, the address of the url is still dialed")
+	fs.DurationVar(&opts.net.maxRetryAfter, "max-retry-after", 5*time.Minute, "longest wait honored when a server answers 429 or 503 with Retry-After")
+	fs.BoolVar(&opts.net.insecure, "insecure", false, "do not verify the tls certificates of the locator, the schedulers and the upload endpoints")
+	fs.StringVar(&opts.net.caCert, "cacert", "", "pem file of ca certificates trusted besides the system ones, for servers with a private ca")
+	fs.DurationVar(&opts.net.rpcTimeout, "rpc-timeout", 30*time.Second, "abort a locator or scheduler rpc that gets no answer for this long, 0 waits forever")
+}
+
+// credentialFlags select the api key stored in the keychain
+func (opts *options) credentialFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.credProfile, "profile", "default", "keychain profile of the api key")
+}
+
+// packFlags are the flags of subcommands that build a car
+func (opts *options) packFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.name, "name", "", "asset name, default is the base name of the input")
+	fs.Var(&opts.headers, "header", "header sent with the request of an http or https url input, like 'Authorization: Bearer ...', can be repeated")
+	fs.Var((*byteSize)(&opts.size), "size", "size of a non regular input such as a block device, default is detected")
+	fs.Var((*byteSize)(&opts.offset), "offset", "pack the file from this byte on, the asset is named <name>@<offset>-<length> unless --name is given")
+	fs.Var((*byteSize)(&opts.length), "length", "pack only this many bytes of the file, default is to its end")
+	fs.Var(&opts.symlinks, "symlinks", "what to do with the symlinks of a folder: preserve stores them as links, follow packs what they point to and fails on a cycle or a dangling link, skip leaves them out, default is preserve")
+	fs.Var((*followSymlinksFlag)(&opts.symlinks), "follow-symlinks", "the same as --symlinks follow")
+	fs.BoolVar(&opts.strict, "strict", false, "no longer needed, a symlink cycle always fails with --symlinks follow")
+	fs.Var(&opts.hashWorkerCount, "hash-workers", "files hashed at the same time while packing, default is the number of cpus up to 16")
+	fs.IntVar(&opts.maxOpenFiles, "max-open-files", 0, "files and directories open at the same time while packing, default is the open file limit less room for sockets")
+	fs.BoolVar(&opts.noChecksums, "no-checksums", false, "do not compute the sha256 of every file while packing")
+	fs.BoolVar(&opts.embedChecksums, "embed-checksums", false, "add the "+checksumsFile+" listing of the files to the root of a folder asset")
+	fs.Var(&opts.chunker, "chunker", "how files are split into blocks: size-<bytes>, rabin, rabin-<min>-<avg>-<max> or buzhash, default is "+defaultChunker+" which with the other defaults gives the cid of ipfs add --cid-version 1")
+	fs.Var((*chunkSizeFlag)(&opts.chunker), "chunk-size", fmt.Sprintf("size of the blocks files are split into, %s to %s, the same as --chunker size-<bytes>", formatSize(minChunkSize), formatSize(maxChunkSize)))
+	fs.BoolVar(&opts.rawLeaves, "raw-leaves", true, "store the chunks of files as raw blocks, --raw-leaves=false wraps them in dag-pb nodes like ipfs add --cid-version 0 does, for the cids of older ipfs tools")
+	fs.Var(&opts.hash, "hash", "multihash function of the blocks, one of "+strings.Join(packHashes, ", ")+", default is sha2-256")
+	fs.Var(&opts.filter.Exclude, "exclude", "leave entries that match the glob out of a folder, like '*.log', '.git' or 'node_modules/**', matched at every depth unless it starts with /, can be repeated")
+	fs.Var(&opts.filter.Include, "include", "keep entries that match the glob even when an --exclude matches them, can be repeated")
+	fs.BoolVar(&opts.excludeMetaFiles, "exclude-meta-files", false, "leave the "+metaFileName+" files out of the asset, their metadata is still in the manifest")
+}
+
+// incrementalFlags are the flags of subcommands that can reuse a previous pack
+func (opts *options) incrementalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.incremental, "incremental", "", "keep the car in the directory and only pack files changed since the last run")
+}
+
+// uploadFlags are the flags of subcommands that send a car
+func (opts *options) uploadFlags(fs *flag.FlagSet) {
+	opts.progressFlags(fs)
+	fs.BoolVar(&opts.noPostcheck, "no-postcheck", false, "do not check that the scheduler registered the upload")
+	fs.BoolVar(&opts.verify, "verify", false, "fetch the asset back after the upload and check it hashes to the uploaded cid, the car is kept when it does not")
+	fs.BoolVar(&opts.noProbe, "no-probe", false, "do not probe the latency of upload endpoints before choosing one")
+	fs.Var(&opts.allowedUploadHosts, "allowed-upload-hosts", "comma separated hosts upload urls may point to, like upload.example.com or *.example.com, can be repeated")
+	fs.BoolVar(&opts.allowInsecureUpload, "allow-insecure-upload", false, "take plain http upload urls, the token is sent in clear")
+	fs.BoolVar(&opts.printUploadInfo, "print-upload-info", false, "print the upload url and token the scheduler returns, unmasked, every other output masks them")
+	fs.BoolVar(&opts.failIfExists, "fail-if-exists", false, "fail when the scheduler already has the asset, by default that is a success with nothing uploaded")
+	fs.BoolVar(&opts.force, "force", false, "register the asset record again when the scheduler already has the asset, the car is only sent when the scheduler no longer has it")
+	fs.BoolVar(&opts.noRollback, "no-rollback", false, "keep the asset record when the upload fails after it was created, to resume it later")
+	fs.BoolVar(&opts.resume, "resume", false, "keep the car, the asset record and the token of a failed upload, the next upload of the input sends the car again without packing it")
+	fs.BoolVar(&opts.notify, "notify", false, "show a desktop notification when the upload ends, if it took longer than notify-after")
+	fs.DurationVar(&opts.notifyAfter, "notify-after", 5*time.Minute, "only notify for uploads that took longer than this")
+	fs.BoolVar(&opts.noPreflight, "no-preflight", false, "do not check the upload endpoint and token with a HEAD request before uploading")
+	fs.StringVar(&opts.gatewayBase, "gateway-base", "", "base url of the retrieval url printed after the upload, like https://gateway.example.com, default is the node the scheduler names")
+	fs.BoolVar(&opts.qr, "qr", false, "show the retrieval url as a qr code after the upload")
+	fs.StringVar(&opts.qrOut, "qr-out", "", "write the retrieval url as a qr code png to the file")
+	fs.StringVar(&opts.visibility, "visibility", "private", "who can retrieve the asset, private or public")
+	fs.StringVar(&opts.description, "description", "", "free-form description of the asset, kept in the local history only")
+	fs.StringVar(&opts.uploadStyle, "upload-style", "multipart", "how the car is sent, multipart posts it in a form, put sends it as the request body")
+	fs.IntVar(&opts.retries, "retries", 4, "send the car to an endpoint again this many times after a connection error, a timeout, 408, 429 or a 5xx answer")
+	fs.DurationVar(&opts.retryMaxWait, "retry-max-wait", time.Minute, "longest backoff between two attempts of an upload, it doubles from 1s")
+	fs.DurationVar(&opts.stallTimeout, "stall-timeout", 2*time.Minute, "abort an upload attempt that sends nothing for this long and try the next endpoint, 0 never aborts")
+	fs.DurationVar(&opts.answerTimeout, "answer-timeout", 10*time.Minute, "abort an upload attempt whose endpoint took the whole car and did not answer for this long, 0 waits forever")
+	fs.Var((*byteSize)(&opts.splitSize), "split-size", "upload a file larger than this as parts of at most this size and a listing of them, like 200GiB")
+	fs.StringVar(&opts.area, "area", "", "area the scheduler and upload endpoints must be in, like Asia-China-Guangdong")
+	opts.historyFlags(fs)
+	opts.hookFlags(fs)
+}
+
+// checkUploadFlags checks the flags of uploadFlags that can not be
+// checked while parsing
+func (opts *options) checkUploadFlags() error {
+	if len(opts.description) > 0 && len(opts.history) == 0 {
+		return fmt.Errorf("description is kept in the history, it can not be used with an empty history")
+	}
+
+	if opts.retries < 0 || opts.retryMaxWait < 0 {
+		return fmt.Errorf("retries and retry-max-wait can not be negative")
+	} else if opts.answerTimeout < 0 {
+		return fmt.Errorf("answer-timeout can not be negative")
+	}
+
+	if opts.uploadStyle != "multipart" && opts.uploadStyle != "put" {
+		return fmt.Errorf("upload-style must be multipart or put")
+	}
+
+	// every part is a window of the file
+	if opts.splitSize > 0 && (opts.offset != 0 || opts.length != 0 || len(opts.incremental) > 0) {
+		return fmt.Errorf("split-size packs the windows of its parts itself, it can not be used with offset, length or incremental")
+	}
+
+	// the blocks of the previous car are reused as they are
+	if len(opts.incremental) > 0 && opts.hash.code() != multihash.SHA2_256 {
+		return fmt.Errorf("hash %s can not be used with incremental, the previous car is hashed with sha2-256", opts.hash.String())
+	} else if len(opts.incremental) > 0 && opts.chunker.String() != defaultChunker {
+		return fmt.Errorf("chunker %s can not be used with incremental, the previous car is chunked with %s", opts.chunker.String(), defaultChunker)
+	} else if len(opts.incremental) > 0 && !opts.rawLeaves {
+		return fmt.Errorf("raw-leaves=false can not be used with incremental, the previous car has raw leaves")
+	}
+
+	// the locator picks the scheduler that made the api key whatever its
+	// area, and CreateUserAsset takes no area for the upload endpoint
+	if len(opts.area) > 0 {
+		return fmt.Errorf("area %s can not be kept, the api key decides the scheduler and the scheduler picks the upload endpoint without an area", opts.area)
+	}
+	return opts.checkVisibility()
+}
+
+// checkVisibility refuses public, candidates serve every asset only with
+// a token the scheduler signs for its owner
+func (opts *options) checkVisibility() error {
+	switch opts.visibility {
+	case "private":
+		return nil
+	case "public":
+		return errNoPublicAssets
+	default:
+		return fmt.Errorf("visibility must be private or public")
+	}
+}
+
+// batchFlags are the flags of uploads with several inputs
+func (opts *options) batchFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&opts.continueOnError, "continue-on-error", true, "keep uploading the other inputs after one failed")
+	fs.BoolVar(&opts.failFast, "fail-fast", false, "stop at the first input that fails, same as --continue-on-error=false")
+	fs.BoolVar(&opts.wrap, "wrap", false, "pack the inputs into one folder asset, each under its base name, instead of an asset for each")
+	fs.IntVar(&opts.concurrency, "concurrency", 3, "inputs uploaded at the same time, over one scheduler connection")
+	fs.IntVar(&opts.pipelineDepth, "pipeline-depth", 1, "cars packed ahead while an upload runs, 0 packs each input only after the upload before it")
+}
+
+// progressFlags are the flags of subcommands that transfer data
+func (opts *options) progressFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.progressMode, "progress", "auto", "progress output, auto is a bar on a terminal and plain lines otherwise, bar, plain or json lines")
+}
+
+func (opts *options) requireAPIKey() error {
+	if len(opts.locatorURL) == 0 {
+		return fmt.Errorf("locator-url can not empty")
+	}
+
+	opts.resolveAPIKey()
+	if len(opts.apiKeys) == 0 {
+		return fmt.Errorf("api-key can not empty, pass --api-key, set %s, set api_key with config set or run auth login", apiKeyEnv)
+	}
+	opts.keys = newKeyPool(opts.apiKeys)
+	return nil
+}
+
+// setup checks the parsed flags and prepares what they need, the returned
+// function must be called when the subcommand is done
+func (opts *options) setup() (func(), error) {
+	var err error
+	if opts.progress, err = newProgressSink(opts.progressMode); err != nil {
+		return nil, err
+	}
+
+	if opts.failIfExists && opts.force {
+		return nil, fmt.Errorf("fail-if-exists and force can not be used together")
+	}
+
+	if opts.ipv4 && opts.ipv6 {
+		return nil, fmt.Errorf("ipv4 and ipv6 can not be used together")
+	} else if opts.ipv4 {
+		opts.net.family = "4"
+	} else if opts.ipv6 {
+		opts.net.family = "6"
+	}
+
+	if opts.net.rpcTimeout < 0 {
+		return nil, fmt.Errorf("rpc-timeout can not be negative")
+	}
+	if err := opts.net.loadCACert(); err != nil {
+		return nil, err
+	}
+	if opts.net.insecure {
+		fmt.Println("warning: --insecure is set, tls certificates are not verified")
+	}
+	if err := opts.net.check(); err != nil {
+		return nil, err
+	}
+	opts.uploadClient = newUploadClient(opts.net)
+
+	opts.maxMemory.apply()
+
+	stopProfiling, err := startProfiling(opts.profile)
+	if err != nil {
+		return nil, err
+	}
+	onInterrupt(stopProfiling)
+	handlePauseSignals()
+	return stopProfiling, nil
+}
+
+// parseFlags parses args with fs and returns the positional arguments,
+// flags are allowed after positional arguments until a "--"
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		rest := fs.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), applyConfig(fs)
+		}
+
+		if len(rest) == 0 {
+			return positional, applyConfig(fs)
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
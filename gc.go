@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// gcItem is something gc removes
+type gcItem struct {
+	// Kind is temp, queue, history or remote
+	Kind   string
+	Target string
+	Reason string
+}
+
+// gcEvent is a line of the event log for every removal of gc
+type gcEvent struct {
+	Time   time.Time
+	Action string
+	Kind   string
+	Target string
+	Reason string
+}
+
+// eventLogPath is the event log gc records its removals in
+func eventLogPath() string {
+	return filepath.Join(stateDir(), "events.jsonl")
+}
+
+func runGC(args []string) error {
+	opts := newOptions()
+	var (
+		olderThan     time.Duration
+		remote        bool
+		deleteExpired bool
+		yes           bool
+	)
+
+	fs := newFlagSet("gc")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	opts.historyFlags(fs)
+	opts.queueFlags(fs)
+	fs.DurationVar(&olderThan, "older-than", 24*time.Hour, "remove temp directories of runs that were last changed longer ago, a younger one may belong to a running upload")
+	fs.BoolVar(&remote, "remote", false, "also check the history against the assets of the scheduler, and list assets past their expiration")
+	fs.BoolVar(&deleteExpired, "delete-remote-expired", false, "delete the assets past their expiration from the scheduler, needs --remote")
+	fs.BoolVar(&yes, "yes", false, "remove what the listing shows, without it gc only lists")
+
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if deleteExpired && !remote {
+		return fmt.Errorf("delete-remote-expired needs --remote")
+	}
+
+	if remote {
+		if err := opts.requireAPIKey(); err != nil {
+			return err
+		}
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	items, err := gcTempDirs(olderThan)
+	if err != nil {
+		return err
+	}
+
+	queueItems, err := gcQueue(opts.queue)
+	if err != nil {
+		return err
+	}
+	items = append(items, queueItems...)
+
+	var conn *schedulerConn
+	if remote {
+		if conn, err = connectScheduler(opts, make(map[int]bool)); err != nil {
+			return err
+		}
+		defer func() { conn.close() }()
+
+		remoteItems, err := gcRemote(opts, conn, deleteExpired)
+		if err != nil {
+			return err
+		}
+		items = append(items, remoteItems...)
+	}
+
+	if len(items) == 0 {
+		fmt.Println("nothing to remove")
+		return nil
+	}
+
+	// the listing always comes first, nothing is removed without --yes
+	for _, it := range items {
+		fmt.Printf("%s %s, %s\n", it.Kind, it.Target, it.Reason)
+	}
+	if !yes {
+		fmt.Printf("%d to remove, run gc again with --yes to remove them\n", len(items))
+		return nil
+	}
+
+	var failed int
+	for _, it := range items {
+		if err := gcRemove(opts, conn, it); err != nil {
+			fmt.Printf("remove %s %s error %s\n", it.Kind, it.Target, errText(err))
+			failed++
+			continue
+		}
+		if err := appendEvent(gcEvent{Time: time.Now(), Action: "gc remove", Kind: it.Kind, Target: it.Target, Reason: it.Reason}); err != nil {
+			fmt.Printf("warning: event log %s error %s\n", eventLogPath(), err.Error())
+		}
+		fmt.Printf("removed %s %s\n", it.Kind, it.Target)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d not removed", failed, len(items))
+	}
+	return nil
+}
+
+// gcTempDirs finds the temp directories of batches, benches and doctor
+// runs and the temp cars that were left behind by a crash
+func gcTempDirs(olderThan time.Duration) ([]gcItem, error) {
+	matches, err := filepath.Glob(filepath.Join(os.TempDir(), "storage-upload-sample-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []gcItem
+	for _, m := range matches {
+		info, err := os.Lstat(m)
+		if err != nil {
+			continue
+		}
+		if age := time.Since(info.ModTime()); age > olderThan {
+			items = append(items, gcItem{Kind: "temp", Target: m, Reason: fmt.Sprintf("left by a run %s ago", formatDuration(age))})
+		}
+	}
+	return items, nil
+}
+
+// gcQueue finds the queued jobs whose input is gone, they can never be retried
+func gcQueue(queuePath string) ([]gcItem, error) {
+	q, err := readQueue(queuePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []gcItem
+	for _, job := range q.Jobs {
+		if _, err := os.Stat(job.Path); errors.Is(err, os.ErrNotExist) {
+			items = append(items, gcItem{Kind: "queue", Target: job.ID, Reason: fmt.Sprintf("input %s no longer exists", job.Path)})
+		}
+	}
+	return items, nil
+}
+
+// gcRemote finds the history entries of assets the scheduler no longer has
+// and the assets past their expiration, which are only removed with
+// deleteExpired
+func gcRemote(opts *options, conn *schedulerConn, deleteExpired bool) ([]gcItem, error) {
+	entries, err := listUserAssets(context.Background(), conn.api)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := readHistory(opts.history)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(entries))
+	var items []gcItem
+	now := time.Now()
+	for _, e := range entries {
+		listed[historyKey(e.CID)] = true
+		if e.Expiration.IsZero() || e.Expiration.After(now) {
+			continue
+		}
+
+		if deleteExpired {
+			items = append(items, gcItem{Kind: "remote", Target: e.CID, Reason: fmt.Sprintf("expired %s", e.Expiration.Format(time.RFC3339))})
+		} else {
+			fmt.Printf("expired %s %s, expired %s, delete it with --delete-remote-expired\n", e.CID, e.Name, e.Expiration.Format(time.RFC3339))
+		}
+	}
+
+	for key, h := range history {
+		if !listed[key] {
+			items = append(items, gcItem{Kind: "history", Target: h.CID, Reason: fmt.Sprintf("%s is no longer on the scheduler", h.Name)})
+		}
+	}
+	return items, nil
+}
+
+func gcRemove(opts *options, conn *schedulerConn, it gcItem) error {
+	switch it.Kind {
+	case "temp":
+		return os.RemoveAll(it.Target)
+	case "queue":
+		return updateQueue(opts.queue, func(q *queue) error {
+			if i := q.find(it.Target); i >= 0 {
+				q.Jobs = append(q.Jobs[:i], q.Jobs[i+1:]...)
+			}
+			return nil
+		})
+	case "history":
+		return dropHistory(opts.history, it.Target)
+	case "remote":
+		return conn.api.DeleteUserAsset(context.Background(), it.Target)
+	}
+	return fmt.Errorf("unknown kind %s", it.Kind)
+}
+
+// dropHistory removes the lines of root from the history, under the lock
+// appendHistory takes so no line of a concurrent run is lost
+func dropHistory(historyPath, root string) error {
+	f, err := os.OpenFile(historyPath, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("lock history %s %w", historyPath, err)
+	}
+	defer unlockFile(f) //nolint:errcheck
+
+	key := historyKey(root)
+	var kept bytes.Buffer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &historyEntry{}
+		// lines that can not be read are kept as they are
+		if err := json.Unmarshal(scanner.Bytes(), e); err == nil && historyKey(e.CID) == key {
+			continue
+		}
+		kept.Write(scanner.Bytes())
+		kept.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(kept.Bytes(), 0)
+	return err
+}
+
+// appendEvent adds ev to the event log
+func appendEvent(ev gcEvent) error {
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(eventLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
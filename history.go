@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// historyEntry is a finished upload as kept in the local history, one
+// json object per line
+type historyEntry struct {
+	CID  string
+	Name string
+	Type string
+	// Path is the absolute input path, empty for submitted bundles
+	Path string `json:",omitempty"`
+	// APIKey names the key of the pool the asset was uploaded with
+	APIKey   string `json:",omitempty"`
+	Uploaded time.Time
+	// Description is only known on this machine
+	Description string `json:",omitempty"`
+}
+
+// stateDir is where the queue and the history are kept
+func stateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "storage-upload-sample")
+}
+
+func (opts *options) historyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.history, "history", filepath.Join(stateDir(), "history.jsonl"), "file keeping a line for every finished upload")
+}
+
+// appendHistory adds e to the history at historyPath, the lock keeps lines
+// of concurrent runs from mixing
+func appendHistory(historyPath string, e *historyEntry) error {
+	if err := os.MkdirAll(filepath.Dir(historyPath), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(historyPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("lock history %s %w", historyPath, err)
+	}
+	defer unlockFile(f) //nolint:errcheck
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// recordUpload adds a finished upload to the history, a failure is only
+// reported since the upload itself is done
+func recordUpload(opts *options, conn *schedulerConn, root, name, assetType, sourcePath string) {
+	if len(opts.history) == 0 {
+		return
+	}
+
+	e := &historyEntry{CID: root, Name: name, Type: assetType, Uploaded: time.Now(), Description: opts.description}
+	if isURLInput(sourcePath) {
+		e.Path = sourcePath
+	} else if len(sourcePath) > 0 && !isStreamInput(sourcePath) {
+		if abs, err := filepath.Abs(sourcePath); err == nil {
+			e.Path = abs
+		}
+	}
+
+	if len(opts.keys.keys) > 1 {
+		e.APIKey = opts.keys.label(conn.key)
+	}
+
+	if err := appendHistory(opts.history, e); err != nil {
+		fmt.Printf("record history error %s\n", err.Error())
+	}
+}
+
+// readHistory returns the latest history entry of every cid keyed by
+// multihash, a missing history is empty
+func readHistory(historyPath string) (map[string]*historyEntry, error) {
+	entries := make(map[string]*historyEntry)
+	f, err := os.Open(historyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		e := &historyEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// a crash can leave the last line cut short
+			logVerbose("history %s line %d %s", historyPath, line, err.Error())
+			continue
+		}
+		entries[historyKey(e.CID)] = e
+	}
+	return entries, scanner.Err()
+}
+
+// historyKey compares cids by multihash like sameCID
+func historyKey(s string) string {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return s
+	}
+	return string(c.Hash())
+}
+
+func runDescribe(args []string) error {
+	opts := newOptions()
+
+	fs := newFlagSet("describe")
+	opts.commonFlags(fs)
+	opts.historyFlags(fs)
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("please input the cid and the description")
+	}
+
+	history, err := readHistory(opts.history)
+	if err != nil {
+		return err
+	}
+
+	h, ok := history[historyKey(args[0])]
+	if !ok {
+		return fmt.Errorf("%s is not in the history %s, descriptions are kept only there", args[0], opts.history)
+	}
+
+	// the latest line of a cid wins, so a copy with the new description
+	// replaces it
+	e := *h
+	e.Description = args[1]
+	if err := appendHistory(opts.history, &e); err != nil {
+		return err
+	}
+
+	fmt.Printf("described %s in %s, the description is local to this machine\n", args[0], opts.history)
+	return nil
+}
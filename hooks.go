@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// hookFlags are the flags of the commands run after an upload
+func (opts *options) hookFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.onSuccess, "on-success", "", "command run by the shell after an upload, with the json result on stdin and TITAN_* variables")
+	fs.StringVar(&opts.onFailure, "on-failure", "", "command run by the shell after a failed upload, with the error on stdin and TITAN_* variables")
+	fs.DurationVar(&opts.hookTimeout, "hook-timeout", 5*time.Minute, "kill a hook that runs longer than this")
+	fs.BoolVar(&opts.hookStrict, "hook-strict", false, "fail the upload when a hook fails or times out")
+}
+
+// hookEvent is what a hook is told about an upload, or about a whole
+// batch when batch is set
+type hookEvent struct {
+	cid      string
+	name     string
+	size     int64
+	duration time.Duration
+	err      error
+	// result goes to the stdin of the hook as json
+	result interface{}
+	batch  *batchCounts
+}
+
+// batchCounts are the outcomes of the inputs of a batch
+type batchCounts struct {
+	Uploaded int `json:"uploaded"`
+	Failed   int `json:"failed"`
+	Skipped  int `json:"skipped"`
+}
+
+// hookEnv is the environment of a hook: the one of this run without any
+// variable that holds an api key or a token, and the TITAN_* of the event
+func hookEnv(ev hookEvent) []string {
+	secrets.mu.Lock()
+	values := append([]string(nil), secrets.values...)
+	secrets.mu.Unlock()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(strings.ToUpper(name), "TITAN_") {
+			continue
+		}
+		leaks := false
+		for _, s := range values {
+			if strings.Contains(value, s) {
+				leaks = true
+				break
+			}
+		}
+		if !leaks {
+			env = append(env, kv)
+		}
+	}
+
+	env = append(env,
+		"TITAN_CID="+ev.cid,
+		"TITAN_NAME="+ev.name,
+		fmt.Sprintf("TITAN_SIZE=%d", ev.size),
+		fmt.Sprintf("TITAN_DURATION_MS=%d", ev.duration.Milliseconds()),
+	)
+	if ev.err != nil {
+		env = append(env, "TITAN_ERROR_CLASS="+failureClass(ev.err))
+	}
+	if ev.batch != nil {
+		env = append(env, fmt.Sprintf("TITAN_UPLOADED=%d", ev.batch.Uploaded), fmt.Sprintf("TITAN_FAILED=%d", ev.batch.Failed), fmt.Sprintf("TITAN_SKIPPED=%d", ev.batch.Skipped))
+	}
+	return env
+}
+
+// shellCommand runs command in the shell of the platform
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// runHook runs --on-success or --on-failure for ev. The exit code is only
+// logged, the error returned is for --hook-strict
+func runHook(opts *options, ev hookEvent) error {
+	command, kind := opts.onSuccess, "on-success"
+	if ev.err != nil {
+		command, kind = opts.onFailure, "on-failure"
+	}
+	if len(command) == 0 {
+		return nil
+	}
+
+	result := ev.result
+	if result == nil && ev.err != nil {
+		result = struct {
+			Phase string `json:"phase"`
+			Name  string `json:"name"`
+			Class string `json:"class"`
+			Error string `json:"error"`
+		}{"failure", ev.name, failureClass(ev.err), errText(ev.err)}
+	}
+	stdin, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.hookTimeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, command)
+	cmd.Env = hookEnv(ev)
+	cmd.Stdin = bytes.NewReader(append(stdin, '\n'))
+	// json progress keeps stdout for its lines
+	var out io.Writer = os.Stdout
+	if opts.progressMode == "json" {
+		out = os.Stderr
+	}
+	cmd.Stdout, cmd.Stderr = out, os.Stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	var ee *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("%s hook timed out after %s", kind, formatDuration(opts.hookTimeout))
+	case errors.As(err, &ee):
+		err = fmt.Errorf("%s hook exited with %d", kind, ee.ExitCode())
+	case err != nil:
+		err = fmt.Errorf("%s hook %w", kind, err)
+	default:
+		logVerbose("%s hook for %s exited with 0 after %s", kind, ev.name, formatDuration(time.Since(start)))
+		return nil
+	}
+
+	fmt.Printf("warning: %s\n", err.Error())
+	if opts.hookStrict {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/ipfs/go-cid"
+	dagpb "github.com/ipld/go-codec-dagpb"
+)
+
+// rootSize is the size of the dag below the root block b of c from the
+// sizes its links carry, and whether it is a folder
+func rootSize(c cid.Cid, b []byte) (int64, bool, error) {
+	// a sharded directory is a folder download can not walk, its size is
+	// still in its links
+	_, dir, err := decodeUnixfsNode(c, b)
+	if err != nil && !dir {
+		return 0, false, err
+	}
+
+	size := int64(len(b))
+	if c.Prefix().Codec == cid.Raw {
+		return size, false, nil
+	}
+
+	nb := dagpb.Type.PBNode.NewBuilder()
+	if err := dagpb.DecodeBytes(nb, b); err != nil {
+		return 0, false, fmt.Errorf("decode %s %w", c, err)
+	}
+	it := nb.Build().(dagpb.PBNode).FieldLinks().Iterator()
+	for !it.Done() {
+		_, link := it.Next()
+		if link.FieldTsize().Exists() {
+			size += link.FieldTsize().Must().Int()
+		}
+	}
+	return size, dir, nil
+}
+
+func runImport(args []string) error {
+	opts := newOptions()
+
+	fs := newFlagSet("import")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	fs.StringVar(&opts.name, "name", "", "asset name, default is the cid")
+	fs.StringVar(&opts.gatewayBase, "gateway-base", "", "base url of the retrieval url printed after the import, like https://gateway.example.com, default is the node the scheduler names")
+	opts.historyFlags(fs)
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("please input the cid to import")
+	}
+
+	want, err := cid.Decode(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid cid %s %w", args[0], err)
+	}
+	root := want.String()
+
+	name := opts.name
+	if len(name) == 0 {
+		name = root
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	// the size of the asset comes from the root block on the network, an
+	// asset no candidate holds can not be imported
+	d := &downloader{cid: want}
+	if err := d.locate(opts); err != nil {
+		return fmt.Errorf("%s is not on the network, upload it instead, %w", root, err)
+	}
+	b, err := d.fetchBlock(context.Background(), "", want)
+	if err != nil {
+		return fmt.Errorf("root block of %s %w", root, err)
+	}
+	size, dir, err := rootSize(want, b)
+	if err != nil {
+		return err
+	}
+	assetType := "file"
+	if dir {
+		assetType = "folder"
+	}
+	logVerbose("%s is a %s of %s", root, assetType, formatSize(size))
+
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	ctx := context.Background()
+	key := opts.keys.keys[conn.key]
+	before, qerr := fetchQuota(ctx, conn.api, key)
+	if errors.Is(qerr, errNoQuota) {
+		printNoQuota()
+	} else if qerr != nil {
+		logDebug("quota error %s", qerr.Error())
+	}
+
+	rsp, err := conn.api.CreateUserAsset(ctx, &types.AssetProperty{AssetCID: root, AssetName: name, AssetSize: size, AssetType: assetType})
+	if err != nil {
+		return fmt.Errorf("CreateUserAsset error %w", err)
+	}
+	addSecret(rsp.Token)
+
+	// the scheduler hands out an upload url when it does not have the
+	// content, nothing is uploaded so the record would stay without data
+	if !rsp.AlreadyExists {
+		rollbackAsset(opts, conn.api, root, "import")
+		return fmt.Errorf("the scheduler does not have the content of %s, it asks for an upload, upload it instead", root)
+	}
+	fmt.Printf("imported %s as %s, %s\n", root, name, formatSize(size))
+
+	recordUpload(opts, conn, root, name, assetType, "")
+	r := newUploadResult(opts, conn, root, name, assetType, nil, nil)
+	var transferred int64
+	r.Imported, r.Transferred = true, &transferred
+	r.print(opts)
+
+	// what the import takes from the quota is up to the scheduler, it is
+	// read back instead of guessed from the size, when the key can read it
+	if qerr != nil {
+		return nil
+	}
+	if after, err := fetchQuota(ctx, conn.api, key); err != nil {
+		logDebug("quota error %s", err.Error())
+	} else {
+		fmt.Printf("quota: %s / %s used, the import took %s\n", formatSize(after.UsedSize), formatSize(after.TotalSize), formatSize(after.UsedSize-before.UsedSize))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+const (
+	incrementalCar      = "pack.car"
+	incrementalManifest = "manifest.json"
+)
+
+// previousPack is the car and manifest kept from the last run of an
+// incremental pack, files that did not change are copied from its car
+type previousPack struct {
+	bs       *blockstore.ReadOnly
+	manifest *manifest
+	// blocks copied from the previous car
+	reused int64
+}
+
+// openPreviousPack opens the pack kept in dir, it returns nil when the
+// directory has no previous pack yet
+func openPreviousPack(dir string) (*previousPack, error) {
+	m, err := readManifest(filepath.Join(dir, incrementalManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	bs, err := blockstore.OpenReadOnly(filepath.Join(dir, incrementalCar))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open previous car %w", err)
+	}
+	return &previousPack{bs: bs, manifest: m}, nil
+}
+
+func (pp *previousPack) close() error {
+	return pp.bs.Close()
+}
+
+// lookup returns the previous dag of a file that has not changed since
+func (pp *previousPack) lookup(rel string, info os.FileInfo) (manifestFile, bool) {
+	f, ok := pp.manifest.Files[rel]
+	if !ok || f.FileSize != info.Size() || !f.ModTime.Equal(info.ModTime()) {
+		return manifestFile{}, false
+	}
+	return f, true
+}
+
+// copyDag writes the dag of root from the previous car with ls, children
+// are written before their parent like the unixfs builder does
+func (pp *previousPack) copyDag(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid) error {
+	blk, err := pp.bs.Get(ctx, root)
+	if err != nil {
+		return fmt.Errorf("get %s from previous car %w", root, err)
+	}
+
+	if root.Prefix().Codec == uint64(multicodec.DagPb) {
+		nb := dagpb.Type.PBNode.NewBuilder()
+		if err := dagpb.DecodeBytes(nb, blk.RawData()); err != nil {
+			return err
+		}
+		links := nb.Build().(dagpb.PBNode).FieldLinks().Iterator()
+		for !links.Done() {
+			_, link := links.Next()
+			l, ok := link.FieldHash().Link().(cidlink.Link)
+			if !ok {
+				return fmt.Errorf("could not interpret %s", link.FieldHash().Link())
+			}
+			if err := pp.copyDag(ctx, ls, l.Cid); err != nil {
+				return err
+			}
+		}
+	}
+
+	w, commit, err := ls.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(blk.RawData()); err != nil {
+		return err
+	}
+	atomic.AddInt64(&pp.reused, 1)
+	return commit(cidlink.Link{Cid: root})
+}
+
+// createIncrementalCar packs input into dir and reuses the pack kept there
+// by the previous run. The new car and manifest replace the previous ones
+// only when the pack succeeds, the path of the car is returned.
+func createIncrementalCar(dir, input string, opts packOptions) (string, *packResult, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+
+	prev, err := openPreviousPack(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	carFile := filepath.Join(dir, incrementalCar)
+	tempFile := carFile + ".new"
+	os.Remove(tempFile)
+
+	opts.Previous = prev
+	result, err := createCar(input, tempFile, opts)
+	if prev != nil {
+		prev.close()
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return "", nil, err
+	}
+
+	if err := os.Rename(tempFile, carFile); err != nil {
+		return "", nil, err
+	}
+	if err := result.Manifest.write(filepath.Join(dir, incrementalManifest)); err != nil {
+		return "", nil, err
+	}
+	if err := writeChecksums(filepath.Join(dir, checksumsFile), result.Manifest); err != nil {
+		return "", nil, err
+	}
+	return carFile, result, nil
+}
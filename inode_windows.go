@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// dirID identifies a directory by its path with every link resolved,
+// windows has no inode in os.FileInfo
+func dirID(p string, info os.FileInfo) string {
+	if real, err := filepath.EvalSymlinks(p); err == nil {
+		if abs, err := filepath.Abs(real); err == nil {
+			return abs
+		}
+	}
+	return p
+}
+
+// hardLinkID always reports false, windows has no inode in os.FileInfo
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// jsonResult is what upload --json prints on stdout when the upload
+// succeeds, the one object a script reads the outcome from
+type jsonResult struct {
+	RootCID   string `json:"root_cid"`
+	AssetName string `json:"asset_name"`
+	AssetType string `json:"asset_type"`
+	CarSize   int64  `json:"car_size"`
+	// UploadDurationMs is the time spent sending the car, 0 when it was
+	// not sent
+	UploadDurationMs int64 `json:"upload_duration_ms"`
+	// UploadURL is the retrieval url of the asset, empty when the
+	// scheduler gave none
+	UploadURL     string `json:"upload_url"`
+	AlreadyExists bool   `json:"already_exists"`
+	// ServerIDs are the identifiers the candidate answered the upload with
+	ServerIDs map[string]string `json:"server_ids,omitempty"`
+	// QuotaUsed and QuotaTotal are the storage of the api key after the
+	// upload, left out when the scheduler does not tell
+	QuotaUsed  *int64 `json:"quota_used,omitempty"`
+	QuotaTotal *int64 `json:"quota_total,omitempty"`
+}
+
+// jsonFailure is what upload --json prints on stderr when the upload fails
+type jsonFailure struct {
+	Error struct {
+		// Code is the class of the failure, like network, quota or upload
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		// ExitCode is the exit code the run ends with
+		ExitCode int `json:"exit_code"`
+		// RootCID is the cid of the input once it was packed
+		RootCID string `json:"root_cid,omitempty"`
+	} `json:"error"`
+}
+
+// printJSONResult prints the outcome of upload --json, the result of asset
+// on out or the failure err on stderr. The error returned only carries the
+// exit code, the failure is already printed
+func printJSONResult(out io.Writer, asset *packedAsset, err error) error {
+	if err == nil && (asset == nil || asset.result == nil) {
+		err = &stageError{"upload", fmt.Errorf("the upload gave no result")}
+	}
+
+	if err != nil {
+		var f jsonFailure
+		f.Error.Code = strings.ReplaceAll(failureClass(err), " ", "_")
+		f.Error.Message = describeError(err)
+		f.Error.ExitCode = exitCode(err)
+		if asset != nil {
+			f.Error.RootCID = asset.root.String()
+		}
+		writeJSON(os.Stderr, f)
+		return &exitError{code: f.Error.ExitCode}
+	}
+
+	r := asset.result
+	jr := jsonResult{
+		RootCID:          r.CID,
+		AssetName:        r.Name,
+		AssetType:        r.Type,
+		CarSize:          r.Size,
+		UploadDurationMs: phaseTime("upload").Milliseconds(),
+		UploadURL:        r.URL,
+		AlreadyExists:    r.AlreadyExists,
+		ServerIDs:        r.ServerIDs,
+	}
+	if q := asset.quota; q != nil {
+		jr.QuotaUsed, jr.QuotaTotal = &q.UsedSize, &q.TotalSize
+	}
+	writeJSON(out, jr)
+	return nil
+}
+
+func writeJSON(w io.Writer, v interface{}) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v) //nolint:errcheck
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// credentials are stored under this service name, one per profile
+const keychainService = "storage-upload-sample"
+
+// apiKeyEnv is the variable with the api key, so it is not on the command
+// line for ps to show
+const apiKeyEnv = "TITAN_API_KEY"
+
+var (
+	errKeychainUnavailable = errors.New("keychain unavailable")
+	errCredentialNotFound  = errors.New("no api key stored")
+)
+
+// keychain is the credential store of the platform
+type keychain interface {
+	name() string
+	get(profile string) (string, error)
+	set(profile, apiKey string) error
+	delete(profile string) error
+}
+
+// readSecret prompts on stderr and reads a line from stdin, without echo
+// when stdin is a terminal
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if restore, err := disableEcho(int(os.Stdin.Fd())); err == nil {
+		defer func() {
+			restore()
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// openKeychain opens the credential store of the platform, the tests swap
+// it for a fake one
+var openKeychain = newKeychain
+
+// resolveAPIKey fills in the api key when no flag gave one, from
+// TITAN_API_KEY, the keychain or the config file in that order
+func (opts *options) resolveAPIKey() {
+	if len(opts.apiKeys) > 0 {
+		opts.apiKeySource = "flag"
+		return
+	}
+
+	if key := os.Getenv(apiKeyEnv); len(key) > 0 {
+		opts.apiKeys = keyList{key}
+		opts.apiKeySource = "env"
+		return
+	}
+
+	key, err := openKeychain().get(opts.credProfile)
+	if err == nil {
+		opts.apiKeys = keyList{key}
+		opts.apiKeySource = "keychain"
+		return
+	}
+
+	if keys := loadedConfig.apiKeys(); len(keys) > 0 {
+		opts.apiKeys = keys
+		opts.apiKeySource = "config"
+		return
+	}
+
+	if errors.Is(err, errKeychainUnavailable) {
+		fmt.Fprintf(os.Stderr, "warning: %s, pass the key with --api-key\n", err.Error())
+	} else if !errors.Is(err, errCredentialNotFound) {
+		fmt.Fprintf(os.Stderr, "warning: read keychain %s\n", err.Error())
+	}
+}
+
+func runAuth(args []string) error {
+	opts := newOptions()
+
+	fs := newFlagSet("auth")
+	fs.Var(&opts.apiKeys, "api-key", "api key, status reports where the key comes from")
+	opts.credentialFlags(fs)
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("please input login, logout or status")
+	}
+
+	kc := openKeychain()
+	switch args[0] {
+	case "login":
+		key, err := readSecret("api key: ")
+		if err != nil {
+			return err
+		}
+
+		if len(key) == 0 {
+			return fmt.Errorf("api-key can not empty")
+		}
+
+		if err := kc.set(opts.credProfile, key); err != nil {
+			return fmt.Errorf("store api key error %w", err)
+		}
+		fmt.Printf("api key of profile %s stored in %s\n", opts.credProfile, kc.name())
+		return nil
+	case "logout":
+		if err := kc.delete(opts.credProfile); err != nil {
+			return fmt.Errorf("remove api key error %w", err)
+		}
+		fmt.Printf("api key of profile %s removed from %s\n", opts.credProfile, kc.name())
+		return nil
+	case "status":
+		opts.resolveAPIKey()
+		switch opts.apiKeySource {
+		case "flag":
+			fmt.Println("api key from --api-key")
+		case "env":
+			fmt.Printf("api key from %s\n", apiKeyEnv)
+		case "config":
+			fmt.Printf("api key from %s\n", loadedConfig.path)
+		case "keychain":
+			fmt.Printf("api key of profile %s from %s\n", opts.credProfile, kc.name())
+		default:
+			fmt.Printf("no api key for profile %s, pass --api-key, set %s, set api_key with config set or run auth login\n", opts.credProfile, apiKeyEnv)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown auth command %s", args[0])
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// macKeychain keeps credentials in the login keychain through security(1)
+type macKeychain struct{}
+
+func newKeychain() keychain {
+	return macKeychain{}
+}
+
+func (macKeychain) name() string {
+	return "macOS Keychain"
+}
+
+func (macKeychain) get(profile string) (string, error) {
+	out, err := security(nil, "find-generic-password", "-s", keychainService, "-a", profile, "-w")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (macKeychain) set(profile, apiKey string) error {
+	// the key goes through stdin in interactive mode so it never shows in ps
+	cmd := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", quoteSecurity(keychainService), quoteSecurity(profile), quoteSecurity(apiKey))
+	_, err := security(strings.NewReader(cmd), "-i")
+	return err
+}
+
+func (macKeychain) delete(profile string) error {
+	_, err := security(nil, "delete-generic-password", "-s", keychainService, "-a", profile)
+	return err
+}
+
+func security(stdin *strings.Reader, args ...string) (string, error) {
+	path, err := exec.LookPath("security")
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errKeychainUnavailable, err.Error())
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// 44 is errSecItemNotFound
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+			return "", errCredentialNotFound
+		}
+		return "", fmt.Errorf("security %s %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func quoteSecurity(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// secretService keeps credentials in the Secret Service through secret-tool(1)
+// from libsecret
+type secretService struct{}
+
+func newKeychain() keychain {
+	return secretService{}
+}
+
+func (secretService) name() string {
+	return "Secret Service"
+}
+
+func (secretService) get(profile string) (string, error) {
+	out, err := secretTool(nil, "lookup", "service", keychainService, "profile", profile)
+	if err != nil {
+		return "", err
+	}
+
+	// lookup prints nothing and exits 1 when there is no such secret
+	if len(out) == 0 {
+		return "", errCredentialNotFound
+	}
+	return out, nil
+}
+
+func (secretService) set(profile, apiKey string) error {
+	_, err := secretTool(strings.NewReader(apiKey), "store", "--label", keychainService+" "+profile,
+		"service", keychainService, "profile", profile)
+	return err
+}
+
+func (secretService) delete(profile string) error {
+	_, err := secretTool(nil, "clear", "service", keychainService, "profile", profile)
+	return err
+}
+
+func secretTool(stdin *strings.Reader, args ...string) (string, error) {
+	path, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errKeychainUnavailable, err.Error())
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(msg) == 0 && args[0] == "lookup" {
+			return "", errCredentialNotFound
+		}
+		// without a session bus or a running secret service there is no keychain
+		return "", fmt.Errorf("%w: secret-tool %s %s", errKeychainUnavailable, args[0], msg)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// noKeychain is used where the platform has no supported credential store
+type noKeychain struct{}
+
+func newKeychain() keychain {
+	return noKeychain{}
+}
+
+func (noKeychain) name() string {
+	return "no keychain"
+}
+
+func (noKeychain) get(profile string) (string, error) {
+	return "", errKeychainUnavailable
+}
+
+func (noKeychain) set(profile, apiKey string) error {
+	return errKeychainUnavailable
+}
+
+func (noKeychain) delete(profile string) error {
+	return errKeychainUnavailable
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/terrors"
+)
+
+var (
+	errInvalidAPIKey = errors.New("api key is not known by any scheduler")
+	errNoUsableKey   = errors.New("no usable api key left")
+)
+
+// dialScheduler connects to the scheduler of an api key, the tests swap it
+// for a fake scheduler
+var dialScheduler = newSchedulerAPI
+
+// keyList is a repeatable string flag
+type keyList []string
+
+func (l *keyList) String() string {
+	return fmt.Sprintf("%d keys", len(*l))
+}
+
+func (l *keyList) Set(s string) error {
+	if len(s) == 0 {
+		return fmt.Errorf("api key can not empty")
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// keyPool holds the api keys of a run, uploads start with the current key
+// and move on when it runs out of quota or is rate limited
+type keyPool struct {
+	mu      sync.Mutex
+	keys    []string
+	current int
+	// keys the locator rejected, skipped for the rest of the run
+	invalid map[int]bool
+}
+
+func newKeyPool(keys []string) *keyPool {
+	for _, key := range keys {
+		addSecret(key)
+	}
+	return &keyPool{keys: keys, invalid: make(map[int]bool)}
+}
+
+// pick returns the first usable key from the current one on that is not in tried
+func (p *keyPool) pick(tried map[int]bool) (int, string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for n := 0; n < len(p.keys); n++ {
+		i := (p.current + n) % len(p.keys)
+		if !p.invalid[i] && !tried[i] {
+			return i, p.keys[i], true
+		}
+	}
+	return 0, "", false
+}
+
+func (p *keyPool) disable(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.invalid[i] = true
+}
+
+// exhausted makes the key after i the current one so later uploads
+// do not start with a key that just ran out
+func (p *keyPool) exhausted(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == i {
+		p.current = (i + 1) % len(p.keys)
+	}
+}
+
+// label names key i without showing it
+func (p *keyPool) label(i int) string {
+	key := p.keys[i]
+	if len(key) > 4 {
+		key = key[len(key)-4:]
+	}
+	return fmt.Sprintf("#%d (...%s)", i+1, key)
+}
+
+// keyExhausted reports whether err means the key ran out of quota or is
+// rate limited, so the next key may still succeed
+func keyExhausted(err error) (string, bool) {
+	var ew *api.ErrWeb
+	if !errors.As(err, &ew) {
+		return "", false
+	}
+
+	switch ew.Code {
+	case terrors.UserStorageSizeNotEnough:
+		return "has not enough storage left", true
+	case terrors.BusyServer:
+		return "is rate limited", true
+	}
+	return "", false
+}
+
+// schedulerBusy reports whether err means the scheduler rate limits the key
+func schedulerBusy(err error) bool {
+	var ew *api.ErrWeb
+	return errors.As(err, &ew) && ew.Code == terrors.BusyServer
+}
+
+// invalidKey reports whether err means the scheduler does not accept the key
+func invalidKey(err error) bool {
+	if errors.Is(err, errInvalidAPIKey) {
+		return true
+	}
+
+	var ew *api.ErrWeb
+	if errors.As(err, &ew) && ew.Code == terrors.UserNotFound {
+		return true
+	}
+	return strings.Contains(err.Error(), "can not get user id")
+}
+
+// schedulerConn is a scheduler connection made with key of the pool
+type schedulerConn struct {
+	key   int
+	api   api.Scheduler
+	close func()
+	// route is the scheduler the rpcs go to
+	route *schedulerRoute
+}
+
+// scheduler is the scheduler that serves the rpcs of c
+func (c *schedulerConn) scheduler() string {
+	if c.route == nil {
+		return ""
+	}
+	return c.route.url()
+}
+
+// connectScheduler connects with the first usable key not in tried, keys
+// the locator does not know are disabled for the rest of the run
+func connectScheduler(opts *options, tried map[int]bool) (*schedulerConn, error) {
+	for {
+		i, key, ok := opts.keys.pick(tried)
+		if !ok {
+			return nil, errNoUsableKey
+		}
+		tried[i] = true
+
+		close, schedulerAPI, route, err := dialScheduler(opts, key)
+		if err != nil && invalidKey(err) {
+			fmt.Printf("warning: api key %s %s, skip it\n", opts.keys.label(i), errText(err))
+			opts.keys.disable(i)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return &schedulerConn{key: i, api: schedulerAPI, close: close, route: route}, nil
+	}
+}
+
+// uploadWithKeys uploads the car through conn, when the scheduler refuses
+// it for quota or rate limit the upload is tried again with the next key
+func uploadWithKeys(opts *options, conn *schedulerConn, tried map[int]bool, carPath, root, name, assetType string) (*uploadResponse, error) {
+	for {
+		result, err := uploadFile(opts, conn.api, carPath, root, name, assetType)
+		if err == nil {
+			if len(opts.keys.keys) > 1 {
+				fmt.Printf("asset %s uploaded with api key %s\n", root, opts.keys.label(conn.key))
+			}
+			return result, nil
+		}
+
+		if invalidKey(err) {
+			fmt.Printf("warning: api key %s %s, skip it\n", opts.keys.label(conn.key), errText(err))
+			opts.keys.disable(conn.key)
+		} else if reason, ok := keyExhausted(err); ok {
+			fmt.Printf("api key %s %s\n", opts.keys.label(conn.key), reason)
+			opts.keys.exhausted(conn.key)
+		} else {
+			return nil, err
+		}
+
+		recordRetry("key", conn.key+1, "api key "+opts.keys.label(conn.key), failureClass(err), 0, false)
+		next, cerr := connectScheduler(opts, tried)
+		if cerr != nil {
+			return nil, fmt.Errorf("%w, %s", err, cerr.Error())
+		}
+
+		conn.close()
+		*conn = *next
+		fmt.Printf("try again with api key %s\n", opts.keys.label(conn.key))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	levelInfo = iota
+	// steps of the upload
+	levelVerbose
+	// requests, responses and other details
+	levelDebug
+)
+
+// logLevel is set from -v on the command line
+var logLevel = levelInfo
+
+// logRelativeTime prefixes log lines with the time since the start of the
+// run instead of the time of day, it is set from --log-relative-time
+var logRelativeTime bool
+
+var logStart = time.Now()
+
+// logTimestamp is RFC3339 with milliseconds, so steps that take less than
+// a second can be told apart
+const logTimestamp = "2006-01-02T15:04:05.000Z07:00"
+
+// verbosity is a flag.Value that raises the log level every time it is given
+type verbosity int
+
+func (v *verbosity) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosity) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on {
+		*v++
+	} else {
+		*v = levelInfo
+	}
+	return nil
+}
+
+func (v *verbosity) IsBoolFlag() bool {
+	return true
+}
+
+// debugVerbosity is a flag.Value for -vv, the log level of -v given twice
+type debugVerbosity int
+
+func (v *debugVerbosity) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *debugVerbosity) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on {
+		*v = levelDebug
+	} else {
+		*v = levelInfo
+	}
+	return nil
+}
+
+func (v *debugVerbosity) IsBoolFlag() bool {
+	return true
+}
+
+// logVerbose prints to stderr when -v is given
+func logVerbose(format string, args ...interface{}) {
+	if logLevel >= levelVerbose {
+		logLine(format, args...)
+	}
+}
+
+// logDebug prints to stderr when -v is given twice
+func logDebug(format string, args ...interface{}) {
+	if logLevel >= levelDebug {
+		logLine(format, args...)
+	}
+}
+
+// logLine prints a timestamped log line, log lines go to stderr so they
+// never mix with the json or quiet output on stdout
+func logLine(format string, args ...interface{}) {
+	now := time.Now()
+	stamp := now.Format(logTimestamp)
+	if logRelativeTime {
+		stamp = fmt.Sprintf("+%.3fs", now.Sub(logStart).Seconds())
+	}
+	fmt.Fprintln(os.Stderr, stamp, redact(fmt.Sprintf(format, args...)))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,223 +13,899 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"time"
 
 	"github.com/Filecoin-Titan/titan/api"
 	"github.com/Filecoin-Titan/titan/api/client"
 	"github.com/Filecoin-Titan/titan/api/types"
-	cliutil "github.com/Filecoin-Titan/titan/cli/util"
 	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/ipfs/go-cid"
+
+	"storage-upload-sample/titanupload"
+)
+
+// the scheduler is asked this often whether an upload was registered
+const (
+	postcheckAttempts = 6
+	postcheckInterval = 5 * time.Second
 )
 
+// command is a subcommand, run gets the arguments after its name
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"upload":         {"upload [flags] <path>, - reads stdin, an http or https url fetches it", runUpload},
+		"prepare":        {"prepare [flags] <path> --bundle <dir>", runPrepare},
+		"submit":         {"submit [flags] <dir>", runSubmit},
+		"retry":          {"retry [flags]", runRetry},
+		"queue":          {"queue [flags] list|clear", runQueue},
+		"auth":           {"auth [flags] login|logout|status", runAuth},
+		"list":           {"list [flags]", runList},
+		"delete":         {"delete [flags] <cid>... | delete --yes <filters>", runDelete},
+		"download":       {"download [flags] <cid>", runDownload},
+		"share":          {"share [flags] <cid>... | share list|revoke", runShare},
+		"describe":       {"describe [flags] <cid> <description>", runDescribe},
+		"set-visibility": {"set-visibility [flags] <cid> private|public", runSetVisibility},
+		"bench":          {"bench [flags]", runBench},
+		"doctor":         {"doctor [flags]", runDoctor},
+		"gc":             {"gc [flags]", runGC},
+		"meta":           {"meta [flags] <cid> [dir]", runMeta},
+		"exists":         {"exists [flags] <cid>...", runExists},
+		"prune-orphans":  {"prune-orphans [flags]", runPruneOrphans},
+		"import":         {"import [flags] <cid>", runImport},
+		"du":             {"du [flags] <dir>", runDu},
+		"cid":            {"cid [flags] <path>...", runCid},
+		"config":         {"config [flags] set <key> <value> | unset <key> | show", runConfig},
+		"renew":          {"renew [flags] --extend <duration> <cid>... | renew --until <time> <filters>", runRenew},
+	}
+}
+
 func main() {
+	// upload is the default so the command line without a subcommand still works
+	name, args := "upload", os.Args[1:]
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			name, args = args[0], args[1:]
+		}
+	}
+
+	if err := commands[name].run(args); err != nil {
+		// an interrupted run ends once its cleanup is done
+		if interruptContext().Err() != nil {
+			select {}
+		}
+
+		var ee *exitError
+		if !errors.As(err, &ee) || ee.err != nil {
+			fmt.Println(describeError(err))
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// newFlagSet returns the flag set of a subcommand
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", path.Base(os.Args[0]), commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runUpload(args []string) error {
+	opts := newOptions()
+
 	// 定义命令行参数
-	locatorURL := flag.String("locator-url", "https://localhost:5000/rpc/v0", "locator url")
-	apiKey := flag.String("api-key", "", "api key")
+	fs := newFlagSet("upload")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	opts.packFlags(fs)
+	opts.incrementalFlags(fs)
+	opts.uploadFlags(fs)
+	opts.queueFlags(fs)
+	opts.batchFlags(fs)
+	fs.BoolVar(&opts.jsonResult, "json", false, "print only the outcome as one json object, on stdout when the upload succeeds and on stderr when it fails, everything else goes to stderr")
 
 	// 解析命令行参数
-	flag.Parse()
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
 
-	if len(*locatorURL) == 0 {
-		fmt.Println("locator-url can not empty")
-		return
+	if !opts.jsonResult {
+		_, err := uploadInputs(opts, args)
+		return err
 	}
 
-	if len(*apiKey) == 0 {
-		fmt.Println("api-key can not empty")
-		return
+	// stdout is only for the result
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = out }()
+
+	asset, err := uploadInputs(opts, args)
+	return printJSONResult(out, asset, err)
+}
+
+// uploadInputs uploads the inputs of upload, the asset is the one of a
+// single input once it is packed
+func uploadInputs(opts *options, args []string) (*packedAsset, error) {
+	if err := opts.requireAPIKey(); err != nil {
+		return nil, err
+	}
+
+	if err := opts.checkUploadFlags(); err != nil {
+		return nil, err
 	}
 
 	// 获取其他非命令行参数
-	args := flag.Args()
 	if len(args) == 0 {
-		fmt.Println("please input file path")
-		return
+		return nil, fmt.Errorf("please input file path")
 	}
 
-	if err := execUpload(*apiKey, *locatorURL, args[0]); err != nil {
-		fmt.Println("upload file error ", err.Error())
-		return
+	inputs, err := expandInputs(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkStreamInputs(inputs); err != nil {
+		return nil, err
+	}
+
+	if opts.wrap {
+		if err := opts.checkWrap(inputs); err != nil {
+			return nil, err
+		}
+	} else if len(inputs) > 1 {
+		if err := opts.checkBatch(); err != nil {
+			return nil, err
+		}
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	start := time.Now()
+	if len(inputs) > 1 && !opts.wrap {
+		err := uploadBatch(opts, inputs)
+		n := notification{title: "upload done", body: fmt.Sprintf("%d inputs uploaded", len(inputs))}
+		if err != nil {
+			n = notification{title: "upload failed", body: errText(err), failed: true}
+		}
+		notifyDone(opts, start, n)
+		return nil, err
 	}
 
+	asset, err := execUpload(opts, inputs[0])
+	name, root := path.Base(inputs[0]), ""
+	if asset != nil {
+		name, root = asset.name, asset.root.String()
+	}
+	notifyDone(opts, start, uploadNotification(name, root, err))
+	ev := hookEvent{cid: root, name: name, duration: time.Since(start), err: err}
+	if asset != nil && asset.result != nil {
+		ev.result, ev.size = asset.result, asset.result.Size
+	}
+	herr := runHook(opts, ev)
+	if err != nil {
+		if isStreamInput(inputs[0]) {
+			fmt.Printf("failed upload of %s not kept for retry, a stream is read once, upload it again\n", inputs[0])
+		} else if qerr := recordFailure(opts, inputs[0], err); qerr != nil {
+			fmt.Printf("record failed upload error %s\n", errText(qerr))
+		} else {
+			fmt.Printf("failed upload kept in %s, run retry to upload it again\n", opts.queue)
+		}
+		if opts.jsonResult {
+			return asset, err
+		}
+		return asset, fmt.Errorf("upload file error %w", err)
+	}
+	return asset, herr
 }
 
-func execUpload(apiKey, locatorURL, filePath string) error {
-	close, schedulerAPI, err := newSchedulerAPI(locatorURL, apiKey)
+// execUpload packs and uploads filePath, the packed asset is returned once
+// packing succeeded even when the upload fails
+func execUpload(opts *options, filePath string) (*packedAsset, error) {
+	tried := make(map[int]bool)
+	conn, err := connectScheduler(opts, tried)
 	if err != nil {
-		return err
+		return nil, &stageError{"connect", err}
+	}
+	defer func() { conn.close() }()
+
+	if opts.splitSize > 0 {
+		if split, err := needsSplit(filePath, opts.splitSize); err != nil {
+			return nil, &stageError{"pack", err}
+		} else if split {
+			return uploadSplit(opts, conn, tried, filePath)
+		}
+	}
+
+	// the car of an earlier --resume run is sent again instead of packing
+	st, err := pendingUpload(opts, conn.api, filePath)
+	if err != nil {
+		return nil, &stageError{"pack", err}
+	}
+
+	var asset *packedAsset
+	if st != nil {
+		asset, err = st.asset()
+	} else {
+		asset, err = packInput(opts, filePath, "")
+		if err == nil && opts.resume && opts.resumable() {
+			st, err = newUploadState(filePath, asset)
+		}
+	}
+	if err != nil {
+		return nil, &stageError{"pack", err}
+	}
+	if len(opts.incremental) == 0 {
+		// the car goes when the upload failed too, unless --resume kept it
+		defer removeTempCar(asset.carPath)
+		defer removeOnInterrupt(asset.carPath)()
+	}
+	opts.pendingState = st
+	return asset, uploadPacked(opts, conn, tried, filePath, asset)
+}
+
+// removeOnInterrupt removes the car at carPath when the process is
+// interrupted, unless --resume kept it for the next run
+func removeOnInterrupt(carPath string) func() {
+	return onInterrupt(func() { removeTempCar(carPath) })
+}
+
+// removeTempCar removes the car at carPath unless --resume kept it for the
+// next run
+func removeTempCar(carPath string) {
+	if _, err := os.Stat(resumeStatePath(carPath)); err != nil {
+		os.Remove(carPath)
+	}
+}
+
+// tempCarPattern names the temp cars, each run packs into a car of its own
+// so runs side by side never write to the same one. The prefix is the one
+// of the other temp files of the cli, so gc finds a car a crash left
+const tempCarPattern = "storage-upload-sample-*.car"
+
+// carOutput is the car to pack into, a new temp car when output is empty.
+// An output that is given is emptied first. The returned function removes
+// the car after a pack that failed
+func carOutput(output string) (string, func(), error) {
+	if len(output) > 0 {
+		if _, err := os.Stat(output); err == nil {
+			os.Remove(output)
+		}
+		return output, func() {}, nil
+	}
+
+	// the name is new, so it is never an input that is in the temp
+	// directory too
+	f, err := os.CreateTemp("", tempCarPattern)
+	if err != nil {
+		return "", nil, err
+	}
+	f.Close()
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+// uploadPacked uploads the car of asset packed from filePath and removes
+// it, unless it is the car of an incremental pack
+func uploadPacked(opts *options, conn *schedulerConn, tried map[int]bool, filePath string, asset *packedAsset) error {
+	result, err := uploadWithKeys(opts, conn, tried, asset.carPath, asset.root.String(), asset.name, asset.assetType)
+	exists := opts.existsOK(err)
+	if err != nil && !exists {
+		return &stageError{"upload", err}
+	}
+	if exists {
+		fmt.Printf("asset %s already exists, nothing uploaded\n", asset.root.String())
+	} else {
+		recordUpload(opts, conn, asset.root.String(), asset.name, asset.assetType, filePath)
+	}
+	if err := storeManifest(asset.root.String(), asset.manifest); err != nil {
+		fmt.Printf("warning: manifest not kept, meta can not show the metadata of %s, %s\n", asset.root.String(), err.Error())
+	}
+	if err := storeChecksums(asset.root.String(), asset.manifest); err != nil {
+		fmt.Printf("warning: checksums of %s not kept, %s\n", asset.root.String(), err.Error())
+	}
+	if opts.verify {
+		if err := verifyUpload(opts, asset); err != nil {
+			fmt.Printf("verify of %s failed, its car is kept in %s\n", asset.root.String(), keepUnverified(opts, asset))
+			return &stageError{"verify", err}
+		}
+		fmt.Printf("verified %s, the candidates serve what was uploaded\n", asset.root.String())
+	}
+	asset.result = newUploadResult(opts, conn, asset.root.String(), asset.name, asset.assetType, result, asset.manifest)
+	asset.result.AlreadyExists = exists
+	if info, err := os.Stat(asset.carPath); err == nil {
+		asset.result.Size = info.Size()
+	}
+	asset.result.print(opts)
+
+	if !opts.batch {
+		asset.quota = printQuota(opts, conn)
+		logPhaseTimes()
+	}
+
+	if len(opts.incremental) > 0 {
+		return nil
+	}
+	return os.Remove(asset.carPath)
+}
+
+// packedAsset is an input packed into a car ready for upload
+type packedAsset struct {
+	carPath string
+	root    cid.Cid
+	name    string
+	// file or folder
+	assetType string
+	// bytes read from a non regular input, 0 for files and folders
+	inputSize int64
+	// window is the part of the file that was packed, nil for all of it
+	window   *fileWindow
+	manifest *manifest
+	// result is the summary once the car is uploaded
+	result *uploadResult
+	// quota is the storage of the api key after the upload, nil when the
+	// scheduler did not tell
+	quota *types.UserInfo
+}
+
+// dirs are the directories of the asset with metadata, nil without any
+func (a *packedAsset) dirs() map[string]manifestDir {
+	if a.manifest == nil {
+		return nil
+	}
+	return a.manifest.Dirs
+}
+
+// packInput packs filePath into the car at output, a temp file when
+// output is empty or the incremental car when --incremental is set
+func packInput(opts *options, filePath string, output string) (*packedAsset, error) {
+	defer timePhase("pack")()
+
+	if len(opts.wrapped) > 0 {
+		return packWrapped(opts, output)
+	} else if isStreamInput(filePath) {
+		return packStream(opts, filePath, output)
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
 	}
-	defer close()
 
 	fileType := "file"
-	if fileInfo, err := os.Stat(filePath); err != nil {
-		return err
-	} else if fileInfo.IsDir() {
+	packOpts := packOptions{Workers: opts.hashWorkers(), Symlinks: opts.symlinks, MaxOpenFiles: opts.maxOpenFiles, ExcludeMetaFiles: opts.excludeMetaFiles, NoChecksums: opts.noChecksums, EmbedChecksums: opts.embedChecksums, Hash: opts.hash, Chunker: opts.chunker, NoRawLeaves: !opts.rawLeaves, Filter: opts.filter, Discard: opts.cidOnly}
+	if opts.embedChecksums && (opts.noChecksums || !fileInfo.IsDir()) {
+		return nil, fmt.Errorf("embed-checksums adds the listing to a folder, it needs a folder input and checksums")
+	}
+	if fileInfo.IsDir() {
 		fileType = "folder"
+	} else if !fileInfo.Mode().IsRegular() {
+		// devices and pipes report no useful size, find it from the input itself
+		size, err := inputSize(filePath, opts.size)
+		if err != nil {
+			return nil, err
+		}
+		packOpts.Size = size
+		fmt.Printf("%s is not a regular file, read %s from it\n", filePath, formatSize(size))
 	}
 
-	tempFile := path.Join(os.TempDir(), path.Base(filePath))
-	if _, err := os.Stat(tempFile); err == nil {
-		os.Remove(tempFile)
+	window, err := opts.window(filePath, fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	packOpts.Range = window
+
+	assetName := path.Base(filePath)
+	if window != nil {
+		assetName = window.name(assetName)
+		fmt.Printf("pack %s of %s from offset %d\n", formatSize(window.Length), filePath, window.Offset)
+	}
+	if len(opts.name) > 0 {
+		assetName = opts.name
 	}
 
-	root, err := createCar(filePath, tempFile)
+	var result *packResult
+	if opts.cidOnly {
+		// cid only packs into no car
+		result, err = createCar(filePath, "", packOpts)
+	} else if len(opts.incremental) > 0 {
+		// the car is kept for the next run instead of the temp file
+		output, result, err = createIncrementalCar(opts.incremental, filePath, packOpts)
+	} else {
+		var removeCar func()
+		if output, removeCar, err = carOutput(output); err != nil {
+			return nil, err
+		}
+		defer removeOnInterrupt(output)()
+		if result, err = createCar(filePath, output, packOpts); err != nil {
+			removeCar()
+		}
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := uploadFile(schedulerAPI, tempFile, root, path.Base(filePath), fileType); err != nil {
-		return err
+	printPackStats(result.Stats, len(opts.incremental) > 0)
+
+	return &packedAsset{carPath: output, root: result.Root, name: assetName, assetType: fileType, inputSize: packOpts.Size, window: window, manifest: result.Manifest}, nil
+}
+
+func printPackStats(stats packStats, incremental bool) {
+	if stats.HardLinks > 0 {
+		fmt.Printf("hard links: %d of %d files reused, %s not read again\n", stats.HardLinks, stats.Files, formatSize(stats.HardLinkBytes))
 	}
 
-	if err := os.Remove(tempFile); err != nil {
-		return err
+	if stats.Excluded > 0 {
+		fmt.Printf("excluded: %d entries left out, %d files packed\n", stats.Excluded, stats.Files)
+	}
+
+	if stats.HoleBytes > 0 {
+		fmt.Printf("sparse files: %s of holes not read\n", formatSize(stats.HoleBytes))
+	}
+
+	if incremental {
+		fmt.Printf("incremental: %d blocks reused from the previous car, %d new\n", stats.ReusedBlocks, stats.Blocks-stats.ReusedBlocks)
+	}
+}
+
+// existsOK is whether err is an asset the scheduler already has that counts
+// as an upload that succeeded without sending the car
+func (opts *options) existsOK(err error) bool {
+	return !opts.failIfExists && errors.Is(err, errAlreadyExists)
+}
+
+// recreateAsset deletes the user record of an asset that already exists
+// for --force and creates it again. DeleteUserAsset only drops the record
+// of the user, so while the scheduler keeps the asset the answer is still
+// already exists and nothing is sent; the car is only uploaded when the
+// scheduler no longer had it
+func recreateAsset(schedulerAPI api.Scheduler, assetProperty *types.AssetProperty) (*types.CreateAssetRsp, error) {
+	if err := schedulerAPI.DeleteUserAsset(interruptContext(), assetProperty.AssetCID); err != nil {
+		return nil, fmt.Errorf("DeleteUserAsset error %w", err)
+	}
+
+	rsp, err := schedulerAPI.CreateUserAsset(interruptContext(), assetProperty)
+	if err != nil {
+		return nil, fmt.Errorf("CreateUserAsset error %w", err)
 	}
-	return nil
+	logVerbose("CreateUserAsset %s again, already exists %t, %d upload urls", assetProperty.AssetCID, rsp.AlreadyExists, len(splitUploadURLs(rsp.UploadURL)))
+	if rsp.AlreadyExists {
+		fmt.Printf("asset record %s registered again, the scheduler still has the asset so the car is not sent\n", assetProperty.AssetCID)
+	}
+	return rsp, nil
 }
 
-func uploadFile(schedulerAPI api.Scheduler, carFilePath, carCID, fileName, fileType string) error {
+// errAlreadyExists is the error of an upload of a cid the scheduler already
+// has an asset of, the one of the titanupload package so callers of either
+// branch on the same error
+var errAlreadyExists = titanupload.ErrAlreadyExists
+
+func uploadFile(opts *options, schedulerAPI api.Scheduler, carFilePath, carCID, fileName, fileType string) (*uploadResponse, error) {
 	f, err := os.Open(carFilePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
 	fileInfo, err := f.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	assetProperty := &types.AssetProperty{AssetCID: carCID, AssetName: fileName, AssetSize: fileInfo.Size(), AssetType: fileType}
 
-	rsp, err := schedulerAPI.CreateUserAsset(context.Background(), assetProperty)
+	endCreate := timePhase("create asset")
+	var rsp *types.CreateAssetRsp
+	if st := opts.pendingState; st != nil && st.Car == carFilePath && st.Root == carCID {
+		rsp, err = resumeAsset(schedulerAPI, st, assetProperty)
+	} else {
+		rsp, err = schedulerAPI.CreateUserAsset(interruptContext(), assetProperty)
+	}
+	endCreate()
 	if err != nil {
-		fmt.Printf("CreateUserAsset error %#v\n", err)
-		return fmt.Errorf("CreateUserAsset error %w", err)
+		logVerbose("CreateUserAsset %s error %s", carCID, errText(err))
+		return nil, fmt.Errorf("CreateUserAsset error %w", err)
 	}
+	logVerbose("CreateUserAsset %s, already exists %t, %d upload urls", carCID, rsp.AlreadyExists, len(splitUploadURLs(rsp.UploadURL)))
+
+	if rsp.AlreadyExists && opts.force {
+		if rsp, err = recreateAsset(schedulerAPI, assetProperty); err != nil {
+			return nil, err
+		}
+	}
+
+	addSecret(rsp.Token)
+	printUploadInfo(opts, rsp.UploadURL, rsp.Token)
 
 	if rsp.AlreadyExists {
-		return fmt.Errorf("asset %s already exist", carCID)
+		return nil, fmt.Errorf("asset %s %w", carCID, errAlreadyExists)
+	}
+
+	// a record without an upload would refuse the next upload of the cid as
+	// already existing, so it is deleted when the upload does not happen,
+	// unless --resume keeps it for the next run
+	uploaded := false
+	stopRollback := onInterrupt(func() { keepOrRollback(opts, schedulerAPI, carFilePath, carCID, rsp, "interrupted") })
+	defer func() {
+		stopRollback()
+		if !uploaded {
+			keepOrRollback(opts, schedulerAPI, carFilePath, carCID, rsp, "upload failed")
+		}
+	}()
+
+	endpoints := splitUploadURLs(rsp.UploadURL)
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("scheduler returned no upload url for %s", carCID)
+	}
+
+	if err := opts.checkUploadURLs(endpoints); err != nil {
+		return nil, err
+	}
+	client := opts.endpointClient()
+
+	if len(endpoints) > 1 && !opts.noProbe {
+		probes := probeEndpoints(context.Background(), client, endpoints)
+		endpoints = endpoints[:0]
+		for _, probe := range probes {
+			if probe.err != nil {
+				logDebug("probe %s error %s", probe.url, probe.err.Error())
+			} else {
+				logDebug("probe %s rtt %s, tls %s", probe.url, probe.rtt, probe.tlsSetup)
+			}
+			endpoints = append(endpoints, probe.url)
+		}
+		if probes[0].err == nil {
+			logVerbose("upload to %s, rtt %s", probes[0].url, probes[0].rtt)
+		}
+	}
+
+	if !opts.noPreflight {
+		if endpoints, err = preflightEndpoints(client, endpoints, rsp.Token); err != nil {
+			return nil, err
+		}
+	}
+
+	// the other endpoints are fallbacks when an upload fails
+	var (
+		stalls int
+		result *uploadResponse
+	)
+	endUpload := timePhase("upload")
+	for i, endpoint := range endpoints {
+		logVerbose("upload %s to %s", carCID, endpoint)
+		result, err = uploadWithBackoff(opts, carFilePath, endpoint, rsp.Token)
+		if err == nil {
+			break
+		}
+
+		var se *stallError
+		if errors.As(err, &se) {
+			stalls++
+		}
+		if i < len(endpoints)-1 {
+			logVerbose("upload to %s error %s, try %s", endpoint, err.Error(), endpoints[i+1])
+			recordRetry("fallback", i+1, endpointHost(endpoint), retryClass(err), 0, false)
+		}
+	}
+	endUpload()
+	if stalls > 0 {
+		fmt.Printf("%d of the upload attempts stalled\n", stalls)
 	}
 
-	err = uploadFileWithForm(carFilePath, rsp.UploadURL, rsp.Token)
 	if err != nil {
-		// fmt.Println("uploadFileWithForm error ", err.Error())
-		return fmt.Errorf("uploadFileWithForm error %w", err)
+		return nil, fmt.Errorf("uploadFileWithForm error %w", err)
+	}
+	uploaded = true
+	if st := opts.pendingState; st != nil && st.Car == carFilePath {
+		os.Remove(resumeStatePath(carFilePath))
+	}
+
+	if opts.noPostcheck {
+		return result, nil
+	}
+
+	// the candidate can accept the file and still fail to tell the scheduler
+	endPostcheck := timePhase("postcheck")
+	asset, err := waitForAsset(context.Background(), schedulerAPI, carCID, postcheckAttempts, postcheckInterval)
+	endPostcheck()
+	var se *assetStateError
+	if err == errAssetNotFound {
+		return nil, fmt.Errorf("upload of %s accepted but not registered by the scheduler, please upload it again", carCID)
+	} else if errors.As(err, &se) && se.pending {
+		return nil, fmt.Errorf("upload of %s accepted but the scheduler still waits for it in %s, please upload it again", carCID, se.state)
+	} else if errors.As(err, &se) {
+		return nil, fmt.Errorf("upload of %s accepted but the scheduler marked it %s, please upload it again", carCID, se.state)
+	} else if err != nil {
+		return nil, fmt.Errorf("check upload %w", err)
 	}
 
-	return nil
+	logVerbose("asset %s registered, state %s", carCID, asset.AssetRecord.State)
+	return result, nil
 }
 
-func newSchedulerAPI(locatorURL, apiKey string) (func(), api.Scheduler, error) {
-	udpPacketConn, err := net.ListenPacket("udp", ":0")
+// rollbackAsset deletes the record CreateUserAsset made for an upload that
+// did not happen, a failure is only reported
+func rollbackAsset(opts *options, schedulerAPI api.Scheduler, carCID, reason string) {
+	if opts.noRollback {
+		fmt.Printf("asset record %s kept after %s, --no-rollback is set\n", carCID, reason)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := schedulerAPI.DeleteUserAsset(ctx, carCID); err != nil {
+		fmt.Printf("warning: asset record %s not rolled back after %s, %s\n", carCID, reason, describeError(err))
+		return
+	}
+	fmt.Printf("asset record %s rolled back after %s\n", carCID, reason)
+}
+
+// newLocatorAPI connects to the locator over http3, the returned client
+// reaches the schedulers the locator names
+func newLocatorAPI(opts *options) (func(), api.Locator, *http.Client, error) {
+	udpPacketConn, err := net.ListenPacket(opts.net.network("udp"), ":0")
 	if err != nil {
-		return nil, nil, fmt.Errorf("ListenPacket %w", err)
+		return nil, nil, nil, fmt.Errorf("ListenPacket %w", err)
 	}
+	logDebug("listen on %s", udpPacketConn.LocalAddr().String())
 
 	// use http3 client
-	httpClient, err := cliutil.NewHTTP3Client(udpPacketConn, true, "")
+	httpClient := newHTTP3Client(udpPacketConn, opts.net)
+
+	locatorAPI, locatorClose, err := client.NewLocator(context.TODO(), opts.locatorURL, nil, jsonrpc.WithHTTPClient(httpClient))
 	if err != nil {
-		return nil, nil, fmt.Errorf("NewHTTP3Client %w", err)
+		udpPacketConn.Close()
+		return nil, nil, nil, fmt.Errorf("NewLocator %w", err)
+	}
+
+	close := func() {
+		locatorClose()
+		udpPacketConn.Close()
 	}
+	return close, locatorAPI, httpClient, nil
+}
 
-	locatorAPI, _, err := client.NewLocator(context.TODO(), locatorURL, nil, jsonrpc.WithHTTPClient(httpClient))
+// newSchedulerAPI connects to the scheduler the locator assigns to apiKey,
+// the rpcs fail over to another scheduler of the key when it is down
+func newSchedulerAPI(opts *options, apiKey string) (func(), api.Scheduler, *schedulerRoute, error) {
+	endLocator := timePhase("locator")
+	locatorClose, locatorAPI, httpClient, err := newLocatorAPI(opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("NewLocator %w", err)
+		endLocator()
+		return nil, nil, nil, err
 	}
 
-	schedulerURL, err := locatorAPI.GetSchedulerWithAPIKey(context.Background(), apiKey)
+	schedulerURL, err := lookupScheduler(locatorAPI, apiKey)
+	endLocator()
 	if err != nil {
-		return nil, nil, fmt.Errorf("GetSchedulerWithAPIKey %w", err)
+		locatorClose()
+		return nil, nil, nil, err
 	}
+	logVerbose("locator %s assigned scheduler %s", opts.locatorURL, schedulerURL)
 
+	// the scheduler can not exchange the api key for a session token, only
+	// AuthNew makes tokens and it is admin only, so every rpc carries the
+	// key. It goes to the scheduler only, upload endpoints get the upload token
 	headers := http.Header{}
 	headers.Add("Authorization", "Bearer "+apiKey)
 
-	schedulerAPI, apiClose, err := client.NewScheduler(context.TODO(), schedulerURL, headers, jsonrpc.WithHTTPClient(httpClient))
+	endConnect := timePhase("connect")
+	route := newSchedulerRoute(locatorAPI, apiKey, schedulerURL)
+	rpcClient := &http.Client{Transport: &failoverTransport{base: httpClient.Transport, route: route}}
+	schedulerAPI, apiClose, err := client.NewScheduler(context.TODO(), schedulerURL, headers, jsonrpc.WithHTTPClient(rpcClient))
+	endConnect()
 	if err != nil {
-		return nil, nil, fmt.Errorf("NewScheduler %w", err)
+		locatorClose()
+		return nil, nil, nil, fmt.Errorf("NewScheduler %w", err)
 	}
 
 	close := func() {
 		apiClose()
-		udpPacketConn.Close()
+		locatorClose()
+	}
+	return close, schedulerAPI, route, nil
+}
+
+// uploadWithBackoff uploads to uploadURL and tries it again when it is
+// refused with 429 or 503, after the wait its Retry-After asks for or with
+// exponential backoff when it has none
+func uploadWithBackoff(opts *options, filePath, uploadURL, token string) (*uploadResponse, error) {
+	// one progress for all attempts, the summary adds up what they sent
+	progress := newUploadProgress(opts.progress, 0)
+	for attempt := 1; ; attempt++ {
+		// every attempt opens the car again, the body of the one before is
+		// drained
+		result, err := uploadFileWithForm(opts, progress, filePath, uploadURL, token)
+
+		reason, ok := transientUpload(err)
+		if !ok || attempt > opts.retries {
+			return result, err
+		}
+
+		delay, hasHeader := backoffDelay(attempt, opts.retryMaxWait), false
+		var rl *retryLaterError
+		if errors.As(err, &rl) && rl.hasHeader {
+			delay, hasHeader = rl.after, true
+			logVerbose("upload to %s %s, honor retry-after %s", uploadURL, rl.status, delay)
+		}
+		fmt.Printf("upload attempt %d of %d to %s failed, %s, retry in %s\n", attempt, opts.retries+1, endpointHost(uploadURL), reason, formatDuration(delay))
+		recordRetry("upload", attempt, endpointHost(uploadURL), retryClass(err), delay, hasHeader)
+		time.Sleep(delay)
 	}
-	return close, schedulerAPI, nil
 }
 
-func uploadFileWithForm(filePath, uploadURL, token string) error {
+// uploadFileWithForm is one attempt of an upload, it starts an attempt of
+// progress
+func uploadFileWithForm(opts *options, progress *uploadProgress, filePath, uploadURL, token string) (*uploadResponse, error) {
 	// Open the file you want to upload
 	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Create a new multipart form body
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Create a new form field for the file
-	fileField, err := writer.CreateFormFile("file", stat.Name())
-	if err != nil {
-		return err
+	// a put sends the car as it is, a post sends it in a multipart form
+	method := "POST"
+	var (
+		body        io.Reader = file
+		contentType           = "application/vnd.ipld.car"
+		totalSize             = stat.Size()
+	)
+	if opts.uploadStyle == "put" {
+		method = "PUT"
+	} else {
+		// Create a new multipart form body
+		body, contentType, totalSize, err = newMultipartBody(file, stat, opts.maxMemory.bufferBody(stat.Size()))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Copy the file data to the form field
-	_, err = io.Copy(fileField, file)
-	if err != nil {
-		return err
+	// an attempt sends the whole car again, from its start
+	progress.startAttempt(0, totalSize)
+	ctx := interruptContext()
+	var reader io.Reader = &pausingReader{body}
+	var watch *stallWatch
+	if opts.stallTimeout > 0 {
+		ctx, watch = newStallWatch(ctx, reader, opts.stallTimeout)
+		defer watch.done()
+		reader = watch
 	}
-
-	// Close the multipart form
-	err = writer.Close()
-	if err != nil {
-		return err
+	var answer *answerWatch
+	if opts.answerTimeout > 0 {
+		ctx, answer = newAnswerWatch(ctx, reader, opts.answerTimeout)
+		defer answer.stop()
+		reader = answer
 	}
 
-	// bar := progressbar.Default(stat.Size())
-	totalSize := body.Len()
-	dongSize := int64(0)
-	pr := &ProgressReader{body, func(r int64) {
+	pr := &ProgressReader{reader, func(r int64) {
 		if r > 0 {
-			dongSize += r
-			fmt.Printf("progress %d/%d\n", dongSize, totalSize)
+			progress.add(r)
 		} else {
-			fmt.Println("upload complete")
+			progress.done()
 		}
 	}}
 
 	// Create a new HTTP request with the form data
-	request, err := http.NewRequest("POST", uploadURL, pr)
+	request, err := http.NewRequestWithContext(ctx, method, uploadURL, pr)
 	if err != nil {
-		return fmt.Errorf("new request error %s", err.Error())
+		return nil, fmt.Errorf("new request error %s", err.Error())
 	}
 
-	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.ContentLength = totalSize
+	request.Header.Set("Content-Type", contentType)
 	request.Header.Set("Authorization", "Bearer "+token)
 
 	// Create an HTTP client and send the request
-	client := http.DefaultClient
+	client := opts.endpointClient()
 	response, err := client.Do(request)
 	if err != nil {
-		return fmt.Errorf("do error %s", err.Error())
+		if watch != nil {
+			if serr := watch.err(uploadURL); serr != nil {
+				fmt.Printf("warning: %s\n", errText(serr))
+				return nil, serr
+			}
+		}
+		if answer != nil {
+			if aerr := answer.err(uploadURL); aerr != nil {
+				return nil, aerr
+			}
+		}
+		return nil, fmt.Errorf("do error %w", err)
 	}
 	defer response.Body.Close()
 
-	// Check the response status
-	fmt.Println("Response status:", response.Status)
+	logVerbose("response status %s", response.Status)
 
 	b, err := ioutil.ReadAll(response.Body)
+	if answer != nil {
+		if aerr := answer.err(uploadURL); aerr != nil {
+			return nil, aerr
+		}
+		answer.stop()
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Println("Response body:", string(b))
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		delay, ok := retryAfterDelay(response, opts.net.maxRetryAfter)
+		return nil, &retryLaterError{status: response.Status, after: delay, hasHeader: ok}
+	}
 
-	return nil
+	// the raw body is only shown with -v, a body that is not the json
+	// envelope leaves the http status to decide
+	result, err := parseUploadResponse(b)
+	if err != nil {
+		logVerbose("response body is not json, %s: %s", err.Error(), redact(string(b)))
+	} else {
+		logVerbose("response body %s", redact(string(b)))
+		if result.failed() {
+			return nil, &uploadRejectedError{host: request.URL.Host, code: result.errorCode(), msg: redact(result.Msg)}
+		}
+	}
+
+	// an error status counts whatever the body, a proxy in front of the
+	// candidate answers without the envelope
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		se := &uploadStatusError{host: request.URL.Host, status: response.Status, code: response.StatusCode}
+		if result != nil {
+			se.msg = redact(result.Msg)
+		}
+		return nil, se
+	}
+	progress.confirm(totalSize)
+	fmt.Println(progress.summary())
+
+	return result, nil
+}
+
+// newMultipartBody returns the form body for file with its content type and
+// length. With inMemory the whole body is built in a buffer, otherwise the
+// file is streamed between the form header and trailer.
+func newMultipartBody(file *os.File, stat os.FileInfo, inMemory bool) (io.Reader, string, int64, error) {
+	header := &bytes.Buffer{}
+	writer := multipart.NewWriter(header)
+
+	// Create a new form field for the file
+	if _, err := writer.CreateFormFile("file", stat.Name()); err != nil {
+		return nil, "", 0, err
+	}
+	headerLen := header.Len()
+
+	// Close the multipart form, this writes the trailer after the header
+	if err := writer.Close(); err != nil {
+		return nil, "", 0, err
+	}
+	trailer := append([]byte(nil), header.Bytes()[headerLen:]...)
+	header.Truncate(headerLen)
+
+	length := int64(header.Len()) + stat.Size() + int64(len(trailer))
+	if !inMemory {
+		return io.MultiReader(header, file, bytes.NewReader(trailer)), writer.FormDataContentType(), length, nil
+	}
+
+	// Copy the file data to the form field
+	header.Grow(int(length) - header.Len())
+	if _, err := io.Copy(header, file); err != nil {
+		return nil, "", 0, err
+	}
+	header.Write(trailer)
+	return header, writer.FormDataContentType(), length, nil
 }
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestUploadExisting(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   []string
+		code    int
+		uploads int
+		deletes int
+		out     string
+	}{
+		{"default", nil, 0, 1, 0, "already exists, nothing uploaded"},
+		{"fail if exists", []string{"--fail-if-exists"}, 1, 1, 0, ""},
+		{"force", []string{"--force"}, 0, 1, 1, "registered again, the scheduler still has the asset"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			input := writeFile(t, "site.txt", "hello world\n")
+
+			if _, err := captureStdout(t, func() error { return runUpload(uploadArgs("--no-postcheck", input)) }); err != nil {
+				t.Fatalf("first upload: %v", err)
+			}
+			if len(s.records) != 1 {
+				t.Fatalf("first upload left %d records", len(s.records))
+			}
+
+			out, err := captureStdout(t, func() error { return runUpload(uploadArgs(append(tt.flags, "--no-postcheck", input)...)) })
+			if code := exitCode(err); err != nil && code != tt.code || err == nil && tt.code != 0 {
+				t.Fatalf("exit code %d, want %d, error %v", code, tt.code, err)
+			}
+			if tt.code != 0 && !errors.Is(err, errAlreadyExists) {
+				t.Errorf("error %v, want already exists", err)
+			}
+			if tt.code == 0 && !strings.Contains(out, "url: https://candidate.example.com/ipfs/") {
+				t.Errorf("no retrieval url in\n%s", out)
+			}
+			if !strings.Contains(out, tt.out) {
+				t.Errorf("no %q in\n%s", tt.out, out)
+			}
+
+			if s.uploads != tt.uploads {
+				t.Errorf("%d uploads, want %d", s.uploads, tt.uploads)
+			}
+			if n := s.count("DeleteUserAsset"); n != tt.deletes {
+				t.Errorf("%d DeleteUserAsset, want %d", n, tt.deletes)
+			}
+			if cars := tempCars(t, tmp); len(cars) > 0 {
+				t.Errorf("temp cars left: %v", cars)
+			}
+		})
+	}
+}
+
+func TestUploadRetrySummary(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) //nolint:errcheck
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"code":0}`)
+	}))
+	defer server.Close()
+
+	opts := testOptions(t)
+	opts.retries = 2
+	car := writeFile(t, "site.car", strings.Repeat("car", 1000))
+	out, err := captureStdout(t, func() error {
+		_, err := uploadWithBackoff(opts, car, server.URL+"/upload", "token")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("%d attempts, want 2", attempts)
+	}
+	// the first attempt sent the whole form for nothing
+	if !strings.Contains(out, "2 attempts sent") || !strings.Contains(out, "of them retried") {
+		t.Errorf("no retry overhead in the summary\n%s", out)
+	}
+}
+
+func TestUploadSameBaseName(t *testing.T) {
+	tmp := testHome(t)
+	s := newFakeScheduler(t)
+	useScheduler(t, s)
+
+	// two inputs named data of several chunks each, packed at the same time
+	var inputs []string
+	for i, b := range [][]byte{testData(2 << 20), bytes.Repeat([]byte("data"), 1<<19)} {
+		dir := filepath.Join(t.TempDir(), fmt.Sprint(i))
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		input := filepath.Join(dir, "data")
+		if err := os.WriteFile(input, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, input)
+	}
+	roots := []string{packCID(t, inputs[0]), packCID(t, inputs[1])}
+
+	// the flags are parsed one run after the other, they set globals of
+	// the process that two processes each have their own of
+	runs := make([]*options, len(inputs))
+	for i := range inputs {
+		runs[i] = newOptions()
+		fs := newFlagSet("upload")
+		runs[i].commonFlags(fs)
+		runs[i].connectFlags(fs)
+		runs[i].packFlags(fs)
+		runs[i].incrementalFlags(fs)
+		runs[i].uploadFlags(fs)
+		runs[i].queueFlags(fs)
+		runs[i].batchFlags(fs)
+		if _, err := parseFlags(fs, uploadArgs("--no-postcheck")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make([]error, len(inputs))
+	out, _ := captureStdout(t, func() error {
+		var wg sync.WaitGroup
+		for i, input := range inputs {
+			wg.Add(1)
+			go func(i int, input string) {
+				defer wg.Done()
+				_, errs[i] = uploadInputs(runs[i], []string{input})
+			}(i, input)
+		}
+		wg.Wait()
+		return nil
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("upload of %s: %v\n%s", inputs[i], err, out)
+		}
+	}
+
+	for _, root := range roots {
+		b, ok := s.cars[root]
+		if !ok {
+			t.Fatalf("no car of %s uploaded", root)
+		}
+		// a car another pack wrote into at the same time has blocks of the
+		// other input
+		if err := checkCarStream(bytes.NewReader(b), cid.MustParse(root)); err != nil {
+			t.Errorf("car of %s: %v", root, err)
+		}
+	}
+	if cars := tempCars(t, tmp); len(cars) > 0 {
+		t.Errorf("temp cars left: %v", cars)
+	}
+}
+
+func TestUploadRollback(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		// exists keeps a record of the asset, createErr and status fail the
+		// create and the upload
+		exists    bool
+		createErr error
+		status    int
+		// deletes are the DeleteUserAsset calls, only after a create whose
+		// upload failed
+		deletes int
+		out     string
+	}{
+		{name: "uploaded", out: "upload complete"},
+		{name: "create failed", createErr: errors.New("database is locked")},
+		{name: "already exists", exists: true, out: "already exists, nothing uploaded"},
+		{name: "upload refused", status: http.StatusRequestEntityTooLarge, deletes: 1, out: "rolled back after upload failed"},
+		{name: "upload failed", status: http.StatusBadGateway, deletes: 1, out: "rolled back after upload failed"},
+		{name: "no rollback", flags: []string{"--no-rollback"}, status: http.StatusBadGateway, out: "kept after upload failed, --no-rollback is set"},
+		{name: "resume", flags: []string{"--resume"}, status: http.StatusBadGateway, out: "run the same upload again to resume it"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			input := writeFile(t, "site.txt", "hello world\n")
+			root := packCID(t, input)
+			if tt.exists {
+				s.add(root, "Servicing")
+			}
+			s.createErr, s.uploadStatus = tt.createErr, tt.status
+
+			out, err := captureStdout(t, func() error { return runUpload(uploadArgs(append(tt.flags, "--no-postcheck", input)...)) })
+			if failed := tt.createErr != nil || tt.status != 0; failed != (err != nil) {
+				t.Fatalf("error %v\n%s", err, out)
+			}
+			if !strings.Contains(out, tt.out) {
+				t.Errorf("no %q in\n%s", tt.out, out)
+			}
+			if n := s.count("DeleteUserAsset"); n != tt.deletes {
+				t.Errorf("%d DeleteUserAsset, want %d", n, tt.deletes)
+			}
+			if s.users[root] == (tt.deletes > 0 || tt.createErr != nil) {
+				t.Errorf("the user has the asset: %t", s.users[root])
+			}
+		})
+	}
+}
+
+func TestUploadErrorStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		flags  []string
+		status int
+		body   string
+		// err is what main prints, $host the host of the endpoint
+		err  string
+		exit int
+		// kept is whether the temp car is left for the next run
+		kept bool
+	}{
+		{name: "401", status: http.StatusUnauthorized, err: "the endpoint refused the upload token (code 401), upload again for a new token", exit: exitRetryable},
+		{name: "403", status: http.StatusForbidden, err: "the endpoint refused the upload token (code 403), upload again for a new token", exit: exitRetryable},
+		{name: "409", status: http.StatusConflict, err: "the car does not hold the cid it was registered with (code 409), pack the input again and upload it", exit: 1},
+		{name: "413", status: http.StatusRequestEntityTooLarge, err: "the car is larger than the endpoint takes (code 413), split the input into smaller uploads", exit: 1},
+		{name: "507", status: http.StatusInsufficientStorage, err: "the endpoint has no room for the car, or the quota is used up (code 507), delete assets or raise the quota, then retry", exit: 1},
+		{name: "502", status: http.StatusBadGateway, err: "upload file error uploadFileWithForm error upload to $host answered 502 Bad Gateway", exit: 1},
+		// the envelope of the candidate tells more than the status
+		{name: "403 envelope", status: http.StatusForbidden, body: `{"code":-1,"msg":"token is expire"}`, err: "the upload token expired, upload again for a new token", exit: exitRetryable},
+		{name: "200 envelope", body: `{"code":-1,"msg":"out of max size"}`, err: "the asset is larger than the candidate takes, split the input into smaller uploads", exit: 1},
+		{name: "envelope not failed", status: http.StatusTeapot, body: `{"code":0,"msg":"short and stout"}`, err: "upload file error uploadFileWithForm error upload to $host answered 418 I'm a teapot, short and stout", exit: 1},
+		{name: "resume", flags: []string{"--resume"}, status: http.StatusBadGateway, err: "upload file error uploadFileWithForm error upload to $host answered 502 Bad Gateway", exit: 1, kept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			s.uploadStatus, s.uploadAnswer = tt.status, tt.body
+			input := writeFile(t, "site.txt", "hello world\n")
+
+			var err error
+			stderr, _ := captureStderr(t, func() error {
+				_, err = captureStdout(t, func() error { return runUpload(uploadArgs(append(tt.flags, "--no-postcheck", input)...)) })
+				return nil
+			})
+			if err == nil {
+				t.Fatal("the upload did not fail")
+			}
+			want := strings.ReplaceAll(tt.err, "$host", strings.TrimPrefix(s.server.URL, "http://"))
+			if got := describeError(err); got != want {
+				t.Errorf("error %q, want %q", got, want)
+			}
+			if code := exitCode(err); code != tt.exit {
+				t.Errorf("exit code %d, want %d", code, tt.exit)
+			}
+			if cars := tempCars(t, tmp); (len(cars) > 0) != tt.kept {
+				t.Errorf("temp cars %v, kept %t", cars, tt.kept)
+			}
+			// the answer is only printed with -v
+			if len(tt.body) > 0 && strings.Contains(stderr, tt.body) {
+				t.Errorf("the answer is printed without -v:\n%s", stderr)
+			}
+		})
+	}
+}
+
+func TestUploadErrorVerbose(t *testing.T) {
+	testHome(t)
+	s := newFakeScheduler(t)
+	useScheduler(t, s)
+	s.uploadStatus, s.uploadAnswer = http.StatusForbidden, `{"code":-1,"msg":"token is expire"}`
+	input := writeFile(t, "site.txt", "hello world\n")
+
+	stderr, _ := captureStderr(t, func() error {
+		_, err := captureStdout(t, func() error { return runUpload(uploadArgs("-v", "--no-postcheck", input)) })
+		return err
+	})
+	for _, want := range []string{"response status 403 Forbidden", `response body {"code":-1,"msg":"token is expire"}`} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("no %q in\n%s", want, stderr)
+		}
+	}
+}
+
+func TestUploadStyles(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+	}{
+		{"put", []string{"--upload-style", "put"}},
+		{"multipart", nil},
+		// a car larger than a quarter of the budget is streamed in the form
+		{"multipart streamed", []string{"--max-memory", "1KiB"}},
+	}
+
+	// every style sends the same car
+	var car []byte
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			input := writeFile(t, "site.txt", strings.Repeat("hello world\n", 400))
+			root := packCID(t, input)
+
+			if out, err := captureStdout(t, func() error { return runUpload(uploadArgs(append(tt.flags, "--no-postcheck", input)...)) }); err != nil {
+				t.Fatalf("upload: %v\n%s", err, out)
+			}
+			if len(s.requests) != 1 {
+				t.Fatalf("%d uploads", len(s.requests))
+			}
+			r := s.requests[0]
+			if err := checkCarStream(bytes.NewReader(s.cars[root]), cid.MustParse(root)); err != nil {
+				t.Fatal(err)
+			}
+			if car == nil {
+				car = s.cars[root]
+			} else if !bytes.Equal(s.cars[root], car) {
+				t.Error("the car is not the car of the other styles")
+			}
+
+			method, contentType, body := http.MethodPut, "application/vnd.ipld.car", car
+			if tt.flags == nil || tt.flags[0] != "--upload-style" {
+				// the boundary is random, the name is the one of the temp car
+				_, params, _ := mime.ParseMediaType(r.header.Get("Content-Type"))
+				boundary := params["boundary"]
+				part, err := multipart.NewReader(bytes.NewReader(r.body), boundary).NextPart()
+				if err != nil {
+					t.Fatal(err)
+				}
+				method, contentType = http.MethodPost, "multipart/form-data; boundary="+boundary
+				body = []byte(fmt.Sprintf("--%s\r\nContent-Disposition: form-data; name=\"file\"; filename=%q\r\nContent-Type: application/octet-stream\r\n\r\n%s\r\n--%s--\r\n", boundary, part.FileName(), car, boundary))
+			}
+
+			want := http.Header{
+				"Accept-Encoding": {"gzip"},
+				"Authorization":   {"Bearer upload-token-" + root},
+				"Content-Length":  {strconv.Itoa(len(body))},
+				"Content-Type":    {contentType},
+				"User-Agent":      {"Go-http-client/1.1"},
+			}
+			if r.method != method || r.length != int64(len(body)) || !reflect.DeepEqual(r.header, want) {
+				t.Errorf("%s of %d bytes with %v, want %s with %v", r.method, r.length, r.header, method, want)
+			}
+			if !bytes.Equal(r.body, body) {
+				t.Errorf("body\n%q\nwant\n%q", r.body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const manifestVersion = 1
+
+// manifest records the files of a pack and the dag built for each of them
+type manifest struct {
+	Version int
+	Root    string
+	// files keyed by their slash separated path relative to the input,
+	// the input itself is "." when it is a single file
+	Files map[string]manifestFile
+	// Dirs are the directories with a metadata file, keyed like Files
+	Dirs map[string]manifestDir `json:",omitempty"`
+}
+
+type manifestFile struct {
+	CID string
+	// DagSize is the size of the dag as used in the parent directory entry
+	DagSize  uint64
+	FileSize int64
+	ModTime  time.Time
+	// Type is the mime type, from the extension or sniffed from the content
+	Type string `json:",omitempty"`
+	// SHA256 is the hex sha256 of the content, empty with --no-checksums
+	SHA256 string `json:",omitempty"`
+}
+
+// single is the file of a manifest with only one
+func (m *manifest) single() (manifestFile, bool) {
+	if len(m.Files) != 1 {
+		return manifestFile{}, false
+	}
+	for _, f := range m.Files {
+		return f, true
+	}
+	return manifestFile{}, false
+}
+
+func newManifest() *manifest {
+	return &manifest{Version: manifestVersion, Files: make(map[string]manifestFile)}
+}
+
+func readManifest(filePath string) (*manifest, error) {
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", filePath, err)
+	}
+
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("manifest %s has version %d, want %d", filePath, m.Version, manifestVersion)
+	}
+	return m, nil
+}
+
+// write saves the manifest through a temp file so a crash never leaves
+// half of it behind
+func (m *manifest) write(filePath string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile := filePath + ".tmp"
+	if err := os.WriteFile(tempFile, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, filePath)
+}
+
+// relPath returns the manifest key of filePath below root
+func relPath(root, filePath string) string {
+	rel, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return filePath
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen is as much of a file as http.DetectContentType looks at
+const sniffLen = 512
+
+// typeByExtension is the mime type of name from its extension, empty when
+// the extension is unknown
+func typeByExtension(name string) string {
+	ext := path.Ext(name)
+	if len(ext) == 0 {
+		return ""
+	}
+	return mime.TypeByExtension(strings.ToLower(ext))
+}
+
+// sniffReader keeps the first bytes read through it so the type of a file
+// without a known extension is found from the read that feeds the chunker
+type sniffReader struct {
+	io.Reader
+	head []byte
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if rest := sniffLen - len(s.head); rest > 0 {
+		if rest > n {
+			rest = n
+		}
+		s.head = append(s.head, p[:rest]...)
+	}
+	return n, err
+}
+
+// contentType is the sniffed type, application/octet-stream when nothing
+// more is known
+func (s *sniffReader) contentType() string {
+	return http.DetectContentType(s.head)
+}
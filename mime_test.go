@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mediaType is the type of a mime type without its parameters, the system
+// tables of some platforms leave out the charset
+func mediaType(t string) string {
+	mt, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return t
+	}
+	return mt
+}
+
+func TestFileTypes(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), testData(600)...)
+	gif := append([]byte("GIF89a"), testData(600)...)
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		// the extension is known
+		{"index.html", []byte("<p>not sniffed</p>"), "text/html"},
+		{"style.css", []byte("body { color: red }"), "text/css"},
+		{"photo.png", png, "image/png"},
+		{"report.pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"data.json", []byte(`{"a":1}`), "application/json"},
+		// the extension wins over the content
+		{"logo.png", []byte("plain text, not an image"), "image/png"},
+		// no extension or an unknown one, the first bytes tell
+		{"README", []byte("hello world\n"), "text/plain"},
+		{"image", png, "image/png"},
+		{"anim.xyz", gif, "image/gif"},
+		{"page", []byte("<!DOCTYPE html><html></html>"), "text/html"},
+		{"blob", testData(2 << 20), "application/octet-stream"},
+		{"empty", nil, "text/plain"},
+	}
+
+	testHome(t)
+	dir := filepath.Join(t.TempDir(), "site")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(dir, tt.name), tt.content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := createCar(dir, filepath.Join(t.TempDir(), "site.car"), packOptions{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := mediaType(result.Manifest.Files[tt.name].Type); got != tt.want {
+			t.Errorf("%s has type %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSniffReader(t *testing.T) {
+	// the head is kept across reads of any size, the bytes pass unchanged
+	data := append([]byte("GIF89a"), testData(4000)...)
+	for _, size := range []int{1, 7, 511, 512, 513, 4096} {
+		s := &sniffReader{Reader: bytes.NewReader(data)}
+		var out []byte
+		buf := make([]byte, size)
+		for {
+			n, err := s.Read(buf)
+			out = append(out, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		if !bytes.Equal(out, data) || !bytes.Equal(s.head, data[:sniffLen]) || s.contentType() != "image/gif" {
+			t.Errorf("reads of %d bytes kept %d bytes of head, type %s", size, len(s.head), s.contentType())
+		}
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	testHome(t)
+	s := newFakeScheduler(t)
+	useScheduler(t, s)
+	// an extensionless binary is sniffed from the read that packs it
+	input := filepath.Join(t.TempDir(), "firmware")
+	if err := os.WriteFile(input, append([]byte("\x89PNG\r\n\x1a\n"), testData(1<<20)...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := captureStdout(t, func() error { return runUpload(uploadArgs("--progress", "json", "--no-postcheck", input)) })
+	if err != nil {
+		t.Fatalf("upload: %v\n%s", err, out)
+	}
+	var result struct {
+		Phase       string `json:"phase"`
+		ContentType string `json:"content_type"`
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, `{"phase":"result"`) {
+			if err := json.Unmarshal([]byte(line), &result); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if result.Phase != "result" {
+		t.Fatalf("no result line in\n%s", out)
+	}
+	if result.ContentType != "image/png" {
+		t.Errorf("content type %q, want image/png", result.ContentType)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// notification is a desktop notification of a finished upload
+type notification struct {
+	title  string
+	body   string
+	failed bool
+}
+
+// shortCID is c cut down for the few characters a notification shows
+func shortCID(c string) string {
+	if len(c) <= 20 {
+		return c
+	}
+	return c[:10] + "…" + c[len(c)-6:]
+}
+
+// notifyDone fires a desktop notification with --notify when the upload
+// that started at start ran longer than --notify-after. Without a way to
+// notify, as on a server with no desktop session, nothing happens
+func notifyDone(opts *options, start time.Time, n notification) {
+	if !opts.notify {
+		return
+	}
+	if d := time.Since(start); d < opts.notifyAfter {
+		logDebug("upload took %s, less than notify-after %s, no notification", formatDuration(d), formatDuration(opts.notifyAfter))
+		return
+	}
+
+	if err := sendNotification(n); err != nil {
+		logDebug("no notification, %s", err.Error())
+	}
+}
+
+// uploadNotification is the notification of the upload of name, err is
+// nil when it succeeded
+func uploadNotification(name, root string, err error) notification {
+	if err != nil {
+		return notification{title: "upload failed", body: fmt.Sprintf("%s: %s", name, errText(err)), failed: true}
+	}
+	return notification{title: "upload done", body: fmt.Sprintf("%s uploaded, %s", name, shortCID(root))}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// appleScriptString quotes s for a string literal of applescript
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// sendNotification notifies through the notification center with
+// osascript(1), a failure plays the Basso sound
+func sendNotification(n notification) error {
+	bin, err := exec.LookPath("osascript")
+	if err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf("display notification %s with title %s", appleScriptString(n.body), appleScriptString("storage-upload-sample"))
+	script += " subtitle " + appleScriptString(n.title)
+	if n.failed {
+		script += ` sound name "Basso"`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return exec.CommandContext(ctx, bin, "-e", script).Run()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// sendNotification notifies through notify-send(1), it needs a desktop
+// session to show the notification in
+func sendNotification(n notification) error {
+	if len(os.Getenv("DISPLAY")) == 0 && len(os.Getenv("WAYLAND_DISPLAY")) == 0 && len(os.Getenv("DBUS_SESSION_BUS_ADDRESS")) == 0 {
+		return fmt.Errorf("no desktop session")
+	}
+
+	bin, err := exec.LookPath("notify-send")
+	if err != nil {
+		return err
+	}
+
+	urgency := "normal"
+	if n.failed {
+		urgency = "critical"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return exec.CommandContext(ctx, bin, "-a", "storage-upload-sample", "-u", urgency, n.title, n.body).Run()
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "fmt"
+
+// sendNotification has no way to notify on this platform
+func sendNotification(n notification) error {
+	return fmt.Errorf("desktop notifications are not supported on this platform")
+}
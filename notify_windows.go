@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// toastScript shows a toast with the title and body from the environment,
+// so nothing of them is parsed as powershell
+const toastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode($env:NOTIFY_TITLE)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode($env:NOTIFY_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('storage-upload-sample').Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+
+// sendNotification shows a toast through powershell, the title tells a
+// failure apart
+func sendNotification(n notification) error {
+	bin, err := exec.LookPath("powershell.exe")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(), "NOTIFY_TITLE="+n.title, "NOTIFY_BODY="+n.body)
+	return cmd.Run()
+}
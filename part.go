@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+const partVersion = 1
+
+// partState is the sidecar of a .part file, it tells how much of the
+// .part file is downloaded so a later run can resume from there
+type partState struct {
+	Version int    `json:"version"`
+	CID     string `json:"cid"`
+	Format  string `json:"format,omitempty"`
+	Size    int64  `json:"size"`
+	// Confirmed bytes from the start of the .part file are downloaded
+	Confirmed int64 `json:"confirmed"`
+	// Sum is the sha256 of the confirmed bytes
+	Sum string `json:"sum"`
+	// Source is tried first on resume
+	Source string `json:"source,omitempty"`
+}
+
+// partFile is a download in progress, ranges finish out of order so only
+// the prefix without holes counts as confirmed
+type partFile struct {
+	path     string
+	metaPath string
+	f        *os.File
+
+	mu    sync.Mutex
+	state partState
+	hash  hash.Hash
+	// done holds the end of finished ranges past the confirmed prefix by their start
+	done map[int64]int64
+}
+
+// openPart opens <output>.part, a .part file that does not match its
+// sidecar or the requested cid is discarded and the download starts over
+func openPart(output string, c cid.Cid, format string) (*partFile, error) {
+	p := &partFile{path: output + ".part", metaPath: output + ".part.json", hash: sha256.New(), done: make(map[int64]int64)}
+
+	f, err := os.OpenFile(p.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p.f = f
+
+	reason, err := p.load(c, format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if len(reason) > 0 {
+		fmt.Printf("discard %s, %s\n", p.path, reason)
+	}
+
+	if len(reason) > 0 || p.state.Confirmed == 0 {
+		p.state = partState{Version: partVersion, CID: c.String(), Format: format}
+		if err := p.reset(0, ""); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return p, nil
+	}
+
+	fmt.Printf("resume %s from %s of %s\n", p.path, formatSize(p.state.Confirmed), formatSize(p.state.Size))
+	return p, nil
+}
+
+// load reads the sidecar and checks it against the .part file, a non
+// empty reason tells why the .part file can not be resumed
+func (p *partFile) load(c cid.Cid, format string) (string, error) {
+	stat, err := p.f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := os.ReadFile(p.metaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if stat.Size() > 0 {
+			return "it has no " + p.metaPath, nil
+		}
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	st := partState{}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Sprintf("parse %s %s", p.metaPath, err.Error()), nil
+	}
+
+	switch {
+	case st.Version != partVersion:
+		return fmt.Sprintf("%s has version %d, want %d", p.metaPath, st.Version, partVersion), nil
+	case st.CID != c.String():
+		return fmt.Sprintf("it is a download of %s", st.CID), nil
+	case st.Format != format:
+		return fmt.Sprintf("it is a download in format %q", st.Format), nil
+	case st.Confirmed < 0 || st.Confirmed > st.Size || stat.Size() < st.Confirmed:
+		return fmt.Sprintf("it has %d bytes, %s confirms %d of %d", stat.Size(), p.metaPath, st.Confirmed, st.Size), nil
+	}
+
+	// the confirmed bytes must still be the ones downloaded
+	if _, err := io.Copy(p.hash, io.NewSectionReader(p.f, 0, st.Confirmed)); err != nil {
+		return "", err
+	}
+
+	if hex.EncodeToString(p.hash.Sum(nil)) != st.Sum {
+		return fmt.Sprintf("its first %d bytes do not match %s", st.Confirmed, p.metaPath), nil
+	}
+
+	p.state = st
+	return "", nil
+}
+
+// reset empties the .part file for a download of size bytes from source
+func (p *partFile) reset(size int64, source string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.f.Truncate(0); err != nil {
+		return err
+	}
+
+	p.hash.Reset()
+	p.done = make(map[int64]int64)
+	p.state.Size = size
+	p.state.Confirmed = 0
+	p.state.Source = source
+	return p.save()
+}
+
+// confirm records a finished range, the sidecar is written when the
+// confirmed prefix grows
+func (p *partFile) confirm(r byteRange) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done[r.start] = r.end
+
+	from := p.state.Confirmed
+	for {
+		end, ok := p.done[p.state.Confirmed]
+		if !ok {
+			break
+		}
+		delete(p.done, p.state.Confirmed)
+		p.state.Confirmed = end
+	}
+
+	if p.state.Confirmed == from {
+		return nil
+	}
+
+	if _, err := io.Copy(p.hash, io.NewSectionReader(p.f, from, p.state.Confirmed-from)); err != nil {
+		return err
+	}
+	return p.save()
+}
+
+// save writes the sidecar through a temp file, p.mu is held
+func (p *partFile) save() error {
+	p.state.Sum = hex.EncodeToString(p.hash.Sum(nil))
+
+	b, err := json.Marshal(&p.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.metaPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.metaPath)
+}
+
+func (p *partFile) close() error {
+	return p.f.Close()
+}
+
+// incomplete moves a .part file that failed verification to
+// <output>.incomplete so it is neither resumed nor taken for the output
+func (p *partFile) incomplete(output string) (string, error) {
+	p.f.Close()
+
+	incomplete := output + ".incomplete"
+	if err := os.Rename(p.path, incomplete); err != nil {
+		return "", err
+	}
+	return incomplete, os.Remove(p.metaPath)
+}
+
+// finish moves the verified .part file to output
+func (p *partFile) finish(output string) error {
+	if err := p.f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(p.path, output); err != nil {
+		return err
+	}
+	return os.Remove(p.metaPath)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// pauseGate holds transfers while they are paused, the connections stay
+// open as long as the other side keeps them
+type pauseGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	since  time.Time
+	// time paused before the current pause
+	total time.Duration
+}
+
+// transfers is paused and resumed by signals, see handlePauseSignals
+var transfers = newPauseGate()
+
+func newPauseGate() *pauseGate {
+	g := &pauseGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// wait blocks while transfers are paused
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.cond.Wait()
+	}
+}
+
+// pause is false when transfers were paused already
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused, g.since = true, time.Now()
+	return true
+}
+
+// resume returns how long the pause was, false when nothing was paused
+func (g *pauseGate) resume() (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return 0, false
+	}
+	d := time.Since(g.since)
+	g.paused, g.total = false, g.total+d
+	g.cond.Broadcast()
+	return d, true
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// pausedFor is the time spent paused so far, the current pause included
+func (g *pauseGate) pausedFor() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return g.total + time.Since(g.since)
+	}
+	return g.total
+}
+
+// pausingReader stops reading while transfers are paused, so nothing is
+// sent or received
+type pausingReader struct {
+	r io.Reader
+}
+
+func (p *pausingReader) Read(b []byte) (int, error) {
+	transfers.wait()
+	return p.r.Read(b)
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals pauses transfers on SIGUSR1 and resumes them on SIGUSR2
+func handlePauseSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range ch {
+			if sig == syscall.SIGUSR1 {
+				if transfers.pause() {
+					fmt.Printf("paused, send SIGUSR2 to pid %d to resume\n", os.Getpid())
+				}
+			} else if d, ok := transfers.resume(); ok {
+				fmt.Printf("resumed after %s\n", formatDuration(d))
+			}
+		}
+	}()
+}
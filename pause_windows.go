@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// handlePauseSignals does nothing, windows has no SIGUSR1 and SIGUSR2
+func handlePauseSignals() {}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// phaseTimes adds up the time spent in each phase of the run, the debug
+// line at the end of a phase and the summary in verbose mode both come
+// from it so they agree
+var phaseTimes = struct {
+	mu sync.Mutex
+	// order is the order the phases first ended in
+	order []string
+	total map[string]time.Duration
+	count map[string]int
+}{total: make(map[string]time.Duration), count: make(map[string]int)}
+
+// timePhase starts the phase name, the returned function ends it. The
+// phases of a batch overlap, each one is timed on its own
+func timePhase(name string) func() {
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+
+		phaseTimes.mu.Lock()
+		if _, ok := phaseTimes.total[name]; !ok {
+			phaseTimes.order = append(phaseTimes.order, name)
+		}
+		phaseTimes.total[name] += d
+		phaseTimes.count[name]++
+		phaseTimes.mu.Unlock()
+
+		logDebug("%s took %s", name, formatDuration(d))
+	}
+}
+
+// phaseTime is the time spent in the phase name so far
+func phaseTime(name string) time.Duration {
+	phaseTimes.mu.Lock()
+	defer phaseTimes.mu.Unlock()
+	return phaseTimes.total[name]
+}
+
+// logPhaseTimes prints the time of every phase in verbose mode, a phase
+// done several times shows its total and how often it ran
+func logPhaseTimes() {
+	phaseTimes.mu.Lock()
+	defer phaseTimes.mu.Unlock()
+
+	if len(phaseTimes.order) == 0 {
+		return
+	}
+
+	parts := make([]string, 0, len(phaseTimes.order))
+	for _, name := range phaseTimes.order {
+		s := fmt.Sprintf("%s %s", name, formatDuration(phaseTimes.total[name]))
+		if n := phaseTimes.count[name]; n > 1 {
+			s += fmt.Sprintf(" (%d times)", n)
+		}
+		parts = append(parts, s)
+	}
+	logVerbose("time per phase: %s", strings.Join(parts, ", "))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// blockStore is where the pipeline puts the blocks, the car being written
+// or discardBlocks
+type blockStore interface {
+	Put(context.Context, blocks.Block) error
+	Get(context.Context, cid.Cid) (blocks.Block, error)
+}
+
+// blocks buffered for every pending node before its builder has to wait
+// for the writer
+const segmentBlocks = 16
+
+// buildFunc builds a node of the dag with ls and returns its link and size
+type buildFunc func(ls *ipld.LinkSystem) (ipld.Link, uint64, error)
+
+// pendingNode is a node of the dag that is built in the background,
+// its blocks are sent to seg and done is closed once link is known
+type pendingNode struct {
+	seg  chan blocks.Block
+	done chan struct{}
+	link ipld.Link
+	size uint64
+	err  error
+}
+
+func (n *pendingNode) wait() (ipld.Link, uint64, error) {
+	<-n.done
+	return n.link, n.size, n.err
+}
+
+type buildJob struct {
+	node  *pendingNode
+	build buildFunc
+	// held is closed once the node is done, built or not
+	held io.Closer
+}
+
+// blockPipeline hashes nodes in worker goroutines while a single writer
+// goroutine puts their blocks to the car. Every node reserves its place
+// in the write order when it is created, so the car is byte for byte
+// the same as the one written by a sequential walk.
+type blockPipeline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	bs     blockStore
+
+	// segments of blocks in the order they must be written
+	segments chan chan blocks.Block
+	jobs     chan buildJob
+
+	workers    sync.WaitGroup
+	writerDone chan struct{}
+
+	errOnce sync.Once
+	err     error
+	// blocks put by the writer
+	blocks int64
+	// format is the hash and the leaves the blocks are made with
+	format dagFormat
+}
+
+func newBlockPipeline(ctx context.Context, bs blockStore, workers int, format dagFormat) *blockPipeline {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	bp := &blockPipeline{
+		ctx:        ctx,
+		cancel:     cancel,
+		bs:         bs,
+		segments:   make(chan chan blocks.Block, 64*workers),
+		jobs:       make(chan buildJob, workers),
+		writerDone: make(chan struct{}),
+		format:     format,
+	}
+
+	go bp.writer()
+	for i := 0; i < workers; i++ {
+		bp.workers.Add(1)
+		go func() {
+			defer bp.workers.Done()
+			for job := range bp.jobs {
+				bp.run(job.node, job.build)
+				if job.held != nil {
+					job.held.Close()
+				}
+			}
+		}()
+	}
+	return bp
+}
+
+func (bp *blockPipeline) fail(err error) {
+	bp.errOnce.Do(func() {
+		bp.err = err
+		bp.cancel()
+	})
+}
+
+func (bp *blockPipeline) writer() {
+	defer close(bp.writerDone)
+	for seg := range bp.segments {
+		for blk := range seg {
+			if bp.ctx.Err() != nil {
+				// keep draining so no builder is left waiting
+				continue
+			}
+			if err := bp.bs.Put(bp.ctx, blk); err != nil {
+				bp.fail(err)
+			}
+			bp.blocks++
+		}
+	}
+}
+
+// reserve creates a node and queues its segment for the writer
+func (bp *blockPipeline) reserve() *pendingNode {
+	n := &pendingNode{seg: make(chan blocks.Block, segmentBlocks), done: make(chan struct{})}
+	select {
+	case bp.segments <- n.seg:
+	case <-bp.ctx.Done():
+		n.finish(nil, 0, bp.ctx.Err())
+	}
+	return n
+}
+
+func (n *pendingNode) finish(link ipld.Link, size uint64, err error) {
+	close(n.seg)
+	n.link, n.size, n.err = link, size, err
+	close(n.done)
+}
+
+// run builds n with a link system that sends its blocks to the segment of n
+func (bp *blockPipeline) run(n *pendingNode, build buildFunc) {
+	if err := bp.ctx.Err(); err != nil {
+		n.finish(nil, 0, err)
+		return
+	}
+
+	ls := cidlink.DefaultLinkSystem()
+	ls.TrustedStorage = true
+	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("not a cidlink")
+		}
+		blk, err := bp.bs.Get(bp.ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewBuffer(blk.RawData()), nil
+	}
+	ls.StorageWriteOpener = func(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		buf := bytes.NewBuffer(nil)
+		return buf, func(l ipld.Link) error {
+			cl, ok := l.(cidlink.Link)
+			if !ok {
+				return fmt.Errorf("not a cidlink")
+			}
+			blk, err := blocks.NewBlockWithCid(buf.Bytes(), bp.format.relabel(cl.Cid))
+			if err != nil {
+				return err
+			}
+			select {
+			case n.seg <- blk:
+				return nil
+			case <-bp.ctx.Done():
+				return bp.ctx.Err()
+			}
+		}, nil
+	}
+
+	bp.format.formatLinkSystem(&ls)
+
+	link, size, err := build(&ls)
+	if err != nil {
+		bp.fail(err)
+	}
+	n.finish(bp.format.relabelLink(link), size, err)
+}
+
+// submit builds a node in the worker pool
+func (bp *blockPipeline) submit(build buildFunc) *pendingNode {
+	return bp.submitHolding(nil, build)
+}
+
+// submitHolding builds a node in the worker pool that holds held, like the
+// file it reads, held is closed once the node is done. A file opened
+// before the node is reserved keeps the slots of an fdLimiter in the
+// write order, so the node the writer waits for never waits for a slot
+// held by a node behind it
+func (bp *blockPipeline) submitHolding(held io.Closer, build buildFunc) *pendingNode {
+	n := bp.reserve()
+	select {
+	case <-n.done:
+		if held != nil {
+			held.Close()
+		}
+		return n
+	default:
+	}
+
+	select {
+	case bp.jobs <- buildJob{node: n, build: build, held: held}:
+	case <-bp.ctx.Done():
+		n.finish(nil, 0, bp.ctx.Err())
+		if held != nil {
+			held.Close()
+		}
+	}
+	return n
+}
+
+// spawn builds a node in its own goroutine, it is for nodes that mostly
+// wait for their children
+func (bp *blockPipeline) spawn(build buildFunc) *pendingNode {
+	n := bp.reserve()
+	bp.workers.Add(1)
+	go func() {
+		defer bp.workers.Done()
+		select {
+		case <-n.done:
+		default:
+			bp.run(n, build)
+		}
+	}()
+	return n
+}
+
+// close waits for every node and the writer, it must be called once
+// after the last node was created
+func (bp *blockPipeline) close() error {
+	close(bp.segments)
+	close(bp.jobs)
+	bp.workers.Wait()
+	<-bp.writerDone
+	bp.cancel()
+	return bp.err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the size of the data of BenchmarkPack, a few GiB show the gain of the
+// workers when the data does not fit in the page cache
+var packBenchSize = flag.String("pack-bench-size", "256MiB", "size of the data BenchmarkPack packs, like 4GiB")
+
+func TestPipelineOrder(t *testing.T) {
+	testHome(t)
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := writeBenchData(dir, benchOptions{size: 24 << 20, files: 40, seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the car is the same whatever the number of workers
+	var want []byte
+	for _, workers := range []int{1, 2, 8} {
+		carPath := filepath.Join(t.TempDir(), "data.car")
+		if _, err := createCar(dir, carPath, packOptions{Workers: workers}); err != nil {
+			t.Fatal(err)
+		}
+		car, err := os.ReadFile(carPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			want = car
+		} else if !bytes.Equal(car, want) {
+			t.Errorf("the car of %d workers is not the car of 1", workers)
+		}
+	}
+}
+
+func BenchmarkPack(b *testing.B) {
+	var size int64
+	if err := (*byteSize)(&size).Set(*packBenchSize); err != nil {
+		b.Fatal(err)
+	}
+	dir := filepath.Join(b.TempDir(), "data")
+	if err := writeBenchData(dir, benchOptions{size: size, files: 64, seed: 1}); err != nil {
+		b.Fatal(err)
+	}
+
+	// more workers than cpus only help while they wait for the disk
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				carPath := filepath.Join(b.TempDir(), "data.car")
+				if _, err := createCar(dir, carPath, packOptions{Workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+				os.Remove(carPath)
+			}
+		})
+	}
+}
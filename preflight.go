@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// an endpoint must answer the preflight within this time
+const preflightTimeout = 10 * time.Second
+
+// preflight sends a HEAD with the upload token to the endpoint before the
+// car is read, so an endpoint that can not take the upload fails in
+// seconds and not after the body was streamed
+func preflight(client *http.Client, endpoint, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return preflightError(endpoint, err)
+	}
+	rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%s refused the upload token, %s", endpoint, rsp.Status)
+	case http.StatusNotFound:
+		return fmt.Errorf("%s has no upload path, %s", endpoint, rsp.Status)
+	}
+
+	// anything else, method not allowed included, says the endpoint is
+	// there, only the upload itself can tell more
+	logDebug("preflight %s %s", endpoint, rsp.Status)
+	return nil
+}
+
+// preflightError names the problem of a failed preflight
+func preflightError(endpoint string, err error) error {
+	var (
+		dnsErr       *net.DNSError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return fmt.Errorf("%s can not be resolved, %s", endpoint, dnsErr.Error())
+	case errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return fmt.Errorf("%s has an invalid tls certificate, %w", endpoint, err)
+	}
+
+	var ue *url.Error
+	if errors.As(err, &ue) && ue.Timeout() {
+		return fmt.Errorf("%s did not answer in %s", endpoint, preflightTimeout)
+	}
+	return fmt.Errorf("%s can not be reached, %w", endpoint, err)
+}
+
+// preflightEndpoints keeps the endpoints that pass the preflight in their
+// order, it fails with the problem of the first one when none passes
+func preflightEndpoints(client *http.Client, endpoints []string, token string) ([]string, error) {
+	var (
+		passed   []string
+		firstErr error
+	)
+	for _, endpoint := range endpoints {
+		if err := preflight(client, endpoint, token); err != nil {
+			logVerbose("preflight %s", err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		passed = append(passed, endpoint)
+	}
+
+	if len(passed) == 0 {
+		return nil, fmt.Errorf("preflight %w", firstErr)
+	}
+	return passed, nil
+}
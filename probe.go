@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an endpoint that does not answer the probe in time is tried last
+const probeTimeout = 1500 * time.Millisecond
+
+// endpointProbe is the result of probing an upload endpoint
+type endpointProbe struct {
+	url string
+	// rtt is the time to the first response byte, tlsSetup is part of it
+	rtt      time.Duration
+	tlsSetup time.Duration
+	err      error
+}
+
+// splitUploadURLs returns the endpoints of an UploadURL, the scheduler
+// can return several of them separated by commas
+func splitUploadURLs(uploadURL string) []string {
+	var urls []string
+	for _, u := range strings.Split(uploadURL, ",") {
+		if u = strings.TrimSpace(u); len(u) > 0 {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// probeEndpoints sends a HEAD request to every endpoint at the same time and
+// returns them fastest first, endpoints that failed the probe keep their
+// order at the end so they are still there as fallbacks
+func probeEndpoints(ctx context.Context, client *http.Client, urls []string) []endpointProbe {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	probes := make([]endpointProbe, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			probes[i] = probeEndpoint(ctx, client, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].err == nil) != (probes[j].err == nil) {
+			return probes[i].err == nil
+		}
+		return probes[i].err == nil && probes[i].rtt < probes[j].rtt
+	})
+	return probes
+}
+
+func probeEndpoint(ctx context.Context, client *http.Client, u string) endpointProbe {
+	probe := endpointProbe{url: u}
+
+	var tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			if !tlsStart.IsZero() {
+				probe.tlsSetup = time.Since(tlsStart)
+			}
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, u, nil)
+	if err != nil {
+		probe.err = err
+		return probe
+	}
+
+	start := time.Now()
+	rsp, err := client.Do(req)
+	if err != nil {
+		probe.err = err
+		return probe
+	}
+	rsp.Body.Close()
+
+	// any status means the endpoint is alive, it only has to accept the POST
+	probe.rtt = time.Since(start)
+	return probe
+}
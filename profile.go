@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+)
+
+// profileOptions are the files the runtime profiles are written to
+type profileOptions struct {
+	cpuProfile  string
+	memProfile  string
+	trace       string
+	pprofListen string
+}
+
+// startProfiling starts the profilers in opts, the returned function stops
+// them and writes the files. It is safe to call more than once.
+func startProfiling(opts profileOptions) (func(), error) {
+	var stops []func()
+	stopAll := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if len(opts.cpuProfile) > 0 {
+		f, err := os.Create(opts.cpuProfile)
+		if err != nil {
+			return nil, fmt.Errorf("create cpu profile %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("start cpu profile %w", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+
+	if len(opts.trace) > 0 {
+		f, err := os.Create(opts.trace)
+		if err != nil {
+			stopAll()
+			return nil, fmt.Errorf("create trace %w", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stopAll()
+			return nil, fmt.Errorf("start trace %w", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+
+	if len(opts.memProfile) > 0 {
+		memProfile := opts.memProfile
+		stops = append(stops, func() {
+			if err := writeMemProfile(memProfile); err != nil {
+				fmt.Println("write mem profile error ", err.Error())
+			}
+		})
+	}
+
+	if len(opts.pprofListen) > 0 {
+		server := &http.Server{Addr: opts.pprofListen}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Println("pprof listen error ", err.Error())
+			}
+		}()
+		stops = append(stops, func() { server.Close() })
+	}
+
+	var once sync.Once
+	return func() { once.Do(stopAll) }, nil
+}
+
+func writeMemProfile(filePath string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// get up-to-date statistics
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressEvent is a snapshot of the progress of a phase
+type progressEvent struct {
+	Phase string `json:"phase"`
+	Total int64  `json:"total"`
+	// Confirmed bytes were accepted by the server, or kept by a download
+	Confirmed int64 `json:"confirmed"`
+	// Attempt is the current attempt and AttemptSent the bytes it sent
+	Attempt     int   `json:"attempt"`
+	AttemptSent int64 `json:"attempt_sent"`
+	// Sent counts the bytes of every attempt, retries included
+	Sent int64 `json:"sent"`
+	// Rate is in bytes per second and ETA in seconds
+	Rate  int64 `json:"rate,omitempty"`
+	ETA   int64 `json:"eta,omitempty"`
+	Files int   `json:"files,omitempty"`
+	Done  bool  `json:"done,omitempty"`
+	// Input names the asset when uploads of a batch run side by side
+	Input string `json:"input,omitempty"`
+}
+
+// position is how far the phase got, bytes of the current attempt count
+// from where it started
+func (ev progressEvent) position(attemptStart int64) int64 {
+	pos := attemptStart + ev.AttemptSent
+	if ev.Confirmed > pos {
+		return ev.Confirmed
+	}
+	return pos
+}
+
+// progressSink displays progress events
+type progressSink interface {
+	progress(ev progressEvent, position int64)
+}
+
+// how often progress is shown: events of an upload are sent at most every
+// progressRefresh, the bar is redrawn with each of them, and plain lines
+// are printed every plainInterval or plainStep percent
+const (
+	progressRefresh = 250 * time.Millisecond
+	plainInterval   = 5 * time.Second
+	plainStep       = 5
+	barWidth        = 30
+)
+
+// newProgressSink returns the sink for a --progress mode, auto is a bar on
+// a terminal and plain lines otherwise
+func newProgressSink(mode string) (progressSink, error) {
+	switch mode {
+	case "", "auto":
+		if stdoutTerminal() {
+			return &barProgress{plain: plainProgress{last: make(map[string]plainMark)}}, nil
+		}
+		return &plainProgress{last: make(map[string]plainMark)}, nil
+	case "bar":
+		return &barProgress{plain: plainProgress{last: make(map[string]plainMark)}}, nil
+	case "plain":
+		return &plainProgress{last: make(map[string]plainMark)}, nil
+	case "json":
+		return &jsonProgress{enc: json.NewEncoder(os.Stdout)}, nil
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q, use auto, bar, plain or json", mode)
+	}
+}
+
+// stdoutTerminal is true when stdout is a terminal and not a file or a pipe
+func stdoutTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressLine is the text of an event without the name of the input
+func progressLine(ev progressEvent, position int64) string {
+	if ev.Done {
+		return fmt.Sprintf("%s complete", ev.Phase)
+	}
+
+	// a total of 0 is unknown, there is no percentage then
+	s := fmt.Sprintf("%s %s", ev.Phase, formatSize(position))
+	if ev.Total > 0 {
+		s += fmt.Sprintf("/%s (%d%%)", formatSize(ev.Total), percent(position, ev.Total))
+	}
+	if ev.Files > 0 {
+		s += fmt.Sprintf(", %d files", ev.Files)
+	}
+	s += fmt.Sprintf(", %s/s", formatSize(ev.Rate))
+	if ev.ETA > 0 {
+		s += fmt.Sprintf(", eta %s", formatDuration(time.Duration(ev.ETA)*time.Second))
+	}
+	return s
+}
+
+func percent(position, total int64) int64 {
+	if total <= 0 {
+		return 0
+	} else if position >= total {
+		return 100
+	}
+	return position * 100 / total
+}
+
+// plainMark is when the last line of a phase was printed and at what
+// percent
+type plainMark struct {
+	at      time.Time
+	percent int64
+}
+
+// plainProgress prints a line when a phase starts and ends, and in between
+// every plainInterval or plainStep percent. Every line is written whole
+// under mu so the lines of uploads side by side do not run into each other
+type plainProgress struct {
+	mu   sync.Mutex
+	last map[string]plainMark
+}
+
+func (pp *plainProgress) progress(ev progressEvent, position int64) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	key := ev.Input + "\x00" + ev.Phase
+	mark, seen := pp.last[key]
+	now, pct := time.Now(), percent(position, ev.Total)
+	switch {
+	case ev.Done:
+		delete(pp.last, key)
+	case !seen, now.Sub(mark.at) >= plainInterval, ev.Total > 0 && pct/plainStep > mark.percent/plainStep:
+		pp.last[key] = plainMark{at: now, percent: pct}
+	default:
+		return
+	}
+
+	s := progressLine(ev, position)
+	if len(ev.Input) > 0 {
+		s = ev.Input + ": " + s
+	}
+	os.Stdout.WriteString(s + "\n") //nolint:errcheck
+}
+
+// barProgress draws a phase on one line of the terminal, redrawn in place.
+// The phases of uploads side by side are printed as plain lines, one line
+// can not show them all
+type barProgress struct {
+	mu    sync.Mutex
+	plain plainProgress
+	// width is the length of the line drawn last, 0 when the line was
+	// ended
+	width int
+}
+
+func (bp *barProgress) progress(ev progressEvent, position int64) {
+	if len(ev.Input) > 0 {
+		bp.plain.progress(ev, position)
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	var s string
+	if ev.Done {
+		s = progressLine(ev, position)
+	} else {
+		bar := strings.Repeat(" ", barWidth)
+		if ev.Total > 0 {
+			n := int(percent(position, ev.Total) * barWidth / 100)
+			bar = strings.Repeat("=", n) + strings.Repeat(" ", barWidth-n)
+			if n < barWidth && n > 0 {
+				bar = bar[:n-1] + ">" + bar[n:]
+			}
+		}
+		s = fmt.Sprintf("[%s] %s", bar, progressLine(ev, position))
+	}
+
+	// spaces wipe what is left of a longer line, escape codes are not
+	// understood by every console
+	pad := ""
+	if len(s) < bp.width {
+		pad = strings.Repeat(" ", bp.width-len(s))
+	}
+	if ev.Done {
+		os.Stdout.WriteString("\r" + s + pad + "\n") //nolint:errcheck
+		bp.width = 0
+		return
+	}
+	os.Stdout.WriteString("\r" + s + pad) //nolint:errcheck
+	bp.width = len(s)
+}
+
+type jsonProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (jp *jsonProgress) progress(ev progressEvent, position int64) {
+	jp.mu.Lock()
+	defer jp.mu.Unlock()
+	jp.enc.Encode(ev)
+}
+
+// labeledProgress names the input in the events of a sink shared by the
+// uploads of a batch that run side by side
+type labeledProgress struct {
+	sink  progressSink
+	label string
+}
+
+func (lp labeledProgress) progress(ev progressEvent, position int64) {
+	ev.Input = lp.label
+	lp.sink.progress(ev, position)
+}
+
+// uploadProgress keeps the byte counters of an upload across attempts,
+// the retry loop starts attempts and confirms what the server accepted
+// while the body reader adds what was sent
+type uploadProgress struct {
+	mu           sync.Mutex
+	sink         progressSink
+	ev           progressEvent
+	attemptStart int64
+	// reached is the furthest position shown, a retry that starts before
+	// it holds the bar there until it catches up
+	reached int64
+	start   time.Time
+	// emitted is when the last event was sent, the body reader adds on
+	// every read and the sink gets at most one event per progressRefresh
+	emitted    time.Time
+	pausedBase time.Duration
+}
+
+func newUploadProgress(sink progressSink, total int64) *uploadProgress {
+	return &uploadProgress{sink: sink, ev: progressEvent{Phase: "upload", Total: total}, start: time.Now(), pausedBase: transfers.pausedFor()}
+}
+
+// startAttempt begins a new attempt that sends the body of total bytes
+// from offset
+func (up *uploadProgress) startAttempt(offset, total int64) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.ev.Attempt++
+	up.ev.AttemptSent = 0
+	up.ev.Total = total
+	up.ev.Done = false
+	up.attemptStart = offset
+}
+
+// add counts n bytes sent by the current attempt
+func (up *uploadProgress) add(n int64) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.ev.AttemptSent += n
+	up.ev.Sent += n
+	if time.Since(up.emitted) >= progressRefresh {
+		up.emit()
+	}
+}
+
+// emit sends the event with rate and eta, up.mu is held
+func (up *uploadProgress) emit() {
+	position := up.ev.position(up.attemptStart)
+	if position < up.reached {
+		position = up.reached
+	}
+	up.reached = position
+	up.ev.Rate, up.ev.ETA = 0, 0
+	// the first reads fill buffers, they say nothing of the rate yet
+	if elapsed := (time.Since(up.start) - (transfers.pausedFor() - up.pausedBase)).Seconds(); elapsed >= progressRefresh.Seconds() {
+		up.ev.Rate = int64(float64(up.ev.Sent) / elapsed)
+	}
+	if up.ev.Rate > 0 && up.ev.Total > position {
+		up.ev.ETA = (up.ev.Total - position) / up.ev.Rate
+	}
+	up.emitted = time.Now()
+	up.sink.progress(up.ev, position)
+}
+
+// confirm records that the server holds the first offset bytes
+func (up *uploadProgress) confirm(offset int64) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if offset > up.ev.Confirmed {
+		up.ev.Confirmed = offset
+	}
+}
+
+// done reports the end of the upload, once however often the body
+// reader reports it
+func (up *uploadProgress) done() {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.ev.Done {
+		return
+	}
+	up.ev.Done = true
+	up.emit()
+}
+
+func (up *uploadProgress) snapshot() progressEvent {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.ev
+}
+
+// summary describes what was delivered and what retries cost
+func (up *uploadProgress) summary() string {
+	ev := up.snapshot()
+	s := fmt.Sprintf("uploaded %s/%s", formatSize(ev.Confirmed), formatSize(ev.Total))
+	if overhead := ev.Sent - ev.Confirmed; ev.Attempt > 1 && overhead > 0 {
+		s += fmt.Sprintf(", %d attempts sent %s, %s of them retried", ev.Attempt, formatSize(ev.Sent), formatSize(overhead))
+	}
+	return s
+}
+
+// transferProgress counts the bytes of a download or extract, connections
+// add concurrently so it reports once per percent, or once per
+// downloadChunk bytes when the total is unknown
+type transferProgress struct {
+	mu    sync.Mutex
+	sink  progressSink
+	ev    progressEvent
+	start time.Time
+	// base bytes were there before this run and do not count for the rate
+	base int64
+	next int64
+	// time paused before start, pauses do not count for the rate either
+	pausedBase time.Duration
+}
+
+func newTransferProgress(sink progressSink, phase string, total int64) *transferProgress {
+	if total < 0 {
+		total = 0
+	}
+	return &transferProgress{sink: sink, ev: progressEvent{Phase: phase, Total: total}, start: time.Now(), pausedBase: transfers.pausedFor()}
+}
+
+// resume starts the count at n bytes kept from an earlier run
+func (tp *transferProgress) resume(n int64) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.base = n
+	tp.ev.Confirmed = n
+	tp.next = n
+}
+
+// add counts n bytes, a negative n takes back bytes that must be fetched again
+func (tp *transferProgress) add(n int64) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.ev.Confirmed += n
+	if n > 0 {
+		tp.ev.Sent += n
+	}
+
+	if tp.ev.Confirmed < tp.next {
+		return
+	}
+
+	step := int64(downloadChunk)
+	if tp.ev.Total > 0 {
+		step = tp.ev.Total/100 + 1
+	}
+	tp.next = tp.ev.Confirmed + step
+	tp.emit()
+}
+
+// file counts a file written by an extract
+func (tp *transferProgress) file() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.ev.Files++
+}
+
+func (tp *transferProgress) done() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.ev.Done = true
+	tp.emit()
+}
+
+// emit sends the event with rate and eta, tp.mu is held
+func (tp *transferProgress) emit() {
+	tp.ev.Rate, tp.ev.ETA = 0, 0
+	if elapsed := (time.Since(tp.start) - (transfers.pausedFor() - tp.pausedBase)).Seconds(); elapsed > 0 {
+		tp.ev.Rate = int64(float64(tp.ev.Confirmed-tp.base) / elapsed)
+	}
+	if tp.ev.Rate > 0 && tp.ev.Total > tp.ev.Confirmed {
+		tp.ev.ETA = (tp.ev.Total - tp.ev.Confirmed) / tp.ev.Rate
+	}
+	tp.sink.progress(tp.ev, tp.ev.Confirmed)
+}
+
+func (tp *transferProgress) snapshot() progressEvent {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.ev
+}
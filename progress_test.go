@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+// recordedProgress keeps the positions of the events it gets
+type recordedProgress struct {
+	positions []int64
+}
+
+func (rp *recordedProgress) progress(ev progressEvent, position int64) {
+	rp.positions = append(rp.positions, position)
+}
+
+func TestUploadProgressRetry(t *testing.T) {
+	const total = 1000
+	// a step starts an attempt from offset, sends bytes or confirms them
+	type step struct {
+		attempt      bool
+		offset, sent int64
+		confirm      int64
+		// position is the one of the event after the step
+		position int64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// sent is the bytes of every attempt, confirmed what the server holds
+		sent, confirmed int64
+	}{
+		{"one attempt", []step{
+			{attempt: true},
+			{sent: 400, position: 400},
+			{sent: 600, position: 1000},
+			{confirm: 1000, position: 1000},
+		}, 1000, 1000},
+		{"retry from the start", []step{
+			{attempt: true},
+			{sent: 700, position: 700},
+			{attempt: true},
+			// the bar holds while the retry sends the bytes it showed
+			{sent: 300, position: 700},
+			{sent: 500, position: 800},
+			{sent: 200, position: 1000},
+			{confirm: 1000, position: 1000},
+		}, 1700, 1000},
+		{"resume from the confirmed offset", []step{
+			{attempt: true},
+			{sent: 600, position: 600},
+			{confirm: 500, position: 600},
+			{attempt: true, offset: 500},
+			{sent: 50, position: 600},
+			{sent: 450, position: 1000},
+			{confirm: 1000, position: 1000},
+		}, 1100, 1000},
+		{"retry sends less before it fails again", []step{
+			{attempt: true},
+			{sent: 900, position: 900},
+			{attempt: true},
+			{sent: 100, position: 900},
+			{attempt: true},
+			{sent: 1000, position: 1000},
+			{confirm: 1000, position: 1000},
+		}, 2000, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := &recordedProgress{}
+			up := newUploadProgress(rp, total)
+			for i, s := range tt.steps {
+				switch {
+				case s.attempt:
+					up.startAttempt(s.offset, total)
+					continue
+				case s.sent > 0:
+					// every add emits, the refresh interval is left out
+					up.mu.Lock()
+					up.emitted = up.emitted.AddDate(-1, 0, 0)
+					up.mu.Unlock()
+					up.add(s.sent)
+				default:
+					up.confirm(s.confirm)
+					up.mu.Lock()
+					up.emit()
+					up.mu.Unlock()
+				}
+				if got := rp.positions[len(rp.positions)-1]; got != s.position {
+					t.Errorf("step %d: position %d, want %d", i, got, s.position)
+				}
+			}
+			up.done()
+
+			for i := 1; i < len(rp.positions); i++ {
+				if rp.positions[i] < rp.positions[i-1] {
+					t.Errorf("the position went back from %d to %d", rp.positions[i-1], rp.positions[i])
+				}
+			}
+			ev := up.snapshot()
+			if ev.Sent != tt.sent || ev.Confirmed != tt.confirmed || !ev.Done {
+				t.Errorf("sent %d, confirmed %d, done %t, want %d and %d", ev.Sent, ev.Confirmed, ev.Done, tt.sent, tt.confirmed)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Filecoin-Titan/titan/api/types"
+)
+
+// orphanStates are the states of an asset whose data never arrived: the
+// scheduler waits for the upload, or gave up on it
+var orphanStates = map[string]bool{
+	"UploadInit":    true,
+	"SeedUploading": true,
+	"UploadFailed":  true,
+	"SeedFailed":    true,
+}
+
+// orphan is an asset record prune-orphans would delete
+type orphan struct {
+	CID     string    `json:"cid"`
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	Created time.Time `json:"created"`
+	// Size is what the record takes from the storage quota of the user
+	Size    int64    `json:"size"`
+	Reasons []string `json:"reasons"`
+}
+
+// orphanOf is the orphan ov is, false for any asset that has or gets data.
+// It is conservative: a replica that is pulling, done or has a single byte
+// keeps the asset, as does any state other than waiting for the upload
+func orphanOf(ov *types.AssetOverview, olderThan time.Duration, now time.Time) (orphan, bool) {
+	r := ov.AssetRecord
+	if r == nil || !orphanStates[r.State] {
+		return orphan{}, false
+	}
+
+	e := newAssetEntry(ov)
+	if now.Sub(e.Created) < olderThan {
+		return orphan{}, false
+	}
+
+	for _, replica := range r.ReplicaInfos {
+		if replica.Status == types.ReplicaStatusPulling || replica.Status == types.ReplicaStatusSucceeded || replica.DoneSize > 0 {
+			return orphan{}, false
+		}
+	}
+
+	o := orphan{CID: e.CID, Name: e.Name, State: r.State, Created: e.Created, Size: e.Size}
+	o.Reasons = append(o.Reasons, fmt.Sprintf("%s for %s", r.State, formatDuration(now.Sub(e.Created).Truncate(time.Minute))))
+	o.Reasons = append(o.Reasons, "no replica has data")
+	if d := ov.UserAssetDetail; d != nil && d.TotalSize > 0 && r.TotalSize != d.TotalSize {
+		o.Reasons = append(o.Reasons, fmt.Sprintf("%s of %s arrived", formatSize(r.TotalSize), formatSize(d.TotalSize)))
+	}
+	return o, true
+}
+
+// findOrphans walks the asset list of the user for orphans
+func findOrphans(ctx context.Context, conn *schedulerConn, olderThan time.Duration) ([]orphan, error) {
+	var orphans []orphan
+	now := time.Now()
+	for offset := 0; ; offset += listPageSize {
+		rsp, err := listAssetPage(ctx, conn.api, listPageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ov := range rsp.AssetOverviews {
+			if o, ok := orphanOf(ov, olderThan, now); ok {
+				orphans = append(orphans, o)
+			}
+		}
+
+		if offset+listPageSize >= rsp.Total {
+			return orphans, nil
+		}
+	}
+}
+
+func runPruneOrphans(args []string) error {
+	opts := newOptions()
+	var (
+		olderThan time.Duration
+		asJSON    bool
+		yes       bool
+	)
+
+	fs := newFlagSet("prune-orphans")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	fs.DurationVar(&olderThan, "older-than", 72*time.Hour, "only take assets created longer ago, a younger one may still be uploading")
+	fs.BoolVar(&asJSON, "json", false, "print the orphans as json for review")
+	fs.BoolVar(&yes, "yes", false, "delete the orphans, without it they are only listed")
+
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if olderThan < time.Hour {
+		return fmt.Errorf("older-than must be at least 1h, an upload can take that long to arrive")
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	orphans, err := findOrphans(context.Background(), conn, olderThan)
+	if err != nil {
+		return err
+	}
+
+	// the listing always comes first, nothing is deleted without --yes
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if orphans == nil {
+			orphans = []orphan{}
+		}
+		enc.Encode(orphans) //nolint:errcheck
+	} else if len(orphans) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CID\tNAME\tSTATE\tCREATED\tSIZE\tREASONS")
+		for _, o := range orphans {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", o.CID, o.Name, o.State, o.Created.Format(time.RFC3339), formatSize(o.Size), strings.Join(o.Reasons, ", "))
+		}
+		tw.Flush()
+	}
+
+	if len(orphans) == 0 {
+		if !asJSON {
+			fmt.Println("no orphaned asset")
+		}
+		return nil
+	} else if !yes {
+		if !asJSON {
+			fmt.Printf("%d orphaned assets, run prune-orphans again with --yes to delete them\n", len(orphans))
+		}
+		return nil
+	}
+
+	var (
+		failed    int
+		reclaimed int64
+	)
+	for _, o := range orphans {
+		if err := conn.api.DeleteUserAsset(context.Background(), o.CID); err != nil {
+			fmt.Printf("delete %s error %s\n", o.CID, describeError(err))
+			failed++
+			continue
+		}
+		reclaimed += o.Size
+		if err := appendEvent(gcEvent{Time: time.Now(), Action: "prune orphan", Kind: "remote", Target: o.CID, Reason: strings.Join(o.Reasons, ", ")}); err != nil {
+			fmt.Printf("warning: event log %s error %s\n", eventLogPath(), err.Error())
+		}
+		fmt.Printf("deleted %s\n", o.CID)
+	}
+	fmt.Printf("%d orphaned assets deleted, %s of quota reclaimed\n", len(orphans)-failed, formatSize(reclaimed))
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d orphaned assets not deleted", failed, len(orphans))
+	}
+	return nil
+}
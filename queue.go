@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const queueVersion = 1
+
+// queue holds the uploads that failed so retry can run them again
+type queue struct {
+	Version int
+	Jobs    []*queueJob
+}
+
+// queueJob is a failed upload
+type queueJob struct {
+	ID string
+	// Path is absolute so retry works from any directory
+	Path    string
+	Options jobOptions
+	// ErrorClass is the stage that failed, connect, pack or upload
+	ErrorClass string
+	Error      string
+	Attempts   int
+	LastFailed time.Time
+	// Terminal is a failure retrying does not fix until the user acts
+	Terminal bool `json:",omitempty"`
+}
+
+// jobOptions are the upload options a job is retried with, the api key
+// is never stored and comes from the retry command line
+type jobOptions struct {
+	Name string `json:",omitempty"`
+	// Description goes into the history once a retry succeeds
+	Description string `json:",omitempty"`
+	Size        int64  `json:",omitempty"`
+	Offset      int64  `json:",omitempty"`
+	Length      int64  `json:",omitempty"`
+	Incremental string `json:",omitempty"`
+	NoPostcheck bool   `json:",omitempty"`
+	Verify      bool   `json:",omitempty"`
+	NoProbe     bool   `json:",omitempty"`
+	// Symlinks is the symlink mode of the pack, FollowSymlinks and Strict
+	// are read from older queue files
+	Symlinks       string `json:",omitempty"`
+	FollowSymlinks bool   `json:",omitempty"`
+	Strict         bool   `json:",omitempty"`
+	UploadStyle    string `json:",omitempty"`
+	NoPreflight    bool   `json:",omitempty"`
+	NoRollback     bool   `json:",omitempty"`
+	FailIfExists   bool   `json:",omitempty"`
+	Force          bool   `json:",omitempty"`
+	Resume         bool   `json:",omitempty"`
+	// AllowedUploadHosts is kept so a retry is checked like the upload was
+	AllowedUploadHosts []string `json:",omitempty"`
+	HashWorkers        int      `json:",omitempty"`
+	// SplitSize lets a retry go on with the missing parts of a split upload
+	SplitSize int64 `json:",omitempty"`
+	// ExcludeMetaFiles and EmbedChecksums change the cid, a retry must
+	// pack the same way
+	ExcludeMetaFiles bool `json:",omitempty"`
+	EmbedChecksums   bool `json:",omitempty"`
+	NoChecksums      bool `json:",omitempty"`
+	// Hash is the multihash code of the blocks, 0 for sha2-256
+	Hash        uint64   `json:",omitempty"`
+	Chunker     string   `json:",omitempty"`
+	NoRawLeaves bool     `json:",omitempty"`
+	Exclude     []string `json:",omitempty"`
+	Include     []string `json:",omitempty"`
+	// Wrapped are the inputs of a --wrap upload, Path is the first of them
+	Wrapped []string `json:",omitempty"`
+}
+
+// stageError tells which stage of an upload failed
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func errorClass(err error) string {
+	var se *stageError
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return "unknown"
+}
+
+func (opts *options) queueFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.queue, "queue", filepath.Join(stateDir(), "queue.json"), "file keeping failed uploads for retry")
+}
+
+func (opts *options) jobOptions() jobOptions {
+	return jobOptions{
+		Name:               opts.name,
+		Description:        opts.description,
+		Size:               opts.size,
+		Offset:             opts.offset,
+		Length:             opts.length,
+		Incremental:        opts.incremental,
+		NoPostcheck:        opts.noPostcheck,
+		Verify:             opts.verify,
+		NoProbe:            opts.noProbe,
+		Symlinks:           string(opts.symlinks),
+		UploadStyle:        opts.uploadStyle,
+		NoPreflight:        opts.noPreflight,
+		NoRollback:         opts.noRollback,
+		FailIfExists:       opts.failIfExists,
+		Force:              opts.force,
+		Resume:             opts.resume,
+		AllowedUploadHosts: opts.allowedUploadHosts,
+		HashWorkers:        int(opts.hashWorkerCount),
+		SplitSize:          opts.splitSize,
+		ExcludeMetaFiles:   opts.excludeMetaFiles,
+		EmbedChecksums:     opts.embedChecksums,
+		NoChecksums:        opts.noChecksums,
+		Hash:               uint64(opts.hash),
+		Chunker:            string(opts.chunker),
+		NoRawLeaves:        !opts.rawLeaves,
+		Exclude:            opts.filter.Exclude,
+		Include:            opts.filter.Include,
+		Wrapped:            opts.wrapped,
+	}
+}
+
+// apply sets the options of the job on a copy of opts
+func (o jobOptions) apply(opts *options) *options {
+	c := *opts
+	c.name = o.Name
+	c.description = o.Description
+	c.size = o.Size
+	c.offset = o.Offset
+	c.length = o.Length
+	c.incremental = o.Incremental
+	c.noPostcheck = o.NoPostcheck
+	c.verify = o.Verify
+	c.noProbe = o.NoProbe
+	c.symlinks = symlinkMode(o.Symlinks)
+	if o.FollowSymlinks && len(o.Symlinks) == 0 {
+		c.symlinks = symlinkFollow
+	}
+	c.noPreflight = o.NoPreflight
+	c.noRollback = o.NoRollback
+	c.failIfExists = o.FailIfExists
+	c.force = o.Force
+	c.resume = o.Resume
+	c.hashWorkerCount = workerCount(o.HashWorkers)
+	c.splitSize = o.SplitSize
+	c.excludeMetaFiles = o.ExcludeMetaFiles
+	c.embedChecksums = o.EmbedChecksums
+	c.noChecksums = o.NoChecksums
+	c.hash = hashFlag(o.Hash)
+	c.chunker = chunkerFlag(o.Chunker)
+	c.rawLeaves = !o.NoRawLeaves
+	c.filter = pathFilter{Exclude: o.Exclude, Include: o.Include}
+	c.wrapped = o.Wrapped
+	if len(c.allowedUploadHosts) == 0 {
+		c.allowedUploadHosts = o.AllowedUploadHosts
+	}
+	if len(o.UploadStyle) > 0 {
+		c.uploadStyle = o.UploadStyle
+	}
+	return &c
+}
+
+// updateQueue runs fn on the queue at queuePath and saves the result,
+// a lock file keeps concurrent runs from losing each other's updates
+func updateQueue(queuePath string, fn func(q *queue) error) error {
+	if err := os.MkdirAll(filepath.Dir(queuePath), 0700); err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(queuePath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("lock queue %s %w", queuePath, err)
+	}
+	defer unlockFile(lock) //nolint:errcheck
+
+	q, err := readQueue(queuePath)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(q); err != nil {
+		return err
+	}
+	return q.write(queuePath)
+}
+
+// readQueue returns the queue at queuePath, an empty queue when there is none
+func readQueue(queuePath string) (*queue, error) {
+	b, err := os.ReadFile(queuePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &queue{Version: queueVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	q := &queue{}
+	if err := json.Unmarshal(b, q); err != nil {
+		return nil, fmt.Errorf("parse queue %s: %w", queuePath, err)
+	}
+
+	if q.Version != queueVersion {
+		return nil, fmt.Errorf("queue %s has version %d, want %d", queuePath, q.Version, queueVersion)
+	}
+	return q, nil
+}
+
+// write saves the queue through a synced temp file so a crash leaves
+// either the old or the new queue
+func (q *queue) write(queuePath string) error {
+	b, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile := queuePath + ".tmp"
+	f, err := os.OpenFile(tempFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, queuePath)
+}
+
+func (q *queue) find(id string) int {
+	for i, job := range q.Jobs {
+		if job.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordFailure adds a failed upload of filePath to the queue, a job for
+// the same path and name is updated instead of added again
+func recordFailure(opts *options, filePath string, uploadErr error) error {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+
+	jobOpts := opts.jobOptions()
+	return updateQueue(opts.queue, func(q *queue) error {
+		var job *queueJob
+		for _, j := range q.Jobs {
+			if j.Path == abs && j.Options.Name == jobOpts.Name {
+				job = j
+				break
+			}
+		}
+
+		if job == nil {
+			job = &queueJob{ID: fmt.Sprintf("%x", time.Now().UnixNano()), Path: abs}
+			q.Jobs = append(q.Jobs, job)
+		}
+
+		job.Options = jobOpts
+		job.markFailed(uploadErr)
+		return nil
+	})
+}
+
+func (job *queueJob) markFailed(err error) {
+	job.ErrorClass = errorClass(err)
+	job.Error = errText(err)
+	job.Terminal = terminalError(err)
+	job.Attempts++
+	job.LastFailed = time.Now()
+}
+
+func runRetry(args []string) error {
+	opts := newOptions()
+	var maxRetries, concurrency int
+	var terminal bool
+
+	fs := newFlagSet("retry")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	opts.uploadFlags(fs)
+	opts.queueFlags(fs)
+	fs.IntVar(&maxRetries, "max-retries", 5, "attempts after which a job is kept in the queue but not retried")
+	fs.IntVar(&concurrency, "concurrency", 1, "jobs retried at the same time")
+	fs.BoolVar(&terminal, "terminal", false, "also retry jobs that failed for a reason retrying does not fix, once it is fixed")
+
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	if err := opts.checkUploadFlags(); err != nil {
+		return err
+	}
+
+	if concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+	opts.batch = true
+
+	q, err := readQueue(opts.queue)
+	if err != nil {
+		return err
+	}
+
+	var jobs []*queueJob
+	for _, job := range q.Jobs {
+		if job.Attempts >= maxRetries {
+			fmt.Printf("skip %s %s, failed %d times\n", job.ID, job.Path, job.Attempts)
+			continue
+		}
+		if job.Terminal && !terminal {
+			fmt.Printf("skip %s %s, %s, retry it with --terminal once that is fixed\n", job.ID, job.Path, job.Error)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(jobs) == 0 {
+		fmt.Println("nothing to retry")
+		return nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job *queueJob) {
+			defer func() { <-sem; wg.Done() }()
+
+			fmt.Printf("retry %s %s, attempt %d\n", job.ID, job.Path, job.Attempts+1)
+			_, uploadErr := execUpload(job.Options.apply(opts), job.Path)
+			if uploadErr != nil {
+				fmt.Printf("retry %s failed %s\n", job.ID, describeError(uploadErr))
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+
+			err := updateQueue(opts.queue, func(q *queue) error {
+				i := q.find(job.ID)
+				if i < 0 {
+					// cleared while the job ran
+					return nil
+				}
+
+				if uploadErr == nil {
+					q.Jobs = append(q.Jobs[:i], q.Jobs[i+1:]...)
+				} else {
+					q.Jobs[i].markFailed(uploadErr)
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("update queue error %s\n", errText(err))
+			}
+		}(job)
+	}
+	wg.Wait()
+
+	if failed < len(jobs) {
+		if conn, err := connectScheduler(opts, make(map[int]bool)); err == nil {
+			printQuota(opts, conn)
+			conn.close()
+		} else {
+			logDebug("quota error %s", err.Error())
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed, kept in queue %s", failed, len(jobs), opts.queue)
+	}
+	return nil
+}
+
+func runQueue(args []string) error {
+	opts := newOptions()
+
+	fs := newFlagSet("queue")
+	opts.queueFlags(fs)
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("please input list or clear")
+	}
+
+	switch args[0] {
+	case "list":
+		q, err := readQueue(opts.queue)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range q.Jobs {
+			fmt.Printf("%s %s attempts %d, %s error at %s: %s\n", job.ID, job.Path, job.Attempts,
+				job.ErrorClass, job.LastFailed.Format(time.RFC3339), job.Error)
+		}
+		fmt.Printf("%d jobs in %s\n", len(q.Jobs), opts.queue)
+		return nil
+	case "clear":
+		var n int
+		err := updateQueue(opts.queue, func(q *queue) error {
+			n = len(q.Jobs)
+			q.Jobs = nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d jobs cleared\n", n)
+		return nil
+	default:
+		return fmt.Errorf("unknown queue command %s", args[0])
+	}
+}
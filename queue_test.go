@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+func TestJobOptionsRoundTrip(t *testing.T) {
+	opts := newOptions()
+	opts.name, opts.description = "site", "the site of the launch"
+	opts.size, opts.offset, opts.length = 4096, 1024, 2048
+	opts.incremental = "/tmp/previous.car"
+	opts.noPostcheck, opts.verify, opts.noProbe = true, true, true
+	opts.symlinks, opts.uploadStyle = symlinkFollow, "put"
+	opts.noPreflight, opts.noRollback, opts.failIfExists, opts.force, opts.resume = true, true, true, true, true
+	opts.allowedUploadHosts = []string{"*.example.com"}
+	opts.hashWorkerCount = 3
+	opts.splitSize = 1 << 30
+	opts.excludeMetaFiles, opts.embedChecksums, opts.noChecksums = true, true, true
+	opts.hash, opts.chunker, opts.rawLeaves = hashFlag(multihash.BLAKE3), "size-65536", false
+	opts.filter = pathFilter{Exclude: globList{"*.log"}, Include: globList{"keep.log"}}
+	opts.wrapped = []string{"/data/a", "/data/b"}
+
+	o := opts.jobOptions()
+	// a field the job does not get from the options is lost on retry, the
+	// symlink flags of older queue files are only read
+	v := reflect.ValueOf(o)
+	for i := 0; i < v.NumField(); i++ {
+		switch name := v.Type().Field(i).Name; name {
+		case "FollowSymlinks", "Strict":
+		default:
+			if v.Field(i).IsZero() {
+				t.Errorf("%s is not kept in the job", name)
+			}
+		}
+	}
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back jobOptions
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if got := back.apply(newOptions()).jobOptions(); !reflect.DeepEqual(got, o) {
+		t.Errorf("the retry runs with\n%+v, the upload was\n%+v", got, o)
+	}
+}
+
+func TestRetryDescription(t *testing.T) {
+	testHome(t)
+	s := newFakeScheduler(t)
+	useScheduler(t, s)
+	input := writeFile(t, "site.txt", "hello world\n")
+	queuePath := filepath.Join(t.TempDir(), "queue.json")
+	historyPath := filepath.Join(t.TempDir(), "history.jsonl")
+	flags := []string{"--queue", queuePath, "--history", historyPath, "--no-postcheck"}
+
+	// the upload fails and is queued with its description
+	s.uploadStatus = http.StatusBadGateway
+	if _, err := captureStdout(t, func() error {
+		return runUpload(uploadArgs(append(flags, "--description", "the site of the launch", input)...))
+	}); err == nil {
+		t.Fatal("the upload did not fail")
+	}
+	q, err := readQueue(queuePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Jobs) != 1 || q.Jobs[0].Options.Description != "the site of the launch" {
+		t.Fatalf("queued %+v", q.Jobs)
+	}
+
+	// the retry keeps it in the history, once the scheduler dropped the
+	// record of the failed upload
+	root := packCID(t, input)
+	s.uploadStatus = 0
+	delete(s.records, root)
+	if out, err := captureStdout(t, func() error {
+		return runRetry([]string{"--api-key", testAPIKey, "--allow-insecure-upload", "--no-preflight", "--progress", "plain", "--queue", queuePath, "--history", historyPath})
+	}); err != nil {
+		t.Fatalf("retry: %v\n%s", err, out)
+	}
+	entries, err := readHistory(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entries[historyKey(root)]; e == nil || e.Description != "the site of the launch" {
+		t.Errorf("history of %s is %+v", root, e)
+	}
+}
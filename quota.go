@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/types"
+)
+
+// userIDFromKey reads the user id from the payload of an api key, the
+// key is a jwt and is not verified here, the scheduler does that
+func userIDFromKey(apiKey string) (string, error) {
+	parts := strings.Split(apiKey, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("api key is not a jwt")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decode api key payload %w", err)
+	}
+
+	payload := types.JWTPayload{}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return "", fmt.Errorf("parse api key payload %w", err)
+	}
+
+	if len(payload.ID) == 0 {
+		return "", fmt.Errorf("api key has no user id")
+	}
+	return payload.ID, nil
+}
+
+// errNoQuota is the answer of a scheduler to GetUserInfo from an api key,
+// the rpc is web and admin only
+var errNoQuota = fmt.Errorf("the scheduler does not give the quota to api keys, its GetUserInfo is web and admin only")
+
+// noQuotaOnce says that the quota is not available once per run, every
+// upload of a batch or a queue would say it again
+var noQuotaOnce sync.Once
+
+// fetchQuota asks the scheduler for the storage used by the owner of apiKey
+func fetchQuota(ctx context.Context, schedulerAPI api.Scheduler, apiKey string) (*types.UserInfo, error) {
+	userID, err := userIDFromKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := schedulerAPI.GetUserInfo(ctx, userID)
+	if err != nil && unsupportedRPC(err) {
+		return nil, fmt.Errorf("GetUserInfo: %w", errNoQuota)
+	} else if err != nil {
+		return nil, fmt.Errorf("GetUserInfo %w", err)
+	}
+	return info, nil
+}
+
+// printNoQuota says that the scheduler does not give the quota, the first
+// time it is called
+func printNoQuota() {
+	noQuotaOnce.Do(func() {
+		fmt.Println("quota: not available, the scheduler only tells it to the web console, not to api keys")
+	})
+}
+
+// printQuota prints the storage used by the key of conn and returns it,
+// nil when the scheduler does not tell, the upload is done either way
+func printQuota(opts *options, conn *schedulerConn) *types.UserInfo {
+	info, err := fetchQuota(context.Background(), conn.api, opts.keys.keys[conn.key])
+	if errors.Is(err, errNoQuota) {
+		printNoQuota()
+		return nil
+	} else if err != nil {
+		logDebug("quota error %s", err.Error())
+		return nil
+	}
+
+	if info.TotalSize <= 0 {
+		logDebug("quota unknown, scheduler reported total size %d", info.TotalSize)
+		return nil
+	}
+
+	fmt.Printf("quota: %s / %s used (%d%%)\n", formatSize(info.UsedSize), formatSize(info.TotalSize), info.UsedSize*100/info.TotalSize)
+	return info
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Filecoin-Titan/titan/api/types"
+)
+
+func TestPrintQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		userInfo *types.UserInfo
+		want     string
+	}{
+		{"api key", nil, "quota: not available, the scheduler only tells it to the web console, not to api keys\n"},
+		{"quota", &types.UserInfo{UsedSize: 1 << 30, TotalSize: 4 << 30}, "quota: 1.00 GiB / 4.00 GiB used (25%)\nquota: 1.00 GiB / 4.00 GiB used (25%)\n"},
+		{"no total", &types.UserInfo{UsedSize: 1 << 30}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			noQuotaOnce = sync.Once{}
+			s := newFakeScheduler(t)
+			s.userInfo = tt.userInfo
+			opts := testOptions(t)
+			opts.keys = newKeyPool([]string{testAPIKey})
+			conn := &schedulerConn{api: s, close: func() {}}
+
+			// printed twice, the note about api keys only the first time
+			out, _ := captureStdout(t, func() error {
+				if info := printQuota(opts, conn); (info != nil) != (tt.userInfo != nil && tt.userInfo.TotalSize > 0) {
+					t.Errorf("quota %v", info)
+				}
+				printQuota(opts, conn)
+				return nil
+			})
+			if out != tt.want {
+				t.Errorf("printed %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONResultQuota(t *testing.T) {
+	for _, withQuota := range []bool{false, true} {
+		testHome(t)
+		noQuotaOnce = sync.Once{}
+		s := newFakeScheduler(t)
+		if withQuota {
+			s.userInfo = &types.UserInfo{UsedSize: 2048, TotalSize: 4096}
+		}
+		useScheduler(t, s)
+		input := writeFile(t, "notes.txt", "hello world\n")
+
+		out, err := captureStdout(t, func() error { return runUpload(uploadArgs("--json", "--no-postcheck", input)) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal([]byte(out), &r); err != nil {
+			t.Fatalf("%v in %q", err, out)
+		}
+		if _, ok := r["quota_used"]; ok != withQuota {
+			t.Errorf("quota %t, quota_used in %s", withQuota, strings.TrimSpace(out))
+		} else if withQuota && (r["quota_used"] != 2048.0 || r["quota_total"] != 4096.0) {
+			t.Errorf("quota fields of %s", strings.TrimSpace(out))
+		}
+	}
+}
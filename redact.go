@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secrets are the values redact masks, the api keys and the upload tokens
+// of this run
+var secrets struct {
+	mu     sync.Mutex
+	values []string
+}
+
+// addSecret makes redact mask s from now on
+func addSecret(s string) {
+	if len(s) == 0 {
+		return
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, v := range secrets.values {
+		if v == s {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, s)
+	// a secret that contains another one is masked first
+	sort.Slice(secrets.values, func(i, j int) bool { return len(secrets.values[i]) > len(secrets.values[j]) })
+}
+
+// bearerValue finds the credentials of an Authorization header that was
+// never added as a secret
+var bearerValue = regexp.MustCompile(`(?i)(bearer\s+)([^\s"',;]+)`)
+
+// mask keeps the last four characters of s so the secret can still be told
+// apart from the others
+func mask(s string) string {
+	if len(s) <= 8 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
+
+// redact masks every known secret and bearer credential in s, whatever
+// goes to the terminal, the logs or the queue passes through it
+func redact(s string) string {
+	secrets.mu.Lock()
+	for _, v := range secrets.values {
+		s = strings.ReplaceAll(s, v, mask(v))
+	}
+	secrets.mu.Unlock()
+
+	return bearerValue.ReplaceAllStringFunc(s, func(m string) string {
+		sub := bearerValue.FindStringSubmatch(m)
+		if strings.HasPrefix(sub[2], "****") {
+			return m
+		}
+		return sub[1] + mask(sub[2])
+	})
+}
+
+// errText is the message of err with the secrets masked
+func errText(err error) string {
+	return redact(err.Error())
+}
+
+// printUploadInfo prints the upload url and token unmasked with
+// --print-upload-info, the one place secrets are shown on purpose
+func printUploadInfo(opts *options, uploadURL, token string) {
+	if !opts.printUploadInfo {
+		return
+	}
+	fmt.Printf("upload url: %s\n", uploadURL)
+	fmt.Printf("upload token: %s\n", token)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errNoRenew is the answer of a scheduler that does not let the user
+// change the expiration, UpdateAssetExpiration is admin only or missing
+var errNoRenew = fmt.Errorf("the scheduler can not renew assets for this api key, its UpdateAssetExpiration is admin only or it has none")
+
+// unsupportedRPC is true when the scheduler refused an rpc for a missing
+// method or permission, not for anything about the request
+func unsupportedRPC(err error) bool {
+	s := err.Error()
+	return strings.Contains(s, "missing permission to invoke") || (strings.Contains(s, "method '") && strings.Contains(s, "not found"))
+}
+
+// renewTime is the new expiration of an asset expiring at old
+func renewTime(old time.Time, extend time.Duration, until time.Time) time.Time {
+	if !until.IsZero() {
+		return until
+	}
+	return old.Add(extend)
+}
+
+func runRenew(args []string) error {
+	opts := newOptions()
+	var (
+		filter assetFilter
+		extend time.Duration
+		until  timeFlag
+	)
+
+	fs := newFlagSet("renew")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	filter.register(fs)
+	fs.DurationVar(&extend, "extend", 0, "move the expiration this much later, like 720h")
+	fs.Var(&until, "until", "set the expiration to the date, like 2025-10-01 or an RFC 3339 time")
+
+	cids, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if (extend != 0) == !until.IsZero() {
+		return fmt.Errorf("give one of --extend or --until")
+	} else if extend < 0 {
+		return fmt.Errorf("extend can not be negative")
+	} else if !until.IsZero() && !until.After(time.Now()) {
+		return fmt.Errorf("until %s is not in the future", until.Format(time.RFC3339))
+	}
+
+	if err := filter.check(); err != nil {
+		return err
+	}
+
+	if len(cids) > 0 && !filter.empty() {
+		return fmt.Errorf("give either cids or filters, not both")
+	} else if len(cids) == 0 && filter.empty() {
+		return fmt.Errorf("please input the cids to renew or filters selecting them")
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	ctx := context.Background()
+	var entries []assetEntry
+	if len(cids) == 0 {
+		all, err := listUserAssets(ctx, conn.api)
+		if err != nil {
+			return err
+		}
+
+		entries = filter.apply(all)
+		if len(entries) == 0 {
+			fmt.Println("no asset matches the filters")
+			return nil
+		}
+	} else {
+		found, err := findUserAssets(ctx, conn.api, cids)
+		if err != nil {
+			return err
+		}
+		for _, c := range cids {
+			ov, ok := found[c]
+			if !ok || ov == nil {
+				return fmt.Errorf("renew %s: %w", c, errAssetNotFound)
+			}
+			entries = append(entries, newAssetEntry(ov))
+		}
+	}
+
+	var failed, renewed int
+	for _, e := range entries {
+		if e.Expiration.IsZero() {
+			fmt.Printf("%s has no expiration, nothing to renew\n", e.CID)
+			continue
+		}
+
+		expiration := renewTime(e.Expiration, extend, until.Time)
+		if err := conn.api.UpdateAssetExpiration(ctx, e.CID, expiration); err != nil {
+			if unsupportedRPC(err) {
+				return fmt.Errorf("renew %s: %w", e.CID, errNoRenew)
+			}
+			fmt.Printf("renew %s error %s\n", e.CID, describeError(err))
+			failed++
+			continue
+		}
+		renewed++
+		fmt.Printf("renewed %s, expiration %s, was %s\n", e.CID, expiration.Format(time.RFC3339), e.Expiration.Format(time.RFC3339))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d assets not renewed", failed, renewed+failed)
+	}
+	return nil
+}
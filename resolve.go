@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// resolveOverrides maps host:port to the address to dial instead,
+// it is a flag.Value for --resolve host:port:addr like curl has
+type resolveOverrides map[string]string
+
+func (r resolveOverrides) String() string {
+	entries := make([]string, 0, len(r))
+	for hostPort, addr := range r {
+		entries = append(entries, hostPort+"->"+addr)
+	}
+	return strings.Join(entries, ",")
+}
+
+func (r resolveOverrides) Set(s string) error {
+	host, rest, ok := strings.Cut(s, ":")
+	if !ok || len(host) == 0 {
+		return fmt.Errorf("invalid resolve %q, want host:port:addr", s)
+	}
+
+	port, addr, ok := strings.Cut(rest, ":")
+	if !ok {
+		return fmt.Errorf("invalid resolve %q, want host:port:addr", s)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q in resolve %q", port, s)
+	}
+
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if net.ParseIP(addr) == nil {
+		return fmt.Errorf("invalid address %q in resolve %q, it must be an ip", addr, s)
+	}
+
+	r[net.JoinHostPort(host, port)] = net.JoinHostPort(addr, port)
+	return nil
+}
+
+// apply returns the address to dial for addr
+func (r resolveOverrides) apply(addr string) string {
+	if override, ok := r[addr]; ok {
+		logVerbose("resolve %s to %s", addr, override)
+		return override
+	}
+	return addr
+}
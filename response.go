@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// uploadResponse is the json envelope a candidate answers an upload with,
+// the http status is 200 even when the upload failed so code tells
+type uploadResponse struct {
+	Code int    `json:"code"`
+	Err  int    `json:"err"`
+	Msg  string `json:"msg"`
+	// IDs are the other string and number fields of the envelope, the
+	// identifiers some candidates add
+	IDs map[string]string `json:"-"`
+}
+
+// parseUploadResponse decodes the body of an upload response, it fails for
+// a body that is not a json object
+func parseUploadResponse(b []byte) (*uploadResponse, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	r := &uploadResponse{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+
+	for k, v := range fields {
+		switch k {
+		case "code", "err", "msg":
+			continue
+		}
+
+		var s string
+		var n json.Number
+		if err := json.Unmarshal(v, &s); err == nil {
+			if len(s) == 0 {
+				continue
+			}
+		} else if err := json.Unmarshal(v, &n); err == nil {
+			s = n.String()
+		} else {
+			continue
+		}
+
+		if r.IDs == nil {
+			r.IDs = make(map[string]string)
+		}
+		r.IDs[k] = s
+	}
+	return r, nil
+}
+
+// failed is true when the candidate refused the upload in the envelope
+func (r *uploadResponse) failed() bool {
+	return r.Code != 0 || r.Err != 0
+}
+
+// errorCode is the code of a failed upload, err when code does not tell
+func (r *uploadResponse) errorCode() int {
+	if r.Code != 0 {
+		return r.Code
+	}
+	return r.Err
+}
+
+// idList is the ids as k=v in the order of their names
+func (r *uploadResponse) idList() string {
+	keys := make([]string, 0, len(r.IDs))
+	for k := range r.IDs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, r.IDs[k]))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// uploadRejectedError is an upload the candidate answered with a non zero
+// code in the envelope
+type uploadRejectedError struct {
+	host string
+	code int
+	msg  string
+}
+
+func (e *uploadRejectedError) Error() string {
+	return fmt.Sprintf("%s rejected the upload, code %d, %s", e.host, e.code, e.msg)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUploadResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// want is nil for a body that is not the envelope
+		want   *uploadResponse
+		failed bool
+	}{
+		{"success", `{"code":0,"err":0,"msg":"Upload succeeded"}`, &uploadResponse{Msg: "Upload succeeded"}, false},
+		{"ids", `{"code":0,"msg":"ok","id":"abc","file_id":12345,"done":true,"empty":"","meta":{"a":1}}`, &uploadResponse{Msg: "ok", IDs: map[string]string{"id": "abc", "file_id": "12345"}}, false},
+		{"code", `{"code":-1,"msg":"out of max size"}`, &uploadResponse{Code: -1, Msg: "out of max size"}, true},
+		{"err", `{"err":1003,"msg":"token expired"}`, &uploadResponse{Err: 1003, Msg: "token expired"}, true},
+		{"html", `<html><body>502 Bad Gateway</body></html>`, nil, false},
+		{"array", `[{"code":0}]`, nil, false},
+		{"empty", ``, nil, false},
+		{"code not a number", `{"code":"ok"}`, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUploadResponse([]byte(tt.body))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("%s is taken for the envelope %+v", tt.body, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("envelope %+v, want %+v", got, tt.want)
+			}
+			if got.failed() != tt.failed {
+				t.Errorf("failed is %t", got.failed())
+			}
+		})
+	}
+}
+
+func TestUploadResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		// body is what the endpoint answers with http 200
+		body string
+		// ids are the server_ids of --json, err is in the message of the
+		// failure, empty for an upload that succeeds
+		ids map[string]string
+		err string
+	}{
+		{"success", `{"code":0,"msg":"Upload succeeded"}`, nil, ""},
+		{"ids", `{"code":0,"msg":"ok","id":"abc","file_id":12345}`, map[string]string{"id": "abc", "file_id": "12345"}, ""},
+		{"rejected with 200", `{"code":0,"err":1003,"msg":"busy"}`, nil, "rejected the upload, code 1003, busy"},
+		{"not json", `<html><body>uploaded</body></html>`, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			s.uploadAnswer = tt.body
+			input := writeFile(t, "site.txt", "hello world\n")
+
+			var err error
+			var stdout string
+			stderr, _ := captureStderr(t, func() error {
+				stdout, err = captureStdout(t, func() error { return runUpload(uploadArgs("--json", "--no-postcheck", input)) })
+				return nil
+			})
+			// the body is only printed with -v
+			if strings.Contains(stderr, tt.body) {
+				t.Errorf("the body is printed without -v:\n%s", stderr)
+			}
+
+			if len(tt.err) > 0 {
+				if err == nil || len(stdout) > 0 {
+					t.Fatalf("the upload did not fail, error %v, stdout\n%s", err, stdout)
+				}
+				lines := strings.Split(strings.TrimSpace(stderr), "\n")
+				var f jsonFailure
+				if err := json.Unmarshal([]byte(lines[len(lines)-1]), &f); err != nil {
+					t.Fatalf("%v in\n%s", err, stderr)
+				}
+				if !strings.Contains(f.Error.Message, tt.err) {
+					t.Errorf("failure %q, want %q", f.Error.Message, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("upload: %v\n%s", err, stderr)
+			}
+			var result jsonResult
+			if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+				t.Fatalf("%v in\n%s", err, stdout)
+			}
+			if !reflect.DeepEqual(result.ServerIDs, tt.ids) {
+				t.Errorf("server ids %v, want %v", result.ServerIDs, tt.ids)
+			}
+		})
+	}
+}
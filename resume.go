@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/ipfs/go-cid"
+)
+
+// resumeSuffix names the state file kept next to the car of an upload
+const resumeSuffix = ".resume.json"
+
+// a token that runs out this soon is asked for again before the upload
+const tokenMargin = time.Minute
+
+// uploadState is what a --resume upload that failed after CreateUserAsset
+// leaves next to its car: the car, the asset record and the token are kept
+// so the next run sends the car again without packing it or asking for
+// another token. Candidates keep nothing of an upload that did not finish,
+// so the whole car is sent again
+type uploadState struct {
+	// Input is the absolute path the car was packed from, with the size and
+	// modification time it had then
+	Input   string    `json:"input"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	Car     string `json:"car"`
+	CarSize int64  `json:"car_size"`
+	Root    string `json:"root"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+
+	UploadURL string `json:"upload_url,omitempty"`
+	Token     string `json:"token,omitempty"`
+	// Expires is when the token runs out, zero when it can not be read
+	Expires  time.Time `json:"expires"`
+	Failed   time.Time `json:"failed"`
+	Manifest *manifest `json:"manifest,omitempty"`
+}
+
+func resumeStatePath(carPath string) string {
+	return carPath + resumeSuffix
+}
+
+// resumable is true for an upload that packs one input into a temp car, the
+// only car a later run can find again by its input
+func (opts *options) resumable() bool {
+	return !opts.batch && len(opts.wrapped) == 0 && len(opts.incremental) == 0 && opts.offset == 0 && opts.length == 0
+}
+
+// newUploadState is the state of the upload of asset packed from filePath,
+// the upload url and token are added once the scheduler gave them
+func newUploadState(filePath string, asset *packedAsset) (*uploadState, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	car, err := os.Stat(asset.carPath)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadState{Input: abs, Size: info.Size(), ModTime: info.ModTime(), Car: asset.carPath, CarSize: car.Size(), Root: asset.root.String(), Name: asset.name, Type: asset.assetType, Manifest: asset.manifest}, nil
+}
+
+// asset is the packed asset of the car of s
+func (s *uploadState) asset() (*packedAsset, error) {
+	root, err := cid.Decode(s.Root)
+	if err != nil {
+		return nil, fmt.Errorf("root of %s %w", resumeStatePath(s.Car), err)
+	}
+	return &packedAsset{carPath: s.Car, root: root, name: s.Name, assetType: s.Type, manifest: s.Manifest}, nil
+}
+
+func (s *uploadState) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the token is a secret of the user
+	p := resumeStatePath(s.Car)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func readUploadState(carPath string) (*uploadState, error) {
+	b, err := os.ReadFile(resumeStatePath(carPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &uploadState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("parse upload state %s: %w", resumeStatePath(carPath), err)
+	}
+	addSecret(s.Token)
+	return s, nil
+}
+
+// stale is why the car of s is not the one a pack of the input would give
+// now, empty when it still is
+func (s *uploadState) stale() string {
+	info, err := os.Stat(s.Input)
+	if err != nil {
+		return fmt.Sprintf("%s is gone", s.Input)
+	} else if info.Size() != s.Size || !info.ModTime().Equal(s.ModTime) {
+		return fmt.Sprintf("%s changed", s.Input)
+	}
+
+	car, err := os.Stat(s.Car)
+	if err != nil {
+		return fmt.Sprintf("its car %s is gone", s.Car)
+	} else if car.Size() != s.CarSize {
+		return fmt.Sprintf("its car %s has %d bytes, %d were packed", s.Car, car.Size(), s.CarSize)
+	}
+	return ""
+}
+
+// tokenExpiration is the expiration in the payload of a jwt upload token,
+// zero when the token is not one
+func tokenExpiration(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var payload types.AuthUserUploadDownloadAsset
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return time.Time{}
+	}
+	return payload.Expiration
+}
+
+// pendingUpload is the state an earlier run left for the upload of
+// filePath, nil when there is none or it no longer fits the input. A state
+// that does not fit is dropped with its asset record
+func pendingUpload(opts *options, schedulerAPI api.Scheduler, filePath string) (*uploadState, error) {
+	// a car kept for the name of a stream is not what the stream has now
+	if !opts.resumable() || isStreamInput(filePath) {
+		return nil, nil
+	}
+
+	name := path.Base(filePath)
+	if len(opts.name) > 0 {
+		name = opts.name
+	}
+	s, err := findUploadState(filePath, name)
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	if reason := s.stale(); len(reason) > 0 {
+		fmt.Printf("upload of %s kept in %s is not resumed, %s, pack it again\n", s.Root, resumeStatePath(s.Car), reason)
+		s.drop(opts, schedulerAPI)
+		os.Remove(s.Car)
+		return nil, nil
+	}
+
+	fmt.Printf("resume upload of %s from %s, packed %s, failed %s\n", s.Root, s.Car, formatSize(s.CarSize), s.Failed.Format(time.RFC3339))
+	return s, nil
+}
+
+// findUploadState is the latest state kept next to a temp car for the
+// upload of filePath as name, nil when there is none
+func findUploadState(filePath, name string) (*uploadState, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(os.TempDir(), tempCarPattern+resumeSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *uploadState
+	for _, m := range matches {
+		s, err := readUploadState(strings.TrimSuffix(m, resumeSuffix))
+		if err != nil {
+			logVerbose("upload state %s error %s", m, err.Error())
+			continue
+		}
+		if s != nil && s.Input == abs && s.Name == name && (latest == nil || s.Failed.After(latest.Failed)) {
+			latest = s
+		}
+	}
+	return latest, nil
+}
+
+// drop removes the state and the asset record it kept without data, so the
+// next CreateUserAsset of the cid is not refused as a duplicate
+func (s *uploadState) drop(opts *options, schedulerAPI api.Scheduler) {
+	if len(s.Token) > 0 {
+		c := *opts
+		c.noRollback = false
+		rollbackAsset(&c, schedulerAPI, s.Root, "dropping its upload state")
+	}
+	os.Remove(resumeStatePath(s.Car))
+}
+
+// resumeAsset is the upload url and token kept in s, a token that ran out
+// is asked for again with CreateUserAsset once the kept record is deleted
+func resumeAsset(schedulerAPI api.Scheduler, s *uploadState, property *types.AssetProperty) (*types.CreateAssetRsp, error) {
+	if len(s.Token) > 0 && (s.Expires.IsZero() || time.Until(s.Expires) > tokenMargin) {
+		logVerbose("upload of %s with the token kept in %s", s.Root, resumeStatePath(s.Car))
+		return &types.CreateAssetRsp{UploadURL: s.UploadURL, Token: s.Token}, nil
+	}
+
+	if len(s.Token) > 0 {
+		fmt.Printf("upload token of %s expired at %s, ask the scheduler for a new one\n", s.Root, s.Expires.Format(time.RFC3339))
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := schedulerAPI.DeleteUserAsset(ctx, s.Root)
+		cancel()
+		if err != nil {
+			logVerbose("delete kept record of %s error %s", s.Root, err.Error())
+		}
+	}
+	return schedulerAPI.CreateUserAsset(interruptContext(), property)
+}
+
+// keepOrRollback saves the state of an upload that did not happen for
+// --resume, or rolls its asset record back
+func keepOrRollback(opts *options, schedulerAPI api.Scheduler, carPath, carCID string, rsp *types.CreateAssetRsp, reason string) {
+	s := opts.pendingState
+	if s == nil || s.Car != carPath || s.Root != carCID {
+		rollbackAsset(opts, schedulerAPI, carCID, reason)
+		return
+	}
+
+	s.UploadURL, s.Token, s.Expires, s.Failed = rsp.UploadURL, rsp.Token, tokenExpiration(rsp.Token), time.Now()
+	if err := s.save(); err != nil {
+		fmt.Printf("warning: upload state of %s not kept, %s\n", carCID, err.Error())
+		rollbackAsset(opts, schedulerAPI, carCID, reason)
+		return
+	}
+	fmt.Printf("upload of %s kept in %s after %s, run the same upload again to resume it\n", carCID, resumeStatePath(carPath), reason)
+}
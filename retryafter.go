@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a request refused with 429 or 503 is sent this many times in all
+const retryAfterAttempts = 3
+
+// the wait before the second attempt of an upload, it doubles for every
+// attempt after up to --retry-max-wait
+const uploadBackoff = time.Second
+
+// parseRetryAfter reads a Retry-After header, either delta seconds or
+// an http date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if len(v) == 0 {
+		return 0, false
+	}
+
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		// a huge value must not overflow, it is clamped anyway
+		if secs > int64(24*time.Hour/time.Second) {
+			secs = int64(24 * time.Hour / time.Second)
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// retryAfterDelay is how long a 429 or 503 response asks to wait, at most
+// max. It is false for other responses and ones without Retry-After
+func retryAfterDelay(resp *http.Response, max time.Duration) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return 0, false
+	}
+
+	if d > max {
+		logVerbose("retry-after %s is more than %s, wait %s", d, max, max)
+		d = max
+	}
+	return d, true
+}
+
+// retryLaterError is an upload the endpoint refused with 429 or 503
+type retryLaterError struct {
+	status string
+	// after is the wait the response asked for, when it had Retry-After
+	after     time.Duration
+	hasHeader bool
+}
+
+func (e *retryLaterError) Error() string {
+	return fmt.Sprintf("upload refused, %s", e.status)
+}
+
+// rpcTimeoutError is a request to the locator or the scheduler that got no
+// answer within --rpc-timeout, it is still the timeout it wraps
+type rpcTimeoutError struct {
+	host    string
+	timeout time.Duration
+	err     error
+}
+
+func (e *rpcTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for %s to answer", formatDuration(e.timeout), e.host)
+}
+
+func (e *rpcTimeoutError) Unwrap() error { return e.err }
+
+func (e *rpcTimeoutError) Timeout() bool { return true }
+
+func (e *rpcTimeoutError) Temporary() bool { return true }
+
+// retryAfterTransport sends a request again after the wait a 429 or 503
+// response asks for in Retry-After, other responses are returned as they
+// are. Every attempt has its own timeout so the wait does not count
+type retryAfterTransport struct {
+	base    http.RoundTripper
+	max     time.Duration
+	timeout time.Duration
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		// the context of every attempt is cancelled before the next one
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if t.timeout > 0 {
+			ctx, cancel = context.WithTimeout(req.Context(), t.timeout)
+		} else {
+			ctx, cancel = context.WithCancel(req.Context())
+		}
+		r := req.Clone(ctx)
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if err != nil {
+			// only the timeout of the attempt is named, not one of the caller
+			if ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil {
+				err = &rpcTimeoutError{host: req.URL.Host, timeout: t.timeout, err: err}
+			}
+			cancel()
+			return nil, err
+		}
+
+		// a body that can not be sent again ends the retries
+		delay, ok := retryAfterDelay(resp, t.max)
+		if !ok || attempt == retryAfterAttempts || (req.Body != nil && req.GetBody == nil) {
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) //nolint:errcheck
+		resp.Body.Close()
+		cancel()
+
+		logVerbose("%s %s, honor retry-after %s", req.URL.Host, resp.Status, delay)
+		recordRetry("rpc", attempt, req.URL.Host, resp.Status, delay, true)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// cancelBody releases the timeout of a request once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// uploadStatusError is an upload answered with an http error status, msg
+// is the message of a json envelope that did not say it failed
+type uploadStatusError struct {
+	host   string
+	status string
+	code   int
+	msg    string
+}
+
+func (e *uploadStatusError) Error() string {
+	if len(e.msg) > 0 {
+		return fmt.Sprintf("upload to %s answered %s, %s", e.host, e.status, e.msg)
+	}
+	return fmt.Sprintf("upload to %s answered %s", e.host, e.status)
+}
+
+// transientUpload is the reason an upload attempt is worth sending again:
+// a connection error or timeout, 408, 429 or a 5xx. Other answers of the
+// endpoint would be the same the next time, and a stalled endpoint is
+// given up for the next one
+func transientUpload(err error) (string, bool) {
+	var (
+		rl *retryLaterError
+		se *stallError
+		st *uploadStatusError
+	)
+	switch {
+	case err == nil, errors.As(err, &se):
+		return "", false
+	case errors.As(err, &rl):
+		return rl.status, true
+	case errors.As(err, &st):
+		return st.status, st.code == http.StatusRequestTimeout || (st.code >= 500 && st.code != http.StatusInsufficientStorage)
+	case connectionError(err):
+		return errText(err), true
+	}
+	return "", false
+}
+
+// backoffDelay is the wait after the failed attempt n of an upload, the
+// exponential backoff with the upper half jittered so uploads that failed
+// together do not come back together
+func backoffDelay(n int, max time.Duration) time.Duration {
+	d := uploadBackoff
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d/2 <= 0 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
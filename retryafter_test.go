@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// contextsTransport keeps the request of every attempt
+type contextsTransport struct {
+	base     http.RoundTripper
+	requests []*http.Request
+}
+
+func (t *contextsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return t.base.RoundTrip(req)
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// refused are the attempts answered 503 with Retry-After, slow is a
+		// wait before any answer
+		refused int
+		slow    time.Duration
+		// attempts are the requests sent, status the one returned
+		attempts int
+		status   int
+		timedOut bool
+	}{
+		{name: "ok", attempts: 1, status: http.StatusOK},
+		{name: "retry after", refused: 2, attempts: 3, status: http.StatusOK},
+		{name: "retry after with timeout", timeout: time.Minute, refused: 2, attempts: 3, status: http.StatusOK},
+		{name: "refused every time", timeout: time.Minute, refused: 5, attempts: retryAfterAttempts, status: http.StatusServiceUnavailable},
+		{name: "timeout", timeout: 20 * time.Millisecond, slow: time.Second, attempts: 1, timedOut: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the handler of a timed out attempt is still running when the
+			// test looks at the bodies
+			var mu sync.Mutex
+			var bodies []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				bodies = append(bodies, string(b))
+				n := len(bodies)
+				mu.Unlock()
+				if n <= tt.refused {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				select {
+				case <-time.After(tt.slow):
+				case <-r.Context().Done():
+					return
+				}
+				fmt.Fprint(w, "answer")
+			}))
+			defer server.Close()
+
+			base := &contextsTransport{base: http.DefaultTransport}
+			rt := &retryAfterTransport{base: base, max: time.Second, timeout: tt.timeout}
+			req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("request"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := rt.RoundTrip(req)
+			var te *rpcTimeoutError
+			if tt.timedOut != errors.As(err, &te) {
+				t.Fatalf("error %v, want a timeout %t", err, tt.timedOut)
+			} else if err == nil {
+				if resp.StatusCode != tt.status {
+					t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+				}
+				io.Copy(io.Discard, resp.Body) //nolint:errcheck
+				resp.Body.Close()
+			}
+
+			if len(base.requests) != tt.attempts {
+				t.Fatalf("%d attempts, want %d", len(base.requests), tt.attempts)
+			}
+			// the body is sent again with every attempt
+			mu.Lock()
+			defer mu.Unlock()
+			for i, b := range bodies {
+				if b != "request" {
+					t.Errorf("attempt %d sent %q", i+1, b)
+				}
+			}
+			// the context of every attempt is released once it is done
+			for i, r := range base.requests {
+				if r.Context().Err() == nil {
+					t.Errorf("the context of attempt %d is not cancelled", i+1)
+				}
+			}
+		})
+	}
+}
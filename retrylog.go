@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// retryEvent is one request that was tried again, or an endpoint or api
+// key given up for the next one
+type retryEvent struct {
+	// Phase is rpc, upload, fallback to the next endpoint, key for the
+	// next api key or scheduler for the next scheduler of the key
+	Phase string `json:"phase"`
+	// Attempt is the number of the attempt that failed
+	Attempt  int    `json:"attempt"`
+	Endpoint string `json:"endpoint"`
+	Class    string `json:"class"`
+	// DelayMS is the wait before the next attempt
+	DelayMS    int64 `json:"delay_ms"`
+	RetryAfter bool  `json:"retry_after"`
+}
+
+// retryLog collects the retry events of the upload being done, the result
+// of the upload takes them
+var retryLog struct {
+	mu     sync.Mutex
+	events []retryEvent
+}
+
+func recordRetry(phase string, attempt int, endpoint, class string, delay time.Duration, retryAfter bool) {
+	retryLog.mu.Lock()
+	defer retryLog.mu.Unlock()
+	retryLog.events = append(retryLog.events, retryEvent{
+		Phase:      phase,
+		Attempt:    attempt,
+		Endpoint:   endpoint,
+		Class:      class,
+		DelayMS:    delay.Milliseconds(),
+		RetryAfter: retryAfter,
+	})
+}
+
+// takeRetries returns the events since the last call
+func takeRetries() []retryEvent {
+	retryLog.mu.Lock()
+	defer retryLog.mu.Unlock()
+	events := retryLog.events
+	retryLog.events = nil
+	return events
+}
+
+// retryClass names why an attempt failed in a retry event
+func retryClass(err error) string {
+	var (
+		rl *retryLaterError
+		se *stallError
+		re *uploadRejectedError
+		st *uploadStatusError
+	)
+	switch {
+	case errors.As(err, &rl):
+		return rl.status
+	case errors.As(err, &se):
+		return "stalled"
+	case errors.As(err, &re):
+		return fmt.Sprintf("rejected, code %d", re.code)
+	case errors.As(err, &st):
+		return st.status
+	}
+	return failureClass(err)
+}
+
+// endpointHost is the host of an upload url for the retry table, the path
+// carries nothing that tells endpoints apart
+func endpointHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && len(u.Host) > 0 {
+		return u.Host
+	}
+	return endpoint
+}
+
+// printRetries prints the retry events as a table with -v
+func printRetries(events []retryEvent) {
+	if len(events) == 0 || logLevel < levelVerbose {
+		return
+	}
+
+	fmt.Printf("retries: %d\n", len(events))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tATTEMPT\tENDPOINT\tCLASS\tDELAY\tRETRY-AFTER")
+	for _, ev := range events {
+		retryAfter := "no"
+		if ev.RetryAfter {
+			retryAfter = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", ev.Phase, ev.Attempt, ev.Endpoint, ev.Class, formatDuration(time.Duration(ev.DelayMS)*time.Millisecond), retryAfter)
+	}
+	tw.Flush()
+}
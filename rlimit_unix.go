@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// openFileLimit is the soft limit of open files, an unlimited or unknown
+// limit is taken as 4096 so the packer still has a bound
+func openFileLimit() int {
+	var rl unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rl); err != nil || rl.Cur == unix.RLIM_INFINITY || rl.Cur > 1<<20 {
+		return 4096
+	}
+	return int(rl.Cur)
+}
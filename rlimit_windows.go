@@ -0,0 +1,7 @@
+package main
+
+// openFileLimit is a fixed bound, windows limits handles per process far
+// above what a pack opens and has no rlimit to read
+func openFileLimit() int {
+	return 4096
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// peakRSS is the most memory the process had resident
+func peakRSS() (int64, bool) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0, false
+	}
+	// darwin reports bytes, the others kilobytes
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		return int64(ru.Maxrss), true
+	}
+	return int64(ru.Maxrss) << 10, true
+}
@@ -0,0 +1,6 @@
+package main
+
+// peakRSS is not known on windows
+func peakRSS() (int64, bool) {
+	return 0, false
+}
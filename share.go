@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// uploadResult is the summary of an upload
+type uploadResult struct {
+	// Phase is result so the line stands out among json progress lines
+	Phase string `json:"phase"`
+	CID   string `json:"cid"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	// Size is the size of the car that was uploaded
+	Size int64 `json:"size,omitempty"`
+	// Visibility is always private, the urls carry the token
+	Visibility string `json:"visibility"`
+	URL        string `json:"url,omitempty"`
+	// PathURL is the url of a file in a folder asset, {path} is replaced
+	// with the path of the file in the folder
+	PathURL string `json:"path_url,omitempty"`
+	// ServerIDs are the identifiers the candidate answered the upload with
+	ServerIDs map[string]string `json:"server_ids,omitempty"`
+	// Retries are the attempts that failed on the way, none when the
+	// upload went through at once
+	Retries []retryEvent `json:"retries,omitempty"`
+	// ContentType is the mime type of a file asset, CreateUserAsset has no
+	// field for it so it is only known here and in the manifest
+	ContentType string `json:"content_type,omitempty"`
+	// Metadata are the directories with a metadata file keyed by path
+	Metadata map[string]manifestDir `json:"metadata,omitempty"`
+	// Scheduler is the scheduler that served the upload, another than the
+	// locator assigned when it was down
+	Scheduler  string `json:"scheduler,omitempty"`
+	FailedOver bool   `json:"failed_over,omitempty"`
+	// Imported is a cid registered without an upload, no byte was sent
+	Imported    bool   `json:"imported,omitempty"`
+	Transferred *int64 `json:"transferred,omitempty"`
+	// AlreadyExists is an asset the scheduler had before the upload, the
+	// car was not sent
+	AlreadyExists bool `json:"already_exists,omitempty"`
+}
+
+// shareURL asks the scheduler for a retrieval url of the asset, the url
+// carries the access token so it can be opened as is
+func shareURL(opts *options, conn *schedulerConn, root string) (*url.URL, error) {
+	urls, err := conn.api.ShareUserAssets(context.Background(), []string{root})
+	if err != nil {
+		return nil, fmt.Errorf("ShareUserAssets %w", err)
+	}
+
+	u, err := url.Parse(urls[root])
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("scheduler returned invalid share url %q", urls[root])
+	}
+
+	if len(opts.gatewayBase) > 0 {
+		base, err := url.Parse(opts.gatewayBase)
+		if err != nil || len(base.Scheme) == 0 || len(base.Host) == 0 {
+			return nil, fmt.Errorf("invalid gateway base %q, want a url like https://gateway.example.com", opts.gatewayBase)
+		}
+
+		// any node of the scheduler accepts the token
+		u.Scheme = base.Scheme
+		u.Host = base.Host
+		u.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+		return u, nil
+	}
+
+	// candidates serve the address they advertise over https only
+	if u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	return u, nil
+}
+
+// printUploadResult prints the summary of an upload with its retrieval url,
+// with json progress the summary is a json line. response is nil when the
+// candidate answered with a body that is not the json envelope, m is the
+// manifest of the pack when there is one
+func printUploadResult(opts *options, conn *schedulerConn, root, name, assetType string, response *uploadResponse, m *manifest) {
+	newUploadResult(opts, conn, root, name, assetType, response, m).print(opts)
+}
+
+// newUploadResult is the summary of an upload with its retrieval url
+func newUploadResult(opts *options, conn *schedulerConn, root, name, assetType string, response *uploadResponse, m *manifest) *uploadResult {
+	r := &uploadResult{Phase: "result", CID: root, Name: name, Type: assetType, Visibility: opts.visibility, Retries: takeRetries()}
+	if response != nil {
+		r.ServerIDs = response.IDs
+	}
+	if conn.route != nil {
+		r.Scheduler, r.FailedOver = conn.scheduler(), conn.route.failedOver()
+	}
+	if m != nil {
+		r.Metadata = m.Dirs
+		if f, ok := m.single(); ok && assetType == "file" {
+			r.ContentType = f.Type
+		}
+	}
+
+	u, err := shareURL(opts, conn, root)
+	if err != nil {
+		fmt.Printf("warning: no retrieval url for %s, %s\n", root, errText(err))
+	} else {
+		r.URL = u.String()
+		if assetType == "folder" {
+			// the file name of the folder is wrong for a file in it
+			q := u.Query()
+			q.Del("filename")
+			r.PathURL = fmt.Sprintf("%s://%s%s/{path}?%s", u.Scheme, u.Host, u.EscapedPath(), q.Encode())
+		}
+	}
+	return r
+}
+
+func (r *uploadResult) print(opts *options) {
+
+	// the qr code goes to stderr when stdout is for json lines
+	qrOut := os.Stdout
+	if opts.progressMode == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.Encode(r) //nolint:errcheck
+		qrOut = os.Stderr
+	} else {
+		fmt.Printf("visibility: %s\n", r.Visibility)
+		if r.FailedOver {
+			fmt.Printf("scheduler: %s, the assigned one was down\n", r.Scheduler)
+		}
+		if len(r.ContentType) > 0 {
+			fmt.Printf("content type: %s\n", r.ContentType)
+		}
+		if r.Imported {
+			fmt.Printf("transferred: 0 B, the scheduler already had the content\n")
+		}
+		if len(r.ServerIDs) > 0 {
+			fmt.Printf("server ids: %s\n", (&uploadResponse{IDs: r.ServerIDs}).idList())
+		}
+		if len(r.URL) > 0 {
+			fmt.Printf("url: %s\n", r.URL)
+		}
+		if len(r.PathURL) > 0 {
+			fmt.Printf("files in the folder: %s\n", strings.Replace(r.PathURL, "{path}", "<path>", 1))
+		}
+		if len(r.Metadata) > 0 {
+			fmt.Printf("metadata: %d directories, run meta %s to show it\n", len(r.Metadata), r.CID)
+		}
+		printRetries(r.Retries)
+	}
+
+	if opts.qr || len(opts.qrOut) > 0 {
+		if err := printQR(opts, r.URL, qrOut); err != nil {
+			fmt.Printf("warning: no qr code, %s\n", err.Error())
+		}
+	}
+}
+
+// printQR renders u as a qr code, to a png file with --qr-out
+func printQR(opts *options, u string, w io.Writer) error {
+	if len(u) == 0 {
+		return fmt.Errorf("there is no url")
+	}
+
+	q, err := newQRCode(u)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.qrOut) > 0 {
+		if err := q.writePNG(opts.qrOut, 8); err != nil {
+			return err
+		}
+		fmt.Printf("qr code written to %s\n", opts.qrOut)
+	}
+
+	if opts.qr {
+		q.render(w, unicodeTerminal())
+	}
+	return nil
+}
+
+// errNoShareLifecycle is the answer to what the user api of the scheduler
+// can not do, ShareUserAssets makes links that never expire and there is no
+// api to list or revoke them
+var errNoShareLifecycle = fmt.Errorf("the scheduler can not do this, its ShareUserAssets only makes links without an expiry and it has no api to list or revoke shares")
+
+// errNoPublicAssets is why --visibility public and set-visibility public fail
+var errNoPublicAssets = fmt.Errorf("the scheduler has no public assets, candidates serve an asset only with a token it signs for the owner, share the asset to get a url with the token")
+
+func runShare(args []string) error {
+	if len(args) > 0 && (args[0] == "list" || args[0] == "revoke") {
+		return fmt.Errorf("share %s: %w", args[0], errNoShareLifecycle)
+	}
+
+	opts := newOptions()
+	var expires time.Duration
+
+	fs := newFlagSet("share")
+	opts.commonFlags(fs)
+	opts.connectFlags(fs)
+	fs.StringVar(&opts.gatewayBase, "gateway-base", "", "base url of the retrieval url, like https://gateway.example.com, default is the node the scheduler names")
+	fs.BoolVar(&opts.qr, "qr", false, "show the retrieval url as a qr code")
+	fs.DurationVar(&expires, "expires", 0, "make a link that stops working after the duration, like 168h")
+
+	cids, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(cids) == 0 {
+		return fmt.Errorf("please input the cids to share")
+	}
+
+	// a permanent link must not be handed out as a temporary one
+	if expires != 0 {
+		return fmt.Errorf("--expires %s: %w", expires, errNoShareLifecycle)
+	}
+
+	if err := opts.requireAPIKey(); err != nil {
+		return err
+	}
+
+	stop, err := opts.setup()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	conn, err := connectScheduler(opts, make(map[int]bool))
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	var failed int
+	for _, c := range cids {
+		u, err := shareURL(opts, conn, c)
+		if err != nil {
+			fmt.Printf("share %s error %s\n", c, errText(err))
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s %s, expires never\n", c, u.String())
+		if opts.qr {
+			if err := printQR(opts, u.String(), os.Stdout); err != nil {
+				fmt.Printf("warning: no qr code, %s\n", err.Error())
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d assets not shared", failed, len(cids))
+	}
+	return nil
+}
+
+func runSetVisibility(args []string) error {
+	opts := newOptions()
+
+	fs := newFlagSet("set-visibility")
+	opts.commonFlags(fs)
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("please input the cid and the visibility, private or public")
+	}
+
+	opts.visibility = args[1]
+	if err := opts.checkVisibility(); err != nil {
+		return err
+	}
+
+	// private is what every asset already is
+	fmt.Printf("%s is private, retrieving it needs a token, share it to get a url with one\n", args[0])
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// exitInterrupted is the exit code of a run stopped by SIGINT or SIGTERM
+const exitInterrupted = 130
+
+var interrupt struct {
+	sync.Mutex
+	once sync.Once
+	next int
+	fns  map[int]func()
+	// ctx is cancelled by the first signal, before the functions run
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// watchInterrupt starts the handler of the first call. The first signal
+// cancels the transfers and runs the cleanup, a second one quits without
+// waiting for a rollback that hangs
+func watchInterrupt() {
+	interrupt.once.Do(func() {
+		interrupt.fns = make(map[int]func())
+		interrupt.ctx, interrupt.cancel = context.WithCancel(context.Background())
+		ch := make(chan os.Signal, 2)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-ch
+			fmt.Fprintln(os.Stderr, "interrupted, clean up, interrupt again to quit now")
+			interrupt.cancel()
+			go func() {
+				<-ch
+				os.Exit(exitInterrupted)
+			}()
+
+			interrupt.Lock()
+			for id := interrupt.next; id >= 0; id-- {
+				if fn, ok := interrupt.fns[id]; ok {
+					fn()
+				}
+			}
+			os.Exit(exitInterrupted)
+		}()
+	})
+}
+
+// interruptContext is cancelled when the process is interrupted, the
+// packing, the rpcs and the uploads it is given stop then
+func interruptContext() context.Context {
+	watchInterrupt()
+	return interrupt.ctx
+}
+
+// onInterrupt runs fn and exits when the process is interrupted, the
+// functions of every call run newest first. The returned func removes fn
+// once it is no longer needed
+func onInterrupt(fn func()) func() {
+	interrupt.Lock()
+	defer interrupt.Unlock()
+
+	watchInterrupt()
+	id := interrupt.next
+	interrupt.next++
+	interrupt.fns[id] = fn
+	return func() {
+		interrupt.Lock()
+		delete(interrupt.fns, id)
+		interrupt.Unlock()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useInterrupt makes the returned cancel the first interrupt of the runs,
+// without the signal and the exit that follows it
+func useInterrupt(t *testing.T) context.CancelFunc {
+	watchInterrupt()
+	ctx, cancel := context.WithCancel(context.Background())
+	saved := interrupt.ctx
+	interrupt.ctx = ctx
+	t.Cleanup(func() {
+		cancel()
+		interrupt.ctx = saved
+	})
+	return cancel
+}
+
+func TestInterruptUpload(t *testing.T) {
+	for _, style := range []string{"put", "multipart"} {
+		t.Run(style, func(t *testing.T) {
+			tmp := testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			cancel := useInterrupt(t)
+
+			// the endpoint takes a KiB and then waits, the upload is in
+			// flight until it is stopped
+			started, ended := make(chan struct{}), make(chan error, 1)
+			stopped := make(chan struct{})
+			s.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := io.ReadFull(r.Body, make([]byte, 1024)); err != nil {
+					ended <- err
+					return
+				}
+				close(started)
+				<-stopped
+				_, err := io.Copy(io.Discard, r.Body)
+				ended <- err
+			})
+			input := filepath.Join(t.TempDir(), "disk.img")
+			if err := os.WriteFile(input, testData(16<<20), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := captureStdout(t, func() error { return runUpload(uploadArgs("--upload-style", style, "--no-postcheck", input)) })
+				done <- err
+			}()
+			select {
+			case <-started:
+			case err := <-done:
+				t.Fatalf("upload ended before it was sent: %v", err)
+			}
+			cancel()
+			close(stopped)
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("error %v, want context canceled", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the upload goes on after the interrupt")
+			}
+			// the endpoint sees the request end before the car did
+			select {
+			case err := <-ended:
+				if err == nil {
+					t.Errorf("the endpoint read the request to its end, %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the request is still open")
+			}
+			if cars := tempCars(t, tmp); len(cars) > 0 {
+				t.Errorf("temp cars left: %v", cars)
+			}
+			if n := s.count("DeleteUserAsset"); n != 1 {
+				t.Errorf("%d DeleteUserAsset, the record is not rolled back", n)
+			}
+		})
+	}
+}
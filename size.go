@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// siUnits makes formatSize use decimal units, it is set from --si
+var siUnits bool
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"kB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseSize parses a size such as 1048576, 512MiB or 2GB
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	multiple := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			multiple = u.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiple)), nil
+}
+
+// formatSize formats n in binary units such as 3.48 GiB, or decimal units
+// such as 3.74 GB with --si. Bytes are whole, larger units have two
+// decimals. Totals must be summed before formatting, not from the output
+func formatSize(n int64) string {
+	units, base := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}, 1024.0
+	if siUnits {
+		units, base = []string{"B", "kB", "MB", "GB", "TB", "PB"}, 1000
+	}
+
+	if n < int64(base) && n > -int64(base) {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	// a value that rounds up to base, like 1023.999 KiB, is shown in the
+	// next unit and not as 1024.00 KiB
+	v := float64(n)
+	i := 0
+	for math.Abs(math.Round(v*100)/100) >= base && i < len(units)-1 {
+		v /= base
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", v, units[i])
+}
+
+// formatDuration formats d like 1h23m45s, a duration under a second keeps
+// its milliseconds
+func formatDuration(d time.Duration) string {
+	if d < time.Second && d > -time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// byteSize is a flag.Value for sizes in bytes
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
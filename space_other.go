@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "fmt"
+
+// freeSpace always fails on this platform, the free space is unknown
+func freeSpace(dir string) (int64, error) {
+	return 0, fmt.Errorf("free space of %s can not be read on this platform", dir)
+}
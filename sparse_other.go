@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// newFileReader returns f as is, holes can not be detected on this platform
+func newFileReader(f *os.File, info os.FileInfo) io.Reader {
+	return f
+}
+
+// sparseHoleBytes always returns 0 on this platform
+func sparseHoleBytes(r io.Reader) int64 {
+	return 0
+}
@@ -0,0 +1,99 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sparseReader reads a file and synthesizes the zeros of its holes instead
+// of reading them from disk, holes are found with SEEK_DATA/SEEK_HOLE
+type sparseReader struct {
+	f    *os.File
+	size int64
+	off  int64
+	// the current region [off, end) is a hole or data
+	end  int64
+	hole bool
+	// bytes produced from holes
+	holeBytes int64
+}
+
+// newFileReader returns a reader for the content of f, sparse files get
+// a sparseReader and everything else is read as is
+func newFileReader(f *os.File, info os.FileInfo) io.Reader {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Blocks*512 >= info.Size() {
+		return f
+	}
+	return &sparseReader{f: f, size: info.Size()}
+}
+
+func (sr *sparseReader) Read(p []byte) (int, error) {
+	if sr.off >= sr.size {
+		return 0, io.EOF
+	}
+
+	if sr.off >= sr.end {
+		sr.nextRegion()
+	}
+
+	if n := sr.end - sr.off; int64(len(p)) > n {
+		p = p[:n]
+	}
+
+	if sr.hole {
+		for i := range p {
+			p[i] = 0
+		}
+		sr.off += int64(len(p))
+		sr.holeBytes += int64(len(p))
+		return len(p), nil
+	}
+
+	n, err := sr.f.ReadAt(p, sr.off)
+	sr.off += int64(n)
+	if err == io.EOF && sr.off < sr.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextRegion finds the hole or data region starting at sr.off
+func (sr *sparseReader) nextRegion() {
+	data, err := sr.f.Seek(sr.off, unix.SEEK_DATA)
+	if errors.Is(err, syscall.ENXIO) {
+		// no more data, the rest of the file is a hole
+		sr.hole, sr.end = true, sr.size
+		return
+	}
+	if err != nil {
+		// the filesystem can not report holes, read the rest
+		sr.hole, sr.end = false, sr.size
+		return
+	}
+
+	if data > sr.off {
+		sr.hole, sr.end = true, data
+		return
+	}
+
+	hole, err := sr.f.Seek(sr.off, unix.SEEK_HOLE)
+	if err != nil || hole > sr.size {
+		hole = sr.size
+	}
+	sr.hole, sr.end = false, hole
+}
+
+// sparseHoleBytes returns how many bytes of r were synthesized from holes
+func sparseHoleBytes(r io.Reader) int64 {
+	if sr, ok := r.(*sparseReader); ok {
+		return sr.holeBytes
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sparseFixture writes a file of size bytes that is a hole but for data at
+// the offsets, it returns the file and its content
+func sparseFixture(t *testing.T, size int64, data map[int64][]byte) (string, []byte) {
+	p := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, size)
+	for off, b := range data {
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		copy(content[off:], b)
+	}
+	return p, content
+}
+
+func TestSparseReader(t *testing.T) {
+	const size = 48 << 20
+	tests := []struct {
+		name string
+		data map[int64][]byte
+	}{
+		{"data at the start", map[int64][]byte{0: testData(100)}},
+		{"data in the middle", map[int64][]byte{20 << 20: testData(1 << 20), 33<<20 + 7: testData(5000)}},
+		{"data at the end", map[int64][]byte{size - 77: testData(77)}},
+		{"holes only", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			p, content := sparseFixture(t, size, tt.data)
+			f, err := os.Open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := newFileReader(f, info)
+			if _, ok := r.(*sparseReader); !ok {
+				t.Skip("the file system of the temp directory keeps no holes")
+			}
+			// reads of odd sizes end on every edge of a hole
+			got, err := io.ReadAll(io.LimitReader(r, size+1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatal("the sparse read is not the content of the file")
+			}
+			var stored int64
+			for _, b := range tt.data {
+				stored += int64(len(b))
+			}
+			if holes := sparseHoleBytes(r); holes == 0 || holes > size-stored {
+				t.Errorf("%d bytes from holes, the file has %d bytes of data", holes, stored)
+			}
+
+			// the cid of the pack is the one of a full read
+			want, err := calculateCid(bytes.NewReader(content), dagFormat{chunker: defaultChunker})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := packCID(t, p); got != want.String() {
+				t.Errorf("cid %s, a full read gives %s", got, want)
+			}
+		})
+	}
+}
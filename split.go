@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// a split upload is a file uploaded as part assets of at most --split-size
+// bytes and a small asset listing them, download puts the file together
+// again when it is given the cid of that listing
+const (
+	splitFormat  = "storage-upload-sample/split"
+	splitVersion = 1
+	// download finds a listing only in a single block, the chunk size of
+	// the unixfs builder, that is thousands of parts
+	maxSplitManifest = 256 << 10
+)
+
+// splitPart is a part of a split upload in the order of the file
+type splitPart struct {
+	Name   string `json:"name"`
+	CID    string `json:"cid,omitempty"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// splitManifest is the listing uploaded after the parts
+type splitManifest struct {
+	Format  string      `json:"format"`
+	Version int         `json:"version"`
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Parts   []splitPart `json:"parts"`
+}
+
+// splitState is what a split upload has done so far, a failed upload is
+// run again from it and only uploads the parts that have no cid yet
+type splitState struct {
+	Input     string      `json:"input"`
+	Size      int64       `json:"size"`
+	ModTime   time.Time   `json:"mod_time"`
+	SplitSize int64       `json:"split_size"`
+	Parts     []splitPart `json:"parts"`
+}
+
+func splitsDir() string {
+	return filepath.Join(stateDir(), "splits")
+}
+
+// splitStatePath is the state of the split upload of input, by its absolute path
+func splitStatePath(input string) string {
+	abs, err := filepath.Abs(input)
+	if err != nil {
+		abs = input
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(splitsDir(), hex.EncodeToString(sum[:8])+".json")
+}
+
+// newSplitState cuts a file of info.Size() bytes into parts named after name
+func newSplitState(input, name string, info os.FileInfo, splitSize int64) *splitState {
+	s := &splitState{Input: input, Size: info.Size(), ModTime: info.ModTime(), SplitSize: splitSize}
+
+	n := int((info.Size() + splitSize - 1) / splitSize)
+	width := len(fmt.Sprint(n))
+	if width < 2 {
+		width = 2
+	}
+	for i := 0; i < n; i++ {
+		p := splitPart{Name: fmt.Sprintf("%s.part%0*d", name, width, i+1), Offset: int64(i) * splitSize, Length: splitSize}
+		if p.Offset+p.Length > info.Size() {
+			p.Length = info.Size() - p.Offset
+		}
+		s.Parts = append(s.Parts, p)
+	}
+	return s
+}
+
+// loadSplitState is the state of an earlier split upload of the same file
+// with the same split size, nil when there is none or the file changed
+func loadSplitState(input string, info os.FileInfo, splitSize int64) (*splitState, error) {
+	b, err := os.ReadFile(splitStatePath(input))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &splitState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("parse split state %s: %w", splitStatePath(input), err)
+	}
+
+	if s.Size != info.Size() || !s.ModTime.Equal(info.ModTime()) || s.SplitSize != splitSize {
+		fmt.Printf("%s changed or split-size is not %s, the parts of the earlier upload are not used\n", input, formatSize(s.SplitSize))
+		return nil, nil
+	}
+	return s, nil
+}
+
+func (s *splitState) save(input string) error {
+	if err := os.MkdirAll(splitsDir(), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := splitStatePath(input)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// needsSplit is true when filePath is a regular file larger than splitSize
+func needsSplit(filePath string, splitSize int64) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	} else if !info.Mode().IsRegular() {
+		return false, fmt.Errorf("split-size only applies to a regular file, %s is not one", filePath)
+	}
+
+	if info.Size() <= splitSize {
+		logVerbose("%s has %s, not more than split-size, upload it as one asset", filePath, formatSize(info.Size()))
+		return false, nil
+	}
+	return true, nil
+}
+
+// uploadSplit uploads filePath as parts of at most --split-size bytes one
+// after the other, then the listing of the parts. The state is saved after
+// every part so running the upload again goes on with the missing parts.
+// The asset of the listing is returned once it is packed
+func uploadSplit(opts *options, conn *schedulerConn, tried map[int]bool, filePath string) (*packedAsset, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, &stageError{"pack", err}
+	}
+
+	name := path.Base(filePath)
+	if len(opts.name) > 0 {
+		name = opts.name
+	}
+
+	state, err := loadSplitState(filePath, info, opts.splitSize)
+	if err != nil {
+		return nil, &stageError{"pack", err}
+	} else if state == nil {
+		state = newSplitState(filePath, name, info, opts.splitSize)
+	}
+
+	tempDir, err := os.MkdirTemp("", "storage-upload-sample-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	defer onInterrupt(func() { os.RemoveAll(tempDir) })()
+
+	fmt.Printf("split %s of %s into %d parts\n", formatSize(info.Size()), filePath, len(state.Parts))
+	for i := range state.Parts {
+		part := &state.Parts[i]
+		if len(part.CID) > 0 {
+			logVerbose("part %d of %d uploaded before, %s", i+1, len(state.Parts), part.CID)
+			continue
+		}
+
+		c := *opts
+		c.name, c.offset, c.length, c.splitSize = part.Name, part.Offset, part.Length, 0
+		carPath := filepath.Join(tempDir, fmt.Sprintf("%d.car", i))
+		asset, err := packInput(&c, filePath, carPath)
+		if err != nil {
+			return nil, &stageError{"pack", fmt.Errorf("part %d of %d %w", i+1, len(state.Parts), err)}
+		}
+
+		_, err = uploadWithKeys(&c, conn, tried, carPath, asset.root.String(), asset.name, asset.assetType)
+		os.Remove(carPath)
+		if err != nil && !c.existsOK(err) {
+			return nil, &stageError{"upload", fmt.Errorf("part %d of %d %w", i+1, len(state.Parts), err)}
+		}
+		recordUpload(&c, conn, asset.root.String(), asset.name, asset.assetType, filePath)
+
+		part.CID = asset.root.String()
+		if err := state.save(filePath); err != nil {
+			fmt.Printf("warning: split state not saved, a retry uploads part %d again, %s\n", i+1, err.Error())
+		}
+		fmt.Printf("part %d of %d uploaded, %s\n", i+1, len(state.Parts), part.CID)
+		takeRetries()
+	}
+
+	m := &splitManifest{Format: splitFormat, Version: splitVersion, Name: name, Size: state.Size, Parts: state.Parts}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	} else if len(b) > maxSplitManifest {
+		return nil, fmt.Errorf("%d parts do not fit the listing, use a larger split-size", len(m.Parts))
+	}
+
+	manifestPath := filepath.Join(tempDir, name+".split.json")
+	if err := os.WriteFile(manifestPath, b, 0644); err != nil {
+		return nil, err
+	}
+
+	c := *opts
+	c.name, c.splitSize = name+".split.json", 0
+	asset, err := packInput(&c, manifestPath, filepath.Join(tempDir, "split.car"))
+	if err != nil {
+		return nil, &stageError{"pack", err}
+	}
+
+	if err := uploadPacked(&c, conn, tried, filePath, asset); err != nil {
+		return asset, err
+	}
+	fmt.Printf("download %s to get %s back in one piece\n", asset.root.String(), name)
+	if err := os.Remove(splitStatePath(filePath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return asset, err
+	}
+	return asset, nil
+}
+
+// parseSplitManifest is the listing of a split upload in b, false when b
+// is not one
+func parseSplitManifest(b []byte) (*splitManifest, bool) {
+	m := &splitManifest{}
+	if err := json.Unmarshal(b, m); err != nil || m.Format != splitFormat {
+		return nil, false
+	}
+	return m, true
+}
+
+// check refuses a listing download can not put together
+func (m *splitManifest) check() error {
+	if m.Version != splitVersion {
+		return fmt.Errorf("split listing has version %d, only %d is supported", m.Version, splitVersion)
+	}
+
+	var offset int64
+	for i, p := range m.Parts {
+		if _, err := cid.Decode(p.CID); err != nil {
+			return fmt.Errorf("part %d of the split listing has invalid cid %q", i+1, p.CID)
+		}
+		if p.Offset != offset || p.Length <= 0 {
+			return fmt.Errorf("part %d of the split listing is not where the part before it ends", i+1)
+		}
+		offset += p.Length
+	}
+
+	if offset != m.Size {
+		return fmt.Errorf("split listing parts have %d bytes, the file has %d", offset, m.Size)
+	}
+	return nil
+}
+
+// splitListing is the split listing at want when the file content is one,
+// a listing is smaller than a chunk so it is a single raw block
+func (d *downloader) splitListing(ctx context.Context, want cid.Cid) (*splitManifest, error) {
+	if want.Prefix().Codec != cid.Raw {
+		return nil, nil
+	}
+
+	b, err := d.fetchBlock(ctx, d.path, want)
+	if err != nil || len(b) > maxSplitManifest {
+		return nil, err
+	}
+
+	m, ok := parseSplitManifest(b)
+	if !ok {
+		return nil, nil
+	}
+	return m, m.check()
+}
+
+// downloadSplit downloads the parts of m one after the other and puts them
+// together in output, or writes them to content. Every part is checked
+// against its cid, a part already downloaded by an earlier run is kept
+func downloadSplit(opts *options, d *downloader, m *splitManifest, output string, content io.Writer) error {
+	fmt.Printf("%s is a split upload of %s, %s in %d parts\n", d.cid, m.Name, formatSize(m.Size), len(m.Parts))
+
+	partPaths := make([]string, len(m.Parts))
+	for i, p := range m.Parts {
+		c, _ := cid.Decode(p.CID)
+		pd := &downloader{cid: c, conns: d.conns, dag: d.dag}
+		if content != nil {
+			if err := download(opts, pd, "", content); err != nil {
+				return fmt.Errorf("part %d of %d %w", i+1, len(m.Parts), err)
+			}
+			continue
+		}
+
+		partPaths[i] = fmt.Sprintf("%s.split%d", output, i+1)
+		if stat, err := os.Stat(partPaths[i]); err == nil && stat.Size() == p.Length {
+			if opts.noVerify || verifyDownload(partPaths[i], "", d.dag, c) == nil {
+				logVerbose("part %d of %d downloaded before", i+1, len(m.Parts))
+				continue
+			}
+		}
+
+		if err := download(opts, pd, partPaths[i], nil); err != nil {
+			return fmt.Errorf("part %d of %d %w", i+1, len(m.Parts), err)
+		}
+		if stat, err := os.Stat(partPaths[i]); err != nil {
+			return err
+		} else if stat.Size() != p.Length {
+			return fmt.Errorf("part %d of %d has %d bytes, the listing says %d", i+1, len(m.Parts), stat.Size(), p.Length)
+		}
+	}
+
+	if content != nil {
+		return nil
+	}
+
+	// the parts are kept until the file is complete
+	tmp := output + ".split"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, p := range partPaths {
+		pf, err := os.Open(p)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(f, pf)
+		pf.Close()
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, output); err != nil {
+		return err
+	}
+	for _, p := range partPaths {
+		os.Remove(p)
+	}
+
+	fmt.Printf("put %s together in %s, %s\n", m.Name, output, formatSize(m.Size))
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stallError is an upload attempt aborted since the endpoint stopped
+// taking bytes, the connection can stay open while it does
+type stallError struct {
+	endpoint string
+	offset   int64
+	timeout  time.Duration
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("upload to %s stalled after %s, nothing sent for %s", e.endpoint, formatSize(e.offset), formatDuration(e.timeout))
+}
+
+// stallWatch cancels a request whose body was not read for timeout. Only
+// the time since the last read counts, a slow link that still takes
+// bytes now and then is not stalled
+type stallWatch struct {
+	r       io.Reader
+	timeout time.Duration
+	cancel  context.CancelFunc
+	// last read in unix nanoseconds and bytes read so far
+	last    int64
+	offset  int64
+	stalled int32
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// newStallWatch watches reads of r, the returned context is canceled
+// when they stall. stop must be called once the body is sent
+func newStallWatch(ctx context.Context, r io.Reader, timeout time.Duration) (context.Context, *stallWatch) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &stallWatch{r: r, timeout: timeout, cancel: cancel, last: time.Now().UnixNano(), stop: make(chan struct{})}
+	go w.watch()
+	return ctx, w
+}
+
+func (w *stallWatch) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	atomic.AddInt64(&w.offset, int64(n))
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+	if err == io.EOF {
+		// the rest is up to the server, it may take a while to answer
+		w.done()
+	}
+	return n, err
+}
+
+func (w *stallWatch) watch() {
+	tick := time.NewTicker(w.timeout / 10)
+	defer tick.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-tick.C:
+			// a pause is not a stall
+			if transfers.isPaused() {
+				atomic.StoreInt64(&w.last, now.UnixNano())
+				continue
+			}
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&w.last))) >= w.timeout {
+				atomic.StoreInt32(&w.stalled, 1)
+				w.cancel()
+				return
+			}
+		}
+	}
+}
+
+// done stops watching, it can be called more than once
+func (w *stallWatch) done() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+// err is the stall of the request to endpoint, nil when it did not stall
+func (w *stallWatch) err(endpoint string) error {
+	if atomic.LoadInt32(&w.stalled) == 0 {
+		return nil
+	}
+	return &stallError{endpoint: endpoint, offset: atomic.LoadInt64(&w.offset), timeout: w.timeout}
+}
+
+// answerTimeoutError is an upload attempt aborted since the endpoint took
+// the whole car and did not answer
+type answerTimeoutError struct {
+	endpoint string
+	timeout  time.Duration
+}
+
+func (e *answerTimeoutError) Error() string {
+	return fmt.Sprintf("upload to %s timed out after %s waiting for the answer to the sent car", e.endpoint, formatDuration(e.timeout))
+}
+
+// answerWatch cancels a request once its body was read to the end and the
+// answer did not come within timeout
+type answerWatch struct {
+	r       io.Reader
+	timeout time.Duration
+	cancel  context.CancelFunc
+	fired   int32
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// newAnswerWatch watches r for its end, stop must be called once the
+// answer is read
+func newAnswerWatch(ctx context.Context, r io.Reader, timeout time.Duration) (context.Context, *answerWatch) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &answerWatch{r: r, timeout: timeout, cancel: cancel}
+}
+
+func (w *answerWatch) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	if err == io.EOF {
+		w.mu.Lock()
+		if w.timer == nil && !w.stopped {
+			w.timer = time.AfterFunc(w.timeout, func() {
+				atomic.StoreInt32(&w.fired, 1)
+				w.cancel()
+			})
+		}
+		w.mu.Unlock()
+	}
+	return n, err
+}
+
+// stop ends the wait, it can be called more than once
+func (w *answerWatch) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// err is the timeout of the request to endpoint, nil when it was answered
+func (w *answerWatch) err(endpoint string) error {
+	if atomic.LoadInt32(&w.fired) == 0 {
+		return nil
+	}
+	return &answerTimeoutError{endpoint: endpoint, timeout: w.timeout}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// stdinInput is the input that packs what is read from stdin
+const stdinInput = "-"
+
+// fetchRedirects is how many redirects a url input follows
+const fetchRedirects = 10
+
+// isStreamInput is whether input is read once as a stream instead of a
+// path that can be stat-ed and read again
+func isStreamInput(input string) bool {
+	return input == stdinInput || isURLInput(input)
+}
+
+// isURLInput is whether input is an http or https url whose body is packed
+func isURLInput(input string) bool {
+	return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://")
+}
+
+// headerList is the flag.Value of --header, "Name: value" pairs sent with
+// the request of a url input
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || len(strings.TrimSpace(name)) == 0 || strings.ContainsAny(strings.TrimSpace(name), " \t") {
+		return fmt.Errorf("invalid header %q, want Name: value", s)
+	}
+	// the value is often a credential of the source server
+	addSecret(strings.TrimSpace(value))
+	*h = append(*h, s)
+	return nil
+}
+
+// checkStreamInputs refuses the flags that read the input again or more
+// than one input, a stream ends once it is read
+func (opts *options) checkStreamInputs(inputs []string) error {
+	for _, input := range inputs {
+		if !isStreamInput(input) {
+			continue
+		}
+		switch {
+		case input == stdinInput && len(inputs) > 1:
+			return fmt.Errorf("%s can only be read once, it can not be uploaded with other inputs", input)
+		case opts.wrap:
+			return fmt.Errorf("wrap packs paths, it can not be used with %s", input)
+		case opts.splitSize > 0:
+			return fmt.Errorf("split-size reads the parts of a file one after the other, it can not be used with %s", input)
+		case opts.resume:
+			return fmt.Errorf("resume packs the input again when the kept car is stale, it can not be used with %s", input)
+		case input == stdinInput && len(opts.name) == 0 && !opts.cidOnly:
+			return fmt.Errorf("name can not empty, stdin has no file name to name the asset after")
+		}
+	}
+	return nil
+}
+
+// inputStream is a stream input being read, it counts the bytes for the
+// progress and fails when the stream has no data at all
+type inputStream struct {
+	r io.Reader
+	c io.Closer
+	// label names the stream in messages, name is the asset name it gives,
+	// empty when it has none
+	label    string
+	name     string
+	read     int64
+	progress *transferProgress
+}
+
+// openStream opens the stream input
+func openStream(opts *options, input string) (*inputStream, error) {
+	if isURLInput(input) {
+		return openURL(opts, input)
+	}
+
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return nil, fmt.Errorf("stdin is not a pipe or a file, pipe the data to upload into it, like pg_dump db | %s upload --name db.sql -", path.Base(os.Args[0]))
+	}
+	return &inputStream{r: os.Stdin, c: io.NopCloser(os.Stdin), label: "stdin", progress: newTransferProgress(opts.progress, "read", 0)}, nil
+}
+
+// openURL sends the request of the url input, the body is the stream
+func openURL(opts *options, input string) (*inputStream, error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %s %w", input, err)
+	}
+	label := u.Redacted()
+
+	req, err := http.NewRequestWithContext(interruptContext(), http.MethodGet, input, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range opts.headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	client := *opts.uploadClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= fetchRedirects {
+			return fmt.Errorf("stopped after %d redirects", fetchRedirects)
+		}
+		logVerbose("fetch %s redirected to %s", label, req.URL.Redacted())
+		// the headers are credentials of the source server, another host
+		// does not get them
+		if req.URL.Host != via[0].URL.Host {
+			for _, h := range opts.headers {
+				name, _, _ := strings.Cut(h, ":")
+				req.Header.Del(strings.TrimSpace(name))
+			}
+		}
+		return nil
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %w", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		// an error page of html says no more than the status
+		if strings.Contains(rsp.Header.Get("Content-Type"), "html") {
+			return nil, fmt.Errorf("fetch %s failed with status %s", label, rsp.Status)
+		}
+		b, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		return nil, fmt.Errorf("fetch %s failed with status %s: %s", label, rsp.Status, strings.Join(strings.Fields(string(b)), " "))
+	}
+
+	if rsp.ContentLength > 0 {
+		fmt.Printf("fetch %s of %s\n", formatSize(rsp.ContentLength), label)
+	} else {
+		fmt.Printf("fetch %s, the size is not known\n", label)
+	}
+
+	// the url that was given names the asset, not where it redirected to
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = ""
+	}
+	return &inputStream{r: rsp.Body, c: rsp.Body, label: label, name: name, progress: newTransferProgress(opts.progress, "fetch", rsp.ContentLength)}, nil
+}
+
+func (s *inputStream) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if n > 0 {
+		s.read += int64(n)
+		s.progress.add(int64(n))
+	}
+	if err == io.EOF && s.read == 0 {
+		return n, fmt.Errorf("%s is empty, there is nothing to upload", s.label)
+	}
+	return n, err
+}
+
+func (s *inputStream) Close() error {
+	return s.c.Close()
+}
+
+// packStream packs the stream input into the car at output, a temp file
+// when output is empty. The car is written as the stream is read, so the
+// data is on disk once, in the car
+func packStream(opts *options, input string, output string) (*packedAsset, error) {
+	switch {
+	case opts.offset != 0 || opts.length != 0:
+		return nil, fmt.Errorf("offset and length are a window of a file, they can not be used with %s", input)
+	case len(opts.incremental) > 0:
+		return nil, fmt.Errorf("incremental reuses the car of a path, it can not be used with %s", input)
+	case opts.embedChecksums:
+		return nil, fmt.Errorf("embed-checksums adds the listing to a folder, it needs a folder input and checksums")
+	}
+
+	stream, err := openStream(opts, input)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	packOpts := packOptions{Workers: opts.hashWorkers(), NoChecksums: true, Hash: opts.hash, Chunker: opts.chunker, NoRawLeaves: !opts.rawLeaves, Discard: opts.cidOnly, Stream: stream}
+
+	assetName := opts.name
+	if len(assetName) == 0 {
+		assetName = stream.name
+	}
+	if len(assetName) == 0 && !opts.cidOnly {
+		return nil, fmt.Errorf("name can not empty, %s has no file name to name the asset after", stream.label)
+	} else if len(assetName) == 0 {
+		assetName = stream.label
+	}
+	removeCar := func() {}
+	if opts.cidOnly {
+		output = ""
+	} else if output, removeCar, err = carOutput(output); err != nil {
+		return nil, err
+	} else {
+		defer removeOnInterrupt(output)()
+	}
+	result, err := createCar(input, output, packOpts)
+	if err != nil {
+		removeCar()
+		return nil, err
+	}
+	stream.progress.done()
+
+	return &packedAsset{carPath: output, root: result.Root, name: assetName, assetType: "file", inputSize: stream.read, manifest: result.Manifest}, nil
+}
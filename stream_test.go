@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// useStdin makes r the stdin of the test, it is written into a pipe as it
+// is read like the output of another command
+func useStdin(t *testing.T, r io.Reader) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(pw, r) //nolint:errcheck
+		pw.Close()
+	}()
+
+	stdin := os.Stdin
+	os.Stdin = pr
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		pr.Close()
+	})
+}
+
+func TestPackStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("packs a stream of 320 MiB")
+	}
+	testHome(t)
+
+	// the stream is made as it is read, it is never in memory or on disk
+	// as a whole
+	const size = 320<<20 + 12345
+	sum := sha256.New()
+	useStdin(t, io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), size), sum))
+
+	dir := filepath.Join(t.TempDir(), "bundle")
+	if _, err := captureStdout(t, func() error { return runPrepare([]string{"--bundle", dir, "--name", "db.sql", "-"}) }); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := readBundleInfo(filepath.Join(dir, bundleDescriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "db.sql" || info.Type != "file" || info.Options.InputSize != size {
+		t.Errorf("bundle %+v, want the file db.sql of %d bytes", info, size)
+	}
+
+	root := cid.MustParse(info.Root)
+	carPath := filepath.Join(dir, info.Car)
+	f, err := os.Open(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := checkCarStream(f, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file of the car is the stream
+	out := filepath.Join(t.TempDir(), "db.sql")
+	if _, err := captureStdout(t, func() error { return extractCar(testOptions(t), carPath, root, out) }); err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extracted.Close()
+	outSum := sha256.New()
+	if n, err := io.Copy(outSum, extracted); err != nil || n != size {
+		t.Fatalf("extracted %d bytes, want %d, error %v", n, size, err)
+	}
+	if !bytes.Equal(outSum.Sum(nil), sum.Sum(nil)) {
+		t.Errorf("the file of the car is not the stream")
+	}
+}
+
+func TestUploadStdinErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string
+		err   string
+	}{
+		{"empty", "", []string{"--name", "db.sql"}, "stdin is empty, there is nothing to upload"},
+		{"no name", "data", nil, "stdin has no file name to name the asset after"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := testHome(t)
+			s := newFakeScheduler(t)
+			useScheduler(t, s)
+			useStdin(t, strings.NewReader(tt.stdin))
+
+			_, err := captureStdout(t, func() error { return runUpload(uploadArgs(append(tt.args, "-")...)) })
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			if n := s.count("CreateUserAsset"); n > 0 {
+				t.Errorf("%d CreateUserAsset for a stream that was not packed", n)
+			}
+			if cars := tempCars(t, tmp); len(cars) > 0 {
+				t.Errorf("temp cars left: %v", cars)
+			}
+		})
+	}
+}
+
+func TestOpenURL(t *testing.T) {
+	// other is another host, it tells whether the header came along
+	var otherToken string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherToken = r.Header.Get("X-Token")
+		fmt.Fprint(w, "moved data")
+	}))
+	defer other.Close()
+
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Token")
+		switch r.URL.Path {
+		case "/dumps/db.sql":
+			w.Header().Set("Content-Length", "1024")
+			w.Write(bytes.Repeat([]byte("d"), 1024)) //nolint:errcheck
+		case "/chunked":
+			// a flush before the end sends the body without a length
+			fmt.Fprint(w, "part")
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, "rest")
+		case "/latest/db.sql":
+			http.Redirect(w, r, "/blobs/4f2a", http.StatusFound)
+		case "/blobs/4f2a":
+			fmt.Fprint(w, "redirected data")
+		case "/moved/db.sql":
+			http.Redirect(w, r, other.URL+"/blobs/4f2a", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/missing.sql":
+			http.Error(w, "no such  dump", http.StatusNotFound)
+		case "/html.sql":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<html><body>forbidden</body></html>")
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		// out is what openURL prints, err its error
+		out, err string
+		name     string
+		data     string
+		// token and otherToken are the header as the hosts got it
+		token, otherToken string
+	}{
+		{path: "/dumps/db.sql", out: "fetch 1.00 KiB of ", name: "db.sql", data: strings.Repeat("d", 1024), token: "secret"},
+		{path: "/chunked", out: "the size is not known", name: "chunked", data: "partrest", token: "secret"},
+		{path: "/latest/db.sql", name: "db.sql", data: "redirected data", token: "secret"},
+		{path: "/moved/db.sql", name: "db.sql", data: "moved data", token: "secret"},
+		{path: "/loop", err: "stopped after 10 redirects"},
+		{path: "/missing.sql", err: "failed with status 404 Not Found: no such dump"},
+		{path: "/html.sql", err: "failed with status 403 Forbidden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			token, otherToken = "", ""
+			opts := testOptions(t)
+			opts.headers = headerList{"X-Token: secret"}
+
+			var stream *inputStream
+			var data []byte
+			out, err := captureStdout(t, func() error {
+				var err error
+				if stream, err = openURL(opts, server.URL+tt.path); err != nil {
+					return err
+				}
+				defer stream.Close()
+				data, err = io.ReadAll(stream)
+				return err
+			})
+			if len(tt.err) > 0 {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != tt.data || stream.name != tt.name {
+				t.Errorf("stream %s of %q, want %s of %q", stream.name, data, tt.name, tt.data)
+			}
+			if !strings.Contains(out, tt.out) {
+				t.Errorf("no %q in %q", tt.out, out)
+			}
+			if token != tt.token || otherToken != tt.otherToken {
+				t.Errorf("header %q and %q on the other host, want %q and %q", token, otherToken, tt.token, tt.otherToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// symlinkMode is what packing a folder does with the symlinks in it
+type symlinkMode string
+
+const (
+	// symlinkPreserve stores a link as a unixfs symlink, a download makes
+	// the link again
+	symlinkPreserve symlinkMode = "preserve"
+	// symlinkFollow packs what a link points to, a cycle or a dangling
+	// link fails the pack
+	symlinkFollow symlinkMode = "follow"
+	// symlinkSkip leaves links out
+	symlinkSkip symlinkMode = "skip"
+)
+
+func (m *symlinkMode) String() string {
+	if m == nil || len(*m) == 0 {
+		return string(symlinkPreserve)
+	}
+	return string(*m)
+}
+
+func (m *symlinkMode) Set(s string) error {
+	switch mode := symlinkMode(s); mode {
+	case symlinkPreserve, symlinkFollow, symlinkSkip:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("unknown symlinks %q, use follow, preserve or skip", s)
+}
+
+// followSymlinksFlag is --follow-symlinks, the same as --symlinks follow
+type followSymlinksFlag symlinkMode
+
+func (f *followSymlinksFlag) IsBoolFlag() bool { return true }
+
+func (f *followSymlinksFlag) String() string {
+	return strconv.FormatBool(symlinkMode(*f) == symlinkFollow)
+}
+
+func (f *followSymlinksFlag) Set(s string) error {
+	follow, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*f = followSymlinksFlag(symlinkPreserve)
+	if follow {
+		*f = followSymlinksFlag(symlinkFollow)
+	}
+	return nil
+}
+
+// resolveSymlink is the info p is packed with, info is its lstat. A link
+// is followed or left out as mode says, skip is true when it is left out.
+// The input itself is always followed unless it is preserved
+func resolveSymlink(p string, info os.FileInfo, mode symlinkMode, input bool) (os.FileInfo, bool, error) {
+	if info.Mode().Type() != fs.ModeSymlink {
+		return info, false, nil
+	}
+
+	target, _ := os.Readlink(p)
+	resolved, err := os.Stat(p)
+	switch {
+	case mode == symlinkFollow || (mode == symlinkSkip && input):
+		if err != nil {
+			return nil, false, fmt.Errorf("dangling symlink %s -> %s can not be followed: %w", p, target, err)
+		}
+		return resolved, false, nil
+	case mode == symlinkSkip:
+		if err != nil {
+			fmt.Printf("warning: skip dangling symlink %s -> %s\n", p, target)
+		} else {
+			fmt.Printf("skip symlink %s -> %s\n", p, target)
+		}
+		return nil, true, nil
+	}
+
+	if err != nil {
+		fmt.Printf("warning: keep dangling symlink %s -> %s\n", p, target)
+	}
+	return info, false, nil
+}
+
+// symlinkCycle is the error of a followed link that leads to a directory
+// above it, first is the path the directory was packed at
+func symlinkCycle(p, first string) error {
+	target, _ := os.Readlink(p)
+	if len(target) == 0 {
+		return fmt.Errorf("symlink cycle, %s is %s again", p, first)
+	}
+	return fmt.Errorf("symlink cycle, %s -> %s leads back to %s", p, target, first)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// symlinkFixture makes a folder site with a file and the links, made at
+// test time since a repository can not hold links on every platform
+func symlinkFixture(t *testing.T, links map[string]string, dirs ...string) string {
+	site := filepath.Join(t.TempDir(), "site")
+	for _, d := range append([]string{"."}, dirs...) {
+		if err := os.MkdirAll(filepath.Join(site, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(site, "index.html"), []byte("<h1>hello</h1>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(site, name)); err != nil {
+			t.Skipf("no symlinks here: %v", err)
+		}
+	}
+	return site
+}
+
+func TestSymlinkCycles(t *testing.T) {
+	tests := []struct {
+		name  string
+		links map[string]string
+		dirs  []string
+		mode  string
+		// err names the cycle, empty for a pack that ends well, and out is
+		// what the pack tells of the links
+		err, out string
+	}{
+		{"self", map[string]string{"loop": "."}, nil, "follow", "symlink cycle, $site/loop -> . leads back to $site", ""},
+		{"parent", map[string]string{"a/up": ".."}, []string{"a"}, "follow", "symlink cycle, $site/a/up -> .. leads back to $site", ""},
+		// the link leads to the directory with site, site in it is the cycle
+		{"grandparent", map[string]string{"a/up": "../.."}, []string{"a"}, "follow", "symlink cycle, $site/a/up/site is $site again", ""},
+		{"deeper", map[string]string{"a/b/top": "../../a"}, []string{"a/b"}, "follow", "symlink cycle, $site/a/b/top -> ../../a leads back to $site/a", ""},
+		// the same directory twice side by side is no cycle
+		{"shared", map[string]string{"a": "shared", "b": "shared"}, []string{"shared"}, "follow", "", ""},
+		{"preserved", map[string]string{"loop": "."}, nil, "preserve", "", ""},
+		{"skipped", map[string]string{"loop": "."}, nil, "skip", "", "skip symlink $site/loop -> ."},
+		{"dangling", map[string]string{"gone": "missing"}, nil, "skip", "", "warning: skip dangling symlink $site/gone -> missing"},
+		{"dangling followed", map[string]string{"gone": "missing"}, nil, "follow", "dangling symlink $site/gone -> missing can not be followed", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			site := symlinkFixture(t, tt.links, tt.dirs...)
+
+			// the walk ends, go test times out a walk that does not. cid
+			// prints the messages to stderr
+			var err error
+			out, _ := captureStderr(t, func() error {
+				_, err = captureStdout(t, func() error { return runCid([]string{"--symlinks", tt.mode, site}) })
+				return nil
+			})
+			if !strings.Contains(out, strings.ReplaceAll(tt.out, "$site", site)) {
+				t.Errorf("no %q in\n%s", tt.out, out)
+			}
+			if len(tt.err) == 0 {
+				if err != nil {
+					t.Fatalf("%v\n%s", err, out)
+				}
+				return
+			}
+			want := strings.ReplaceAll(tt.err, "$site", site)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("error %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestSymlinkFollowShared(t *testing.T) {
+	testHome(t)
+	// two links to one directory pack like two copies of it
+	linked := symlinkFixture(t, map[string]string{"a": "shared", "b": "shared"}, "shared")
+	if err := os.WriteFile(filepath.Join(linked, "shared", "app.js"), []byte("console.log(1)"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	copied := symlinkFixture(t, nil, "a", "b", "shared")
+	for _, d := range []string{"a", "b", "shared"} {
+		if err := os.WriteFile(filepath.Join(copied, d, "app.js"), []byte("console.log(1)"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := packCID(t, "--symlinks", "follow", linked), packCID(t, copied); got != want {
+		t.Errorf("cid %s of the links, want %s of the copies", got, want)
+	}
+}
+
+func TestSymlinkModes(t *testing.T) {
+	links := map[string]string{"link.html": "index.html", "alias": "docs"}
+	tests := []struct {
+		mode symlinkMode
+		// dangling adds a link to nothing
+		dangling bool
+		// want is what the extracted folder has at a path, "-> target" for a
+		// link, "directory" for a directory and "" for nothing
+		want map[string]string
+		out  string
+	}{
+		{symlinkPreserve, false, map[string]string{"link.html": "-> index.html", "alias": "-> docs", "alias/page.html": "<p>docs</p>"}, ""},
+		{symlinkPreserve, true, map[string]string{"link.html": "-> index.html", "gone": "-> missing"}, "warning: keep dangling symlink $site/gone -> missing"},
+		{symlinkFollow, false, map[string]string{"link.html": "<h1>hello</h1>", "alias": "directory", "alias/page.html": "<p>docs</p>"}, ""},
+		{symlinkSkip, false, map[string]string{"link.html": "", "alias": "", "docs/page.html": "<p>docs</p>"}, "skip symlink $site/alias -> docs"},
+		{symlinkSkip, true, map[string]string{"link.html": "", "gone": ""}, "warning: skip dangling symlink $site/gone -> missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s dangling %t", tt.mode, tt.dangling), func(t *testing.T) {
+			testHome(t)
+			l := map[string]string{"gone": "missing"}
+			if !tt.dangling {
+				l = make(map[string]string)
+			}
+			for name, target := range links {
+				l[name] = target
+			}
+			site := symlinkFixture(t, l, "docs")
+			if err := os.WriteFile(filepath.Join(site, "docs", "page.html"), []byte("<p>docs</p>"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			carPath := filepath.Join(t.TempDir(), "site.car")
+			var result *packResult
+			out, err := captureStdout(t, func() error {
+				var err error
+				result, err = createCar(site, carPath, packOptions{Workers: 2, Symlinks: tt.mode})
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, strings.ReplaceAll(tt.out, "$site", site)) {
+				t.Errorf("no %q in\n%s", tt.out, out)
+			}
+
+			dir := filepath.Join(t.TempDir(), "site")
+			if _, err := captureStdout(t, func() error { return extractCar(testOptions(t), carPath, result.Root, dir) }); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				p := filepath.Join(dir, filepath.FromSlash(name))
+				var got string
+				if target, err := os.Readlink(p); err == nil {
+					got = "-> " + target
+				} else if b, err := os.ReadFile(p); err == nil {
+					got = string(b)
+				} else if info, err := os.Stat(p); err == nil && info.IsDir() {
+					got = "directory"
+				}
+				if got != want {
+					t.Errorf("%s is %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
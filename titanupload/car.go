@@ -0,0 +1,99 @@
+package titanupload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// PackCAR packs the file or folder at path into a car in the temp
+// directory of the options, with the chunking and hash of the cli
+// defaults so the root is the one upload prints. The car is the caller's
+// to remove
+func (u *Uploader) PackCAR(ctx context.Context, path string) (cid.Cid, string, error) {
+	f, err := os.CreateTemp(u.opts.TempDir, "titanupload-*.car")
+	if err != nil {
+		return cid.Undef, "", err
+	}
+	carPath := f.Name()
+	f.Close()
+
+	root, err := u.writeCar(ctx, path, carPath)
+	if err != nil {
+		os.Remove(carPath)
+		return cid.Undef, "", err
+	}
+	return root, carPath, nil
+}
+
+func (u *Uploader) writeCar(ctx context.Context, input, output string) (cid.Cid, error) {
+	// a root of the right length, replaced once the dag is built
+	hash, err := multihash.Sum(nil, multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	proxyRoot := cid.NewCidV1(uint64(multicodec.DagPb), hash)
+
+	bs, err := blockstore.OpenReadWrite(output, []cid.Cid{proxyRoot})
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	var packed int64
+	ls := cidlink.DefaultLinkSystem()
+	ls.TrustedStorage = true
+	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("not a cidlink")
+		}
+		blk, err := bs.Get(ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	ls.StorageWriteOpener = func(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		buf := bytes.NewBuffer(nil)
+		return buf, func(l ipld.Link) error {
+			cl, ok := l.(cidlink.Link)
+			if !ok {
+				return fmt.Errorf("not a cidlink")
+			}
+			blk, err := blocks.NewBlockWithCid(buf.Bytes(), cl.Cid)
+			if err != nil {
+				return err
+			}
+			packed += int64(buf.Len())
+			u.progress(Progress{Phase: PhasePack, Done: packed})
+			return bs.Put(ctx, blk)
+		}, nil
+	}
+
+	l, _, err := builder.BuildUnixFSRecursive(input, &ls)
+	if err != nil {
+		bs.Discard()
+		return cid.Undef, err
+	}
+	if err := bs.Finalize(); err != nil {
+		return cid.Undef, err
+	}
+
+	root := l.(cidlink.Link).Cid
+	return root, car.ReplaceRootsInFile(output, []cid.Cid{root})
+}
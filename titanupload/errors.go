@@ -0,0 +1,79 @@
+package titanupload
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/terrors"
+)
+
+var (
+	// ErrAlreadyExists is an upload of a cid the scheduler already has an
+	// asset of, nothing was sent
+	ErrAlreadyExists = errors.New("already exist")
+	// ErrAuth is an api key the locator or the scheduler does not accept
+	ErrAuth = errors.New("api key is not accepted")
+	// ErrQuota is an api key without enough storage left for the asset, or
+	// one the scheduler rate limits
+	ErrQuota = errors.New("api key has no storage left")
+)
+
+// classify wraps err of the locator or the scheduler in the error callers
+// branch on, other errors are returned as they are
+func classify(err error) error {
+	var ew *api.ErrWeb
+	if errors.As(err, &ew) {
+		switch ew.Code {
+		case terrors.UserNotFound, terrors.VerifyTokenError:
+			return &classifiedError{ErrAuth, err}
+		case terrors.UserStorageSizeNotEnough, terrors.BusyServer:
+			return &classifiedError{ErrQuota, err}
+		}
+	}
+	if strings.Contains(err.Error(), "can not get user id") {
+		return &classifiedError{ErrAuth, err}
+	}
+	return err
+}
+
+// classifiedError is err that errors.Is matches with kind too
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// RejectedError is an upload the candidate answered with a non zero code
+// in its json envelope
+type RejectedError struct {
+	Code int
+	Msg  string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("upload rejected, code %d: %s", e.Code, e.Msg)
+}
+
+// StatusError is an upload the candidate answered with an http status
+// other than 200 and no envelope
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upload failed with status %d: %s", e.StatusCode, e.Body)
+}
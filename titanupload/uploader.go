@@ -0,0 +1,338 @@
+// Package titanupload packs files and folders into cars and uploads them to
+// titan storage, the core of the storage-upload-sample cli without its
+// flags and output
+package titanupload
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/client"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/ipfs/go-cid"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// the phases of Progress
+const (
+	PhasePack   = "pack"
+	PhaseUpload = "upload"
+)
+
+// Progress is how far a phase is, Total is 0 when it is not known ahead
+type Progress struct {
+	Phase string
+	Done  int64
+	Total int64
+}
+
+// Options are the optional settings of an Uploader
+type Options struct {
+	// Scheduler is used instead of the one the locator names, for callers
+	// that keep their own connection
+	Scheduler api.Scheduler
+	// RPCClient is the http client of the locator and the scheduler, the
+	// default speaks http3 like the cli
+	RPCClient *http.Client
+	// UploadClient is the http client that posts cars to the candidates,
+	// the default is http.DefaultClient
+	UploadClient *http.Client
+	// Insecure skips verifying the tls certificates of the default rpc
+	// client
+	Insecure bool
+	// TempDir is where PackCAR writes cars, the default is os.TempDir
+	TempDir string
+	// Progress is called as packing and uploading go on, from the
+	// goroutine of the call
+	Progress func(Progress)
+}
+
+// Uploader uploads with one api key, it connects to the scheduler on
+// first use
+type Uploader struct {
+	locatorURL string
+	apiKey     string
+	opts       Options
+
+	mu        sync.Mutex
+	scheduler api.Scheduler
+	close     func()
+}
+
+// New returns an uploader for the api key, the scheduler is looked up on
+// the locator at locatorURL
+func New(locatorURL, apiKey string, opts Options) (*Uploader, error) {
+	if len(apiKey) == 0 && opts.Scheduler == nil {
+		return nil, fmt.Errorf("api key can not empty")
+	} else if len(locatorURL) == 0 && opts.Scheduler == nil {
+		return nil, fmt.Errorf("locator url can not empty")
+	}
+	if opts.UploadClient == nil {
+		opts.UploadClient = http.DefaultClient
+	}
+	return &Uploader{locatorURL: locatorURL, apiKey: apiKey, opts: opts, scheduler: opts.Scheduler}, nil
+}
+
+// Close closes the connection to the scheduler
+func (u *Uploader) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.close != nil {
+		u.close()
+		u.close, u.scheduler = nil, nil
+	}
+}
+
+func (u *Uploader) progress(p Progress) {
+	if u.opts.Progress != nil {
+		u.opts.Progress(p)
+	}
+}
+
+// connect returns the scheduler of the api key
+func (u *Uploader) connect(ctx context.Context) (api.Scheduler, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.scheduler != nil {
+		return u.scheduler, nil
+	}
+
+	httpClient, closeConn := u.opts.RPCClient, func() {}
+	if httpClient == nil {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: u.opts.Insecure}
+		rt := &http3.RoundTripper{TLSClientConfig: tlsConfig}
+		httpClient, closeConn = &http.Client{Transport: rt}, func() { rt.Close() }
+	}
+
+	locatorAPI, locatorClose, err := client.NewLocator(ctx, u.locatorURL, nil, jsonrpc.WithHTTPClient(httpClient))
+	if err != nil {
+		closeConn()
+		return nil, fmt.Errorf("NewLocator %w", err)
+	}
+	defer locatorClose()
+
+	schedulerURL, err := locatorAPI.GetSchedulerWithAPIKey(ctx, u.apiKey)
+	if err != nil {
+		closeConn()
+		return nil, fmt.Errorf("GetSchedulerWithAPIKey %w", classify(err))
+	} else if len(schedulerURL) == 0 {
+		// the locator answers without error when no scheduler knows the key
+		closeConn()
+		return nil, fmt.Errorf("no scheduler knows the key %w", ErrAuth)
+	}
+
+	headers := http.Header{}
+	headers.Add("Authorization", "Bearer "+u.apiKey)
+	schedulerAPI, apiClose, err := client.NewScheduler(ctx, schedulerURL, headers, jsonrpc.WithHTTPClient(httpClient))
+	if err != nil {
+		closeConn()
+		return nil, fmt.Errorf("NewScheduler %w", err)
+	}
+
+	u.scheduler = schedulerAPI
+	u.close = func() {
+		apiClose()
+		closeConn()
+	}
+	return schedulerAPI, nil
+}
+
+// Upload registers the car at carPath as an asset with props and posts it
+// to the candidate the scheduler names. The cid and size of props are the
+// ones of the car when they are not set, the name is the base name of the
+// car. ErrAlreadyExists is returned when the scheduler has the asset
+func (u *Uploader) Upload(ctx context.Context, carPath string, root cid.Cid, props types.AssetProperty) error {
+	info, err := os.Stat(carPath)
+	if err != nil {
+		return err
+	}
+	if len(props.AssetCID) == 0 {
+		props.AssetCID = root.String()
+	}
+	if props.AssetSize == 0 {
+		props.AssetSize = info.Size()
+	}
+	if len(props.AssetName) == 0 {
+		props.AssetName = filepath.Base(carPath)
+	}
+	if len(props.AssetType) == 0 {
+		props.AssetType = "file"
+	}
+
+	schedulerAPI, err := u.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := schedulerAPI.CreateUserAsset(ctx, &props)
+	if err != nil {
+		return fmt.Errorf("CreateUserAsset %w", classify(err))
+	} else if rsp.AlreadyExists {
+		return fmt.Errorf("asset %s %w", props.AssetCID, ErrAlreadyExists)
+	}
+
+	if err := u.post(ctx, carPath, info.Size(), rsp.UploadURL, rsp.Token); err != nil {
+		// a record without an upload would refuse the next upload of the
+		// cid as already existing
+		schedulerAPI.DeleteUserAsset(context.Background(), props.AssetCID) //nolint:errcheck
+		return err
+	}
+	return nil
+}
+
+// post streams the car as the file field of a multipart form
+func (u *Uploader) post(ctx context.Context, carPath string, size int64, uploadURL, token string) error {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filepath.Base(carPath))
+		if err == nil {
+			_, err = io.Copy(part, &progressReader{r: f, report: func(done int64) {
+				u.progress(Progress{Phase: PhaseUpload, Done: done, Total: size})
+			}})
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rsp, err := u.opts.UploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(rsp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: rsp.StatusCode, Body: string(b)}
+	}
+
+	// the status is 200 even when the upload failed, the envelope tells
+	var envelope struct {
+		Code int    `json:"code"`
+		Err  int    `json:"err"`
+		Msg  string `json:"msg"`
+	}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		// a candidate that answers without the envelope took the car
+		return nil
+	}
+	if envelope.Code != 0 || envelope.Err != 0 {
+		code := envelope.Code
+		if code == 0 {
+			code = envelope.Err
+		}
+		return &RejectedError{Code: code, Msg: envelope.Msg}
+	}
+	return nil
+}
+
+// UploadOptions are the settings of one UploadPath
+type UploadOptions struct {
+	// Name is the name of the asset, the base name of the path by default
+	Name string
+	// KeepCAR keeps the packed car, its path is in the result
+	KeepCAR bool
+}
+
+// Result is an asset UploadPath uploaded
+type Result struct {
+	Root cid.Cid
+	Name string
+	// Type is file or folder
+	Type    string
+	CARSize int64
+	// CARPath is the packed car with KeepCAR, empty otherwise
+	CARPath string
+	// URL is the retrieval url of the asset, it carries the access token;
+	// empty when the scheduler gave none
+	URL string
+}
+
+// UploadPath packs the file or folder at path and uploads it. The car is
+// removed after the upload unless opts keep it
+func (u *Uploader) UploadPath(ctx context.Context, path string, opts UploadOptions) (Result, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Result{}, err
+	}
+
+	r := Result{Name: opts.Name, Type: "file"}
+	if len(r.Name) == 0 {
+		r.Name = filepath.Base(path)
+	}
+	if info.IsDir() {
+		r.Type = "folder"
+	}
+
+	root, carPath, err := u.PackCAR(ctx, path)
+	if err != nil {
+		return Result{}, fmt.Errorf("pack %w", err)
+	}
+	if opts.KeepCAR {
+		r.CARPath = carPath
+	} else {
+		defer os.Remove(carPath)
+	}
+	r.Root = root
+	if carInfo, err := os.Stat(carPath); err == nil {
+		r.CARSize = carInfo.Size()
+	}
+
+	err = u.Upload(ctx, carPath, root, types.AssetProperty{AssetCID: root.String(), AssetName: r.Name, AssetSize: r.CARSize, AssetType: r.Type})
+	if err != nil {
+		return r, err
+	}
+
+	if schedulerAPI, err := u.connect(ctx); err == nil {
+		if urls, err := schedulerAPI.ShareUserAssets(ctx, []string{root.String()}); err == nil {
+			r.URL = urls[root.String()]
+		}
+	}
+	return r, nil
+}
+
+// progressReader reports the bytes read so far
+type progressReader struct {
+	r      io.Reader
+	done   int64
+	report func(done int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.report(p.done)
+	}
+	return n, err
+}
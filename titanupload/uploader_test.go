@@ -0,0 +1,283 @@
+package titanupload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/terrors"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/ipfs/go-cid"
+)
+
+// mockScheduler is the scheduler of the tests, it keeps the assets of the
+// user by cid. The nil api.Scheduler makes any other rpc panic
+type mockScheduler struct {
+	api.Scheduler
+
+	mu     sync.Mutex
+	assets map[string]*types.AssetProperty
+	calls  map[string]int
+	// createErr fails CreateUserAsset
+	createErr error
+
+	server *httptest.Server
+	// status and body are the answer of the upload endpoint
+	status int
+	body   string
+	// cars are the cars the upload endpoint received
+	cars []string
+}
+
+func newMockScheduler(t *testing.T) *mockScheduler {
+	s := &mockScheduler{assets: make(map[string]*types.AssetProperty), calls: make(map[string]int), status: http.StatusOK, body: `{"code":0}`}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveUpload))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *mockScheduler) serveUpload(w http.ResponseWriter, r *http.Request) {
+	root := strings.TrimPrefix(r.URL.Path, "/upload/")
+	if r.Header.Get("Authorization") != "Bearer token-"+root {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b, _ := io.ReadAll(f)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cars = append(s.cars, string(b))
+	w.WriteHeader(s.status)
+	fmt.Fprint(w, s.body)
+}
+
+func (s *mockScheduler) count(rpc string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[rpc]
+}
+
+func (s *mockScheduler) CreateUserAsset(ctx context.Context, p *types.AssetProperty) (*types.CreateAssetRsp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls["CreateUserAsset"]++
+	if s.createErr != nil {
+		return nil, s.createErr
+	}
+	if _, ok := s.assets[p.AssetCID]; ok {
+		return &types.CreateAssetRsp{AlreadyExists: true}, nil
+	}
+	props := *p
+	s.assets[p.AssetCID] = &props
+	return &types.CreateAssetRsp{UploadURL: s.server.URL + "/upload/" + p.AssetCID, Token: "token-" + p.AssetCID}, nil
+}
+
+func (s *mockScheduler) DeleteUserAsset(ctx context.Context, root string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls["DeleteUserAsset"]++
+	delete(s.assets, root)
+	return nil
+}
+
+func (s *mockScheduler) ShareUserAssets(ctx context.Context, roots []string) (map[string]string, error) {
+	urls := make(map[string]string)
+	for _, root := range roots {
+		urls[root] = "https://candidate.example.com/ipfs/" + root
+	}
+	return urls, nil
+}
+
+// newTestUploader is an uploader that talks to s, it packs into a
+// directory of the test
+func newTestUploader(t *testing.T, s *mockScheduler, progress func(Progress)) *Uploader {
+	u, err := New("", "", Options{Scheduler: s, TempDir: t.TempDir(), Progress: progress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// packTestFile packs a file of content, it returns the root and the car
+func packTestFile(t *testing.T, u *Uploader, content string) (cid.Cid, string) {
+	p := filepath.Join(t.TempDir(), "site.txt")
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, carPath, err := u.PackCAR(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(carPath) })
+	return root, carPath
+}
+
+func TestUploadCreate(t *testing.T) {
+	s := newMockScheduler(t)
+	var last Progress
+	u := newTestUploader(t, s, func(p Progress) { last = p })
+	root, carPath := packTestFile(t, u, "hello world\n")
+
+	if err := u.Upload(context.Background(), carPath, root, types.AssetProperty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := s.assets[root.String()]
+	if props == nil {
+		t.Fatalf("no asset %s", root)
+	}
+	if props.AssetSize != info.Size() || props.AssetName != filepath.Base(carPath) || props.AssetType != "file" {
+		t.Errorf("asset %+v, want the size, the name and the type of the car", props)
+	}
+	car, _ := os.ReadFile(carPath)
+	if len(s.cars) != 1 || s.cars[0] != string(car) {
+		t.Errorf("%d cars uploaded, want the car once", len(s.cars))
+	}
+	if last.Phase != PhaseUpload || last.Done != info.Size() || last.Total != info.Size() {
+		t.Errorf("last progress %+v, want the whole car uploaded", last)
+	}
+}
+
+func TestUploadExists(t *testing.T) {
+	s := newMockScheduler(t)
+	u := newTestUploader(t, s, nil)
+	root, carPath := packTestFile(t, u, "hello world\n")
+	s.assets[root.String()] = &types.AssetProperty{AssetCID: root.String()}
+
+	err := u.Upload(context.Background(), carPath, root, types.AssetProperty{})
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("error %v, want %v", err, ErrAlreadyExists)
+	}
+	if len(s.cars) > 0 || s.count("DeleteUserAsset") > 0 {
+		t.Errorf("%d cars uploaded and %d assets deleted for an existing asset", len(s.cars), s.count("DeleteUserAsset"))
+	}
+}
+
+func TestUploadCreateError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"user not found", &api.ErrWeb{Code: int(terrors.UserNotFound), Message: "user not found"}, ErrAuth},
+		{"no storage left", &api.ErrWeb{Code: int(terrors.UserStorageSizeNotEnough), Message: "storage size not enough"}, ErrQuota},
+		{"busy", &api.ErrWeb{Code: int(terrors.BusyServer), Message: "busy server"}, ErrQuota},
+		{"no user id", errors.New("can not get user id"), ErrAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMockScheduler(t)
+			s.createErr = tt.err
+			u := newTestUploader(t, s, nil)
+			root, carPath := packTestFile(t, u, "hello world\n")
+
+			err := u.Upload(context.Background(), carPath, root, types.AssetProperty{})
+			if !errors.Is(err, tt.kind) || !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v wrapping %v", err, tt.kind, tt.err)
+			}
+			if len(s.cars) > 0 {
+				t.Errorf("%d cars uploaded without an asset", len(s.cars))
+			}
+		})
+	}
+}
+
+func TestUploadError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{"status", http.StatusBadGateway, "bad gateway", &StatusError{StatusCode: http.StatusBadGateway, Body: "bad gateway"}},
+		{"rejected", http.StatusOK, `{"code":-1,"msg":"disk full"}`, &RejectedError{Code: -1, Msg: "disk full"}},
+		{"rejected with err", http.StatusOK, `{"err":1003,"msg":"token expired"}`, &RejectedError{Code: 1003, Msg: "token expired"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMockScheduler(t)
+			s.status, s.body = tt.status, tt.body
+			u := newTestUploader(t, s, nil)
+			root, carPath := packTestFile(t, u, "hello world\n")
+
+			err := u.Upload(context.Background(), carPath, root, types.AssetProperty{})
+			if err == nil || err.Error() != tt.want.Error() {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+			// the record of the failed upload is dropped
+			if n := s.count("DeleteUserAsset"); n != 1 || s.assets[root.String()] != nil {
+				t.Errorf("%d DeleteUserAsset, the asset is kept: %t", n, s.assets[root.String()] != nil)
+			}
+		})
+	}
+}
+
+func TestUploadRetry(t *testing.T) {
+	s := newMockScheduler(t)
+	s.status = http.StatusServiceUnavailable
+	u := newTestUploader(t, s, nil)
+	root, carPath := packTestFile(t, u, "hello world\n")
+
+	var se *StatusError
+	if err := u.Upload(context.Background(), carPath, root, types.AssetProperty{}); !errors.As(err, &se) {
+		t.Fatalf("error %v, want a status error", err)
+	}
+
+	// the dropped record lets the retry create the asset again
+	s.status = http.StatusOK
+	if err := u.Upload(context.Background(), carPath, root, types.AssetProperty{}); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if n := s.count("CreateUserAsset"); n != 2 || len(s.cars) != 2 {
+		t.Errorf("%d CreateUserAsset and %d cars uploaded, want 2 of each", n, len(s.cars))
+	}
+	if s.assets[root.String()] == nil {
+		t.Errorf("no asset %s after the retry", root)
+	}
+}
+
+func TestUploadPath(t *testing.T) {
+	s := newMockScheduler(t)
+	u := newTestUploader(t, s, nil)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>hello</h1>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := u.UploadPath(context.Background(), dir, UploadOptions{Name: "site"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "site" || r.Type != "folder" || len(r.CARPath) > 0 {
+		t.Errorf("result %+v, want the folder site without the car", r)
+	}
+	if r.URL != "https://candidate.example.com/ipfs/"+r.Root.String() {
+		t.Errorf("url %s", r.URL)
+	}
+	if props := s.assets[r.Root.String()]; props == nil || props.AssetName != "site" || props.AssetType != "folder" || props.AssetSize != r.CARSize {
+		t.Errorf("asset %+v", props)
+	}
+	if cars, _ := filepath.Glob(filepath.Join(u.opts.TempDir, "*.car")); len(cars) > 0 {
+		t.Errorf("cars left: %v", cars)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// netOptions controls how connections are made
+type netOptions struct {
+	// family is "4" or "6" to use only that ip family, empty for both
+	family string
+	// addresses to dial instead of resolving the host, tls still
+	// verifies the original host
+	resolve resolveOverrides
+	// longest wait a Retry-After of a 429 or 503 response is honored for
+	maxRetryAfter time.Duration
+	// insecure skips the verification of every certificate, rootCAs are
+	// the system roots and the ones of caCert, nil for the system only
+	insecure bool
+	caCert   string
+	rootCAs  *x509.CertPool
+	// rpcTimeout bounds every attempt of a locator or scheduler request
+	rpcTimeout time.Duration
+	// serverName is verified and sent as sni instead of the host of the
+	// url, the address is still the one of the url
+	serverName string
+}
+
+func (n netOptions) network(base string) string {
+	return base + n.family
+}
+
+// check fails when the host has no global address of the selected family,
+// dialing would otherwise only hang until the timeout
+func (n netOptions) check() error {
+	if len(n.family) == 0 {
+		return nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) == (n.family == "4") {
+			return nil
+		}
+	}
+	return fmt.Errorf("--ipv%s is set but this host has no IPv%s address", n.family, n.family)
+}
+
+// logServerName tells when the name tls verifies is not the host of addr
+func (n netOptions) logServerName(addr string) {
+	if len(n.serverName) == 0 {
+		return
+	}
+	if host, _, err := net.SplitHostPort(addr); err != nil || host != n.serverName {
+		logVerbose("tls server name %s for %s", n.serverName, addr)
+	}
+}
+
+// resolveUDPAddr resolves addr to an address of the selected family
+func (n netOptions) resolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	udpAddr, err := net.ResolveUDPAddr(n.network("udp"), n.resolve.apply(addr))
+	if err != nil {
+		return nil, err
+	}
+	logDebug("resolved %s to %s", addr, udpAddr.String())
+	return udpAddr, nil
+}
+
+// loadCACert reads the pem bundle of --cacert, its certificates are
+// trusted besides the ones of the system
+func (n *netOptions) loadCACert() error {
+	if len(n.caCert) == 0 {
+		return nil
+	}
+
+	b, err := os.ReadFile(n.caCert)
+	if err != nil {
+		return fmt.Errorf("cacert %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("cacert %s has no pem certificate", n.caCert)
+	}
+	n.rootCAs = pool
+	return nil
+}
+
+// tlsConfig is the tls config of every connection, the same for the rpcs
+// and the uploads
+func (n netOptions) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            n.rootCAs,
+		InsecureSkipVerify: n.insecure,
+		ServerName:         n.serverName,
+	}
+}
+
+// newHTTP3Client returns an http3 client that sends its quic packets on pConn
+func newHTTP3Client(pConn net.PacketConn, nopts netOptions) *http.Client {
+	dial := func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+		remoteAddr, err := nopts.resolveUDPAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		nopts.logServerName(addr)
+		return quic.DialEarlyContext(ctx, pConn, remoteAddr, addr, tlsCfg, cfg)
+	}
+
+	roundTripper := &http3.RoundTripper{
+		TLSClientConfig: nopts.tlsConfig(),
+		QuicConfig:      &quic.Config{},
+		Dial:            dial,
+	}
+
+	// the timeout is per attempt, a client timeout would cut a retry-after wait short
+	return &http.Client{Transport: &retryAfterTransport{base: debugTransport{roundTripper}, max: nopts.maxRetryAfter, timeout: nopts.rpcTimeout}}
+}
+
+// newUploadClient returns the http client used to reach candidate nodes
+func newUploadClient(nopts netOptions) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, nopts.network("tcp"), nopts.resolve.apply(addr))
+		if err != nil {
+			return nil, err
+		}
+		logDebug("connected to %s (%s)", addr, conn.RemoteAddr().String())
+		nopts.logServerName(addr)
+		return conn, nil
+	}
+	transport.TLSClientConfig = nopts.tlsConfig()
+	return &http.Client{Transport: debugTransport{transport}}
+}
+
+// debugTransport logs the method, url and headers of every request and the
+// status of its response with -v -v, credentials are masked
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if logLevel < levelDebug {
+		return t.base.RoundTrip(req)
+	}
+
+	logDebug("> %s %s %s", req.Method, req.URL.Redacted(), formatHeaders(req.Header))
+	start := time.Now()
+	rsp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logDebug("< %s %s error %s after %s", req.Method, req.URL.Redacted(), err.Error(), time.Since(start).Round(time.Millisecond))
+		return nil, err
+	}
+	logDebug("< %s %s %s in %s %s", req.Method, req.URL.Redacted(), rsp.Status, time.Since(start).Round(time.Millisecond), formatHeaders(rsp.Header))
+	return rsp, nil
+}
+
+// formatHeaders is h on one line in name order, the value of Authorization
+// is masked
+func formatHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h.Values(name), ", ")
+		if name == "Authorization" {
+			scheme, credential, _ := strings.Cut(value, " ")
+			value = scheme + " " + mask(credential)
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return "[" + strings.Join(parts, "; ") + "]"
+}
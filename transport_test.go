@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newTLSServer starts a server of h with a self-signed certificate, the
+// handshakes the tests fail on purpose are not logged
+func newTLSServer(t *testing.T, h http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(h)
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// writeServerCA writes the self-signed certificate of server as the pem
+// file --cacert takes
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	p := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(p, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTLSVerify(t *testing.T) {
+	server := newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ca := writeServerCA(t, server)
+
+	tests := []struct {
+		name string
+		net  netOptions
+		// err is in the error of the request, empty for one that is answered
+		err string
+	}{
+		{"system roots", netOptions{}, "certificate signed by unknown authority"},
+		{"cacert", netOptions{caCert: ca}, ""},
+		{"insecure", netOptions{insecure: true}, ""},
+		// the certificate of httptest is for example.com and 127.0.0.1
+		{"cacert server name", netOptions{caCert: ca, serverName: "example.com"}, ""},
+		{"cacert other name", netOptions{caCert: ca, serverName: "other.example.org"}, "not other.example.org"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := tt.net
+			if err := n.loadCACert(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the rpcs over http3 trust what the uploads trust
+			h3 := newHTTP3Client(nil, n).Transport.(*retryAfterTransport).base.(debugTransport).base.(*http3.RoundTripper)
+			if cfg := h3.TLSClientConfig; cfg.RootCAs != n.rootCAs || cfg.InsecureSkipVerify != n.insecure || cfg.ServerName != n.serverName {
+				t.Errorf("the http3 client has another tls config than the uploads")
+			}
+
+			rsp, err := newUploadClient(n).Get(server.URL)
+			if err == nil {
+				rsp.Body.Close()
+			}
+			if len(tt.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadCACert(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.der")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, caCert, err string
+	}{
+		{"no pem", notPEM, "cacert " + notPEM + " has no pem certificate"},
+		{"missing", filepath.Join(dir, "missing.pem"), "cacert open " + filepath.Join(dir, "missing.pem")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := netOptions{caCert: tt.caCert}
+			if err := n.loadCACert(); err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUploadTLS(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags func(ca string) []string
+		// err is in the error of the upload, out is what it prints
+		err, out string
+	}{
+		{"system roots", func(string) []string { return nil }, "certificate signed by unknown authority", ""},
+		{"cacert", func(ca string) []string { return []string{"--cacert", ca} }, "", "upload complete"},
+		{"insecure", func(string) []string { return []string{"--insecure"} }, "", "warning: --insecure is set, tls certificates are not verified"},
+		{"bad cacert", func(ca string) []string { return []string{"--cacert", ca + ".missing"} }, "cacert open", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHome(t)
+			s := newFakeScheduler(t)
+			// the upload endpoint is the one of a server with a private ca
+			s.server.Close()
+			s.server = newTLSServer(t, http.HandlerFunc(s.serveUpload))
+			useScheduler(t, s)
+			input := writeFile(t, "site.txt", "hello world\n")
+
+			out, err := captureStdout(t, func() error {
+				return runUpload(uploadArgs(append(tt.flags(writeServerCA(t, s.server)), "--no-postcheck", input)...))
+			})
+			if len(tt.err) == 0 && err != nil {
+				t.Fatalf("upload: %v\n%s", err, out)
+			}
+			if len(tt.err) > 0 && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			if !strings.Contains(out, tt.out) {
+				t.Errorf("no %q in\n%s", tt.out, out)
+			}
+			// the warning of --insecure is printed once a run
+			if n := strings.Count(out, "warning: --insecure"); n > 1 {
+				t.Errorf("%d warnings of --insecure in\n%s", n, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	dagpb "github.com/ipld/go-codec-dagpb"
+)
+
+// maxBlockSize is more than any block of a unixfs dag
+const maxBlockSize = 4 << 20
+
+// resolve walks d.path from the root of the asset one block at a time and
+// returns the cid the path names and whether it is a directory, every
+// block is checked against the cid it was linked with
+func (d *downloader) resolve(ctx context.Context) (cid.Cid, bool, error) {
+	var names []string
+	for _, name := range strings.Split(d.path, "/") {
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+
+	c := d.cid
+	for i := 0; ; i++ {
+		p := strings.Join(names[:i], "/")
+		b, err := d.fetchBlock(ctx, p, c)
+		if err != nil {
+			return cid.Undef, false, err
+		}
+
+		links, dir, err := decodeUnixfsNode(c, b)
+		if err != nil {
+			return cid.Undef, false, err
+		}
+
+		if i == len(names) {
+			return c, dir, nil
+		}
+
+		if !dir {
+			return cid.Undef, false, fmt.Errorf("%s/%s is a file, not a directory", d.cid, p)
+		}
+
+		next, ok := links[names[i]]
+		if !ok {
+			return cid.Undef, false, fmt.Errorf("%s/%s has no %s", d.cid, p, names[i])
+		}
+		c = next
+	}
+}
+
+// fetchBlock gets the block at path p below the root from the first
+// source that has it
+func (d *downloader) fetchBlock(ctx context.Context, p string, c cid.Cid) ([]byte, error) {
+	var lastErr error
+	for _, src := range d.sources {
+		rsp, err := d.get(ctx, src, p, "raw", nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		b, err := io.ReadAll(io.LimitReader(rsp.Body, maxBlockSize+1))
+		rsp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if len(b) > maxBlockSize {
+			return nil, fmt.Errorf("block %s from %s is larger than %d bytes", c, src.address, maxBlockSize)
+		}
+
+		sum, err := c.Prefix().Sum(b)
+		if err != nil {
+			return nil, err
+		}
+
+		if !sum.Equals(c) {
+			lastErr = fmt.Errorf("block %s from %s does not match its hash", c, src.address)
+			continue
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("get block %s %w", c, lastErr)
+}
+
+// decodeUnixfsNode returns the entries of a directory block, or false
+// when the block is a file
+func decodeUnixfsNode(c cid.Cid, b []byte) (map[string]cid.Cid, bool, error) {
+	if c.Prefix().Codec == cid.Raw {
+		return nil, false, nil
+	}
+
+	if c.Prefix().Codec != cid.DagProtobuf {
+		return nil, false, fmt.Errorf("%s is not unixfs", c)
+	}
+
+	nb := dagpb.Type.PBNode.NewBuilder()
+	if err := dagpb.DecodeBytes(nb, b); err != nil {
+		return nil, false, fmt.Errorf("decode %s %w", c, err)
+	}
+	pbNode := nb.Build().(dagpb.PBNode)
+
+	if !pbNode.FieldData().Exists() {
+		return nil, false, fmt.Errorf("%s is not unixfs", c)
+	}
+
+	fsData, err := data.DecodeUnixFSData(pbNode.FieldData().Must().Bytes())
+	if err != nil {
+		return nil, false, fmt.Errorf("decode %s %w", c, err)
+	}
+
+	switch fsData.FieldDataType().Int() {
+	case data.Data_File, data.Data_Raw:
+		return nil, false, nil
+	case data.Data_Directory:
+	case data.Data_HAMTShard:
+		return nil, true, fmt.Errorf("%s is a sharded directory, use --extract", c)
+	default:
+		return nil, false, fmt.Errorf("%s has unsupported unixfs type %d", c, fsData.FieldDataType().Int())
+	}
+
+	links := make(map[string]cid.Cid)
+	it := pbNode.FieldLinks().Iterator()
+	for !it.Done() {
+		_, link := it.Next()
+		if !link.FieldName().Exists() {
+			continue
+		}
+
+		lnk, err := link.FieldHash().AsLink()
+		if err != nil {
+			return nil, false, err
+		}
+
+		lc, err := cid.Parse(lnk.String())
+		if err != nil {
+			return nil, false, err
+		}
+		links[link.FieldName().Must().String()] = lc
+	}
+	return links, true, nil
+}
+
+// get requests path p below the root of the asset from src in format
+func (d *downloader) get(ctx context.Context, src *downloadSource, p, format string, r *byteRange) (*http.Response, error) {
+	url := fmt.Sprintf("https://%s/ipfs/%s", src.address, d.cid.String())
+	if len(p) > 0 {
+		url += "/" + strings.TrimPrefix(p, "/")
+	}
+	if len(format) > 0 {
+		url += "?format=" + format
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, bytes.NewReader(src.token))
+	if err != nil {
+		return nil, err
+	}
+
+	if r != nil && r.end > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.start, r.end-1))
+	} else if r != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.start))
+	}
+
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusPartialContent {
+		b, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		rsp.Body.Close()
+		return nil, fmt.Errorf("%s status %d %s", src.address, rsp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return rsp, nil
+}
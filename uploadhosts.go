@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hostPatterns is the flag.Value of --allowed-upload-hosts, each pattern is
+// a host like upload.titannet.io or a suffix like *.titannet.io
+type hostPatterns []string
+
+func (p *hostPatterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *hostPatterns) Set(s string) error {
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if len(pattern) == 0 {
+			continue
+		}
+
+		host := strings.TrimPrefix(pattern, "*.")
+		if len(host) == 0 || strings.ContainsAny(host, "*/:@ ") {
+			return fmt.Errorf("invalid upload host %q, want a host like upload.example.com or *.example.com", pattern)
+		}
+		*p = append(*p, pattern)
+	}
+	return nil
+}
+
+// match is true when host is one of the patterns, *.example.com matches
+// the hosts under example.com but not example.com itself
+func (p hostPatterns) match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUploadURL refuses an upload url the data and the token must not go
+// to, it runs before any connection to the url is made
+func (opts *options) checkUploadURL(u *url.URL) error {
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !opts.allowInsecureUpload {
+			return fmt.Errorf("refuse plain http upload url %s, the token would be sent in clear, allow it with --allow-insecure-upload", u.Redacted())
+		}
+	default:
+		return fmt.Errorf("refuse upload url %s, scheme %q is not http or https", u.Redacted(), u.Scheme)
+	}
+
+	if len(opts.allowedUploadHosts) > 0 && !opts.allowedUploadHosts.match(u.Hostname()) {
+		return fmt.Errorf("refuse upload host %s, it is not in allowed-upload-hosts %s", u.Hostname(), opts.allowedUploadHosts.String())
+	}
+	return nil
+}
+
+// checkUploadURLs checks every endpoint the scheduler returned, one bad
+// url means the scheduler can not be trusted with the rest either
+func (opts *options) checkUploadURLs(endpoints []string) error {
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err == nil {
+			err = opts.checkUploadURL(u)
+		}
+		if err != nil {
+			fmt.Printf("warning: security, the scheduler returned an upload url that is refused, %s\n", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// endpointClient is the client for requests to upload endpoints, it checks
+// the url of every redirect like the url the scheduler returned
+func (opts *options) endpointClient() *http.Client {
+	c := *opts.uploadClient
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := opts.checkUploadURL(req.URL); err != nil {
+			fmt.Printf("warning: security, %s redirected to a refused url, %s\n", via[len(via)-1].URL.Host, err.Error())
+			return err
+		}
+		// the limit of the default policy
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &c
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+)
+
+// verifyMismatchError is an uploaded asset the candidates serve as another
+// cid
+type verifyMismatchError struct {
+	want cid.Cid
+	got  string
+}
+
+func (e *verifyMismatchError) Error() string {
+	return fmt.Sprintf("uploaded %s but the candidates serve %s", e.want, e.got)
+}
+
+// verifyUpload fetches the asset back from the candidates that hold it and
+// checks it is the one uploaded. The content of a file is chunked again
+// the way it was packed, the car of a folder has the hash of every block
+// checked
+func verifyUpload(opts *options, asset *packedAsset) error {
+	defer timePhase("verify")()
+
+	d := &downloader{cid: asset.root, conns: 1, phase: "verify", dag: dagFormat{hash: asset.root.Prefix().MhType, chunker: opts.chunker.String(), pbLeaves: !opts.rawLeaves}}
+	if asset.assetType == "folder" {
+		d.format = "car"
+	}
+
+	// the candidate that took the upload may not be located right away
+	var err error
+	for attempt := 1; attempt <= postcheckAttempts; attempt++ {
+		if err = d.locate(opts); !errors.Is(err, errNoCandidate) || attempt == postcheckAttempts {
+			break
+		}
+		logVerbose("verify %s, %s, look again in %s", asset.root, err.Error(), postcheckInterval)
+		time.Sleep(postcheckInterval)
+	}
+	if err != nil {
+		return err
+	}
+	return d.verify(asset.root)
+}
+
+// verify streams the content of d, or its car, through the check of want
+func (d *downloader) verify(want cid.Cid) error {
+	pr, pw := io.Pipe()
+	checked := make(chan error, 1)
+	go func() {
+		var err error
+		if d.format == "car" {
+			err = checkCarStream(pr, want)
+		} else if got, cerr := calculateCid(pr, d.dag); cerr != nil {
+			err = cerr
+		} else if !bytes.Equal(got.Hash(), want.Hash()) {
+			err = &verifyMismatchError{want: want, got: got.String()}
+		}
+		// the rest of the stream is not needed once the check failed, what
+		// follows a checked car, as the index of a v2 car, is read through
+		if err == nil {
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		checked <- err
+	}()
+
+	err := d.stream(interruptContext(), pw, want, true)
+	pw.CloseWithError(err)
+	if cerr := <-checked; cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// checkCarStream reads a car as it comes and checks that it has the root
+// want and that every block matches its hash
+func checkCarStream(r io.Reader, want cid.Cid) error {
+	br, err := car.NewBlockReader(r)
+	if err != nil {
+		return fmt.Errorf("read car %w", err)
+	}
+	if len(br.Roots) != 1 || !bytes.Equal(br.Roots[0].Hash(), want.Hash()) {
+		return &verifyMismatchError{want: want, got: fmt.Sprintf("a car with roots %v", br.Roots)}
+	}
+
+	root := false
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read car block %w", err)
+		}
+
+		sum, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return err
+		}
+		if !sum.Equals(blk.Cid()) {
+			return &verifyMismatchError{want: want, got: fmt.Sprintf("block %s with content of %s", blk.Cid(), sum)}
+		}
+		root = root || bytes.Equal(blk.Cid().Hash(), want.Hash())
+	}
+
+	if !root {
+		return &verifyMismatchError{want: want, got: "a car without its root block"}
+	}
+	return nil
+}
+
+// keepUnverified keeps the car of an asset that failed --verify out of the
+// temp files removed after an upload, and returns where it is
+func keepUnverified(opts *options, asset *packedAsset) string {
+	if len(opts.incremental) > 0 {
+		return asset.carPath
+	}
+	kept := filepath.Join(os.TempDir(), asset.root.String()+".car")
+	if err := os.Rename(asset.carPath, kept); err != nil {
+		return asset.carPath
+	}
+	return kept
+}
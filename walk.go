@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// fileID identifies a file on disk independent of its path
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// packStats collects counters about a pack
+type packStats struct {
+	Files         int
+	HardLinks     int
+	HardLinkBytes int64
+	// zeros of sparse files that were not read from disk
+	HoleBytes int64
+	// Excluded are the entries --exclude left out, a directory counts once
+	// for all below it unless it was walked for an include
+	Excluded int
+	// Blocks written to the car and how many of them came from the
+	// previous car of an incremental pack
+	Blocks       int64
+	ReusedBlocks int64
+}
+
+// packResult is the outcome of a pack
+type packResult struct {
+	Root     cid.Cid
+	Stats    packStats
+	Manifest *manifest
+}
+
+// packOptions controls how the input is packed
+type packOptions struct {
+	// Size is the length to read from a non regular input
+	Size int64
+	// Stream is read instead of the input when it is set, to its end
+	Stream io.Reader
+	// Range packs only a window of a regular file input
+	Range *fileWindow
+	// Workers is the number of files hashed at the same time
+	Workers int
+	// Previous is the last pack of an incremental pack, unchanged files
+	// are copied from it instead of being chunked again
+	Previous *previousPack
+	// Symlinks is what is done with the symlinks of a folder, empty is
+	// preserve
+	Symlinks symlinkMode
+	// MaxOpenFiles bounds the files and directories open at the same time
+	MaxOpenFiles int
+	// ExcludeMetaFiles leaves the metadata files out of the dag, their
+	// content is in the manifest either way
+	ExcludeMetaFiles bool
+	// NoChecksums skips the sha256 of every file, EmbedChecksums adds
+	// their listing to the root of a folder
+	NoChecksums    bool
+	EmbedChecksums bool
+	// Hash is the multihash function of the blocks, Chunker splits the
+	// files into them, NoRawLeaves wraps the chunks in dag-pb nodes
+	Hash        hashFlag
+	Chunker     chunkerFlag
+	NoRawLeaves bool
+	// Filter leaves entries of folders out of the dag
+	Filter pathFilter
+	// Discard only hashes the dag, no car is written
+	Discard bool
+}
+
+// packer walks the input tree and builds the unixfs dag for it,
+// it follows builder.BuildUnixFSRecursive so the result is the same dag
+type packer struct {
+	bp   *blockPipeline
+	opts packOptions
+	// files with more than one link that were already packed
+	inodes map[fileID]packedFile
+	// directories from the root to the one being walked, to the path they
+	// were reached by, only kept when symlinks are followed
+	dirs  map[string]string
+	stats packStats
+	// manifest paths are relative to root, filter paths to the input
+	root     string
+	input    string
+	files    []packedFile
+	fds      fdLimiter
+	metaDirs []packedDir
+}
+
+// packedDir is a directory with metadata waiting for its dag
+type packedDir struct {
+	rel  string
+	meta *dirMeta
+	node *pendingNode
+}
+
+// packedFile is a file of the manifest waiting for its dag
+type packedFile struct {
+	rel  string
+	info os.FileInfo
+	node *pendingNode
+	// mime is the type from the extension, content is what the read of
+	// the file found, set once node is done. Hard links share content
+	mime    string
+	content *fileContent
+}
+
+// fileContent is what is learned about a file from the read that feeds
+// the chunker, so nothing is read twice
+type fileContent struct {
+	// mime is sniffed from the first bytes
+	mime   string
+	sha256 string
+}
+
+// contentType is the mime type of f, from its extension when it is known
+func (f packedFile) contentType() string {
+	if len(f.mime) > 0 {
+		return f.mime
+	}
+	return f.content.mime
+}
+
+func newPacker(bp *blockPipeline, opts packOptions) *packer {
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = defaultMaxOpenFiles()
+	}
+	return &packer{bp: bp, opts: opts, inodes: make(map[fileID]packedFile), dirs: make(map[string]string), fds: newFDLimiter(opts.MaxOpenFiles)}
+}
+
+// manifest returns the manifest of the packed files, it must be called
+// after every node is done
+func (p *packer) manifest(root string) *manifest {
+	m := newManifest()
+	m.Root = root
+	for _, f := range p.files {
+		l, size, err := f.node.wait()
+		if err != nil {
+			continue
+		}
+		m.Files[f.rel] = manifestFile{CID: l.String(), DagSize: size, FileSize: f.info.Size(), ModTime: f.info.ModTime(), Type: f.contentType(), SHA256: f.content.sha256}
+	}
+
+	for _, d := range p.metaDirs {
+		l, _, err := d.node.wait()
+		if err != nil {
+			continue
+		}
+		if m.Dirs == nil {
+			m.Dirs = make(map[string]manifestDir)
+		}
+		m.Dirs[d.rel] = manifestDir{CID: l.String(), Meta: *d.meta}
+	}
+	return m
+}
+
+// buildInput packs one of the inputs given on the command line,
+// unlike entries of a directory it can be a device or a pipe
+func (p *packer) buildInput(input string) *pendingNode {
+	if p.opts.Stream != nil {
+		p.input = input
+		p.stats.Files++
+		return p.bp.submit(func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+			return builder.BuildUnixFSFile(p.opts.Stream, p.opts.Chunker.String(), ls)
+		})
+	}
+
+	info, err := os.Stat(input)
+	if err != nil {
+		return p.failed(err)
+	}
+
+	p.input = input
+	if p.opts.Range != nil {
+		return p.buildWindow(input, *p.opts.Range)
+	}
+	if info.IsDir() || info.Mode().IsRegular() {
+		return p.buildUnixFSRecursive(input, false)
+	}
+
+	p.stats.Files++
+	f, err := p.fds.open(input)
+	if err != nil {
+		return p.failed(err)
+	}
+	return p.bp.submitHolding(f, func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+		r := &packProgressReader{Reader: io.LimitReader(f, p.opts.Size), total: p.opts.Size}
+		link, size, err := builder.BuildUnixFSFile(r, p.opts.Chunker.String(), ls)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if r.done != p.opts.Size {
+			return nil, 0, fmt.Errorf("%s ended after %d of %d bytes", input, r.done, p.opts.Size)
+		}
+		return link, size, nil
+	})
+}
+
+// failed returns a node that failed before it could be built
+func (p *packer) failed(err error) *pendingNode {
+	return p.bp.spawn(func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+		return nil, 0, err
+	})
+}
+
+// buildUnixFSRecursive packs root, skipped is true below a directory the
+// filter left out, only the entries an include keeps are packed there
+func (p *packer) buildUnixFSRecursive(root string, skipped bool) *pendingNode {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return p.failed(err)
+	}
+
+	info, skip, err := resolveSymlink(root, info, p.opts.Symlinks, root == p.input)
+	if err != nil {
+		return p.failed(err)
+	} else if skip {
+		return nil
+	}
+
+	m := info.Mode()
+	switch {
+	case m.IsDir():
+		if p.opts.Symlinks == symlinkFollow {
+			key := dirID(root, info)
+			if first, ok := p.dirs[key]; ok {
+				return p.failed(symlinkCycle(root, first))
+			}
+			p.dirs[key] = root
+			defer delete(p.dirs, key)
+		}
+
+		entries, err := p.fds.readDir(root)
+		if err != nil {
+			return p.failed(err)
+		}
+		meta, err := readDirMeta(p.fds, root)
+		if err != nil {
+			return p.failed(err)
+		}
+
+		names := make([]string, 0, len(entries))
+		children := make([]*pendingNode, 0, len(entries))
+		for _, e := range entries {
+			if p.opts.ExcludeMetaFiles && meta != nil && e.Name() == metaFileName {
+				continue
+			}
+			skip, walk := p.opts.Filter.skip(relPath(p.input, path.Join(root, e.Name())), e.IsDir(), skipped)
+			if skip && !walk {
+				p.stats.Excluded++
+				continue
+			}
+			// nil is a skipped symlink, or a directory left out with nothing
+			// included in it
+			if child := p.buildUnixFSRecursive(path.Join(root, e.Name()), skip); child != nil {
+				names = append(names, e.Name())
+				children = append(children, child)
+			}
+		}
+		if skipped && len(children) == 0 {
+			return nil
+		}
+
+		// the walk below the root is done, so every file is in p.files
+		if p.opts.EmbedChecksums && root == p.root {
+			i := sort.SearchStrings(names, checksumsFile)
+			if i < len(names) && names[i] == checksumsFile {
+				return p.failed(fmt.Errorf("%s already has a %s, it can not be embedded", root, checksumsFile))
+			}
+			names = append(names[:i], append([]string{checksumsFile}, names[i:]...)...)
+			children = append(children[:i], append([]*pendingNode{p.buildChecksums()}, children[i:]...)...)
+		}
+		n := p.bp.spawn(func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+			lnks := make([]dagpb.PBLink, 0, len(children))
+			for i, child := range children {
+				lnk, sz, err := child.wait()
+				if err != nil {
+					return nil, 0, err
+				}
+				entry, err := builder.BuildUnixFSDirectoryEntry(names[i], int64(sz), lnk)
+				if err != nil {
+					return nil, 0, err
+				}
+				lnks = append(lnks, entry)
+			}
+			return builder.BuildUnixFSDirectory(lnks, ls)
+		})
+		if meta != nil {
+			p.metaDirs = append(p.metaDirs, packedDir{rel: relPath(p.root, root), meta: meta, node: n})
+		}
+		return n
+	case m.Type() == fs.ModeSymlink:
+		content, err := os.Readlink(root)
+		if err != nil {
+			return p.failed(err)
+		}
+		return p.bp.spawn(func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+			return builder.BuildUnixFSSymlink(content, ls)
+		})
+	case m.IsRegular():
+		return p.buildFile(root, info)
+	default:
+		return p.failed(fmt.Errorf("cannot encode non regular file: %s", root))
+	}
+}
+
+func (p *packer) buildFile(filePath string, info os.FileInfo) *pendingNode {
+	p.stats.Files++
+	rel := relPath(p.root, filePath)
+
+	// the same inode always has the same content, so the dag of a hard link
+	// that was already packed can be reused without reading it again
+	id, linked := hardLinkID(info)
+	if linked {
+		if f, ok := p.inodes[id]; ok {
+			p.stats.HardLinks++
+			p.stats.HardLinkBytes += info.Size()
+			// the links share the sniffed type of their content
+			f.rel, f.info, f.mime = rel, info, typeByExtension(info.Name())
+			p.files = append(p.files, f)
+			return f.node
+		}
+	}
+
+	f := packedFile{rel: rel, info: info, mime: typeByExtension(info.Name()), content: &fileContent{}}
+	f.node = p.buildFileContent(filePath, f)
+	p.files = append(p.files, f)
+	if linked {
+		p.inodes[id] = f
+	}
+	return f.node
+}
+
+// buildChecksums is the node of the checksums listing of the files packed
+// so far, it waits for their reads to end
+func (p *packer) buildChecksums() *pendingNode {
+	files := p.files
+	return p.bp.spawn(func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+		sums := make(map[string]string, len(files))
+		for _, f := range files {
+			if _, _, err := f.node.wait(); err != nil {
+				return nil, 0, err
+			}
+			sums[f.rel] = f.content.sha256
+		}
+		return builder.BuildUnixFSFile(bytes.NewReader(formatChecksums(sums)), p.opts.Chunker.String(), ls)
+	})
+}
+
+// buildFileContent builds the dag of the file of f and sniffs its type from
+// the first bytes the chunker reads
+func (p *packer) buildFileContent(filePath string, f packedFile) *pendingNode {
+	info := f.info
+
+	if prev := p.opts.Previous; prev != nil {
+		if pf, ok := prev.lookup(f.rel, info); ok {
+			*f.content = fileContent{mime: pf.Type, sha256: pf.SHA256}
+			if c, err := cid.Decode(pf.CID); err == nil {
+				return p.bp.submit(func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+					if err := prev.copyDag(p.bp.ctx, ls, c); err != nil {
+						return nil, 0, err
+					}
+					return cidlink.Link{Cid: c}, pf.DagSize, nil
+				})
+			}
+		}
+	}
+
+	// the file is opened here and not in the worker, see submitHolding
+	fp, err := p.fds.open(filePath)
+	if err != nil {
+		return p.failed(err)
+	}
+	return p.bp.submitHolding(fp, func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+		r := newFileReader(fp.File, info)
+		src := io.Reader(r)
+		var h hash.Hash
+		if !p.opts.NoChecksums {
+			h = sha256.New()
+			src = io.TeeReader(r, h)
+		}
+		sniff := &sniffReader{Reader: src}
+		link, size, err := builder.BuildUnixFSFile(sniff, p.opts.Chunker.String(), ls)
+		if err != nil {
+			return nil, 0, err
+		}
+		f.content.mime = sniff.contentType()
+		if h != nil {
+			f.content.sha256 = hex.EncodeToString(h.Sum(nil))
+		}
+		atomic.AddInt64(&p.stats.HoleBytes, sparseHoleBytes(r))
+		return link, size, nil
+	})
+}
+
+// packProgressReader prints the progress of reading a stream input,
+// at most once for every percent
+type packProgressReader struct {
+	io.Reader
+	total   int64
+	done    int64
+	percent int64
+}
+
+func (pr *packProgressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	pr.done += int64(n)
+	if pr.total > 0 {
+		if percent := pr.done * 100 / pr.total; percent > pr.percent {
+			pr.percent = percent
+			fmt.Printf("pack progress %s/%s\n", formatSize(pr.done), formatSize(pr.total))
+		}
+	}
+	return n, err
+}
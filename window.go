@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipld/go-ipld-prime"
+)
+
+// fileWindow is the part of a file --offset and --length pack
+type fileWindow struct {
+	Offset int64
+	Length int64
+}
+
+// window is the range --offset and --length ask for in a file of size
+// bytes, nil when neither is given. A length of 0 is to the end of the file
+func (opts *options) window(filePath string, info os.FileInfo) (*fileWindow, error) {
+	if opts.offset == 0 && opts.length == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case opts.offset < 0 || opts.length < 0:
+		return nil, fmt.Errorf("offset and length can not be negative")
+	case !info.Mode().IsRegular():
+		return nil, fmt.Errorf("offset and length only apply to a regular file, %s is not one", filePath)
+	case len(opts.incremental) > 0:
+		return nil, fmt.Errorf("offset and length can not be used with incremental")
+	}
+
+	// the size is taken now, an append-only file may grow while it is packed
+	size := info.Size()
+	if opts.offset >= size {
+		return nil, fmt.Errorf("offset %d is not before the end of %s, it has %d bytes", opts.offset, filePath, size)
+	}
+
+	r := &fileWindow{Offset: opts.offset, Length: opts.length}
+	if r.Length == 0 {
+		r.Length = size - r.Offset
+	} else if r.Length > size-r.Offset {
+		return nil, fmt.Errorf("offset %d and length %d end after %s, it has %d bytes", r.Offset, r.Length, filePath, size)
+	}
+	return r, nil
+}
+
+// name is the default asset name of the window of base
+func (r *fileWindow) name(base string) string {
+	return fmt.Sprintf("%s@%d-%d", base, r.Offset, r.Length)
+}
+
+// buildWindow packs the window r of the file input, the dag is the dag of a
+// file with just those bytes
+func (p *packer) buildWindow(input string, r fileWindow) *pendingNode {
+	p.stats.Files++
+	f, err := p.fds.open(input)
+	if err != nil {
+		return p.failed(err)
+	}
+	return p.bp.submitHolding(f, func(ls *ipld.LinkSystem) (ipld.Link, uint64, error) {
+		sr := &packProgressReader{Reader: io.NewSectionReader(f, r.Offset, r.Length)}
+		link, size, err := builder.BuildUnixFSFile(sr, p.opts.Chunker.String(), ls)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if sr.done != r.Length {
+			return nil, 0, fmt.Errorf("%s ended after %d of %d bytes from offset %d", input, sr.done, r.Length, r.Offset)
+		}
+		return link, size, nil
+	})
+}
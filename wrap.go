@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// checkWrap refuses the flags that pack a single input in a way --wrap can
+// not, and records the inputs to wrap as absolute paths so a retry finds them
+func (opts *options) checkWrap(inputs []string) error {
+	switch {
+	case len(opts.incremental) > 0:
+		return fmt.Errorf("incremental keeps the car of one input, it can not be used with wrap")
+	case opts.splitSize > 0:
+		return fmt.Errorf("split-size splits one file, it can not be used with wrap")
+	case opts.offset != 0 || opts.length != 0:
+		return fmt.Errorf("offset and length are a window of one file, they can not be used with wrap")
+	case opts.embedChecksums:
+		return fmt.Errorf("embed-checksums adds the listing to the root of a folder input, it can not be used with wrap")
+	}
+
+	opts.wrapped = opts.wrapped[:0]
+	for _, input := range inputs {
+		abs, err := filepath.Abs(input)
+		if err != nil {
+			return err
+		}
+		opts.wrapped = append(opts.wrapped, abs)
+	}
+	return nil
+}
+
+// wrapName is the default name of a folder wrapping inputs
+func wrapName(inputs []string) string {
+	name := path.Base(filepath.ToSlash(inputs[0]))
+	if len(inputs) > 1 {
+		name = fmt.Sprintf("%s+%d more", name, len(inputs)-1)
+	}
+	return name
+}
+
+// packWrapped packs opts.wrapped into one car as the entries of a folder,
+// each named after the base name of its input
+func packWrapped(opts *options, output string) (*packedAsset, error) {
+	inputs := append([]string(nil), opts.wrapped...)
+	seen := make(map[string]string, len(inputs))
+	for _, input := range inputs {
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a file or a directory, it can not be wrapped", input)
+		}
+
+		base := filepath.Base(input)
+		if first, ok := seen[base]; ok {
+			return nil, fmt.Errorf("%s and %s are both named %s in the folder, give inputs with different names", first, input, base)
+		}
+		seen[base] = input
+	}
+
+	assetName := wrapName(opts.wrapped)
+	if len(opts.name) > 0 {
+		assetName = opts.name
+	}
+
+	// the entries of a unixfs directory are sorted by name
+	sort.Slice(inputs, func(i, j int) bool { return filepath.Base(inputs[i]) < filepath.Base(inputs[j]) })
+
+	removeCar := func() {}
+	if opts.cidOnly {
+		output = ""
+	} else {
+		var err error
+		if output, removeCar, err = carOutput(output); err != nil {
+			return nil, err
+		}
+	}
+
+	packOpts := packOptions{Workers: opts.hashWorkers(), Symlinks: opts.symlinks, MaxOpenFiles: opts.maxOpenFiles, ExcludeMetaFiles: opts.excludeMetaFiles, NoChecksums: opts.noChecksums, Hash: opts.hash, Chunker: opts.chunker, NoRawLeaves: !opts.rawLeaves, Filter: opts.filter, Discard: opts.cidOnly}
+	fmt.Printf("wrap %d inputs in folder %s\n", len(inputs), assetName)
+	result, err := createWrappedCar(inputs, output, packOpts)
+	if err != nil {
+		removeCar()
+		return nil, err
+	}
+
+	printPackStats(result.Stats, false)
+	return &packedAsset{carPath: output, root: result.Root, name: assetName, assetType: "folder", manifest: result.Manifest}, nil
+}